@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/budget"
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
+	"blitiri.com.ar/go/log"
+)
+
+// Live statistics for the dashboard, fed by the DNS servers.
+var dashboard = dnsserver.NewDashboard()
+
+// Window over which the health of the upstreams and listeners is computed.
+const dashboardHealthWindow = 5 * time.Minute
+
+func registerDashboard(mux *http.ServeMux) {
+	mux.HandleFunc("/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		if err := htmlDashboard.Execute(w, nil); err != nil {
+			log.Infof("Dashboard handler error: %v", err)
+		}
+	})
+	mux.HandleFunc("/dashboard/data", dashboardData)
+}
+
+// dashboardData returns the statistics shown in the dashboard, as JSON.
+func dashboardData(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		dnsserver.DashboardData
+		Health []budget.Health
+	}{
+		DashboardData: dashboard.Snapshot(),
+		Health:        budget.AllHealth(dashboardHealthWindow),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+// The dashboard polls /dashboard/data, and renders it.
+var htmlDashboard = template.Must(template.New("dashboard").Parse(
+	`<!DOCTYPE html>
+<html>
+
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>dnss dashboard</title>
+<style type="text/css">
+  body {
+    font-family: sans-serif;
+  }
+  @media (prefers-color-scheme: dark) {
+    body {
+      background: #121212;
+      color: #c9d1d9;
+    }
+    a { color: #44b4ec; }
+  }
+  .big {
+    font-size: x-large;
+  }
+  .bad {
+    color: #e53935;
+  }
+  td {
+    padding-right: 1em;
+  }
+</style>
+</head>
+
+<body>
+  <h1>dnss dashboard</h1>
+
+  <p>
+  <span class="big" id="qps">-</span> queries/s &nbsp;
+  <span class="big" id="hitratio">-</span> cache hits &nbsp;
+  <span class="big" id="blocked">-</span> blocked
+  (of <span id="queries">-</span> queries)
+
+  <h2>Top domains</h2>
+  <p id="hidden" hidden>Names are only shown when running with <tt>-v=1</tt>.
+  <table id="domains"></table>
+
+  <h2>Health</h2>
+  <table id="health"></table>
+
+  <h2>Actions</h2>
+  <button id="flush">Flush cache</button> <span id="flushresult"></span>
+
+  <p><a href="/">back to the monitoring page</a>
+
+<script>
+function row(table, cells, bad) {
+  var tr = table.insertRow();
+  if (bad) {
+    tr.className = "bad";
+  }
+  cells.forEach(function(c) {
+    tr.insertCell().textContent = c;
+  });
+}
+
+function since(t) {
+  if (t.startsWith("0001-")) {
+    return "never";
+  }
+  return Math.round((Date.now() - Date.parse(t)) / 1000) + "s ago";
+}
+
+function refresh() {
+  fetch("/dashboard/data").then(function(resp) {
+    return resp.json();
+  }).then(function(data) {
+    document.getElementById("qps").textContent = data.QPS.toFixed(1);
+    document.getElementById("hitratio").textContent =
+      (data.CacheHitRatio * 100).toFixed(1) + "%";
+    document.getElementById("blocked").textContent = data.Blocked;
+    document.getElementById("queries").textContent = data.Queries;
+    document.getElementById("hidden").hidden = !data.NamesHidden;
+
+    var domains = document.getElementById("domains");
+    domains.replaceChildren();
+    (data.TopDomains || []).forEach(function(d) {
+      row(domains, [d.Name, d.Queries]);
+    });
+
+    var health = document.getElementById("health");
+    health.replaceChildren();
+    data.Health.forEach(function(h) {
+      row(health, [h.Name, (h.Ratio * 100).toFixed(1) + "% ok",
+                   h.Total + " recent", "last success " +
+                   since(h.LastSuccess)], h.Ratio < 0.9);
+    });
+  });
+}
+
+document.getElementById("flush").onclick = function() {
+  fetch("/debug/dnsserver/cache/flush", {method: "POST"}).then(function(resp) {
+    return resp.text();
+  }).then(function(text) {
+    document.getElementById("flushresult").textContent = text;
+  });
+};
+
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`))
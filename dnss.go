@@ -12,17 +12,31 @@
 package main
 
 import (
+	"encoding/json"
+	"expvar"
 	"flag"
+	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
+	"blitiri.com.ar/go/dnss/internal/acme"
+	"blitiri.com.ar/go/dnss/internal/budget"
 	"blitiri.com.ar/go/dnss/internal/dnsserver"
 	"blitiri.com.ar/go/dnss/internal/httpresolver"
 	"blitiri.com.ar/go/dnss/internal/httpserver"
+	"blitiri.com.ar/go/dnss/internal/loop"
+	"blitiri.com.ar/go/dnss/internal/nettrace"
+	"blitiri.com.ar/go/dnss/internal/statsd"
+	"blitiri.com.ar/go/dnss/internal/trace"
+	"blitiri.com.ar/go/dnss/internal/upgrade"
 	"blitiri.com.ar/go/log"
+	"github.com/miekg/dns"
 
 	// Register pprof handlers for monitoring and debugging.
 	_ "net/http/pprof"
@@ -31,42 +45,349 @@ import (
 var (
 	dnsListenAddr = flag.String("dns_listen_addr", ":53",
 		"address to listen on for DNS")
+	dnsSystemdFallbackAddr = flag.String("dns_systemd_fallback_addr", "",
+		"address to listen on for DNS if -dns_listen_addr=systemd but no "+
+			"sockets were passed (default: exit with an error)")
+	dnsListenInterface = flag.String("dns_listen_interface", "",
+		"network interface to bind the DNS sockets to, so only queries "+
+			"arriving through it are served (Linux only; needs "+
+			"CAP_NET_RAW on kernels older than 5.7)")
+	dnsUDPSockets = flag.Int("dns_udp_sockets", 1,
+		"number of UDP sockets to listen on for DNS, with SO_REUSEPORT, "+
+			"so the kernel spreads the queries among them (Linux only)")
+	dnsUDPReadBuffer = flag.Int("dns_udp_read_buffer", 0,
+		"size of the DNS UDP sockets' read buffer, in bytes "+
+			"(0 = system default)")
+	dnsUDPWriteBuffer = flag.Int("dns_udp_write_buffer", 0,
+		"size of the DNS UDP sockets' write buffer, in bytes "+
+			"(0 = system default)")
+	dnsUDPWorkers = flag.Int("dns_udp_workers", 0,
+		"number of workers to serve each DNS UDP socket with, reusing "+
+			"their buffers (0 = a goroutine per query)")
 
 	dnsUnqualifiedUpstream = flag.String("dns_unqualified_upstream", "",
 		"DNS server to forward unqualified requests to")
 	dnsServerForDomain = flag.String("dns_server_for_domain", "",
 		"DNS server to use for a specific domain, "+
-			`in the form of "domain1:addr1, domain2:addr, ..."`)
+			`in the form of "domain1:addr1, domain2:addr, ..."; the `+
+			"servers can also be DoH URLs (https://...) or DoT ones "+
+			`(tls://host:853); "!domain" excludes a subdomain from its `+
+			`parent's server; and "domain/TYPE" limits the entry to a `+
+			`query type ("./TYPE" matches all domains)`)
+	dnsServerForDomainFile = flag.String("dns_server_for_domain_file", "",
+		"file with DNS servers to use for specific domains, one "+
+			`"domain addr" (or "!domain") per line (# starts a `+
+			"comment), like -dns_server_for_domain (and taking "+
+			"precedence over it); it is reloaded when it changes")
+
+	viewsFile = flag.String("views_file", "",
+		"JSON file with views: configurations for the queries of some "+
+			"clients (split-horizon DNS, or per-client upstreams), "+
+			"see the README for details; it is reloaded when it changes")
+
+	localRecordsFile = flag.String("local_records_file", "",
+		"file with DNS records to answer locally, in zone file format "+
+			"(wildcards like *.lab.home are supported, and PTR records "+
+			"are generated automatically)")
+
+	selfName = flag.String("self_name", "",
+		"if set, answer queries for this name with our own addresses "+
+			"(and the corresponding PTR queries)")
+
+	handleSpecialDomains = flag.Bool("handle_special_domains", true,
+		"answer queries for special-use domains (like .localhost, .invalid "+
+			"or .home.arpa) locally, instead of sending them upstream")
+	privateReverse = flag.String("private_reverse_zones", "",
+		"what to do with the reverse queries for private addresses "+
+			"(RFC 1918 and IPv6 ULA): empty to send them upstream, "+
+			"\"nxdomain\" to answer NXDOMAIN locally, or a server to "+
+			"send them to (like in -dns_server_for_domain)")
+	blockDoHCanary = flag.Bool("block_doh_canary", false,
+		"answer NXDOMAIN for canary domains like use-application-dns.net, "+
+			"so browsers disable their built-in DoH and use dnss instead")
+	captivePortalAssist = flag.Bool("captive_portal_assist", false,
+		"if the upstreams fail right after joining a network, resolve "+
+			"captive portal detection domains using the network's "+
+			"resolvers, so the portal's login page can be shown")
+	captivePortalDomains = flag.String("captive_portal_domains", "",
+		"comma-separated domains to resolve with -captive_portal_assist "+
+			"(default: well-known portal detection domains)")
+	captivePortalResolvConf = flag.String("captive_portal_resolv_conf",
+		"/run/systemd/resolve/resolv.conf",
+		"file with the network's resolvers, for -captive_portal_assist")
+	enableMDNSBridge = flag.Bool("enable_mdns_bridge", false,
+		"resolve .local names using multicast DNS on the local network")
+	loopDetection = flag.Bool("loop_detection", false,
+		"tag the queries we forward over plain DNS with an identifier "+
+			"of this process, to detect and refuse forwarding loops (our "+
+			"own queries coming back to us); the queries to the HTTPS "+
+			"upstream are never tagged")
+
+	queryLogFile = flag.String("query_log_file", "",
+		"file to log every DNS query to, including which layer decided "+
+			"the answer (\"-\" for stderr)")
+	queryStream = flag.Bool("query_stream", false,
+		"stream every DNS query (name, type, result, latency) as it is "+
+			"handled, on /debug/queries/stream of the monitoring server; "+
+			"note it exposes the names being queried")
+	logModifiedAnswers = flag.Bool("log_modified_answers", false,
+		"log every time we modify an answer relative to what the upstream "+
+			"returned (e.g. TTL capped, truncated); they are always counted")
+	researchStatsFile = flag.String("research_stats_file", "",
+		"file to periodically write anonymized aggregates of the queries "+
+			"to (query types, response codes, TTL and latency histograms), "+
+			"for network research (\"-\" for stderr)")
+	researchStatsPeriod = flag.Duration("research_stats_period", time.Hour,
+		"how often to write to -research_stats_file")
+	statsdAddr = flag.String("statsd_addr", "",
+		"address (host:port) of a statsd server to periodically push the "+
+			"statistics and query latencies to")
+	statsdPrefix = flag.String("statsd_prefix", "dnss",
+		"prefix for the names of the metrics pushed to -statsd_addr")
+	statsdPeriod = flag.Duration("statsd_period", 10*time.Second,
+		"how often to push the statistics to -statsd_addr")
+	maxInflightQueries = flag.Int("max_inflight_queries", 0,
+		"maximum number of DNS queries to resolve concurrently (0 = no limit)")
+	maxInflightWait = flag.Duration("max_inflight_wait", 1*time.Second,
+		"how long a DNS query can wait in line when -max_inflight_queries "+
+			"is reached, before it gets a SERVFAIL (0 = don't wait)")
+	queryTimeout = flag.Duration("query_timeout", 0,
+		"how long we have to answer each DNS query, end to end; once it "+
+			"passes, the work on it is canceled and the client gets a "+
+			"SERVFAIL (0 = no limit)")
+	maxTCPConns = flag.Int("max_tcp_conns", 0,
+		"maximum number of concurrent TCP connections per DNS listener "+
+			"(0 = no limit); when reached, the least recently used is "+
+			"closed, so idle clients can't exhaust the file descriptors")
+	tcpIdleTimeout = flag.Duration("tcp_idle_timeout", 8*time.Second,
+		"how long to keep an idle DNS TCP connection open, waiting for "+
+			"the next query on it")
+	highPriorityClients = flag.String("high_priority_clients", "",
+		"clients whose queries are served first when -max_inflight_queries "+
+			`is reached, in the form of "net1, net2, ..."`)
 
 	fallbackUpstream = flag.String("fallback_upstream", "8.8.8.8:53",
-		"DNS server used to resolve domains in -https_upstream"+
-			" (including proxy if needed)")
+		"DNS servers used to resolve domains in -https_upstream"+
+			" (including proxy if needed); comma-separated list, "+
+			"used in order, moving on to the next one on errors; "+
+			"use tls://host[:port][#name] for DNS over TLS")
 
 	enableDNStoHTTPS = flag.Bool("enable_dns_to_https", false,
 		"enable DNS-to-HTTPS proxy")
 	httpsUpstream = flag.String("https_upstream",
 		"https://dns.google/dns-query",
-		"URL of upstream DNS-to-HTTP server")
+		"URL of upstream DNS-to-HTTP server; use a comma-separated "+
+			"list to fail over between multiple servers")
+	httpsUpstreamMode = flag.String("https_upstream_mode", "post",
+		"how to send the queries to -https_upstream: post, get (which "+
+			"lets HTTP caches along the way answer them), or json (for "+
+			"upstreams that only have the JSON API, like "+
+			"https://dns.google/resolve)")
+	httpsUpstreamPinning = flag.Bool("https_upstream_pinning", false,
+		"consistently send each client to the same upstream (if there "+
+			"are multiple), instead of using them in order")
+	httpsUpstreamHost = flag.String("https_upstream_host", "",
+		"HTTP Host header and TLS server name (SNI) to use for the "+
+			"upstreams, if different from the ones in -https_upstream "+
+			"(which are still used to connect)")
+	httpsUpstreamHeaders = flag.String("https_upstream_headers", "",
+		"additional HTTP headers to send to the upstreams (e.g. for "+
+			"authentication), as a comma-separated list of \"Name: value\"")
+	httpsUpstreamIP = flag.String("https_upstream_ip", "",
+		"IP addresses to connect to for the upstreams, instead of "+
+			"resolving their names (which are still used to verify the "+
+			"certificates); comma-separated list, one per upstream in "+
+			"-https_upstream")
+	httpsUpstreamBootstrap = flag.String("https_upstream_bootstrap", "",
+		"comma-separated list of IP addresses to use for the upstreams' "+
+			"names, instead of resolving them via "+
+			"-fallback_upstream")
+	httpsUpstreamBootstrapDir = flag.String("https_upstream_bootstrap_dir", "",
+		"directory to save the upstreams' addresses to, once resolved, "+
+			"so they can be used on the next start even if "+
+			"-fallback_upstream is not reachable then")
+	httpsClientTimeout = flag.Duration("https_client_timeout",
+		httpresolver.DefaultTimeout,
+		"timeout for the HTTPS client requests (to -https_upstream)")
+	httpsClientRotateAfter = flag.Duration("https_client_rotate_after",
+		httpresolver.DefaultRotateAfter,
+		"replace the HTTPS client (and its connections) after seeing "+
+			"errors for this long")
+	httpsClientMaintainPeriod = flag.Duration(
+		"https_client_maintain_period",
+		httpresolver.DefaultMaintainPeriod,
+		"how often the HTTPS client checks if it needs to be replaced, "+
+			"and other periodic maintenance")
+	httpsClientProbePeriod = flag.Duration("https_client_probe_period", 0,
+		"if set, send a query to the upstreams this often, to detect "+
+			"broken connections (e.g. after a network change) before "+
+			"the clients' queries do")
 	httpsClientCAFile = flag.String("https_client_cafile", "",
-		"CA file to use for the HTTPS client")
+		"CA files and directories (comma-separated) to use for the "+
+			"HTTPS client, instead of the system's; they are reloaded "+
+			"when they change")
+	httpsClientSystemCAs = flag.Bool("https_client_system_cas", false,
+		"also trust the system's CAs, in addition to -https_client_cafile")
+	httpsClientMinTLSVersion = flag.String("https_client_min_tls_version", "",
+		"minimum TLS version for the HTTPS client (1.2 or 1.3); "+
+			"the default is Go's")
+	httpsClientCipherSuites = flag.String("https_client_cipher_suites", "",
+		"comma-separated list of cipher suites the HTTPS client can use "+
+			"for TLS 1.2 and below (like "+
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256); the default is Go's")
+	httpsUpstreamPin = flag.String("https_upstream_pin", "",
+		"comma-separated list of base64 SHA-256 hashes of public keys "+
+			"(SPKI); if set, the certificate chain of the upstreams "+
+			"must include one of them")
 	enableCache = flag.Bool("enable_cache", true, "enable the local cache")
+	cacheSize   = flag.Int("cache_size", 2000,
+		"maximum number of entries in the cache")
+	cacheMaxBytes = flag.Int64("cache_max_bytes", 0,
+		"maximum approximate memory used by the cache entries, in bytes "+
+			"(0 = no limit besides -cache_size)")
+	cacheMinTTL = flag.Duration("cache_min_ttl", 2*time.Minute,
+		"do not cache answers with a TTL lower than this")
+	cacheMaxTTL = flag.Duration("cache_max_ttl", 2*time.Hour,
+		"cap the TTL of cached answers to this")
+	cacheGCPeriod = flag.Duration("cache_gc_period", 30*time.Second,
+		"how often to remove expired entries from the cache")
+	cacheBypassOption = flag.Uint("cache_bypass_edns_option", 0,
+		"code of an EDNS0 option that makes queries bypass the cache, "+
+			"like the ones with CD do (0 = none)")
+	cachePrefetch = flag.Bool("cache_prefetch", false,
+		"refresh popular cache entries before they expire, so clients "+
+			"don't have to wait for the upstream")
+	cacheFollowCNAMEs = flag.Bool("cache_follow_cnames", false,
+		"on a cache miss, build the answer from the cached CNAMEs and "+
+			"the cached answer for their target, if there is one")
+	cacheSnapshotFile = flag.String("cache_snapshot_file", "",
+		"file to save the cache to when exiting, and to load it from on "+
+			"start, so we don't start with a cold cache (default: don't)")
+
+	stripClientSubnet = flag.Bool("strip_client_subnet", false,
+		"remove the EDNS Client Subnet option from queries sent to the "+
+			"HTTPS upstream, so it does not learn the clients' networks")
+	injectClientSubnet = flag.String("inject_client_subnet", "",
+		"add an EDNS Client Subnet option to queries sent to the HTTPS "+
+			"upstream, for geo-accurate answers; either a fixed subnet "+
+			"(e.g. 203.0.113.0/24), or \"client\" to derive it from "+
+			"the client's address")
+	clientSubnetMask4 = flag.Int("client_subnet_mask4", 24,
+		"prefix length for -inject_client_subnet=client, for IPv4 clients")
+	clientSubnetMask6 = flag.Int("client_subnet_mask6", 56,
+		"prefix length for -inject_client_subnet=client, for IPv6 clients")
+
+	enableDNSSECValidation = flag.Bool("enable_dnssec_validation", false,
+		"validate DNSSEC signatures of the answers from the HTTPS upstream, "+
+			"instead of trusting its AD bit; note negative answers "+
+			"(NXDOMAIN and NODATA) are not validated, and are passed "+
+			"through as insecure")
 
 	enableHTTPStoDNS = flag.Bool("enable_https_to_dns", false,
 		"enable HTTPS-to-DNS proxy")
 	dnsUpstream = flag.String("dns_upstream",
 		"8.8.8.8:53",
-		"Address of the upstream DNS server (for the HTTPS-to-DNS proxy)")
+		"Address of the upstream DNS server (for the HTTPS-to-DNS proxy); "+
+			"use tls://host[:port][#name] for DNS over TLS, or an "+
+			"https:// URL to relay to another DNS-over-HTTPS server")
+	dnsUpstreamTimeout = flag.Duration("dns_upstream_timeout",
+		2*time.Second,
+		"timeout for the queries to -dns_upstream (and the -https_routes "+
+			"upstreams), except DNS-over-HTTPS ones")
+	httpsRoutes = flag.String("https_routes", "",
+		"serve other upstreams on their own paths, so different clients "+
+			"can use different resolvers; in the form of "+
+			`"/path1=upstream1, /path2=upstream2, ..." (the upstreams use `+
+			"the same format as -dns_upstream)")
 	httpsCertFile = flag.String("https_cert", "",
 		"certificate to use for the HTTPS server")
 	httpsKeyFile = flag.String("https_key", "",
 		"key to use for the HTTPS server")
+	httpsACMEHosts = flag.String("https_acme_hosts", "",
+		"comma-separated hostnames to automatically get a certificate for, "+
+			"using ACME (e.g. Let's Encrypt); replaces -https_cert and "+
+			"-https_key")
+	httpsACMEEmail = flag.String("https_acme_email", "",
+		"contact email for the ACME account (optional)")
+	httpsACMEDirectory = flag.String("https_acme_directory",
+		acme.LetsEncryptURL,
+		"directory URL of the ACME server")
+	httpsACMECacheDir = flag.String("https_acme_cache_dir",
+		"/var/lib/dnss/acme",
+		"directory to keep the ACME account key and certificates in")
+	httpsClientCA = flag.String("https_client_ca", "",
+		"if set, the HTTPS server requires client certificates signed by "+
+			"one of the CAs in this file (PEM format)")
+	httpsTokensFile = flag.String("https_tokens_file", "",
+		"if set, the HTTPS server requires one of the tokens in this file, "+
+			"one \"<name> <token>\" per line; clients give it in the path "+
+			"(/dns-query/<token>) or as a bearer token")
 	httpsAddr = flag.String("https_server_addr", ":443",
-		"address to listen on for HTTPS-to-DNS requests")
+		"address to listen on for HTTPS-to-DNS requests; use "+
+			"unix:<path> to listen on a unix socket (e.g. behind a "+
+			"reverse proxy)")
 	insecureHTTPServer = flag.Bool("insecure_http_server", false,
 		"listen on plain HTTP, not HTTPS")
+	insecureHTTPServerH2C = flag.Bool("insecure_http_server_h2c", false,
+		"also accept cleartext HTTP/2 (h2c) in the insecure HTTP server, "+
+			"for reverse proxies that speak HTTP/2")
+	httpsReadTimeout = flag.Duration("https_read_timeout", 10*time.Second,
+		"maximum time to read an HTTPS request (0 for no limit)")
+	httpsWriteTimeout = flag.Duration("https_write_timeout", 20*time.Second,
+		"maximum time to handle an HTTPS request and write the reply "+
+			"(0 for no limit)")
+	httpsIdleTimeout = flag.Duration("https_idle_timeout", 2*time.Minute,
+		"maximum time to keep idle HTTPS connections open (0 for no limit)")
+	httpsMaxConcurrent = flag.Int("https_max_concurrent_requests", 0,
+		"maximum number of HTTPS requests to handle at the same time; "+
+			"the ones over it are rejected (0 for no limit)")
+	httpsTrustedProxies = flag.String("https_trusted_proxies", "",
+		"proxies (like load balancers) trusted to tell us the real client "+
+			"address, via X-Forwarded-For or the PROXY protocol; in the "+
+			`form of "net1, net2, ..."`)
+	httpsProxyProtocol = flag.Bool("https_proxy_protocol", false,
+		"expect HTTPS connections to start with a PROXY protocol (v1 or v2) "+
+			"header; they must come from -https_trusted_proxies (or over "+
+			"a unix socket)")
+	httpsBanThreshold = flag.Int("https_ban_threshold", 0,
+		"ban clients that send more than this many malformed requests "+
+			"per minute (0 = never ban)")
+	httpsBanDuration = flag.Duration("https_ban_duration", 10*time.Minute,
+		"how long to ban clients for, see -https_ban_threshold")
+
+	faultInjection = flag.String("testing_fault_injection", "",
+		"for testing only: inject faults in the DNS-to-HTTPS resolution, "+
+			`in the form of "latency=100ms, loss=0.1, errors=0.05"`)
+
+	alertWebhookURL = flag.String("alert_webhook_url", "",
+		"URL to POST a notification to when an upstream or listener "+
+			"success ratio stays below -alert_threshold")
+	alertThreshold = flag.Float64("alert_threshold", 0.9,
+		"minimum acceptable success ratio for upstreams and listeners")
+	alertWindow = flag.Duration("alert_window", 5*time.Minute,
+		"window over which success ratios are computed (max 1h)")
+	alertSustain = flag.Duration("alert_sustain", 5*time.Minute,
+		"how long the success ratio must stay below the threshold "+
+			"before alerting")
+	alertMinQueries = flag.Int("alert_min_queries", 20,
+		"minimum queries in the window to consider the success ratio")
 
 	monitoringListenAddr = flag.String("monitoring_listen_addr", "",
 		"address to listen on for monitoring HTTP requests")
+	traceSampleRate = flag.Int("trace_sample_rate", 1,
+		"trace only 1 in every N queries (queries with errors are always "+
+			"traced)")
+	tracesPerBucket = flag.Int("traces_per_bucket", 10,
+		"number of finished traces to keep per latency bucket and family")
+
+	shutdownTimeout = flag.Duration("shutdown_timeout", 10*time.Second,
+		"on exit (SIGTERM or SIGINT) or after an upgrade, how long to "+
+			"wait for the queries in flight to be answered")
+
+	sigusr2Actions = flag.String("sigusr2_actions",
+		"rotate_query_log,flush_cache",
+		"actions to take on SIGUSR2, comma-separated list of: "+
+			"rotate_query_log, flush_cache")
 
 	// Deprecated flags that no longer make sense; we keep them for backwards
 	// compatibility but may be removed in the future.
@@ -84,12 +405,45 @@ func main() {
 		Version,
 		SourceDate.Format("2006-01-02 15:04:05 -0700"))
 
+	for _, action := range strings.Split(*sigusr2Actions, ",") {
+		switch strings.TrimSpace(action) {
+		case "rotate_query_log", "flush_cache", "":
+		default:
+			log.Fatalf("-sigusr2_actions: unknown action %q", action)
+		}
+	}
+
 	go signalHandler()
 
+	trace.SetSampleRate(*traceSampleRate)
+	nettrace.SetTracesPerBucket(*tracesPerBucket)
+	loop.SetEnabled(*loopDetection)
+
 	if *monitoringListenAddr != "" {
 		go monitoringServer(*monitoringListenAddr)
 	}
 
+	var statsdExporter *statsd.Exporter
+	if *statsdAddr != "" {
+		statsdExporter = &statsd.Exporter{
+			Addr:   *statsdAddr,
+			Prefix: *statsdPrefix,
+			Period: *statsdPeriod,
+		}
+		go statsdExporter.Run()
+	}
+
+	if *alertWebhookURL != "" {
+		alerter := &budget.Alerter{
+			WebhookURL: *alertWebhookURL,
+			Threshold:  *alertThreshold,
+			Window:     *alertWindow,
+			Sustain:    *alertSustain,
+			MinQueries: *alertMinQueries,
+		}
+		go alerter.Run()
+	}
+
 	if !(*enableDNStoHTTPS || *enableHTTPStoDNS) {
 		log.Errorf("Need to set one of the following:")
 		log.Errorf("  --enable_dns_to_https")
@@ -97,31 +451,257 @@ func main() {
 		log.Fatalf("")
 	}
 
+	if *enableCache {
+		err := dnsserver.SetCacheTuning(*cacheSize,
+			*cacheMinTTL, *cacheMaxTTL, *cacheGCPeriod)
+		if err == nil {
+			err = dnsserver.SetCacheMaxBytes(*cacheMaxBytes)
+		}
+		if err != nil {
+			log.Fatalf("Invalid cache flags: %v", err)
+		}
+	}
+
 	var wg sync.WaitGroup
 
+	// Servers we are waiting on to be ready, to tell the previous process
+	// (if we were started by an upgrade) that it can stop.
+	var ready sync.WaitGroup
+
 	// DNS to HTTPS.
 	if *enableDNStoHTTPS {
-		upstream, err := url.Parse(*httpsUpstream)
+		switch *httpsUpstreamMode {
+		case "post", "get", "json":
+		default:
+			log.Fatalf("-https_upstream_mode must be post, get or json")
+		}
+		headers, err := parseHeaders(*httpsUpstreamHeaders)
 		if err != nil {
-			log.Fatalf("-https_upstream is not a valid URL: %v", err)
+			log.Fatalf("-https_upstream_headers is invalid: %v", err)
+		}
+		upstreams := strings.Split(*httpsUpstream, ",")
+		ips := []string{}
+		if *httpsUpstreamIP != "" {
+			ips = strings.Split(*httpsUpstreamIP, ",")
+			if len(ips) != len(upstreams) {
+				log.Fatalf("-https_upstream_ip must have one IP for " +
+					"each upstream in -https_upstream")
+			}
+		}
+		names := []string{}
+		backs := []dnsserver.Resolver{}
+		for i, s := range upstreams {
+			upstream, err := url.Parse(strings.TrimSpace(s))
+			if err != nil {
+				log.Fatalf("-https_upstream is not a valid URL: %v", err)
+			}
+			names = append(names, upstream.String())
+			doh := httpresolver.NewDoH(
+				upstream, *httpsClientCAFile, *fallbackUpstream)
+			doh.Host = *httpsUpstreamHost
+			if len(ips) > 0 {
+				doh.IP = strings.TrimSpace(ips[i])
+			}
+			doh.Bootstrap = *httpsUpstreamBootstrap
+			doh.BootstrapDir = *httpsUpstreamBootstrapDir
+			doh.Header = headers
+			doh.Pins = *httpsUpstreamPin
+			doh.SystemCAs = *httpsClientSystemCAs
+			doh.MinTLSVersion = *httpsClientMinTLSVersion
+			doh.CipherSuites = *httpsClientCipherSuites
+			doh.Timeout = *httpsClientTimeout
+			doh.RotateAfter = *httpsClientRotateAfter
+			doh.MaintainPeriod = *httpsClientMaintainPeriod
+			doh.ProbePeriod = *httpsClientProbePeriod
+			doh.GET = *httpsUpstreamMode == "get"
+			doh.JSON = *httpsUpstreamMode == "json"
+			backs = append(backs, doh)
 		}
 
 		var resolver dnsserver.Resolver
-		resolver = httpresolver.NewDoH(upstream, *httpsClientCAFile, *fallbackUpstream)
+		if len(backs) == 1 {
+			resolver = backs[0]
+		} else {
+			resolver = dnsserver.NewUpstreamsResolver(
+				names, backs, *httpsUpstreamPinning)
+		}
+
+		if *faultInjection != "" {
+			fc, err := dnsserver.FaultConfigFromString(*faultInjection)
+			if err != nil {
+				log.Fatalf("-testing_fault_injection is not valid: %v", err)
+			}
+			log.Errorf("WARNING: injecting faults: %+v", fc)
+			resolver = dnsserver.NewFaultResolver(resolver, fc)
+		}
+
+		if *enableDNSSECValidation {
+			resolver = dnsserver.NewValidatingResolver(resolver)
+		}
 
 		if *enableCache {
-			cr := dnsserver.NewCachingResolver(resolver)
-			cr.RegisterDebugHandlers()
-			resolver = cr
+			resolver = newCache(resolver)
+		}
+
+		// The client subnet is handled above the cache, as it is part of
+		// the cache key: this way stripped queries share the cached
+		// answers, and injected ones are cached per subnet.
+		if *stripClientSubnet && *injectClientSubnet != "" {
+			log.Fatalf("-strip_client_subnet and -inject_client_subnet " +
+				"are mutually exclusive")
+		}
+		if *stripClientSubnet {
+			resolver = dnsserver.NewECSStripResolver(resolver)
+		}
+		if *injectClientSubnet != "" {
+			ecs, err := dnsserver.NewECSInjectResolver(resolver,
+				*injectClientSubnet, *clientSubnetMask4, *clientSubnetMask6)
+			if err != nil {
+				log.Fatalf("-inject_client_subnet is not valid: %v", err)
+			}
+			resolver = ecs
+		}
+
+		if *captivePortalAssist {
+			domains := []string{}
+			for _, d := range strings.Split(*captivePortalDomains, ",") {
+				if d = strings.TrimSpace(d); d != "" {
+					domains = append(domains, d)
+				}
+			}
+			resolver = dnsserver.NewCaptivePortalResolver(resolver,
+				domains, *captivePortalResolvConf)
+		}
+
+		if *handleSpecialDomains {
+			resolver = dnsserver.NewSpecialUseResolver(resolver)
+		}
+
+		if *privateReverse == "nxdomain" {
+			resolver = dnsserver.NewPrivateReverseResolver(resolver)
+		}
+
+		if *blockDoHCanary {
+			resolver = dnsserver.NewCanaryResolver(resolver)
+		}
+
+		// The views build on top of the resolver so far, with their own
+		// local records (and upstream) if they have them.
+		base := resolver
+
+		selfRecords := []dns.RR{}
+		if *selfName != "" {
+			selfRecords, err = dnsserver.SelfRecords(
+				*selfName, *dnsListenAddr)
+			if err != nil {
+				log.Fatalf("Error getting our own addresses: %v", err)
+			}
+		}
+		localRecords := []dns.RR{}
+		if *localRecordsFile != "" {
+			rrs, err := dnsserver.LoadLocalRecords(*localRecordsFile)
+			if err != nil {
+				log.Fatalf("-local_records_file is not valid: %v", err)
+			}
+			localRecords = append(localRecords, rrs...)
+		}
+		localRecords = append(localRecords, selfRecords...)
+		if len(localRecords) > 0 {
+			resolver = dnsserver.NewLocalResolver(resolver, localRecords)
+		}
+
+		if *enableMDNSBridge {
+			resolver = dnsserver.NewMDNSResolver(resolver)
 		}
 
-		overrides, err := dnsserver.DomainMapFromString(*dnsServerForDomain)
+		http.HandleFunc("/debug/dnsserver/watch",
+			dnsserver.WatchHandler(resolver))
+
+		overridesSig := fileSignature(*dnsServerForDomainFile)
+		overrides, err := loadOverrides()
 		if err != nil {
-			log.Fatalf("-dns_server_for_domain is not valid: %v", err)
+			log.Fatalf("%v", err)
+		}
+
+		highPriority, err := dnsserver.NetListFromString(*highPriorityClients)
+		if err != nil {
+			log.Fatalf("-high_priority_clients is not valid: %v", err)
 		}
 
 		dth := dnsserver.New(*dnsListenAddr, resolver,
 			*dnsUnqualifiedUpstream, overrides)
+		dth.OverrideResolvers = overrideResolvers(overrides, nil)
+		if *dnsServerForDomainFile != "" {
+			go watchOverrides(dth, overridesSig)
+		}
+		if *viewsFile != "" {
+			vl := newViewLoader(base, localRecords, selfRecords)
+			viewsSig := fileSignature(*viewsFile)
+			dth.Views, err = vl.load()
+			if err != nil {
+				log.Fatalf("-views_file is not valid: %v", err)
+			}
+			go vl.watch(dth, viewsSig)
+		}
+		dth.MaxInflight = *maxInflightQueries
+		dth.InflightWait = *maxInflightWait
+		if dth.InflightWait == 0 {
+			dth.InflightWait = -1
+		}
+		dth.QueryTimeout = *queryTimeout
+		dth.HighPriority = highPriority
+		dth.MaxTCPConns = *maxTCPConns
+		dth.TCPIdleTimeout = *tcpIdleTimeout
+		dth.SystemdFallbackAddr = *dnsSystemdFallbackAddr
+		dth.Interface = *dnsListenInterface
+		dth.UDPSockets = *dnsUDPSockets
+		dth.UDPReadBuffer = *dnsUDPReadBuffer
+		dth.UDPWriteBuffer = *dnsUDPWriteBuffer
+		dth.UDPWorkers = *dnsUDPWorkers
+		dnsserver.SetLogModified(*logModifiedAnswers)
+
+		if *queryLogFile != "" {
+			dth.QueryLog, err = dnsserver.OpenQueryLog(*queryLogFile)
+			if err != nil {
+				log.Fatalf("Error opening -query_log_file: %v", err)
+			}
+			ops.Lock()
+			ops.queryLog = dth.QueryLog
+			ops.Unlock()
+		}
+
+		ready.Add(1)
+		dth.NotifyStarted = ready.Done
+		ops.Lock()
+		ops.servers = append(ops.servers, dth)
+		ops.Unlock()
+
+		if *monitoringListenAddr != "" {
+			dth.Observers = append(dth.Observers, dashboard)
+			if *queryStream {
+				dth.QueryStream = dnsserver.NewQueryStream()
+				http.HandleFunc("/debug/queries/stream",
+					dth.QueryStream.Handler)
+			}
+		}
+		if statsdExporter != nil {
+			dth.Observers = append(dth.Observers, statsdExporter)
+		}
+
+		if *researchStatsFile != "" {
+			ao, err := dnsserver.OpenAggregateObserver(*researchStatsFile)
+			if err != nil {
+				log.Fatalf("Error opening -research_stats_file: %v", err)
+			}
+			dth.Observers = append(dth.Observers, ao)
+			go func() {
+				for range time.Tick(*researchStatsPeriod) {
+					if err := ao.Flush(); err != nil {
+						log.Errorf("Error writing research stats: %v", err)
+					}
+				}
+			}()
+		}
 
 		wg.Add(1)
 		go func() {
@@ -132,14 +712,91 @@ func main() {
 
 	// HTTPS to DNS.
 	if *enableHTTPStoDNS {
+		if *insecureHTTPServerH2C && !*insecureHTTPServer {
+			log.Fatalf("-insecure_http_server_h2c needs " +
+				"-insecure_http_server")
+		}
+		if *httpsClientCA != "" && *insecureHTTPServer {
+			log.Fatalf("-https_client_ca needs HTTPS, it can't be used " +
+				"with -insecure_http_server")
+		}
+
+		var acmeManager *acme.Manager
+		if *httpsACMEHosts != "" {
+			if *insecureHTTPServer {
+				log.Fatalf("-https_acme_hosts needs HTTPS, it can't be " +
+					"used with -insecure_http_server")
+			}
+			if *httpsCertFile != "" || *httpsKeyFile != "" {
+				log.Fatalf("-https_acme_hosts replaces -https_cert and " +
+					"-https_key, use only one of them")
+			}
+			acmeManager = &acme.Manager{
+				DirectoryURL: *httpsACMEDirectory,
+				Email:        *httpsACMEEmail,
+				CacheDir:     *httpsACMECacheDir,
+			}
+			for _, h := range strings.Split(*httpsACMEHosts, ",") {
+				acmeManager.Hosts = append(acmeManager.Hosts,
+					strings.TrimSpace(h))
+			}
+		}
+
+		routes := map[string]*httpserver.Route{}
+		for _, r := range strings.Split(*httpsRoutes, ",") {
+			r = strings.TrimSpace(r)
+			if r == "" {
+				continue
+			}
+			path, upstream, ok := strings.Cut(r, "=")
+			path = strings.TrimRight(strings.TrimSpace(path), "/")
+			if !ok || !strings.HasPrefix(path, "/") {
+				log.Fatalf("-https_routes: invalid route %q", r)
+			}
+			upstream = strings.TrimSpace(upstream)
+			routes[path] = &httpserver.Route{
+				Upstream: upstream,
+				Resolver: httpsToDNSResolver(upstream),
+			}
+		}
+
+		trustedProxies, err := dnsserver.NetListFromString(
+			*httpsTrustedProxies)
+		if err != nil {
+			log.Fatalf("-https_trusted_proxies is not valid: %v", err)
+		}
+
 		s := httpserver.Server{
-			Addr:     *httpsAddr,
-			Upstream: *dnsUpstream,
-			CertFile: *httpsCertFile,
-			KeyFile:  *httpsKeyFile,
-			Insecure: *insecureHTTPServer,
+			Addr:         *httpsAddr,
+			Upstream:     *dnsUpstream,
+			CertFile:     *httpsCertFile,
+			KeyFile:      *httpsKeyFile,
+			Insecure:     *insecureHTTPServer,
+			H2C:          *insecureHTTPServerH2C,
+			ClientCAFile: *httpsClientCA,
+			TokensFile:   *httpsTokensFile,
+			ACME:         acmeManager,
+			Resolver:     httpsToDNSResolver(*dnsUpstream),
+			Routes:       routes,
+
+			BanThreshold: *httpsBanThreshold,
+			BanDuration:  *httpsBanDuration,
+
+			ReadTimeout:   *httpsReadTimeout,
+			WriteTimeout:  *httpsWriteTimeout,
+			IdleTimeout:   *httpsIdleTimeout,
+			MaxConcurrent: *httpsMaxConcurrent,
+
+			TrustedProxies: trustedProxies,
+			ProxyProtocol:  *httpsProxyProtocol,
 		}
 
+		ready.Add(1)
+		s.NotifyStarted = ready.Done
+		ops.Lock()
+		ops.servers = append(ops.servers, &s)
+		ops.Unlock()
+
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
@@ -147,17 +804,481 @@ func main() {
 		}()
 	}
 
+	go func() {
+		ready.Wait()
+		upgrade.Ready()
+	}()
+
 	wg.Wait()
+	saveCacheSnapshot()
+	log.Infof("dnss exiting")
+}
+
+// Things that can be operated on via signals. They are set once the servers
+// are configured.
+var ops struct {
+	sync.Mutex
+	cache interface {
+		Flush()
+		Summary() string
+		SaveSnapshot(path string) error
+	}
+	queryLog *dnsserver.QueryLog
+
+	// Servers to shut down after an upgrade, or on exit.
+	servers []interface {
+		Shutdown(timeout time.Duration)
+	}
+}
+
+// httpsToDNSResolver returns the resolver for the given HTTPS-to-DNS
+// upstream (see upstreamResolver), with the cache in front if it is
+// enabled.
+func httpsToDNSResolver(upstream string) dnsserver.Resolver {
+	resolver := upstreamResolver(upstream)
+	if *enableCache {
+		resolver = newCache(resolver)
+	}
+	return resolver
+}
+
+// upstreamResolver returns the resolver for the given upstream: a DoH
+// resolver for https:// URLs, or a plain DNS (or DoT) one otherwise.
+func upstreamResolver(upstream string) dnsserver.Resolver {
+	var resolver dnsserver.Resolver
+	if strings.HasPrefix(upstream, "https://") {
+		u, err := url.Parse(upstream)
+		if err != nil {
+			log.Fatalf("%q is not a valid URL: %v", upstream, err)
+		}
+		doh := httpresolver.NewDoH(u, *httpsClientCAFile, *fallbackUpstream)
+		doh.SystemCAs = *httpsClientSystemCAs
+		doh.MinTLSVersion = *httpsClientMinTLSVersion
+		doh.CipherSuites = *httpsClientCipherSuites
+		doh.Timeout = *httpsClientTimeout
+		doh.RotateAfter = *httpsClientRotateAfter
+		doh.MaintainPeriod = *httpsClientMaintainPeriod
+		resolver = doh
+	} else {
+		resolver = dnsserver.NewUpstreamResolver(
+			upstream, *dnsUpstreamTimeout)
+	}
+	return resolver
+}
+
+// newCache returns a caching resolver in front of the given one, configured
+// from the flags (the global tuning must be set before). The first one
+// created gets the debug handlers, and is the one operated on via signals.
+func newCache(back dnsserver.Resolver) dnsserver.Resolver {
+	cr := dnsserver.NewCachingResolver(back)
+	cr.SetPrefetch(*cachePrefetch)
+	cr.SetFollowCNAMEs(*cacheFollowCNAMEs)
+	if *cacheBypassOption > 0xFFFF {
+		log.Fatalf("-cache_bypass_edns_option must be < 65536")
+	}
+	cr.SetBypassOption(uint16(*cacheBypassOption))
+
+	ops.Lock()
+	defer ops.Unlock()
+	if ops.cache == nil {
+		cr.RegisterDebugHandlers()
+		ops.cache = cr
+		if *cacheSnapshotFile != "" {
+			if err := cr.LoadSnapshot(*cacheSnapshotFile); err != nil {
+				log.Errorf("Error loading cache snapshot: %v", err)
+			}
+		}
+	}
+	return cr
+}
+
+// loadOverrides returns the server overrides, from -dns_server_for_domain
+// and -dns_server_for_domain_file.
+func loadOverrides() (dnsserver.DomainMap, error) {
+	overrides, err := dnsserver.DomainMapFromString(*dnsServerForDomain)
+	if err != nil {
+		return nil, fmt.Errorf("-dns_server_for_domain is not valid: %v", err)
+	}
+	if *dnsServerForDomainFile != "" {
+		fromFile, err := dnsserver.DomainMapFromFile(*dnsServerForDomainFile)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"-dns_server_for_domain_file is not valid: %v", err)
+		}
+		for domain, server := range fromFile {
+			overrides[domain] = server
+		}
+	}
+	addPrivateReverseZones(overrides)
+	return overrides, nil
+}
+
+// addPrivateReverseZones adds the private reverse zones to the overrides, if
+// -private_reverse_zones is a server. The ones that are in the overrides
+// already are left alone, so they can be routed elsewhere.
+func addPrivateReverseZones(overrides dnsserver.DomainMap) {
+	if *privateReverse == "" || *privateReverse == "nxdomain" {
+		return
+	}
+	for _, zone := range dnsserver.PrivateReverseZones {
+		if _, ok := overrides.GetExact(zone); !ok {
+			overrides.Set(zone, *privateReverse)
+		}
+	}
+}
+
+// overrideResolvers returns the resolvers for the overrides that need one
+// (the DoH and DoT servers), reusing the ones in known, if any.
+func overrideResolvers(overrides dnsserver.DomainMap, known map[string]dnsserver.Resolver) map[string]dnsserver.Resolver {
+	resolvers := map[string]dnsserver.Resolver{}
+	for _, server := range overrides {
+		if !strings.HasPrefix(server, "https://") &&
+			!strings.HasPrefix(server, "tls://") {
+			continue
+		}
+		if r, ok := known[server]; ok {
+			resolvers[server] = r
+		} else {
+			resolvers[server] = upstreamResolver(server)
+		}
+	}
+	return resolvers
+}
+
+// How often to check if -dns_server_for_domain_file changed.
+const overridesCheckPeriod = 5 * time.Second
+
+// watchOverrides reloads the overrides when -dns_server_for_domain_file
+// changes. If it can't be loaded, we keep using the previous ones.
+// The resolvers of the overrides are kept even if they are no longer used,
+// as they can't be stopped, so we reuse them if they come back.
+func watchOverrides(dth *dnsserver.Server, sig string) {
+	known := map[string]dnsserver.Resolver{}
+	for server, r := range dth.OverrideResolvers {
+		known[server] = r
+	}
+
+	for range time.Tick(overridesCheckPeriod) {
+		newSig := fileSignature(*dnsServerForDomainFile)
+		if newSig == sig {
+			continue
+		}
+		sig = newSig
+
+		overrides, err := loadOverrides()
+		if err != nil {
+			log.Errorf("Error reloading overrides, keeping the old ones: %v",
+				err)
+			continue
+		}
+
+		resolvers := overrideResolvers(overrides, known)
+		initResolvers(resolvers, known)
+		dth.SetOverrides(overrides, resolvers)
+		log.Infof("Reloaded overrides from %q: %d entries",
+			*dnsServerForDomainFile, len(overrides))
+	}
+}
+
+// initResolvers initializes (and starts maintaining) the resolvers that are
+// not in known, and adds them to it. The ones that fail to initialize are
+// removed from resolvers.
+func initResolvers(resolvers, known map[string]dnsserver.Resolver) {
+	for server, r := range resolvers {
+		if _, ok := known[server]; ok {
+			continue
+		}
+		if err := r.Init(); err != nil {
+			log.Errorf("Error initializing resolver for %q: %v",
+				server, err)
+			delete(resolvers, server)
+			continue
+		}
+		go r.Maintain()
+		known[server] = r
+	}
+}
+
+// fileSignature returns a string that changes when the file does (or ""
+// if it can't be read), so we can tell when to reload it.
+func fileSignature(path string) string {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d %d", fi.Size(), fi.ModTime().UnixNano())
+}
+
+// viewConfig is the configuration of a view, as given in -views_file. The
+// fields are in the same format as the flags they replace for the view's
+// clients; the ones that are not set are taken from the flags.
+type viewConfig struct {
+	Name    string
+	Clients string
+
+	// Like -dns_server_for_domain.
+	ServerForDomain string `json:"server_for_domain"`
+
+	// Like -local_records_file.
+	LocalRecordsFile string `json:"local_records_file"`
+
+	// Like -https_upstream, but only one, and it can also be a plain DNS
+	// or DoT server.
+	Upstream string
+}
+
+// viewLoader loads the views from -views_file. Their resolvers are built on
+// top of base, with their own local records (plus our own records), or the
+// global ones if they don't have them.
+type viewLoader struct {
+	base         dnsserver.Resolver
+	localRecords []dns.RR
+	selfRecords  []dns.RR
+
+	// Resolvers for the upstreams and the overrides of the views, by their
+	// value in the file. They are initialized when they are created, and
+	// kept across reloads even if they are no longer used, as they can't
+	// be stopped, so we reuse them if they come back.
+	upstreams map[string]dnsserver.Resolver
+	overrides map[string]dnsserver.Resolver
+}
+
+func newViewLoader(base dnsserver.Resolver, localRecords, selfRecords []dns.RR) *viewLoader {
+	return &viewLoader{
+		base:         base,
+		localRecords: localRecords,
+		selfRecords:  selfRecords,
+		upstreams:    map[string]dnsserver.Resolver{},
+		overrides:    map[string]dnsserver.Resolver{},
+	}
+}
+
+// load the views from -views_file.
+func (l *viewLoader) load() ([]*dnsserver.View, error) {
+	data, err := os.ReadFile(*viewsFile)
+	if err != nil {
+		return nil, err
+	}
+	configs := []viewConfig{}
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+
+	views := []*dnsserver.View{}
+	for _, vc := range configs {
+		v, err := l.view(vc)
+		if err != nil {
+			return nil, fmt.Errorf("view %q: %v", vc.Name, err)
+		}
+		views = append(views, v)
+	}
+	return views, nil
+}
+
+func (l *viewLoader) view(vc viewConfig) (*dnsserver.View, error) {
+	var err error
+	v := &dnsserver.View{Name: vc.Name}
+	v.Clients, err = dnsserver.NetListFromString(vc.Clients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clients: %v", err)
+	}
+	if len(v.Clients) == 0 {
+		return nil, fmt.Errorf("no clients")
+	}
+
+	if vc.ServerForDomain != "" {
+		v.Overrides, err = dnsserver.DomainMapFromString(vc.ServerForDomain)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server_for_domain: %v", err)
+		}
+		addPrivateReverseZones(v.Overrides)
+		resolvers := overrideResolvers(v.Overrides, l.overrides)
+		initResolvers(resolvers, l.overrides)
+		v.OverrideResolvers = map[string]dnsserver.Resolver{}
+		for server, r := range resolvers {
+			v.OverrideResolvers[server] = sharedResolver{r}
+		}
+	}
+
+	if vc.Upstream == "" && vc.LocalRecordsFile == "" {
+		// Same resolver as the server.
+		return v, nil
+	}
+
+	var resolver dnsserver.Resolver = sharedResolver{l.base}
+	if vc.Upstream != "" {
+		r, ok := l.upstreams[vc.Upstream]
+		if !ok {
+			r = httpsToDNSResolver(vc.Upstream)
+			if err := r.Init(); err != nil {
+				return nil, fmt.Errorf("error initializing upstream: %v",
+					err)
+			}
+			go r.Maintain()
+			l.upstreams[vc.Upstream] = r
+		}
+		resolver = sharedResolver{r}
+	}
+
+	records := l.localRecords
+	if vc.LocalRecordsFile != "" {
+		records, err = dnsserver.LoadLocalRecords(vc.LocalRecordsFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local_records_file: %v", err)
+		}
+		records = append(records, l.selfRecords...)
+	}
+	if len(records) > 0 {
+		resolver = dnsserver.NewLocalResolver(resolver, records)
+	}
+	v.Resolver = resolver
+	return v, nil
+}
+
+// watch reloads the views when -views_file changes. If they can't be loaded,
+// we keep using the previous ones.
+func (l *viewLoader) watch(dth *dnsserver.Server, sig string) {
+	for range time.Tick(overridesCheckPeriod) {
+		newSig := fileSignature(*viewsFile)
+		if newSig == sig {
+			continue
+		}
+		sig = newSig
+
+		views, err := l.load()
+		if err != nil {
+			log.Errorf("Error reloading views, keeping the old ones: %v",
+				err)
+			continue
+		}
+		dth.SetViews(views)
+		log.Infof("Reloaded views from %q: %d views",
+			*viewsFile, len(views))
+	}
+}
+
+// sharedResolver wraps a resolver that is initialized and maintained
+// elsewhere (by the server, or when it was created), so the views that use
+// it don't do it again.
+type sharedResolver struct {
+	dnsserver.Resolver
+}
+
+func (sharedResolver) Init() error { return nil }
+func (sharedResolver) Maintain()   {}
+
+// parseHeaders parses a comma-separated list of "Name: value" HTTP headers.
+func parseHeaders(s string) (http.Header, error) {
+	h := http.Header{}
+	for _, kv := range strings.Split(s, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(kv, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("%q is not a valid header", kv)
+		}
+		h.Add(name, strings.TrimSpace(value))
+	}
+	return h, nil
 }
 
 func signalHandler() {
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT,
+		syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
 
+	exiting := false
 	for sig := range signals {
 		switch sig {
 		case syscall.SIGTERM, syscall.SIGINT:
-			log.Fatalf("Got signal to exit: %v", sig)
+			if exiting {
+				log.Fatalf("Got signal to exit again: %v", sig)
+			}
+			exiting = true
+			log.Infof("Got signal to exit: %v, shutting down", sig)
+			go shutdownServers()
+		case syscall.SIGUSR1:
+			log.Infof("Got %v, dumping stats", sig)
+			dumpStats()
+		case syscall.SIGUSR2:
+			log.Infof("Got %v, running: %s", sig, *sigusr2Actions)
+			runSIGUSR2Actions()
+		case syscall.SIGHUP:
+			log.Infof("Got %v, upgrading", sig)
+			upgradeProcess()
+		}
+	}
+}
+
+// dumpStats writes the exported variables and the cache summary to the log.
+func dumpStats() {
+	expvar.Do(func(kv expvar.KeyValue) {
+		// Skip the standard variables, which are large and not very useful
+		// in the log.
+		if kv.Key == "memstats" || kv.Key == "cmdline" {
+			return
+		}
+		log.Infof("stats: %s = %s", kv.Key, kv.Value)
+	})
+
+	ops.Lock()
+	defer ops.Unlock()
+	if ops.cache != nil {
+		log.Infof("stats: %s", ops.cache.Summary())
+	}
+}
+
+func runSIGUSR2Actions() {
+	ops.Lock()
+	defer ops.Unlock()
+
+	for _, action := range strings.Split(*sigusr2Actions, ",") {
+		switch strings.TrimSpace(action) {
+		case "rotate_query_log":
+			if err := ops.queryLog.Reopen(); err != nil {
+				log.Errorf("Error reopening query log: %v", err)
+			}
+		case "flush_cache":
+			if ops.cache != nil {
+				ops.cache.Flush()
+			}
 		}
 	}
 }
+
+// upgradeProcess starts a new dnss process (usually, a new binary that
+// replaced ours), handing off our listening sockets to it. Once it is ready,
+// we stop serving and main returns.
+func upgradeProcess() {
+	if err := upgrade.Exec(); err != nil {
+		log.Errorf("Upgrade failed, continuing to serve: %v", err)
+		return
+	}
+	log.Infof("New process is ready, shutting down")
+	shutdownServers()
+}
+
+// shutdownServers stops the servers, waiting for the queries in flight to be
+// answered (up to -shutdown_timeout). Once they are done, main returns.
+func shutdownServers() {
+	ops.Lock()
+	defer ops.Unlock()
+	for _, s := range ops.servers {
+		s.Shutdown(*shutdownTimeout)
+	}
+	ops.servers = nil
+}
+
+// saveCacheSnapshot saves the cache to -cache_snapshot_file, if set.
+func saveCacheSnapshot() {
+	ops.Lock()
+	defer ops.Unlock()
+	if ops.cache == nil || *cacheSnapshotFile == "" {
+		return
+	}
+	if err := ops.cache.SaveSnapshot(*cacheSnapshotFile); err != nil {
+		log.Errorf("Error saving cache snapshot: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package doh
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Dial returns a connection which resolves the DNS queries written to it
+// using the DoH server. The network and address are ignored.
+//
+// It is meant to be used as the Dial function of a net.Resolver (which
+// must have PreferGo set). The connection behaves like a DNS over TCP
+// connection: queries and replies are prefixed by their 2-byte length.
+func (c *Client) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	return &conn{client: c}, nil
+}
+
+// conn implements net.Conn on top of a DoH client, using DNS over TCP
+// framing (RFC 1035 section 4.2.2).
+type conn struct {
+	client *Client
+
+	mu       sync.Mutex
+	wbuf     bytes.Buffer
+	rbuf     bytes.Buffer
+	deadline time.Time
+	closed   bool
+}
+
+var errClosed = errors.New("connection closed")
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, errClosed
+	}
+	c.wbuf.Write(b)
+
+	// Process all the complete queries we have.
+	for c.wbuf.Len() >= 2 {
+		l := int(binary.BigEndian.Uint16(c.wbuf.Bytes()))
+		if c.wbuf.Len() < 2+l {
+			break
+		}
+
+		query := make([]byte, l)
+		c.wbuf.Next(2)
+		c.wbuf.Read(query)
+
+		if err := c.exchange(query); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// exchange the query, and append the reply to the read buffer.
+// Must be called with c.mu held.
+func (c *conn) exchange(query []byte) error {
+	ctx := context.Background()
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+
+	reply, err := c.client.ExchangeRaw(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(reply)))
+	c.rbuf.Write(l[:])
+	c.rbuf.Write(reply)
+	return nil
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, errClosed
+	}
+	if c.rbuf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.rbuf.Read(b)
+}
+
+func (c *conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *conn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+func (c *conn) LocalAddr() net.Addr  { return dohAddr{} }
+func (c *conn) RemoteAddr() net.Addr { return dohAddr{} }
+
+// dohAddr is the address of DoH connections, which don't have meaningful
+// network addresses.
+type dohAddr struct{}
+
+func (dohAddr) Network() string { return "doh" }
+func (dohAddr) String() string  { return "doh" }
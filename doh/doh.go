@@ -0,0 +1,205 @@
+// Package doh implements a DNS over HTTPS (DoH) client, as specified in
+// RFC 8484: https://tools.ietf.org/html/rfc8484.
+//
+// The Client can be used directly to exchange DNS messages, or plugged into
+// a net.Resolver via Client.Dial, so the standard library resolves names
+// using DoH:
+//
+//	c := &doh.Client{URL: u}
+//	r := &net.Resolver{PreferGo: true, Dial: c.Dial}
+//	addrs, err := r.LookupHost(ctx, "example.com")
+//
+// This package only handles the DoH exchange itself. How the HTTP client
+// connects to the server (including resolving the server's own name) is up
+// to the caller, via Client.HTTPClient.
+package doh
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+
+	"github.com/miekg/dns"
+)
+
+// MediaType is the media type for DNS messages sent over HTTPS.
+const MediaType = "application/dns-message"
+
+// Maximum size of a response we are willing to read.
+const maxResponseSize = 64 * 1024
+
+// Block sizes to pad queries and responses to, as recommended by RFC 8467.
+const (
+	QueryPaddingBlock    = 128
+	ResponsePaddingBlock = 468
+)
+
+// Client is a DoH client.
+// The zero value is not usable, URL must be set.
+type Client struct {
+	// URL of the DoH server, e.g. "https://dns.google/dns-query".
+	URL *url.URL
+
+	// HTTP client used to send the requests. If nil, http.DefaultClient is
+	// used.
+	HTTPClient *http.Client
+
+	// Host header to send, if different from the URL's host (for example,
+	// when the URL uses the server's IP address).
+	Host string
+
+	// Additional headers to send with the requests (for example, for
+	// authentication).
+	Header http.Header
+
+	// Pad queries that use EDNS0, as recommended by RFC 8467, so their size
+	// does not reveal the name being queried.
+	Padding bool
+
+	// Send the queries using GET instead of POST, so HTTP caches along the
+	// way can answer them. Exchange sets the message ID to 0 to make them
+	// more cacheable, as recommended by RFC 8484.
+	GET bool
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Exchange sends the query to the DoH server, and returns its reply.
+// The query is not modified.
+func (c *Client) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	id := m.Id
+	if c.GET && m.Id != 0 {
+		m = m.Copy()
+		m.Id = 0
+	}
+	if c.Padding && m.IsEdns0() != nil {
+		m = m.Copy()
+		Pad(m, QueryPaddingBlock)
+	}
+
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("cannot pack query: %v", err)
+	}
+
+	raw, err := c.ExchangeRaw(ctx, packed)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &dns.Msg{}
+	err = reply.Unpack(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error unpacking response: %v", err)
+	}
+	reply.Id = id
+
+	return reply, nil
+}
+
+// ExchangeRaw sends the packed query to the DoH server, and returns its
+// packed reply.
+func (c *Client) ExchangeRaw(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := c.newRequest(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request: %v", err)
+	}
+	if c.Host != "" {
+		req.Host = c.Host
+	}
+	for name, values := range c.Header {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+	req.Header.Set("Accept", MediaType)
+
+	hr, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w", req.Method, err)
+	}
+	defer hr.Body.Close()
+
+	if hr.StatusCode != http.StatusOK {
+		return nil, &StatusError{Proto: hr.Proto, Status: hr.Status,
+			StatusCode: hr.StatusCode}
+	}
+
+	ct, _, err := mime.ParseMediaType(hr.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse content type: %v", err)
+	}
+
+	if ct != MediaType {
+		return nil, fmt.Errorf("unknown response content type %q", ct)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(hr.Body, maxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("error reading from body: %v", err)
+	}
+
+	return raw, nil
+}
+
+// newRequest returns the HTTP request for the packed query: a POST with the
+// query as the body, or a GET with the query in the "dns" parameter.
+func (c *Client) newRequest(ctx context.Context, query []byte) (*http.Request, error) {
+	if !c.GET {
+		req, err := http.NewRequestWithContext(ctx, "POST", c.URL.String(),
+			bytes.NewReader(query))
+		if err == nil {
+			req.Header.Set("Content-Type", MediaType)
+		}
+		return req, err
+	}
+
+	u := *c.URL
+	params := u.Query()
+	params.Set("dns", base64.RawURLEncoding.EncodeToString(query))
+	u.RawQuery = params.Encode()
+	return http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+}
+
+// StatusError is returned when the server replies with an HTTP status other
+// than 200 OK.
+type StatusError struct {
+	Proto      string
+	Status     string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Response status: %s", e.Status)
+}
+
+// Pad the message using the EDNS0 padding option (RFC 7830), so its size is
+// a multiple of the given block size. The message must have an OPT record.
+func Pad(m *dns.Msg, block int) {
+	opt := m.IsEdns0()
+
+	// Remove any existing padding, so we can compute it from scratch.
+	opts := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0PADDING {
+			opts = append(opts, o)
+		}
+	}
+	opt.Option = opts
+
+	// The padding option has a 4 byte header (code and length).
+	l := m.Len() + 4
+	padding := (block - l%block) % block
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_PADDING{Padding: make([]byte, padding)})
+}
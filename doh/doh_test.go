@@ -0,0 +1,184 @@
+package doh
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newTestServer returns a DoH server which answers all A queries with
+// 1.2.3.4, and the size of the last query it received.
+func newTestServer(t *testing.T) (*httptest.Server, *int) {
+	lastLen := new(int)
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Accept") != MediaType {
+				t.Errorf("unexpected Accept header: %q",
+					r.Header.Get("Accept"))
+			}
+
+			body, _ := io.ReadAll(r.Body)
+			*lastLen = len(body)
+			q := &dns.Msg{}
+			if err := q.Unpack(body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			m := &dns.Msg{}
+			m.SetReply(q)
+			if q.Question[0].Qtype == dns.TypeA {
+				rr, _ := dns.NewRR(q.Question[0].Name + " A 1.2.3.4")
+				m.Answer = append(m.Answer, rr)
+			}
+			msg, _ := m.Pack()
+
+			w.Header().Set("Content-Type", MediaType)
+			w.Write(msg)
+		}))
+	return ts, lastLen
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatalf("invalid URL %q: %v", s, err)
+	}
+	return u
+}
+
+func TestExchange(t *testing.T) {
+	ts, lastLen := newTestServer(t)
+	defer ts.Close()
+
+	c := &Client{URL: mustParseURL(t, ts.URL)}
+
+	q := &dns.Msg{}
+	q.SetQuestion("test.blah.", dns.TypeA)
+	reply, err := c.Exchange(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	if len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Errorf("unexpected reply: %v", reply)
+	}
+	if *lastLen != q.Len() {
+		t.Errorf("query was modified: sent %d bytes, expected %d",
+			*lastLen, q.Len())
+	}
+
+	// With padding, EDNS0 queries are padded to a multiple of 128.
+	c.Padding = true
+	q.SetEdns0(4096, false)
+	origLen := q.Len()
+	if _, err := c.Exchange(context.Background(), q); err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	if *lastLen%QueryPaddingBlock != 0 {
+		t.Errorf("query was not padded, sent %d bytes", *lastLen)
+	}
+	if q.Len() != origLen {
+		t.Errorf("query was modified by padding")
+	}
+}
+
+func TestExchangeGET(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" || r.Header.Get("Content-Type") != "" {
+				t.Errorf("unexpected request: %s %v", r.Method, r.Header)
+			}
+			if r.Header.Get("Authorization") != "Bearer s3cret" {
+				t.Errorf("missing extra header: %v", r.Header)
+			}
+			if r.URL.Query().Get("other") != "param" {
+				t.Errorf("URL parameters lost: %v", r.URL)
+			}
+			raw, err := base64.RawURLEncoding.DecodeString(
+				r.URL.Query().Get("dns"))
+			q := &dns.Msg{}
+			if err == nil {
+				err = q.Unpack(raw)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if q.Id != 0 {
+				t.Errorf("expected ID 0, got %d", q.Id)
+			}
+
+			m := &dns.Msg{}
+			m.SetReply(q)
+			msg, _ := m.Pack()
+			w.Header().Set("Content-Type", MediaType)
+			w.Write(msg)
+		}))
+	defer ts.Close()
+
+	c := &Client{URL: mustParseURL(t, ts.URL+"/dns-query?other=param"),
+		GET:    true,
+		Header: http.Header{"Authorization": {"Bearer s3cret"}},
+	}
+
+	q := &dns.Msg{}
+	q.SetQuestion("test.blah.", dns.TypeA)
+	id := q.Id
+	reply, err := c.Exchange(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	if reply.Id != id || q.Id != id {
+		t.Errorf("ID not restored: query %d, reply %d, expected %d",
+			q.Id, reply.Id, id)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		}))
+	defer ts.Close()
+
+	c := &Client{URL: mustParseURL(t, ts.URL)}
+	q := &dns.Msg{}
+	q.SetQuestion("test.blah.", dns.TypeA)
+	_, err := c.Exchange(context.Background(), q)
+
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected StatusError with 429, got %v", err)
+	}
+}
+
+func TestDial(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+
+	c := &Client{URL: mustParseURL(t, ts.URL)}
+	r := &net.Resolver{PreferGo: true, Dial: c.Dial}
+
+	addrs, err := r.LookupIP(context.Background(), "ip4", "test.blah")
+	if err != nil {
+		t.Fatalf("LookupIP failed: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0].String() != "1.2.3.4" {
+		t.Errorf("unexpected addresses: %v", addrs)
+	}
+
+	// Errors are surfaced to the resolver.
+	ts.Close()
+	if _, err := r.LookupIP(context.Background(), "ip4", "test.blah"); err == nil {
+		t.Errorf("expected error after closing the server")
+	}
+}
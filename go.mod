@@ -7,12 +7,14 @@ require (
 	blitiri.com.ar/go/systemd v1.1.0
 	github.com/google/go-cmp v0.6.0
 	github.com/miekg/dns v1.1.61
+	golang.org/x/crypto v0.26.0
+	golang.org/x/net v0.28.0
+	golang.org/x/sys v0.24.0
 )
 
 require (
 	golang.org/x/mod v0.20.0 // indirect
-	golang.org/x/net v0.28.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
-	golang.org/x/sys v0.24.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
 	golang.org/x/tools v0.24.0 // indirect
 )
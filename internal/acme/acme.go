@@ -0,0 +1,121 @@
+// Package acme obtains and renews TLS certificates automatically, from a
+// certificate authority like Let's Encrypt, using the ACME protocol
+// (RFC 8555).
+//
+// The protocol is implemented by golang.org/x/crypto/acme/autocert; this
+// package just configures it for our servers. It uses the TLS-ALPN-01
+// challenge (RFC 8737), which is answered by the same TLS listener that uses
+// the certificates, so no other ports or DNS changes are needed.
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"strings"
+
+	"blitiri.com.ar/go/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// LetsEncryptURL is the directory URL of Let's Encrypt's production server.
+const LetsEncryptURL = acme.LetsEncryptURL
+
+// Manager obtains and renews a certificate for the given hosts, and serves
+// it (and the challenges) via the TLS configuration.
+//
+// Certificates are obtained on the first handshake that needs them, and
+// renewed in the background 30 days before they expire.
+type Manager struct {
+	// Directory URL of the ACME server, e.g. LetsEncryptURL.
+	DirectoryURL string
+
+	// Hostnames to get the certificate for.
+	Hosts []string
+
+	// Contact email for the account, optional.
+	Email string
+
+	// Directory where we keep the account key and the certificates, so we
+	// don't request new ones every time we start.
+	CacheDir string
+
+	// HTTP client to talk to the ACME server. If nil, http.DefaultClient is
+	// used.
+	HTTPClient *http.Client
+}
+
+// Configure the TLS configuration to serve our certificates, and answer the
+// challenges. The challenges are answered without asking for client
+// certificates, even if the configuration requires them.
+func (m *Manager) Configure(cfg *tls.Config) {
+	am := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      cache{autocert.DirCache(m.CacheDir)},
+		HostPolicy: autocert.HostWhitelist(m.Hosts...),
+		Email:      m.Email,
+		Client: &acme.Client{
+			DirectoryURL: m.DirectoryURL,
+			HTTPClient:   m.HTTPClient,
+		},
+	}
+
+	cfg.GetCertificate = am.GetCertificate
+	cfg.NextProtos = append(cfg.NextProtos, "h2", "http/1.1")
+
+	base := cfg.Clone()
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if !isChallenge(hello) {
+			return nil, nil
+		}
+		c := base.Clone()
+		c.ClientAuth = tls.NoClientCert
+		c.NextProtos = []string{acme.ALPNProto}
+		return c, nil
+	}
+}
+
+func isChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 &&
+		hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// cache is an autocert.DirCache that treats the entries it can't load as
+// missing, so they get replaced instead of failing every handshake.
+type cache struct {
+	autocert.DirCache
+}
+
+func (c cache) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := c.DirCache.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkEntry(name, data); err != nil {
+		log.Errorf("WARNING: ACME: ignoring broken cache entry %q: %v",
+			name, err)
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, nil
+}
+
+// checkEntry returns an error if the cache entry can't be loaded. The
+// account key is a PEM-encoded EC key; the other entries have a private key
+// followed by its certificate chain.
+func checkEntry(name string, data []byte) error {
+	if strings.HasPrefix(name, "acme_account") {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return errors.New("no key found")
+		}
+		_, err := x509.ParseECPrivateKey(block.Bytes)
+		return err
+	}
+
+	_, err := tls.X509KeyPair(data, data)
+	return err
+}
@@ -0,0 +1,371 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// OID of the acmeIdentifier extension of the challenge certificates.
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// fakeServer is a minimal ACME server, that validates the TLS-ALPN-01
+// challenges by doing a handshake with the given TLS configuration.
+type fakeServer struct {
+	t   *testing.T
+	srv *httptest.Server
+	tls *tls.Config
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu        sync.Mutex
+	nonces    map[string]bool
+	nextNonce int
+	badNonces int // How many requests to reject with badNonce.
+	jwk       map[string]string
+	valid     map[string]bool
+	orders    int
+	cert      []byte
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	f := &fakeServer{
+		t:      t,
+		nonces: map[string]bool{},
+		valid:  map[string]bool{},
+	}
+
+	var err error
+	f.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating CA key: %v", err)
+	}
+	f.caCert = &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	f.srv = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeServer) newNonce(w http.ResponseWriter) {
+	f.nextNonce++
+	n := fmt.Sprintf("nonce-%d", f.nextNonce)
+	f.nonces[n] = true
+	w.Header().Set("Replay-Nonce", n)
+}
+
+func (f *fakeServer) problem(w http.ResponseWriter, typ string) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{
+		"type":   "urn:ietf:params:acme:error:" + typ,
+		"detail": "test problem",
+	})
+}
+
+func (f *fakeServer) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	url := f.srv.URL
+	if r.URL.Path == "/dir" {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   url + "/nonce",
+			"newAccount": url + "/account",
+			"newOrder":   url + "/new-order",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		f.newNonce(w)
+		return
+	}
+
+	// Everything else is a signed POST.
+	jws := map[string]string{}
+	json.NewDecoder(r.Body).Decode(&jws)
+	protected := struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  map[string]string
+	}{}
+	ph, _ := base64.RawURLEncoding.DecodeString(jws["protected"])
+	json.Unmarshal(ph, &protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws["payload"])
+
+	nonceOK := f.nonces[protected.Nonce]
+	delete(f.nonces, protected.Nonce)
+	f.newNonce(w)
+	if !nonceOK || f.badNonces > 0 {
+		f.badNonces--
+		f.problem(w, "badNonce")
+		return
+	}
+	if protected.Alg != "ES256" || protected.URL != url+r.URL.Path {
+		f.t.Errorf("unexpected protected header: %s", ph)
+	}
+
+	host := "example.com"
+	switch {
+	case r.URL.Path == "/account":
+		f.jwk = protected.JWK
+		w.Header().Set("Location", url+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status": "valid"}`))
+	case protected.Kid != url+"/account/1":
+		f.t.Errorf("unexpected kid: %q", protected.Kid)
+		f.problem(w, "unauthorized")
+	case r.URL.Path == "/new-order":
+		f.orders++
+		w.Header().Set("Location", url+"/order")
+		w.WriteHeader(http.StatusCreated)
+		f.writeOrder(w)
+	case r.URL.Path == "/order":
+		f.writeOrder(w)
+	case r.URL.Path == "/authz":
+		status := "pending"
+		if f.valid[host] {
+			status = "valid"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": host},
+			"challenges": []map[string]string{
+				{"type": "http-01", "url": url + "/other", "token": "x"},
+				{"type": "tls-alpn-01", "url": url + "/chall",
+					"token": "tok"},
+			},
+		})
+	case r.URL.Path == "/chall":
+		f.validate(host, "tok")
+		w.Write([]byte("{}"))
+	case r.URL.Path == "/finalize":
+		req := struct{ CSR string }{}
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		f.issue(der)
+		f.writeOrder(w)
+	case r.URL.Path == "/cert":
+		w.Write(f.cert)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeServer) writeOrder(w http.ResponseWriter) {
+	status := "pending"
+	if f.cert != nil {
+		status = "valid"
+	} else if f.valid["example.com"] {
+		status = "ready"
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         status,
+		"authorizations": []string{f.srv.URL + "/authz"},
+		"finalize":       f.srv.URL + "/finalize",
+		"certificate":    f.srv.URL + "/cert",
+	})
+}
+
+// validate the TLS-ALPN-01 challenge, like the real servers do.
+func (f *fakeServer) validate(host, token string) {
+	jwk := fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`,
+		f.jwk["crv"], f.jwk["kty"], f.jwk["x"], f.jwk["y"])
+	thumb := sha256.Sum256([]byte(jwk))
+	keyAuth := token + "." + base64.RawURLEncoding.EncodeToString(thumb[:])
+	expected := sha256.Sum256([]byte(keyAuth))
+
+	cert, err := handshake(f.tls, host, acme.ALPNProto)
+	if err != nil {
+		f.t.Errorf("challenge handshake failed: %v", err)
+		return
+	}
+
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(idPeACMEIdentifier) {
+			continue
+		}
+		var got []byte
+		asn1.Unmarshal(ext.Value, &got)
+		if ext.Critical && bytes.Equal(got, expected[:]) {
+			f.valid[host] = true
+			return
+		}
+	}
+	f.t.Errorf("invalid challenge certificate: %v", cert.Extensions)
+}
+
+func (f *fakeServer) issue(csrDER []byte) {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		f.t.Errorf("invalid CSR: %v", err)
+		return
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(f.orders + 1)),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, tmpl, f.caCert, csr.PublicKey, f.caKey)
+	if err != nil {
+		f.t.Errorf("error issuing certificate: %v", err)
+		return
+	}
+	f.cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// handshake does a TLS handshake with a server using the given
+// configuration, and returns the server's certificate.
+func handshake(cfg *tls.Config, host string, protos ...string) (*x509.Certificate, error) {
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+	go tls.Server(sconn, cfg).Handshake()
+
+	client := tls.Client(cconn, &tls.Config{
+		ServerName:         host,
+		NextProtos:         protos,
+		InsecureSkipVerify: true,
+	})
+	if err := client.Handshake(); err != nil {
+		return nil, err
+	}
+	return client.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestObtain(t *testing.T) {
+	f := newFakeServer(t)
+	f.badNonces = 1
+
+	m := &Manager{
+		DirectoryURL: f.srv.URL + "/dir",
+		Hosts:        []string{"example.com"},
+		Email:        "admin@example.com",
+		CacheDir:     t.TempDir() + "/acme",
+	}
+
+	// The challenges must work even if the server requires client
+	// certificates.
+	cfg := &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}
+	m.Configure(cfg)
+	f.tls = cfg
+
+	// The certificate is obtained on the first handshake.
+	cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:      "example.com",
+		SupportedProtos: []string{"h2"},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err != nil {
+		t.Fatalf("GetCertificate failed: %v", err)
+	}
+	if !f.valid["example.com"] {
+		t.Errorf("challenge not validated")
+	}
+	if cert.Leaf.DNSNames[0] != "example.com" {
+		t.Errorf("unexpected certificate: %v", cert.Leaf.DNSNames)
+	}
+
+	// A new manager loads the certificate from the cache.
+	m2 := &Manager{
+		DirectoryURL: m.DirectoryURL,
+		Hosts:        m.Hosts,
+		CacheDir:     m.CacheDir,
+	}
+	cfg2 := &tls.Config{}
+	m2.Configure(cfg2)
+	leaf, err := handshake(cfg2, "example.com", "h2")
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if !leaf.Equal(cert.Leaf) {
+		t.Errorf("cached certificate not used")
+	}
+	if f.orders != 1 {
+		t.Errorf("expected 1 order, got %d", f.orders)
+	}
+}
+
+func TestBrokenCache(t *testing.T) {
+	f := newFakeServer(t)
+	dir := t.TempDir()
+	for _, name := range []string{"acme_account+key", "example.com"} {
+		err := os.WriteFile(dir+"/"+name, []byte("broken"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := &Manager{
+		DirectoryURL: f.srv.URL + "/dir",
+		Hosts:        []string{"example.com"},
+		CacheDir:     dir,
+	}
+	cfg := &tls.Config{}
+	m.Configure(cfg)
+	f.tls = cfg
+
+	// The broken entries are ignored, and replaced.
+	if _, err := handshake(cfg, "example.com", "h2"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if f.orders != 1 {
+		t.Errorf("expected 1 order, got %d", f.orders)
+	}
+	data, _ := os.ReadFile(dir + "/example.com")
+	if err := checkEntry("example.com", data); err != nil {
+		t.Errorf("broken entry not replaced: %v", err)
+	}
+}
+
+func TestUnknownHost(t *testing.T) {
+	f := newFakeServer(t)
+	m := &Manager{
+		DirectoryURL: f.srv.URL + "/dir",
+		Hosts:        []string{"example.com"},
+		CacheDir:     t.TempDir(),
+	}
+	cfg := &tls.Config{}
+	m.Configure(cfg)
+
+	_, err := cfg.GetCertificate(&tls.ClientHelloInfo{
+		ServerName: "other.example.com"})
+	if err == nil || !strings.Contains(err.Error(), "not configured") {
+		t.Errorf("expected host not configured error, got %v", err)
+	}
+	if f.orders != 0 {
+		t.Errorf("ordered a certificate for an unknown host")
+	}
+}
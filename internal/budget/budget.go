@@ -0,0 +1,324 @@
+// Package budget keeps track of the success ratio of upstreams and
+// listeners, and notifies a webhook when they stay below a threshold for too
+// long (that is, when their error budget is being exhausted).
+package budget
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"blitiri.com.ar/go/log"
+)
+
+// Constants that tune the trackers.
+const (
+	// Width of the buckets we count results in.
+	bucketWidth = 10 * time.Second
+
+	// How often the Alerter evaluates the trackers.
+	checkPeriod = 10 * time.Second
+)
+
+// Number of buckets we keep per tracker, which limits the maximum window.
+const numBuckets = 360
+
+// MaxWindow is the longest window the success ratio can be computed over.
+var MaxWindow = numBuckets * bucketWidth
+
+type bucket struct {
+	start     time.Time
+	successes int
+	total     int
+}
+
+// Tracker counts the results of an upstream or listener over time.
+// A nil *Tracker is valid, and ignores all results.
+type Tracker struct {
+	name string
+
+	mu      sync.Mutex
+	buckets [numBuckets]bucket
+
+	// When the last successful operation happened.
+	lastSuccess time.Time
+}
+
+var (
+	mu       sync.Mutex
+	trackers = map[string]*Tracker{}
+)
+
+// Get returns the tracker with the given name, creating it if needed.
+func Get(name string) *Tracker {
+	mu.Lock()
+	defer mu.Unlock()
+
+	t, ok := trackers[name]
+	if !ok {
+		t = &Tracker{name: name}
+		trackers[name] = t
+	}
+	return t
+}
+
+// all returns all the trackers, sorted by name.
+func all() []*Tracker {
+	mu.Lock()
+	defer mu.Unlock()
+
+	ts := make([]*Tracker, 0, len(trackers))
+	for _, t := range trackers {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].name < ts[j].name })
+	return ts
+}
+
+// Record the result of an operation.
+func (t *Tracker) Record(success bool) {
+	if t == nil {
+		return
+	}
+	t.record(time.Now(), success)
+}
+
+func (t *Tracker) record(now time.Time, success bool) {
+	start := now.Truncate(bucketWidth)
+	i := int(start.UnixNano()/int64(bucketWidth)) % numBuckets
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := &t.buckets[i]
+	if !b.start.Equal(start) {
+		*b = bucket{start: start}
+	}
+	b.total++
+	if success {
+		b.successes++
+		if now.After(t.lastSuccess) {
+			t.lastSuccess = now
+		}
+	}
+}
+
+// Freshness is when a tracker last recorded a success.
+type Freshness struct {
+	Name string
+
+	// Zero if it never succeeded.
+	LastSuccess time.Time
+}
+
+// AllFreshness returns the freshness of all the trackers, sorted by name.
+func AllFreshness() []Freshness {
+	fs := []Freshness{}
+	for _, t := range all() {
+		t.mu.Lock()
+		fs = append(fs, Freshness{Name: t.name, LastSuccess: t.lastSuccess})
+		t.mu.Unlock()
+	}
+	return fs
+}
+
+// Health is the recent success ratio of a tracker, and its freshness.
+type Health struct {
+	Freshness
+
+	// Ratio of successes over the window (1 if there were no results), and
+	// the number of results it is based on.
+	Ratio float64
+	Total int
+}
+
+// AllHealth returns the health of all the trackers over the given window,
+// sorted by name.
+func AllHealth(window time.Duration) []Health {
+	now := time.Now()
+	hs := []Health{}
+	for _, t := range all() {
+		ratio, total := t.ratio(now, window)
+		t.mu.Lock()
+		f := Freshness{Name: t.name, LastSuccess: t.lastSuccess}
+		t.mu.Unlock()
+		hs = append(hs, Health{Freshness: f, Ratio: ratio, Total: total})
+	}
+	return hs
+}
+
+// secondsSinceSuccess returns, for each tracker, the seconds since its last
+// success, or -1 if it never succeeded. Exported as a gauge.
+func secondsSinceSuccess() interface{} {
+	now := time.Now()
+	m := map[string]float64{}
+	for _, f := range AllFreshness() {
+		m[f.Name] = -1
+		if !f.LastSuccess.IsZero() {
+			m[f.Name] = now.Sub(f.LastSuccess).Round(time.Millisecond).Seconds()
+		}
+	}
+	return m
+}
+
+func init() {
+	expvar.Publish("seconds-since-success", expvar.Func(secondsSinceSuccess))
+}
+
+// ratio returns the success ratio over the given window, and the total
+// number of results it is based on.
+func (t *Tracker) ratio(now time.Time, window time.Duration) (float64, int) {
+	since := now.Add(-window)
+	successes, total := 0, 0
+
+	t.mu.Lock()
+	for _, b := range t.buckets {
+		if b.total > 0 && !b.start.Before(since) {
+			successes += b.successes
+			total += b.total
+		}
+	}
+	t.mu.Unlock()
+
+	if total == 0 {
+		return 1, 0
+	}
+	return float64(successes) / float64(total), total
+}
+
+// Alerter periodically checks the trackers, and notifies the webhook when
+// their success ratio stays below the threshold for a sustained period, and
+// again when they recover.
+type Alerter struct {
+	// URL to POST the notifications to.
+	WebhookURL string
+
+	// Minimum acceptable success ratio (between 0 and 1).
+	Threshold float64
+
+	// Window over which the success ratio is computed. Capped to MaxWindow.
+	Window time.Duration
+
+	// How long the ratio must stay below the threshold before notifying.
+	Sustain time.Duration
+
+	// Minimum number of results in the window for the ratio to be
+	// considered; below it, the tracker is assumed to be healthy.
+	MinQueries int
+
+	client *http.Client
+
+	// Per-tracker state, indexed by name.
+	belowSince map[string]time.Time
+	firing     map[string]bool
+}
+
+// Notification is the JSON body POSTed to the webhook.
+type Notification struct {
+	// Name of the tracker, e.g. "upstream https://dns.google/dns-query".
+	Name string `json:"name"`
+
+	// "firing" or "resolved".
+	Status string `json:"status"`
+
+	Ratio     float64 `json:"ratio"`
+	Threshold float64 `json:"threshold"`
+	Total     int     `json:"total"`
+
+	// Human-readable summary, for services that display it directly.
+	Text string `json:"text"`
+}
+
+// Run the alerter. It runs indefinitely.
+func (a *Alerter) Run() {
+	log.Infof("Alerting to %s when success ratio < %.3f for %s",
+		a.WebhookURL, a.Threshold, a.Sustain)
+	for range time.Tick(checkPeriod) {
+		a.check(time.Now())
+	}
+}
+
+func (a *Alerter) check(now time.Time) {
+	if a.belowSince == nil {
+		a.belowSince = map[string]time.Time{}
+		a.firing = map[string]bool{}
+	}
+
+	window := a.Window
+	if window > MaxWindow {
+		window = MaxWindow
+	}
+
+	for _, t := range all() {
+		ratio, total := t.ratio(now, window)
+		below := total >= a.MinQueries && ratio < a.Threshold
+
+		if !below {
+			delete(a.belowSince, t.name)
+			if a.firing[t.name] {
+				a.firing[t.name] = false
+				a.notify(t.name, "resolved", ratio, total)
+			}
+			continue
+		}
+
+		since, ok := a.belowSince[t.name]
+		if !ok {
+			a.belowSince[t.name] = now
+			since = now
+		}
+
+		if !a.firing[t.name] && now.Sub(since) >= a.Sustain {
+			a.firing[t.name] = true
+			a.notify(t.name, "firing", ratio, total)
+		}
+	}
+}
+
+func (a *Alerter) notify(name, status string, ratio float64, total int) {
+	tr := trace.New("budget.Alerter", name)
+	defer tr.Finish()
+
+	n := Notification{
+		Name:      name,
+		Status:    status,
+		Ratio:     ratio,
+		Threshold: a.Threshold,
+		Total:     total,
+		Text: fmt.Sprintf("dnss: %s is %s (success ratio %.3f, threshold %.3f)",
+			name, status, ratio, a.Threshold),
+	}
+	tr.Printf("%s", n.Text)
+	log.Infof("%s", n.Text)
+
+	body, err := json.Marshal(n)
+	if err != nil {
+		tr.Errorf("error encoding notification: %v", err)
+		return
+	}
+
+	if a.client == nil {
+		a.client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	resp, err := a.client.Post(a.WebhookURL, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("Error sending alert to webhook: %v", err)
+		tr.Error(err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err = tr.Errorf("webhook returned status %s", resp.Status)
+		log.Errorf("Error sending alert to webhook: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package budget
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRatio(t *testing.T) {
+	tk := &Tracker{name: "test"}
+	now := time.Now()
+
+	if r, n := tk.ratio(now, time.Minute); r != 1 || n != 0 {
+		t.Errorf("empty tracker: got %v %v", r, n)
+	}
+
+	// Old results, outside the window.
+	for i := 0; i < 10; i++ {
+		tk.record(now.Add(-10*time.Minute), false)
+	}
+
+	for i := 0; i < 3; i++ {
+		tk.record(now, true)
+	}
+	tk.record(now, false)
+
+	if r, n := tk.ratio(now, time.Minute); r != 0.75 || n != 4 {
+		t.Errorf("expected 0.75 over 4, got %v over %v", r, n)
+	}
+	if r, n := tk.ratio(now, 20*time.Minute); n != 14 || r != 3.0/14 {
+		t.Errorf("expected 3/14 over 14, got %v over %v", r, n)
+	}
+
+	// A nil tracker ignores results.
+	var nilTracker *Tracker
+	nilTracker.Record(true)
+}
+
+func TestFreshness(t *testing.T) {
+	tk := Get("test freshness")
+	now := time.Now()
+
+	find := func() Freshness {
+		t.Helper()
+		for _, f := range AllFreshness() {
+			if f.Name == "test freshness" {
+				return f
+			}
+		}
+		t.Fatalf("tracker not found in %v", AllFreshness())
+		return Freshness{}
+	}
+
+	// Failures don't count.
+	tk.record(now, false)
+	if f := find(); !f.LastSuccess.IsZero() {
+		t.Errorf("expected no success, got %v", f.LastSuccess)
+	}
+	if s := secondsSinceSuccess().(map[string]float64); s["test freshness"] != -1 {
+		t.Errorf("expected -1 seconds since success, got %v", s)
+	}
+
+	tk.record(now.Add(-time.Minute), true)
+	if f := find(); !f.LastSuccess.Equal(now.Add(-time.Minute)) {
+		t.Errorf("expected success 1m ago, got %v", f.LastSuccess)
+	}
+
+	// Older results don't go back in time.
+	tk.record(now, true)
+	tk.record(now.Add(-time.Hour), true)
+	if f := find(); !f.LastSuccess.Equal(now) {
+		t.Errorf("expected success now, got %v", f.LastSuccess)
+	}
+	if s := secondsSinceSuccess().(map[string]float64); s["test freshness"] > 60 {
+		t.Errorf("unexpected seconds since success: %v", s)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	tk := Get("test health")
+	now := time.Now()
+	tk.record(now, true)
+	tk.record(now, false)
+
+	for _, h := range AllHealth(time.Minute) {
+		if h.Name != "test health" {
+			continue
+		}
+		if h.Ratio != 0.5 || h.Total != 2 || !h.LastSuccess.Equal(now) {
+			t.Errorf("unexpected health: %+v", h)
+		}
+		return
+	}
+	t.Errorf("tracker not found in %v", AllHealth(time.Minute))
+}
+
+func TestAlerter(t *testing.T) {
+	notifications := make(chan Notification, 10)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			n := Notification{}
+			if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+				t.Errorf("error decoding notification: %v", err)
+			}
+			notifications <- n
+		}))
+	defer srv.Close()
+
+	a := &Alerter{
+		WebhookURL: srv.URL,
+		Threshold:  0.9,
+		Window:     2 * time.Minute,
+		Sustain:    time.Minute,
+		MinQueries: 5,
+	}
+
+	tk := Get("TestAlerter")
+	now := time.Now()
+
+	// Not enough queries to consider it.
+	tk.record(now, false)
+	a.check(now)
+	if _, ok := a.belowSince[tk.name]; ok {
+		t.Errorf("tracker considered with too few queries")
+	}
+
+	// Below the threshold, but not for long enough.
+	for i := 0; i < 5; i++ {
+		tk.record(now, false)
+	}
+	a.check(now)
+	a.check(now.Add(30 * time.Second))
+	if len(notifications) != 0 {
+		t.Fatalf("unexpected notification: %v", <-notifications)
+	}
+
+	// Sustained, we should be notified (only once).
+	a.check(now.Add(time.Minute))
+	a.check(now.Add(time.Minute))
+	n := <-notifications
+	if n.Name != "TestAlerter" || n.Status != "firing" || n.Ratio != 0 {
+		t.Errorf("unexpected notification: %+v", n)
+	}
+	if len(notifications) != 0 {
+		t.Errorf("unexpected notification: %v", <-notifications)
+	}
+
+	// Once the failures are out of the window, it recovers.
+	a.check(now.Add(3 * time.Minute))
+	n = <-notifications
+	if n.Name != "TestAlerter" || n.Status != "resolved" {
+		t.Errorf("unexpected notification: %+v", n)
+	}
+}
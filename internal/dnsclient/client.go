@@ -0,0 +1,167 @@
+package dnsclient
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+// Timeout for the queries, if none is given.
+const defaultTimeout = 2 * time.Second
+
+// Maximum number of idle connections we keep to each server.
+const maxIdleConns = 8
+
+// How long we keep idle connections for. The servers usually close them
+// after a few seconds anyway.
+var idleConnTimeout = 10 * time.Second
+
+// Client sends queries to a DNS server over UDP, retrying over TCP if the
+// replies are truncated; or over TLS for DoT servers (see DoTPrefix). The
+// TCP and TLS connections are reused across queries.
+type Client struct {
+	addr string
+	udp  *dns.Client
+
+	// Client for TCP, or TLS for DoT servers, and its idle connections.
+	conns *dns.Client
+	mu    sync.Mutex
+	idle  []idleConn
+}
+
+type idleConn struct {
+	conn  *dns.Conn
+	since time.Time
+}
+
+// New returns a client for the given server (see ParseAddr). A timeout of 0
+// means the default (2s).
+func New(server string, timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	addr, tlsConfig := ParseAddr(server)
+	c := &Client{
+		addr:  addr,
+		udp:   &dns.Client{Net: "udp", Timeout: timeout},
+		conns: &dns.Client{Net: "tcp", Timeout: timeout},
+	}
+	if tlsConfig != nil {
+		c.udp = nil
+		c.conns = &dns.Client{
+			Net:       "tcp-tls",
+			Timeout:   timeout,
+			TLSConfig: tlsConfig,
+		}
+	}
+	return c
+}
+
+// Exchange sends the query to the server, and returns its reply. It gives up
+// once the context is done.
+func (c *Client) Exchange(ctx context.Context, tr *trace.Trace, req *dns.Msg) (*dns.Msg, error) {
+	if c.udp == nil {
+		return c.exchangeConn(ctx, tr, req)
+	}
+
+	conn, err := c.udp.DialContext(ctx, c.addr)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := exchangeWithConn(ctx, c.udp, req, conn)
+	conn.Close()
+	if err != nil {
+		tr.Printf("error on UDP exchange: %v", err)
+		return nil, err
+	}
+	if !reply.Truncated {
+		tr.Printf("UDP exchange successful")
+		return reply, nil
+	}
+
+	// If the reply was truncated, retry over TCP. We don't on errors, as
+	// it would just double the time to fail if the server is down.
+	tr.Printf("UDP exchange returned truncated reply: %v", reply.MsgHdr)
+	tr.Printf("retrying on TCP")
+	return c.exchangeConn(ctx, tr, req)
+}
+
+// exchangeConn sends the query over TCP (or TLS), reusing an idle
+// connection if there is one. If that fails, it is retried once over a new
+// connection, as the server may have closed the idle one.
+func (c *Client) exchangeConn(ctx context.Context, tr *trace.Trace, req *dns.Msg) (*dns.Msg, error) {
+	if conn := c.getIdle(); conn != nil {
+		reply, err := exchangeWithConn(ctx, c.conns, req, conn)
+		if err == nil {
+			tr.Printf("%s exchange successful (reused connection)",
+				c.conns.Net)
+			c.putIdle(conn)
+			return reply, nil
+		}
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		tr.Printf("error on reused connection, retrying: %v", err)
+	}
+
+	conn, err := c.conns.DialContext(ctx, c.addr)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := exchangeWithConn(ctx, c.conns, req, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tr.Printf("%s exchange successful", c.conns.Net)
+	c.putIdle(conn)
+	return reply, nil
+}
+
+// exchangeWithConn sends the query over the connection, and returns the
+// reply. Unlike dns.Client.ExchangeWithConnContext, it gives up as soon as
+// the context is canceled, not just at its deadline.
+func exchangeWithConn(ctx context.Context, c *dns.Client, req *dns.Msg, conn *dns.Conn) (*dns.Msg, error) {
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	reply, _, err := c.ExchangeWithConnContext(ctx, req, conn)
+	return reply, err
+}
+
+// getIdle returns the most recently used idle connection, or nil if there
+// are none. Connections idle for too long are closed.
+func (c *Client) getIdle() *dns.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.idle) > 0 {
+		ic := c.idle[len(c.idle)-1]
+		c.idle = c.idle[:len(c.idle)-1]
+		if time.Since(ic.since) < idleConnTimeout {
+			return ic.conn
+		}
+		ic.conn.Close()
+	}
+	return nil
+}
+
+// putIdle keeps the connection for later reuse, or closes it if we have
+// enough already.
+func (c *Client) putIdle(conn *dns.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.idle) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, idleConn{conn: conn, since: time.Now()})
+}
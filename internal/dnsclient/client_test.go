@@ -0,0 +1,207 @@
+package dnsclient
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+func TestDoT(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dot.test"},
+		DNSNames:     []string{"dot.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	defer func(prev *x509.CertPool) { RootCAs = prev }(RootCAs)
+	RootCAs = x509.NewCertPool()
+	RootCAs.AddCert(cert)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{
+			{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	dnsSrv := &dns.Server{
+		Net:      "tcp-tls",
+		Listener: ln,
+		Handler: dns.HandlerFunc(
+			testutil.MakeStaticHandler(t, "test. A 1.1.1.1")),
+	}
+	go dnsSrv.ActivateAndServe()
+	defer dnsSrv.Shutdown()
+
+	tr := trace.New("test", "TestDoT")
+	defer tr.Finish()
+
+	r := &dns.Msg{}
+	r.SetQuestion("test.", dns.TypeA)
+
+	addr := ln.Addr().String()
+	c := New("tls://"+addr+"#dot.test", 0)
+	reply, err := c.Exchange(context.Background(), tr, r)
+	if err != nil {
+		t.Fatalf("DoT exchange failed: %v", err)
+	}
+	if len(reply.Answer) != 1 ||
+		reply.Answer[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Errorf("unexpected reply: %v", reply)
+	}
+
+	// The name is verified against the certificate.
+	c = New("tls://"+addr+"#other.test", 0)
+	if _, err := c.Exchange(context.Background(), tr, r); err == nil {
+		t.Errorf("exchange with the wrong name succeeded")
+	}
+}
+
+func TestTCPFallback(t *testing.T) {
+	addr := testutil.GetFreePort()
+
+	// Over UDP the replies are truncated, so the client has to retry over
+	// TCP. We keep track of the TCP connections, to check they're reused.
+	mu := sync.Mutex{}
+	conns := map[string]bool{}
+	static := testutil.MakeStaticHandler(t, "test. A 1.1.1.1")
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if w.RemoteAddr().Network() == "udp" {
+			m := &dns.Msg{}
+			m.SetReply(r)
+			m.Truncated = true
+			w.WriteMsg(m)
+			return
+		}
+		mu.Lock()
+		conns[w.RemoteAddr().String()] = true
+		mu.Unlock()
+		static(w, r)
+	})
+
+	for _, n := range []string{"udp", "tcp"} {
+		srv := &dns.Server{Addr: addr, Net: n, Handler: handler}
+		go srv.ListenAndServe()
+		defer srv.Shutdown()
+	}
+	testutil.WaitForDNSServer(addr)
+
+	tr := trace.New("test", "TestTCPFallback")
+	defer tr.Finish()
+
+	c := New(addr, 0)
+	for i := 0; i < 3; i++ {
+		r := &dns.Msg{}
+		r.SetQuestion("test.", dns.TypeA)
+		reply, err := c.Exchange(context.Background(), tr, r)
+		if err != nil {
+			t.Fatalf("%d: query failed: %v", i, err)
+		}
+		if reply.Truncated || len(reply.Answer) != 1 {
+			t.Errorf("%d: unexpected reply: %v", i, reply)
+		}
+	}
+
+	mu.Lock()
+	if len(conns) != 1 {
+		t.Errorf("expected 1 TCP connection, got %v", conns)
+	}
+	mu.Unlock()
+
+	// Connections idle for too long are not reused.
+	defer func(prev time.Duration) { idleConnTimeout = prev }(idleConnTimeout)
+	idleConnTimeout = 0
+
+	r := &dns.Msg{}
+	r.SetQuestion("test.", dns.TypeA)
+	if _, err := c.Exchange(context.Background(), tr, r); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	mu.Lock()
+	if len(conns) != 2 {
+		t.Errorf("expected 2 TCP connections, got %v", conns)
+	}
+	mu.Unlock()
+}
+
+func TestContextDeadline(t *testing.T) {
+	addr := testutil.GetFreePort()
+
+	// The server never answers our queries (only the ones of
+	// WaitForDNSServer), and we keep track of the TCP ones, to check we
+	// don't retry over TCP.
+	mu := sync.Mutex{}
+	tcpQueries := 0
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "unused." {
+			m := &dns.Msg{}
+			m.SetReply(r)
+			w.WriteMsg(m)
+			return
+		}
+		if w.RemoteAddr().Network() == "tcp" {
+			mu.Lock()
+			tcpQueries++
+			mu.Unlock()
+		}
+	})
+	for _, n := range []string{"udp", "tcp"} {
+		srv := &dns.Server{Addr: addr, Net: n, Handler: handler}
+		go srv.ListenAndServe()
+		defer srv.Shutdown()
+	}
+	testutil.WaitForDNSServer(addr)
+
+	tr := trace.New("test", "TestContextDeadline")
+	defer tr.Finish()
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	r := &dns.Msg{}
+	r.SetQuestion("test.", dns.TypeA)
+
+	// The query gives up at the context's deadline, not the (longer)
+	// client timeout.
+	c := New(addr, 5*time.Second)
+	start := time.Now()
+	if _, err := c.Exchange(ctx, tr, r); err == nil {
+		t.Errorf("query to a server that doesn't answer succeeded")
+	}
+	if d := time.Since(start); d > 1*time.Second {
+		t.Errorf("query took %v, the deadline was ignored", d)
+	}
+
+	mu.Lock()
+	if tcpQueries != 0 {
+		t.Errorf("retried over TCP after a UDP timeout")
+	}
+	mu.Unlock()
+}
@@ -0,0 +1,43 @@
+// Package dnsclient has what we need to talk to the DNS servers given to us
+// by address, over plain DNS or DNS over TLS (DoT).
+package dnsclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+)
+
+// DoTPrefix is the prefix of the DoT servers, like "tls://dns.example:853".
+// The name to verify can be given after a '#', like
+// "tls://192.0.2.1#dns.example"; by default, the host is used.
+const DoTPrefix = "tls://"
+
+// RootCAs to verify the DoT servers with; nil means the system's.
+// It is a variable so the tests can use their own CA.
+var RootCAs *x509.CertPool
+
+// ParseAddr returns the address of the server, and if it is a DoT one, the
+// TLS configuration to use with it (nil otherwise). The port defaults to 853
+// for DoT, and 53 for plain DNS.
+func ParseAddr(server string) (string, *tls.Config) {
+	if !strings.HasPrefix(server, DoTPrefix) {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		return server, nil
+	}
+
+	addr, serverName, _ := strings.Cut(
+		strings.TrimPrefix(server, DoTPrefix), "#")
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.Trim(addr, "[]")
+		addr = net.JoinHostPort(host, "853")
+	}
+	if serverName == "" {
+		serverName = host
+	}
+	return addr, &tls.Config{ServerName: serverName, RootCAs: RootCAs}
+}
@@ -0,0 +1,27 @@
+package dnsclient
+
+import "testing"
+
+func TestParseAddr(t *testing.T) {
+	cases := []struct{ server, addr, name string }{
+		{"192.0.2.1:53", "192.0.2.1:53", ""},
+		{"192.0.2.1", "192.0.2.1:53", ""},
+		{"[2001:db8::1]", "[2001:db8::1]:53", ""},
+		{"tls://dns.example", "dns.example:853", "dns.example"},
+		{"tls://dns.example:8853", "dns.example:8853", "dns.example"},
+		{"tls://192.0.2.1#dns.example", "192.0.2.1:853", "dns.example"},
+		{"tls://[2001:db8::1]", "[2001:db8::1]:853", "2001:db8::1"},
+		{"tls://[2001:db8::1]:53#x", "[2001:db8::1]:53", "x"},
+	}
+	for _, c := range cases {
+		addr, tlsConfig := ParseAddr(c.server)
+		name := ""
+		if tlsConfig != nil {
+			name = tlsConfig.ServerName
+		}
+		if addr != c.addr || name != c.name {
+			t.Errorf("%q: expected (%q, %q), got (%q, %q)",
+				c.server, c.addr, c.name, addr, name)
+		}
+	}
+}
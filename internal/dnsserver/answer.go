@@ -0,0 +1,82 @@
+package dnsserver
+
+import (
+	"github.com/miekg/dns"
+)
+
+// fitReply returns a reply with the contents of the given one, that fits
+// within max bytes. If the reply already fits, it is returned as-is.
+// Otherwise, records are kept in order until they no longer fit, and the
+// reply is marked as truncated if any answer or authority records were left
+// out.
+//
+// The work is done by dns.Msg.Truncate, which keeps a running estimate of
+// the compressed size as it goes, instead of packing the message after
+// every record. It keeps the OPT record at the end, and we do the same for
+// the TSIG one, which must go after it (RFC 6891, RFC 8945).
+func fitReply(reply *dns.Msg, max int) *dns.Msg {
+	// Clients can't advertise less than the default size (RFC 6891).
+	if max < dns.MinMsgSize {
+		max = dns.MinMsgSize
+	}
+
+	reply.Compress = true
+	if reply.Len() <= max {
+		return reply
+	}
+
+	m := reply.Copy()
+	defer setTruncated(m, reply)
+
+	// Truncate doesn't touch messages with a TSIG record, so we take it out
+	// of the way, and put it back afterwards.
+	n := len(m.Extra)
+	if n == 0 || m.Extra[n-1].Header().Rrtype != dns.TypeTSIG {
+		m.Truncate(max)
+		m.Compress = true
+		return m
+	}
+
+	tsig := m.Extra[n-1]
+	m.Extra = m.Extra[:n-1]
+	m.Truncate(max - dns.Len(tsig))
+	m.Compress = true
+	m.Extra = append(m.Extra, tsig)
+
+	// Truncate doesn't go below the minimum size, so we can still be over
+	// by up to the size of the TSIG; drop records from the end until we
+	// fit. It's only a few, as the TSIG is small.
+	for m.Len() > max && dropLast(m) {
+	}
+	return m
+}
+
+// setTruncated sets the truncated bit of m, which was cut down from orig.
+// Truncate sets it if any record was left out, but we don't want to do that
+// when only additional records were dropped, as clients would retry over
+// TCP for no good reason (RFC 2181 section 9).
+func setTruncated(m, orig *dns.Msg) {
+	m.Truncated = orig.Truncated ||
+		len(m.Answer) < len(orig.Answer) || len(m.Ns) < len(orig.Ns)
+}
+
+// dropLast removes the last record of the reply, other than the OPT and
+// TSIG ones. Returns false if there were no records to remove.
+func dropLast(m *dns.Msg) bool {
+	for i := len(m.Extra) - 1; i >= 0; i-- {
+		rrtype := m.Extra[i].Header().Rrtype
+		if rrtype != dns.TypeOPT && rrtype != dns.TypeTSIG {
+			m.Extra = append(m.Extra[:i:i], m.Extra[i+1:]...)
+			return true
+		}
+	}
+	if n := len(m.Ns); n > 0 {
+		m.Ns = m.Ns[:n-1]
+		return true
+	}
+	if n := len(m.Answer); n > 0 {
+		m.Answer = m.Answer[:n-1]
+		return true
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package dnsserver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func bigReply(t *testing.T, n int) *dns.Msg {
+	r := newQuery("big.example.", dns.TypeTXT)
+	r.SetEdns0(1232, true)
+
+	reply := &dns.Msg{}
+	reply.SetReply(r)
+	for i := 0; i < n; i++ {
+		reply.Answer = append(reply.Answer, mustNewRR(t,
+			fmt.Sprintf("big.example. 60 TXT \"record number %03d\"", i)))
+	}
+	reply.Ns = append(reply.Ns, mustNewRR(t,
+		"example. 60 NS ns1.example."))
+	reply.Extra = append(reply.Extra, mustNewRR(t,
+		"ns1.example. 60 A 1.2.3.4"))
+	reply.SetEdns0(1232, true)
+	reply.SetTsig("key.", dns.HmacSHA256, 300, 0)
+	return reply
+}
+
+func TestFitReplyFits(t *testing.T) {
+	reply := bigReply(t, 3)
+	fit := fitReply(reply, 512)
+	if fit != reply || fit.Truncated {
+		t.Errorf("reply was modified: %v", fit)
+	}
+}
+
+func TestFitReplyTruncates(t *testing.T) {
+	reply := bigReply(t, 100)
+	fit := fitReply(reply, 512)
+
+	if !fit.Truncated {
+		t.Errorf("reply not marked as truncated")
+	}
+	if l := fit.Len(); l > 512 {
+		t.Errorf("reply too long: %d > 512", l)
+	}
+	if len(fit.Answer) == 0 || len(fit.Answer) >= 100 {
+		t.Errorf("unexpected number of answers: %d", len(fit.Answer))
+	}
+	if len(fit.Ns) != 0 {
+		t.Errorf("authority section should have been dropped: %v", fit.Ns)
+	}
+
+	// OPT and TSIG must be kept, at the end, in that order.
+	n := len(fit.Extra)
+	if n != 2 ||
+		fit.Extra[n-2].Header().Rrtype != dns.TypeOPT ||
+		fit.Extra[n-1].Header().Rrtype != dns.TypeTSIG {
+		t.Errorf("OPT/TSIG not preserved: %v", fit.Extra)
+	}
+
+	// The original reply is not changed.
+	if len(reply.Answer) != 100 || reply.Truncated {
+		t.Errorf("original reply was modified")
+	}
+}
+
+func TestFitReplyDropsExtra(t *testing.T) {
+	reply := bigReply(t, 1)
+	for i := 0; i < 50; i++ {
+		reply.Extra = append([]dns.RR{mustNewRR(t,
+			fmt.Sprintf("ns%d.example. 60 A 1.2.3.4", i))}, reply.Extra...)
+	}
+
+	fit := fitReply(reply, 512)
+
+	// Only additional records were dropped, so it's not truncated.
+	if fit.Truncated {
+		t.Errorf("reply marked as truncated")
+	}
+	if len(fit.Answer) != 1 || len(fit.Ns) != 1 {
+		t.Errorf("answer or authority lost: %v", fit)
+	}
+	if l := fit.Len(); l > 512 {
+		t.Errorf("reply too long: %d > 512", l)
+	}
+	n := len(fit.Extra)
+	if fit.Extra[n-1].Header().Rrtype != dns.TypeTSIG {
+		t.Errorf("TSIG is not the last record: %v", fit.Extra)
+	}
+}
@@ -3,10 +3,17 @@ package dnsserver
 // Tests for the caching resolver.
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -49,6 +56,16 @@ func TestBasic(t *testing.T) {
 	if resp.Authoritative {
 		t.Errorf("cache hit was authoritative")
 	}
+
+	// Check the breakdown by type, and the derived stats.
+	h, m := stats.cacheHitsByType.Get("A"), stats.cacheMissesByType.Get("A")
+	if h == nil || h.String() != "1" || m == nil || m.String() != "1" {
+		t.Errorf("bad stats by type: hits %v, misses %v",
+			stats.cacheHitsByType, stats.cacheMissesByType)
+	}
+	if r := cacheHitRatio(); r != 0.5 {
+		t.Errorf("expected hit ratio 0.5, got %v", r)
+	}
 }
 
 // Test TTL handling.
@@ -58,11 +75,9 @@ func TestTTL(t *testing.T) {
 	c.Init()
 	resetStats()
 
-	// Note we don't start c.Maintain() yet, as we don't want the background
-	// TTL updater until later.
-
 	// Test a record with a larger-than-max TTL (1 day).
-	// The TTL of the response should be capped.
+	// The TTL of the response should be capped, and counted as modified.
+	answersModified.Init()
 	resp := queryA(t, c, "test. 86400 A 1.2.3.4", "test.", "1.2.3.4")
 	if !statsEquals(1, 0, 1) {
 		t.Errorf("bad stats: %v", dumpStats())
@@ -70,9 +85,11 @@ func TestTTL(t *testing.T) {
 	if ttl := getTTL(resp.Answer); ttl != maxTTL {
 		t.Errorf("expected max TTL (%v), got %v", maxTTL, ttl)
 	}
+	if v := answersModified.Get(modTTLClamped); v == nil || v.String() != "1" {
+		t.Errorf("expected 1 modified answer, got %v", answersModified)
+	}
 
 	// Same query, should be cached, and TTL also capped.
-	// As we've not enabled cache maintenance, we can be sure TTL == maxTTL.
 	resp = queryA(t, c, "", "test.", "1.2.3.4")
 	if !statsEquals(2, 1, 1) {
 		t.Errorf("bad stats: %v", dumpStats())
@@ -81,37 +98,73 @@ func TestTTL(t *testing.T) {
 		t.Errorf("expected max TTL (%v), got %v", maxTTL, ttl)
 	}
 
-	// To test that the TTL is reduced appropriately, set a small maintenance
-	// period, and then repeatedly query the record. We should see its TTL
-	// shrinking down within 1s.
-	// Even though the TTL resolution in the protocol is in seconds, we don't
-	// need to wait that much "thanks" to rounding artifacts.
-	maintenancePeriod = 50 * time.Millisecond
-	go c.Maintain()
-	resetStats()
+	// The TTL is reduced by the time that passed since the entry was
+	// stored.
+	ageCache(c, 10*time.Second)
+	resp = queryA(t, c, "", "test.", "1.2.3.4")
+	if ttl := getTTL(resp.Answer); ttl != maxTTL-10*time.Second {
+		t.Errorf("expected maxTTL-10s, got %v", ttl)
+	}
 
 	// Check that the back resolver's Maintain() is called.
+	maintenancePeriod = 50 * time.Millisecond
+	go c.Maintain()
 	select {
 	case <-r.MaintainC:
 		t.Log("Maintain() called")
 	case <-time.After(1 * time.Second):
 		t.Errorf("back resolver Maintain() was not called")
 	}
+}
 
-	start := time.Now()
-	for time.Since(start) < 1*time.Second {
-		resp = queryA(t, c, "", "test.", "1.2.3.4")
-		t.Logf("TTL %v", getTTL(resp.Answer))
-		if ttl := getTTL(resp.Answer); ttl <= (maxTTL - 1*time.Second) {
-			break
-		}
-		time.Sleep(maintenancePeriod)
+// Test that each record keeps its own TTL, and the entry expires with the
+// lowest one.
+func TestPerRecordTTL(t *testing.T) {
+	r := testutil.NewTestResolver()
+	c := NewCachingResolver(r)
+	c.Init()
+	resetStats()
+
+	r.Response = newReply(mustNewRR(t, "test. 300 A 1.2.3.4"))
+	r.Response.Answer = append(r.Response.Answer,
+		mustNewRR(t, "test. 600 A 1.2.3.5"))
+	queryA(t, c, "", "test.", "1.2.3.4")
+
+	ageCache(c, 100*time.Second)
+	resp := queryA(t, c, "", "test.", "1.2.3.4")
+	if !statsEquals(2, 1, 1) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+	if a, b := resp.Answer[0].Header().Ttl, resp.Answer[1].Header().Ttl; a != 200 || b != 500 {
+		t.Errorf("expected TTLs 200 and 500, got %d and %d", a, b)
 	}
-	if ttl := getTTL(resp.Answer); ttl > (maxTTL - 1*time.Second) {
-		t.Errorf("expected maxTTL-1s, got %v", ttl)
+
+	// Once the first record expires, so does the entry.
+	ageCache(c, 200*time.Second)
+	queryA(t, c, "", "test.", "1.2.3.4")
+	if !statsEquals(3, 1, 2) {
+		t.Errorf("bad stats: %v", dumpStats())
 	}
 }
 
+// ageCache makes all the entries in the cache look like they were stored d
+// earlier.
+func ageCache(c *cachingResolver, d time.Duration) {
+	for _, sh := range c.shards {
+		sh.mu.Lock()
+		for k, e := range sh.answer {
+			e.stored = e.stored.Add(-d)
+			e.expires = e.expires.Add(-d)
+			sh.answer[k] = e
+		}
+		sh.mu.Unlock()
+	}
+}
+
+func getTTL(answer []dns.RR) time.Duration {
+	return time.Duration(answer[0].Header().Ttl) * time.Second
+}
+
 // Test that we don't cache failed queries.
 func TestFailedQueries(t *testing.T) {
 	r := testutil.NewTestResolver()
@@ -212,6 +265,49 @@ func TestCacheFull(t *testing.T) {
 	}
 }
 
+// Test the cache's memory limit.
+func TestCacheMaxBytes(t *testing.T) {
+	r := testutil.NewTestResolver()
+	c := NewCachingResolver(r)
+	c.Init()
+	resetStats()
+
+	// Room for exactly two entries like the ones we use.
+	r.Response = newReply(mustNewRR(t, "test0. A 1.2.3.4"))
+	size := entrySize(cacheKey{Question: dns.Question{Name: "test0."}},
+		r.Response.Answer)
+	prevMaxCacheBytes := maxCacheBytes
+	maxCacheBytes = 2 * size
+	defer func() { maxCacheBytes = prevMaxCacheBytes }()
+
+	for i := 0; i < 3; i++ {
+		queryA(t, c, "", fmt.Sprintf("test%d.", i), "1.2.3.4")
+	}
+	if n, b := c.size.Load(), c.bytes.Load(); n != 2 || b != 2*size {
+		t.Errorf("expected 2 entries of %d bytes, got %d with %d bytes",
+			size, n, b)
+	}
+
+	// The first two are cached, the third one didn't fit.
+	resetStats()
+	for i := 0; i < 3; i++ {
+		queryA(t, c, "", fmt.Sprintf("test%d.", i), "1.2.3.4")
+	}
+	if !statsEquals(3, 2, 1) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+
+	// Once they're gone, the memory is given back.
+	c.FlushDomain("test0.")
+	if b := c.bytes.Load(); b != size {
+		t.Errorf("expected %d bytes after flushing one, got %d", size, b)
+	}
+	c.Flush()
+	if n, b := c.size.Load(), c.bytes.Load(); n != 0 || b != 0 {
+		t.Errorf("expected empty cache, got %d entries with %d bytes", n, b)
+	}
+}
+
 // Test behaviour when the size of the cache is 0 (so users can disable it
 // that way).
 func TestZeroSize(t *testing.T) {
@@ -245,6 +341,662 @@ func TestZeroSize(t *testing.T) {
 	}
 }
 
+// Test the cache GC, which is done shard by shard.
+func TestGC(t *testing.T) {
+	r := testutil.NewTestResolver()
+	c := NewCachingResolver(r)
+	c.Init()
+	resetStats()
+
+	queryA(t, c, "short. 180 A 1.2.3.4", "short.", "1.2.3.4")
+	queryA(t, c, "long. 3600 A 1.2.3.4", "long.", "1.2.3.4")
+	if n := c.size.Load(); n != 2 {
+		t.Errorf("expected 2 entries, got %d", n)
+	}
+
+	ageCache(c, 5*time.Minute)
+	for _, sh := range c.shards {
+		c.gcShard(sh)
+	}
+
+	if n := c.size.Load(); n != 1 {
+		t.Errorf("expected 1 entry after GC, got %d", n)
+	}
+
+	// The long entry is still cached, with a reduced TTL.
+	resetStats()
+	resp := queryA(t, c, "", "long.", "1.2.3.4")
+	if !statsEquals(1, 1, 0) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+	if ttl := getTTL(resp.Answer); ttl != 55*time.Minute {
+		t.Errorf("expected TTL of 55m, got %v", ttl)
+	}
+
+	// The short one expired.
+	queryA(t, c, "short. 180 A 1.2.3.4", "short.", "1.2.3.4")
+	if !statsEquals(2, 1, 1) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+}
+
+// Test prefetching of popular entries that are about to expire.
+func TestPrefetch(t *testing.T) {
+	r := testutil.NewTestResolver()
+	c := NewCachingResolver(r)
+	c.Init()
+	c.SetPrefetch(true)
+
+	// "popular" gets enough hits, "unpopular" does not.
+	queryA(t, c, "popular. 360 A 1.2.3.4", "popular.", "1.2.3.4")
+	queryA(t, c, "unpopular. 360 A 1.2.3.4", "unpopular.", "1.2.3.4")
+	for i := int64(0); i < prefetchMinHits; i++ {
+		queryA(t, c, "", "popular.", "1.2.3.4")
+	}
+
+	prevPeriod := maintenancePeriod
+	maintenancePeriod = 3 * time.Minute
+	defer func() { maintenancePeriod = prevPeriod }()
+
+	// Both expire in 3m (before the next GC), but only the popular one
+	// should be prefetched.
+	ageCache(c, 3*time.Minute)
+	var toPrefetch []cacheKey
+	for _, sh := range c.shards {
+		toPrefetch = append(toPrefetch, c.gcShard(sh)...)
+	}
+	if len(toPrefetch) != 1 || toPrefetch[0].Name != "popular." {
+		t.Fatalf("expected to prefetch popular., got %v", toPrefetch)
+	}
+
+	stats.cachePrefetched.Set(0)
+	r.Response = newReply(mustNewRR(t, "popular. 360 A 5.6.7.8"))
+	c.prefetchEntries(toPrefetch)
+	if stats.cachePrefetched.Value() != 1 {
+		t.Errorf("expected 1 prefetch, got %v", stats.cachePrefetched)
+	}
+
+	// The fresh answer is served from the cache, with the full TTL.
+	resetStats()
+	resp := queryA(t, c, "", "popular.", "5.6.7.8")
+	if !statsEquals(1, 1, 0) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+	if ttl := getTTL(resp.Answer); ttl != 6*time.Minute {
+		t.Errorf("expected TTL of 6m, got %v", ttl)
+	}
+
+	// Its hits were reset, so it won't be prefetched again unless it stays
+	// popular.
+	ageCache(c, 3*time.Minute)
+	for _, sh := range c.shards {
+		if keys := c.gcShard(sh); len(keys) != 0 {
+			t.Errorf("unexpected prefetch: %v", keys)
+		}
+	}
+}
+
+// Test maintenance mode.
+func TestMaintenance(t *testing.T) {
+	r := testutil.NewTestResolver()
+	c := NewCachingResolver(r)
+	c.Init()
+	resetStats()
+
+	queryA(t, c, "test. A 1.2.3.4", "test.", "1.2.3.4")
+
+	// Enable maintenance mode via the HTTP handler.
+	w := httptest.NewRecorder()
+	c.MaintenanceMode(w,
+		httptest.NewRequest("GET", "/?enable=1", nil))
+	if body := w.Body.String(); body != "maintenance mode: true\n" {
+		t.Errorf("unexpected handler output: %q", body)
+	}
+
+	// Cached entries are still served, the rest fail without reaching the
+	// backing resolver.
+	r.LastQuery = nil
+	queryA(t, c, "", "test.", "1.2.3.4")
+
+	// Even if they expired.
+	ageCache(c, 2*maxTTL)
+	resp := queryA(t, c, "", "test.", "1.2.3.4")
+	if ttl := resp.Answer[0].Header().Ttl; ttl != staleTTL {
+		t.Errorf("expected stale TTL, got %d", ttl)
+	}
+
+	tr := trace.New("test", "TestMaintenance")
+	defer tr.Finish()
+	_, err := c.Query(newQuery("other.", dns.TypeA), tr)
+	if err != errMaintenance {
+		t.Errorf("expected maintenance error, got %v", err)
+	}
+	if r.LastQuery != nil {
+		t.Errorf("backing resolver queried in maintenance mode")
+	}
+
+	// Disable it, and check queries go through again.
+	c.SetMaintenance(false)
+	queryA(t, c, "other. A 2.2.2.2", "other.", "2.2.2.2")
+
+	// Invalid parameter.
+	w = httptest.NewRecorder()
+	c.MaintenanceMode(w,
+		httptest.NewRequest("GET", "/?enable=blah", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected bad request, got %d", w.Code)
+	}
+}
+
+// Test that the DNSSEC bits of the query are part of the cache key.
+func TestDumpJSON(t *testing.T) {
+	r := testutil.NewTestResolver()
+	c := NewCachingResolver(r)
+	c.Init()
+
+	queryA(t, c, "example.com. A 1.2.3.4", "example.com.", "1.2.3.4")
+	queryA(t, c, "www.example.com. A 1.2.3.4", "www.example.com.", "1.2.3.4")
+	queryA(t, c, "other. A 1.2.3.4", "other.", "1.2.3.4")
+
+	dump := func(params string) []jsonCacheEntry {
+		t.Helper()
+		w := httptest.NewRecorder()
+		c.DumpCache(w, httptest.NewRequest("GET", "/?format=json"+params, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: unexpected code %d: %s", params, w.Code, w.Body)
+		}
+		entries := []jsonCacheEntry{}
+		if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+			t.Fatalf("%q: error decoding: %v", params, err)
+		}
+		return entries
+	}
+
+	if entries := dump(""); len(entries) != 3 {
+		t.Errorf("expected 3 entries, got %v", entries)
+	}
+	entries := dump("&name=example.com&type=a")
+	if len(entries) != 2 {
+		t.Errorf("expected 2 entries, got %v", entries)
+	}
+	for _, e := range entries {
+		if e.Type != "A" || e.NAnswer != 1 || e.TTL <= 0 {
+			t.Errorf("unexpected entry: %+v", e)
+		}
+	}
+	if entries := dump("&type=AAAA"); len(entries) != 0 {
+		t.Errorf("expected no entries, got %v", entries)
+	}
+
+	// Invalid filters are rejected.
+	for _, params := range []string{"?type=blah", "?name=a..b"} {
+		w := httptest.NewRecorder()
+		c.DumpCache(w, httptest.NewRequest("GET", "/"+params, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", params, w.Code)
+		}
+	}
+}
+
+func TestFlushDomain(t *testing.T) {
+	r := testutil.NewTestResolver()
+	c := NewCachingResolver(r)
+	c.Init()
+
+	queryA(t, c, "example.com. A 1.2.3.4", "example.com.", "1.2.3.4")
+	queryA(t, c, "www.example.com. A 1.2.3.4", "www.example.com.", "1.2.3.4")
+	queryA(t, c, "notexample.com. A 1.2.3.4", "notexample.com.", "1.2.3.4")
+	queryA(t, c, "other. A 1.2.3.4", "other.", "1.2.3.4")
+
+	// Flush example.com and its subdomains, but nothing else.
+	w := httptest.NewRecorder()
+	c.FlushCache(w, httptest.NewRequest("POST", "/?name=Example.COM", nil))
+	if body := w.Body.String(); body != "cache flush complete: 2 entries removed" {
+		t.Errorf("unexpected handler output: %q", body)
+	}
+	if c.size.Load() != 2 {
+		t.Errorf("expected 2 entries left, got %d", c.size.Load())
+	}
+
+	resetStats()
+	queryA(t, c, "", "notexample.com.", "1.2.3.4")
+	queryA(t, c, "", "other.", "1.2.3.4")
+	queryA(t, c, "www.example.com. A 5.6.7.8", "www.example.com.", "5.6.7.8")
+	if !statsEquals(3, 2, 1) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+
+	// Invalid names are rejected.
+	w = httptest.NewRecorder()
+	c.FlushCache(w, httptest.NewRequest("POST", "/?name=a..b", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid name, got %d", w.Code)
+	}
+
+	// Without a name, everything is flushed.
+	w = httptest.NewRecorder()
+	c.FlushCache(w, httptest.NewRequest("POST", "/", nil))
+	if c.size.Load() != 0 {
+		t.Errorf("expected an empty cache, got %d entries", c.size.Load())
+	}
+}
+
+// gatedResolver is a Resolver that blocks queries until the gate is
+// opened, and counts them.
+type gatedResolver struct {
+	*testutil.TestResolver
+	gate    chan struct{}
+	queries atomic.Int32
+}
+
+func (r *gatedResolver) Query(req *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
+	r.queries.Add(1)
+	<-r.gate
+
+	// Always with an OPT, like the replies from most upstreams.
+	rr, _ := dns.NewRR("test. A 1.2.3.4")
+	reply := newReply(rr)
+	reply.SetReply(req)
+	reply.SetEdns0(4096, false)
+	return reply, nil
+}
+
+func TestCoalescing(t *testing.T) {
+	r := &gatedResolver{
+		TestResolver: testutil.NewTestResolver(),
+		gate:         make(chan struct{}),
+	}
+	c := NewCachingResolver(r)
+	c.Init()
+	resetStats()
+	stats.cacheCoalesced.Set(0)
+
+	// Send concurrent identical queries, which will all miss. Only the even
+	// ones use EDNS0.
+	const n = 5
+	replies := make(chan *dns.Msg, n)
+	for i := 0; i < n; i++ {
+		go func(id uint16) {
+			tr := trace.New("test", "TestCoalescing")
+			defer tr.Finish()
+			req := newQuery("test.", dns.TypeA)
+			req.Id = id
+			if id%2 == 0 {
+				req.SetEdns0(1232, false)
+			}
+			resp, err := c.Query(req, tr)
+			if err != nil {
+				t.Errorf("query failed: %v", err)
+			}
+			replies <- resp
+		}(uint16(i))
+	}
+
+	// Wait until all but the first are waiting for it, before letting the
+	// query through.
+	for stats.cacheCoalesced.Value() < n-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(r.gate)
+
+	ids := map[uint16]bool{}
+	for i := 0; i < n; i++ {
+		resp := <-replies
+		if resp == nil || len(resp.Answer) != 1 {
+			t.Fatalf("unexpected reply: %v", resp)
+		}
+		if hasOPT := resp.IsEdns0() != nil; hasOPT != (resp.Id%2 == 0) {
+			t.Errorf("%d: OPT doesn't match the query: %v", resp.Id, resp)
+		}
+		ids[resp.Id] = true
+	}
+
+	if q := r.queries.Load(); q != 1 {
+		t.Errorf("expected 1 query to the backing resolver, got %d", q)
+	}
+	if v := stats.cacheCoalesced.Value(); v != n-1 {
+		t.Errorf("expected %d coalesced queries, got %d", n-1, v)
+	}
+	if len(ids) != n {
+		t.Errorf("replies don't keep their IDs: %v", ids)
+	}
+	if len(c.inflight) != 0 {
+		t.Errorf("in-flight queries left behind: %v", c.inflight)
+	}
+}
+
+func TestCoalescingDeadline(t *testing.T) {
+	r := &gatedResolver{
+		TestResolver: testutil.NewTestResolver(),
+		gate:         make(chan struct{}),
+	}
+	defer close(r.gate)
+	c := NewCachingResolver(r)
+	c.Init()
+	stats.cacheCoalesced.Set(0)
+
+	// The first query is stuck in the backing resolver.
+	go func() {
+		tr := trace.New("test", "TestCoalescingDeadline")
+		defer tr.Finish()
+		c.Query(newQuery("test.", dns.TypeA), tr)
+	}()
+	for r.queries.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The second one waits for it, but only until its own deadline.
+	tr := trace.New("test", "TestCoalescingDeadline")
+	defer tr.Finish()
+	tr.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	_, err := c.Query(newQuery("test.", dns.TypeA), tr)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("waited %v for the in-flight query", d)
+	}
+	if v := stats.cacheCoalesced.Value(); v != 1 {
+		t.Errorf("expected 1 coalesced query, got %d", v)
+	}
+}
+
+func TestDNSSECKey(t *testing.T) {
+	r := testutil.NewTestResolver()
+	c := NewCachingResolver(r)
+	c.Init()
+	resetStats()
+
+	tr := trace.New("test", "TestDNSSECKey")
+	defer tr.Finish()
+
+	// Record an answer without signatures, for a query without DO.
+	queryA(t, c, "test. A 1.2.3.4", "test.", "1.2.3.4")
+
+	// A query with DO must not get the cached answer.
+	r.Response = newReply(mustNewRR(t, "test. A 1.2.3.4"))
+	r.Response.Answer = append(r.Response.Answer, mustNewRR(t,
+		"test. RRSIG A 8 1 3600 20300101000000 20200101000000 1234 test. AAAA"))
+	r.Response.AuthenticatedData = true
+
+	req := newQuery("test.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	resp, err := c.Query(req, tr)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if !statsEquals(2, 0, 2) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+	if len(resp.Answer) != 2 {
+		t.Errorf("expected A and RRSIG, got %v", resp.Answer)
+	}
+
+	// The same query again should hit the cache, keeping the signatures and
+	// the AD bit.
+	resp, err = c.Query(req, tr)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if !statsEquals(3, 1, 2) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+	if len(resp.Answer) != 2 || !resp.AuthenticatedData {
+		t.Errorf("unexpected cached answer: %v", resp)
+	}
+	if opt := resp.IsEdns0(); opt == nil || !opt.Do() {
+		t.Errorf("cached answer is missing the DO bit: %v", resp)
+	}
+
+}
+
+func TestBypass(t *testing.T) {
+	r := testutil.NewTestResolver()
+	c := NewCachingResolver(r)
+	c.Init()
+	resetStats()
+
+	tr := trace.New("test", "TestBypass")
+	defer tr.Finish()
+
+	queryA(t, c, "test. A 1.2.3.4", "test.", "1.2.3.4")
+
+	// Queries with CD go to the backing resolver, and their answers don't
+	// replace the cached one.
+	r.Response = newReply(mustNewRR(t, "test. A 6.6.6.6"))
+	req := newQuery("test.", dns.TypeA)
+	req.CheckingDisabled = true
+	resp, err := c.Query(req, tr)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if a := resp.Answer[0].(*dns.A).A.String(); a != "6.6.6.6" {
+		t.Errorf("expected fresh answer 6.6.6.6, got %v", a)
+	}
+	if stats.cacheBypassed.Value() != 1 {
+		t.Errorf("expected 1 bypassed query, got %v", stats.cacheBypassed)
+	}
+	queryA(t, c, "", "test.", "1.2.3.4")
+
+	// Same with the bypass option, once it's configured.
+	const code = dns.EDNS0LOCALSTART
+	req = newQuery("test.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: code})
+
+	c.Query(req, tr)
+	if stats.cacheBypassed.Value() != 1 {
+		t.Errorf("bypassed without the option configured")
+	}
+
+	c.SetBypassOption(code)
+	resp, _ = c.Query(req, tr)
+	if stats.cacheBypassed.Value() != 2 {
+		t.Errorf("expected 2 bypassed queries, got %v", stats.cacheBypassed)
+	}
+	if a := resp.Answer[0].(*dns.A).A.String(); a != "6.6.6.6" {
+		t.Errorf("expected fresh answer 6.6.6.6, got %v", a)
+	}
+	queryA(t, c, "", "test.", "1.2.3.4")
+}
+
+func TestSections(t *testing.T) {
+	r := testutil.NewTestResolver()
+	c := NewCachingResolver(r)
+	c.Init()
+	resetStats()
+
+	tr := trace.New("test", "TestSections")
+	defer tr.Finish()
+
+	r.Response = newReply(mustNewRR(t, "test. A 1.2.3.4"))
+	r.Response.Ns = []dns.RR{mustNewRR(t, "test. NS ns.test.")}
+	r.Response.Extra = []dns.RR{mustNewRR(t, "ns.test. A 5.6.7.8")}
+	r.Response.SetEdns0(4096, false)
+
+	for i := 0; i < 2; i++ {
+		resp, err := c.Query(newQuery("test.", dns.TypeA), tr)
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		if len(resp.Ns) != 1 || resp.Ns[0].(*dns.NS).Ns != "ns.test." {
+			t.Errorf("%d: unexpected authority: %v", i, resp.Ns)
+		}
+		if len(resp.Extra) != 1 || resp.Extra[0].Header().Name != "ns.test." {
+			t.Errorf("%d: unexpected additional: %v", i, resp.Extra)
+		}
+	}
+	if !statsEquals(2, 1, 1) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+
+	// The OPT is not cached, but built for the query.
+	req := newQuery("test.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	resp, _ := c.Query(req, tr)
+	if len(resp.Extra) != 2 {
+		t.Errorf("expected glue and OPT, got %v", resp.Extra)
+	}
+	if opt := resp.IsEdns0(); opt == nil || opt.UDPSize() != dns.DefaultMsgSize {
+		t.Errorf("expected our own OPT, got %v", opt)
+	}
+}
+
+func TestCNAMEChain(t *testing.T) {
+	r := testutil.NewTestResolver()
+	c := NewCachingResolver(r)
+	c.Init()
+	resetStats()
+
+	tr := trace.New("test", "TestCNAMEChain")
+	defer tr.Finish()
+
+	query := func(domain string, qtype uint16, expected int) *dns.Msg {
+		t.Helper()
+		resp, err := c.Query(newQuery(domain, qtype), tr)
+		if err != nil {
+			t.Fatalf("query for %s failed: %v", domain, err)
+		}
+		if len(resp.Answer) != expected {
+			t.Errorf("%s: expected %d records, got %v",
+				domain, expected, resp.Answer)
+		}
+		return resp
+	}
+
+	r.Response = &dns.Msg{
+		MsgHdr: dns.MsgHdr{Response: true, Rcode: dns.RcodeSuccess},
+		Answer: []dns.RR{
+			mustNewRR(t, "a. 3600 CNAME b."),
+			mustNewRR(t, "b. 3600 CNAME c."),
+			mustNewRR(t, "c. 3600 A 1.2.3.4"),
+		},
+	}
+	query("a.", dns.TypeA, 3)
+	if !statsEquals(1, 0, 1) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+
+	// The rest of the chain, and each CNAME, are now cached.
+	r.Response = newReply(mustNewRR(t, "x. A 6.6.6.6"))
+	query("b.", dns.TypeA, 2)
+	query("c.", dns.TypeA, 1)
+	query("a.", dns.TypeCNAME, 1)
+	query("b.", dns.TypeCNAME, 1)
+	if !statsEquals(5, 4, 1) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+
+	// A name pointing into the chain is only followed if enabled.
+	r.Response = &dns.Msg{
+		MsgHdr: dns.MsgHdr{Response: true, Rcode: dns.RcodeSuccess},
+		Answer: []dns.RR{mustNewRR(t, "z. 3600 CNAME b.")},
+	}
+	query("z.", dns.TypeCNAME, 1)
+	r.Response = newReply(mustNewRR(t, "z. A 6.6.6.6"))
+	query("z.", dns.TypeAAAA, 1)
+	if !statsEquals(7, 4, 3) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+
+	c.SetFollowCNAMEs(true)
+	resp := query("z.", dns.TypeA, 3)
+	if a := resp.Answer[2].(*dns.A).A.String(); a != "1.2.3.4" {
+		t.Errorf("expected 1.2.3.4 at the end of the chain, got %v", a)
+	}
+	if !statsEquals(8, 5, 3) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+
+	// Without the target cached, it's a miss.
+	c.FlushDomain("b.")
+	query("z.", dns.TypeA, 1)
+	if !statsEquals(9, 5, 4) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+}
+
+func TestECSKey(t *testing.T) {
+	r := testutil.NewTestResolver()
+	c := NewCachingResolver(r)
+	c.Init()
+	resetStats()
+
+	tr := trace.New("test", "TestECSKey")
+	defer tr.Finish()
+
+	// Query with the given client address and prefix length, or without
+	// ECS if the address is empty. The host bits of the address should be
+	// ignored.
+	query := func(addr string, prefix uint8) *dns.Msg {
+		t.Helper()
+		req := newQuery("test.", dns.TypeA)
+		if addr != "" {
+			req.SetEdns0(4096, false)
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: prefix,
+				Address:       net.ParseIP(addr).To4(),
+			})
+		}
+		resp, err := c.Query(req, tr)
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		return resp
+	}
+
+	// Answers for different subnets, and without subnet, are kept apart.
+	r.Response = newReply(mustNewRR(t, "test. A 1.1.1.1"))
+	query("", 0)
+	r.Response = newReply(mustNewRR(t, "test. A 2.2.2.2"))
+	query("192.0.2.1", 24)
+	r.Response = newReply(mustNewRR(t, "test. A 3.3.3.3"))
+	query("198.51.100.1", 24)
+	if !statsEquals(3, 0, 3) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+
+	// Queries from the same subnet get the same cached answer, and the
+	// subnet is returned with the scope set.
+	resp := query("192.0.2.200", 24)
+	if !statsEquals(4, 1, 3) {
+		t.Errorf("bad stats: %v", dumpStats())
+	}
+	if a := resp.Answer[0].(*dns.A).A.String(); a != "2.2.2.2" {
+		t.Errorf("expected 2.2.2.2, got %v", a)
+	}
+	opt := resp.IsEdns0()
+	if opt == nil || len(opt.Option) != 1 {
+		t.Fatalf("expected ECS in the reply, got %v", resp)
+	}
+	ecs := opt.Option[0].(*dns.EDNS0_SUBNET)
+	if ecs.Address.String() != "192.0.2.0" || ecs.SourceNetmask != 24 ||
+		ecs.SourceScope != 24 {
+		t.Errorf("unexpected ECS in the reply: %v", ecs)
+	}
+
+	resp = query("", 0)
+	if a := resp.Answer[0].(*dns.A).A.String(); a != "1.1.1.1" {
+		t.Errorf("expected 1.1.1.1, got %v", a)
+	}
+
+	// Prefetching repeats the query with the same subnet.
+	key := newCacheKey(r.LastQuery)
+	if key.ECS != "198.51.100.0/24" {
+		t.Fatalf("unexpected key: %+v", key)
+	}
+	r.Response = newReply(mustNewRR(t, "test. A 4.4.4.4"))
+	c.prefetchEntries([]cacheKey{key})
+	if got := newCacheKey(r.LastQuery); got != key {
+		t.Errorf("prefetch used a different key: %+v != %+v", got, key)
+	}
+}
+
 //
 // === Benchmarks ===
 //
@@ -282,6 +1034,8 @@ func resetStats() {
 	stats.cacheHits.Set(0)
 	stats.cacheMisses.Set(0)
 	stats.cacheRecorded.Set(0)
+	stats.cacheHitsByType.Init()
+	stats.cacheMissesByType.Init()
 }
 
 func statsEquals(total, hits, misses int) bool {
@@ -374,3 +1128,77 @@ func newReply(answer dns.RR) *dns.Msg {
 		Answer: []dns.RR{answer},
 	}
 }
+
+func TestSnapshot(t *testing.T) {
+	c := NewCachingResolver(testutil.NewTestResolver())
+	c.Init()
+	queryA(t, c, "snap.test. 3600 A 1.2.3.4", "snap.test.", "1.2.3.4")
+	queryA(t, c, "other.test. 3600 A 1.2.3.5", "other.test.", "1.2.3.5")
+
+	path := t.TempDir() + "/snapshot"
+	if err := c.SaveSnapshot(path); err != nil {
+		t.Fatalf("error saving snapshot: %v", err)
+	}
+
+	// A new cache, whose backing resolver has a different answer, so we
+	// can tell if it came from the snapshot.
+	c2 := NewCachingResolver(testutil.NewTestResolver())
+	c2.Init()
+	if err := c2.LoadSnapshot(path); err != nil {
+		t.Fatalf("error loading snapshot: %v", err)
+	}
+	if c2.size.Load() != 2 {
+		t.Errorf("expected 2 entries, got %d", c2.size.Load())
+	}
+	c2.back.(*testutil.TestResolver).Response = newReply(
+		mustNewRR(t, "snap.test. 3600 A 5.6.7.8"))
+	resp := queryA(t, c2, "", "snap.test.", "1.2.3.4")
+	if ttl := resp.Answer[0].Header().Ttl; ttl > 3600 || ttl < 3590 {
+		t.Errorf("unexpected TTL %d", ttl)
+	}
+
+	// A missing snapshot is fine, a broken one is not.
+	if err := c2.LoadSnapshot(path + "-missing"); err != nil {
+		t.Errorf("error loading missing snapshot: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.LoadSnapshot(path); err == nil {
+		t.Errorf("broken snapshot loaded")
+	}
+}
+
+func TestSetCacheTuning(t *testing.T) {
+	prevSize, prevMin, prevMax, prevPeriod :=
+		maxCacheSize, minTTL, maxTTL, maintenancePeriod
+	defer func() {
+		maxCacheSize, minTTL, maxTTL, maintenancePeriod =
+			prevSize, prevMin, prevMax, prevPeriod
+	}()
+
+	err := SetCacheTuning(100, time.Minute, time.Hour, 10*time.Second)
+	if err != nil {
+		t.Fatalf("SetCacheTuning failed: %v", err)
+	}
+	if maxCacheSize != 100 || minTTL != time.Minute || maxTTL != time.Hour ||
+		maintenancePeriod != 10*time.Second {
+		t.Errorf("tuning not applied: %d %v %v %v",
+			maxCacheSize, minTTL, maxTTL, maintenancePeriod)
+	}
+
+	bad := []struct {
+		size          int
+		min, max, gcp time.Duration
+	}{
+		{0, time.Minute, time.Hour, time.Second},
+		{10, time.Hour, time.Minute, time.Second},
+		{10, -time.Minute, time.Hour, time.Second},
+		{10, time.Minute, time.Hour, 0},
+	}
+	for _, b := range bad {
+		if err := SetCacheTuning(b.size, b.min, b.max, b.gcp); err == nil {
+			t.Errorf("%v: expected error, got nil", b)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/loop"
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"blitiri.com.ar/go/log"
+	"github.com/miekg/dns"
+)
+
+// Domains used by operating systems and browsers to detect captive portals.
+var captivePortalDomains = []string{
+	// Android, ChromeOS and Chrome.
+	"connectivitycheck.gstatic.com.",
+	"clients3.google.com.",
+
+	// Apple.
+	"captive.apple.com.",
+
+	// Firefox.
+	"detectportal.firefox.com.",
+
+	// Windows.
+	"www.msftconnecttest.com.",
+
+	// NetworkManager.
+	"nmcheck.gnome.org.",
+}
+
+// Constants that tune the captive portal assist.
+const (
+	// How long after joining a network we may forward queries to its
+	// resolvers, if the upstreams don't work.
+	captivePortalWindow = 10 * time.Minute
+
+	// How often to check the network's resolvers for changes.
+	captivePortalCheckPeriod = 5 * time.Second
+)
+
+// captivePortalResolver implements a Resolver that helps log in to captive
+// portals, which usually block all DNS traffic (including ours to the
+// upstreams) until the user logs in via a web page.
+//
+// If the backing resolver fails shortly after we joined a new network, the
+// queries for the portal detection domains are forwarded to the network's
+// own resolvers (as given by DHCP), so the operating system can detect the
+// portal and show its login page. As soon as the backing resolver works
+// again, we go back to only using it.
+//
+// We detect new networks by watching a resolv.conf file with the network's
+// resolvers, like the one systemd-resolved or NetworkManager maintain.
+type captivePortalResolver struct {
+	back       Resolver
+	domains    []string
+	resolvConf string
+
+	mu sync.Mutex
+
+	// The network's resolvers, as read from resolvConf.
+	loaded  bool
+	servers []string
+
+	// When we joined the current network (or started). Zero once the
+	// backing resolver worked on it.
+	joined time.Time
+}
+
+// NewCaptivePortalResolver returns a new resolver which forwards the queries
+// for the given domains (and their subdomains) to the network's resolvers,
+// read from resolvConf, if the backing resolver fails shortly after joining
+// a network. If domains is empty, a list of well-known portal detection
+// domains is used.
+func NewCaptivePortalResolver(back Resolver, domains []string, resolvConf string) *captivePortalResolver {
+	c := &captivePortalResolver{back: back, resolvConf: resolvConf}
+	if len(domains) == 0 {
+		domains = captivePortalDomains
+	}
+	for _, d := range domains {
+		c.domains = append(c.domains, dns.CanonicalName(d))
+	}
+	return c
+}
+
+func (c *captivePortalResolver) Init() error {
+	c.reload()
+	return c.back.Init()
+}
+
+func (c *captivePortalResolver) Maintain() {
+	go c.back.Maintain()
+
+	for range time.Tick(captivePortalCheckPeriod) {
+		c.reload()
+	}
+}
+
+// reload the network's resolvers, and if they changed, consider we joined
+// a new network.
+func (c *captivePortalResolver) reload() {
+	servers, err := readResolvConf(c.resolvConf)
+	if err != nil {
+		// The file may not exist while we're not connected.
+		servers = nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.loaded && strings.Join(servers, " ") == strings.Join(c.servers, " ") {
+		return
+	}
+
+	log.Infof("Captive portal assist: network resolvers: %v", servers)
+	c.loaded = true
+	c.servers = servers
+	c.joined = time.Now()
+}
+
+// readResolvConf returns the resolvers in the given resolv.conf file,
+// skipping the loopback ones (which could be ourselves).
+func readResolvConf(path string) ([]string, error) {
+	conf, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	servers := []string{}
+	for _, s := range conf.Servers {
+		if ip := net.ParseIP(s); ip == nil || ip.IsLoopback() {
+			continue
+		}
+		servers = append(servers, net.JoinHostPort(s, conf.Port))
+	}
+	return servers, nil
+}
+
+// portalServers returns the network's resolvers to forward the query to, or
+// nil if we should not.
+func (c *captivePortalResolver) portalServers(r *dns.Msg) []string {
+	if len(r.Question) != 1 || !c.isPortalDomain(r.Question[0].Name) {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.joined.IsZero() || time.Since(c.joined) > captivePortalWindow {
+		return nil
+	}
+	return c.servers
+}
+
+func (c *captivePortalResolver) isPortalDomain(name string) bool {
+	for _, d := range c.domains {
+		if dns.IsSubDomain(d, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// backWorks is called when the backing resolver answered, and closes the
+// window, so we go back to only using it.
+func (c *captivePortalResolver) backWorks() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.joined.IsZero() {
+		log.Infof("Captive portal assist: upstream works, not forwarding")
+		c.joined = time.Time{}
+	}
+}
+
+func (c *captivePortalResolver) Query(r *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
+	reply, err := c.back.Query(r, tr)
+	if err == nil || errors.Is(err, ErrDropQuery) {
+		// Answers from the cache don't tell us if the upstream works.
+		if layer, _ := tr.Policy(); layer != "cache" {
+			c.backWorks()
+		}
+		return reply, err
+	}
+
+	ctx, cancel := tr.Context(context.Background())
+	defer cancel()
+
+	servers := c.portalServers(r)
+	for _, s := range servers {
+		tr.Printf("captive portal: upstream failed, forwarding to %s", s)
+		tr.SetPolicy("captive-portal", s)
+		u, xerr := dns.ExchangeContext(ctx, loop.Tag(r), s)
+		if xerr == nil {
+			loop.Untag(r, u)
+			return u, nil
+		}
+		tr.Printf("captive portal: %s failed: %v", s, xerr)
+	}
+
+	return reply, err
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &captivePortalResolver{}
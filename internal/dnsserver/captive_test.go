@@ -0,0 +1,89 @@
+package dnsserver
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+func TestCaptivePortal(t *testing.T) {
+	portalAddr := testutil.GetFreePort()
+	go testutil.ServeTestDNSServer(portalAddr,
+		testutil.MakeStaticHandler(t, "captive.apple.com. A 10.0.0.1"))
+	testutil.WaitForDNSServer(portalAddr)
+
+	back := testutil.NewTestResolver()
+	back.RespError = errors.New("upstream blocked")
+	c := NewCaptivePortalResolver(back, nil, "/doesnotexist")
+	c.Init()
+
+	// We just joined a network; the file doesn't tell us its resolvers
+	// because we use a loopback server for testing.
+	c.servers = []string{portalAddr}
+
+	query := func(name string) (*dns.Msg, error) {
+		tr := trace.New("test", "TestCaptivePortal")
+		defer tr.Finish()
+		return c.Query(newQuery(name, dns.TypeA), tr)
+	}
+
+	// Portal domains are forwarded, the rest are not.
+	resp, err := query("captive.apple.com.")
+	if err != nil || len(resp.Answer) != 1 {
+		t.Errorf("portal domain not forwarded: %v %v", resp, err)
+	}
+	if _, err := query("example.com."); err == nil {
+		t.Errorf("non-portal domain was forwarded")
+	}
+
+	// Once the upstream works, we stop forwarding.
+	back.RespError = nil
+	back.Response = newReply(mustNewRR(t, "example.com. A 1.2.3.4"))
+	if _, err := query("example.com."); err != nil {
+		t.Errorf("query failed: %v", err)
+	}
+	back.RespError = errors.New("upstream blocked")
+	if _, err := query("captive.apple.com."); err == nil {
+		t.Errorf("portal domain forwarded after upstream worked")
+	}
+}
+
+func TestCaptivePortalWindow(t *testing.T) {
+	back := testutil.NewTestResolver()
+	back.RespError = errors.New("upstream blocked")
+	c := NewCaptivePortalResolver(back, []string{"portal.test"}, "")
+	c.Init()
+	c.servers = []string{"192.0.2.1:53"}
+
+	if s := c.portalServers(newQuery("x.portal.test.", dns.TypeA)); len(s) != 1 {
+		t.Errorf("expected to forward subdomain, got %v", s)
+	}
+
+	// Outside the window, we don't forward.
+	c.joined = time.Now().Add(-2 * captivePortalWindow)
+	if s := c.portalServers(newQuery("portal.test.", dns.TypeA)); s != nil {
+		t.Errorf("expected not to forward, got %v", s)
+	}
+}
+
+func TestReadResolvConf(t *testing.T) {
+	path := t.TempDir() + "/resolv.conf"
+	os.WriteFile(path, []byte(
+		"nameserver 127.0.0.53\nnameserver 192.0.2.1\nnameserver ::1\n"+
+			"nameserver 2001:db8::1\n"), 0644)
+
+	servers, err := readResolvConf(path)
+	if err != nil {
+		t.Fatalf("error reading: %v", err)
+	}
+	if len(servers) != 2 || servers[0] != "192.0.2.1:53" ||
+		servers[1] != "[2001:db8::1]:53" {
+		t.Errorf("unexpected servers: %v", servers)
+	}
+}
@@ -0,0 +1,69 @@
+package dnsserver
+
+import (
+	"context"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/dnsclient"
+	"blitiri.com.ar/go/dnss/internal/loop"
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+// clientResolver implements a Resolver that sends the queries to an
+// upstream server, over plain DNS or DNS over TLS, using a dnsclient.Client.
+// Queries are given up on once the trace's context is done (see
+// trace.Trace.Context).
+type clientResolver struct {
+	name   string
+	client *dnsclient.Client
+}
+
+// NewUpstreamResolver returns a resolver that sends the queries to the given
+// upstream, over plain DNS or DNS over TLS (see dnsclient.DoTPrefix).
+// A timeout of 0 means the default (2s).
+func NewUpstreamResolver(upstream string, timeout time.Duration) Resolver {
+	return &clientResolver{
+		name:   upstream,
+		client: dnsclient.New(upstream, timeout),
+	}
+}
+
+func (r *clientResolver) Init() error {
+	return nil
+}
+
+func (r *clientResolver) Maintain() {
+}
+
+func (r *clientResolver) Query(req *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
+	tr.SetPolicy("upstream", r.name)
+	ctx, cancel := tr.Context(context.Background())
+	defer cancel()
+
+	reply, err := r.client.Exchange(ctx, tr, loop.Tag(req))
+	loop.Untag(req, reply)
+	return reply, err
+}
+
+// clientFor returns the client for the given plain DNS server (used for the
+// overrides and the unqualified upstream), creating it the first time, so
+// its connections are reused across queries.
+func (s *Server) clientFor(server string) *dnsclient.Client {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	if s.clients == nil {
+		s.clients = map[string]*dnsclient.Client{}
+	}
+	c, ok := s.clients[server]
+	if !ok {
+		c = dnsclient.New(server, 0)
+		s.clients[server] = c
+	}
+	return c
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &clientResolver{}
@@ -0,0 +1,47 @@
+package dnsserver
+
+import (
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamResolverDeadline(t *testing.T) {
+	addr := testutil.GetFreePort()
+
+	// The server never answers our queries, only the ones of
+	// WaitForDNSServer.
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "unused." {
+			m := &dns.Msg{}
+			m.SetReply(r)
+			w.WriteMsg(m)
+		}
+	})
+	srv := &dns.Server{Addr: addr, Net: "udp", Handler: handler}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	testutil.WaitForDNSServer(addr)
+
+	tr := trace.New("test", "TestUpstreamResolverDeadline")
+	defer tr.Finish()
+	tr.SetDeadline(time.Now().Add(50 * time.Millisecond))
+
+	r := &dns.Msg{}
+	r.SetQuestion("test.", dns.TypeA)
+
+	// The query gives up at the trace's deadline, not the (longer)
+	// resolver timeout.
+	res := NewUpstreamResolver(addr, 5*time.Second)
+	start := time.Now()
+	if _, err := res.Query(r, tr); err == nil {
+		t.Errorf("query to a server that doesn't answer succeeded")
+	}
+	if d := time.Since(start); d > 1*time.Second {
+		t.Errorf("query took %v, the deadline was ignored", d)
+	}
+}
@@ -0,0 +1,190 @@
+package dnsserver
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/log"
+	"github.com/miekg/dns"
+)
+
+// Constants that tune the dashboard.
+// They are declared as variables so we can tweak them for testing.
+var (
+	// Number of seconds the query rate is averaged over.
+	rateWindow = 10
+
+	// Maximum number of domains we keep counts for. When reached, all the
+	// counts are halved, and the ones that drop to 0 are forgotten, so the
+	// popular domains stay and the rest make room for new ones.
+	maxDashboardDomains = 5000
+
+	// Number of domains in the top list.
+	topDomains = 10
+)
+
+// Dashboard is an Observer that keeps live statistics of the queries, for
+// the monitoring dashboard: the query rate, the most queried domains, and
+// how many queries were blocked.
+type Dashboard struct {
+	mu sync.Mutex
+
+	// Queries in each of the last seconds, as a ring indexed by the Unix
+	// time, which is kept in seconds so we know when a slot is stale.
+	perSecond []int
+	seconds   []int64
+
+	total   int64
+	blocked int64
+
+	// Queries for each domain (lowercased).
+	domains map[string]int
+}
+
+// NewDashboard returns a new, empty, Dashboard.
+func NewDashboard() *Dashboard {
+	return &Dashboard{
+		perSecond: make([]int, rateWindow+1),
+		seconds:   make([]int64, rateWindow+1),
+		domains:   map[string]int{},
+	}
+}
+
+func (d *Dashboard) Observe(q dns.Question, reply *dns.Msg, elapsed time.Duration) {
+	d.observe(time.Now(), q, reply)
+}
+
+func (d *Dashboard) observe(t time.Time, q dns.Question, reply *dns.Msg) {
+	now := t.Unix()
+	name := strings.ToLower(q.Name)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	i := now % int64(len(d.seconds))
+	if d.seconds[i] != now {
+		d.seconds[i] = now
+		d.perSecond[i] = 0
+	}
+	d.perSecond[i]++
+
+	d.total++
+	if isBlocked(reply) {
+		d.blocked++
+	}
+
+	if _, ok := d.domains[name]; !ok && len(d.domains) >= maxDashboardDomains {
+		for n, c := range d.domains {
+			if c/2 == 0 {
+				delete(d.domains, n)
+			} else {
+				d.domains[n] = c / 2
+			}
+		}
+	}
+	d.domains[name]++
+}
+
+// isBlocked returns true if the reply says the query was blocked, as far as
+// we can tell from it: it was refused, or has an Extended DNS Error saying
+// so (which we only include if the client uses EDNS0).
+func isBlocked(reply *dns.Msg) bool {
+	if reply == nil {
+		return false
+	}
+	if reply.Rcode == dns.RcodeRefused {
+		return true
+	}
+
+	opt := reply.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		ede, ok := o.(*dns.EDNS0_EDE)
+		if !ok {
+			continue
+		}
+		switch ede.InfoCode {
+		case dns.ExtendedErrorCodeBlocked, dns.ExtendedErrorCodeCensored,
+			dns.ExtendedErrorCodeFiltered, dns.ExtendedErrorCodeProhibited:
+			return true
+		}
+	}
+	return false
+}
+
+// DomainCount is how many queries a domain got.
+type DomainCount struct {
+	Name    string
+	Queries int
+}
+
+// DashboardData is a snapshot of the dashboard's statistics.
+type DashboardData struct {
+	// Queries per second, averaged over the last rateWindow seconds.
+	QPS float64
+
+	// Queries and blocked queries since we started.
+	Queries int64
+	Blocked int64
+
+	// Ratio of cache hits (0 if the cache hasn't been used yet).
+	CacheHitRatio float64
+
+	// Most queried domains. They're only included if we are running
+	// verbosily, like in the other debug handlers.
+	TopDomains  []DomainCount
+	NamesHidden bool
+}
+
+// Snapshot returns the current statistics.
+func (d *Dashboard) Snapshot() DashboardData {
+	return d.snapshot(time.Now(), log.V(1))
+}
+
+func (d *Dashboard) snapshot(t time.Time, verbose bool) DashboardData {
+	now := t.Unix()
+	data := DashboardData{
+		CacheHitRatio: cacheHitRatio().(float64),
+		NamesHidden:   !verbose,
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// The current second is still in progress, so we leave it out.
+	inWindow := 0
+	for i, s := range d.seconds {
+		if s < now && s >= now-int64(rateWindow) {
+			inWindow += d.perSecond[i]
+		}
+	}
+	data.QPS = float64(inWindow) / float64(rateWindow)
+	data.Queries = d.total
+	data.Blocked = d.blocked
+
+	if data.NamesHidden {
+		return data
+	}
+
+	for n, c := range d.domains {
+		data.TopDomains = append(data.TopDomains, DomainCount{n, c})
+	}
+	sort.Slice(data.TopDomains, func(i, j int) bool {
+		a, b := data.TopDomains[i], data.TopDomains[j]
+		if a.Queries != b.Queries {
+			return a.Queries > b.Queries
+		}
+		return a.Name < b.Name
+	})
+	if len(data.TopDomains) > topDomains {
+		data.TopDomains = data.TopDomains[:topDomains]
+	}
+	return data
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Observer = &Dashboard{}
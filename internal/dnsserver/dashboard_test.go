@@ -0,0 +1,81 @@
+package dnsserver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDashboard(t *testing.T) {
+	d := NewDashboard()
+	question := func(name string) dns.Question {
+		return dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	}
+
+	ok := newReply(mustNewRR(t, "test. A 1.2.3.4"))
+	refused := &dns.Msg{}
+	refused.Rcode = dns.RcodeRefused
+	blocked := &dns.Msg{}
+	blocked.Rcode = dns.RcodeNameError
+	blocked.SetEdns0(dns.DefaultMsgSize, false)
+	opt := blocked.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeBlocked})
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		d.observe(now, question("Test."), ok)
+	}
+	d.observe(now, question("refused."), refused)
+	d.observe(now, question("blocked."), blocked)
+	d.observe(now, question("blocked."), nil)
+
+	// The queries are in the current second, which is not counted in the
+	// rate until it's over.
+	data := d.snapshot(now, true)
+	if data.Queries != 6 || data.Blocked != 2 || data.QPS != 0 {
+		t.Errorf("unexpected data: %+v", data)
+	}
+	data = d.snapshot(now.Add(time.Second), true)
+	if data.QPS != 6.0/float64(rateWindow) {
+		t.Errorf("expected %v qps, got %v", 6.0/float64(rateWindow), data.QPS)
+	}
+	expected := []DomainCount{{"test.", 3}, {"blocked.", 2}, {"refused.", 1}}
+	if fmt.Sprint(data.TopDomains) != fmt.Sprint(expected) {
+		t.Errorf("expected top domains %v, got %v", expected, data.TopDomains)
+	}
+
+	// Names are hidden unless verbose.
+	data = d.snapshot(now, false)
+	if !data.NamesHidden || data.TopDomains != nil {
+		t.Errorf("names not hidden: %+v", data)
+	}
+
+	// Out of the window, the rate goes back to 0.
+	data = d.snapshot(now.Add(time.Duration(rateWindow+1)*time.Second), true)
+	if data.QPS != 0 {
+		t.Errorf("expected 0 qps, got %v", data.QPS)
+	}
+}
+
+func TestDashboardDomainsLimit(t *testing.T) {
+	defer func(prev int) { maxDashboardDomains = prev }(maxDashboardDomains)
+	maxDashboardDomains = 4
+
+	d := NewDashboard()
+	for i := 0; i < 4; i++ {
+		d.Observe(dns.Question{Name: "popular."}, nil, 0)
+	}
+	for i := 0; i < 3; i++ {
+		d.Observe(dns.Question{Name: fmt.Sprintf("d%d.", i)}, nil, 0)
+	}
+
+	// The cache is full, so this one halves the counts, and drops the ones
+	// that only had 1 query.
+	d.Observe(dns.Question{Name: "new."}, nil, 0)
+	if len(d.domains) != 2 || d.domains["popular."] != 2 || d.domains["new."] != 1 {
+		t.Errorf("unexpected domains: %v", d.domains)
+	}
+}
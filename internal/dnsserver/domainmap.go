@@ -1,20 +1,41 @@
 package dnsserver
 
 import (
+	"bufio"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
 
 	"github.com/miekg/dns"
 )
 
 // DomainMap maps a DNS name to an arbitrary string.
+//
+// It can also have exceptions, which exclude a domain (and its subdomains)
+// from the entry of a parent domain, for GetMostSpecific lookups. They are
+// written as the domain with an exceptionPrefix, like "!public.corp".
+//
+// Entries (and exceptions) can be limited to a query type, for Route
+// lookups, by adding it after a '/', like "corp/PTR" or "./HTTPS" (the
+// root is only allowed for these, and matches all domains).
 type DomainMap map[string]string
 
+// Prefix of the exceptions, in the keys of the map and in the strings and
+// files we parse.
+const exceptionPrefix = "!"
+
 // Set the value for the given domain.
 func (m DomainMap) Set(domain, value string) {
 	m[dns.CanonicalName(domain)] = value
 }
 
+// SetException excludes the given domain (and its subdomains) from the
+// entries of its parents.
+func (m DomainMap) SetException(domain string) {
+	m[exceptionPrefix+dns.CanonicalName(domain)] = ""
+}
+
 // GetExact value for the given domain, using an exact lookup (the domain must
 // match exactly what was set).
 func (m DomainMap) GetExact(domain string) (string, bool) {
@@ -23,32 +44,95 @@ func (m DomainMap) GetExact(domain string) (string, bool) {
 }
 
 // GetMostSpecific value for the given domain, using a most-specific lookup
-// (we pick the map entry that is closest to the domain).
+// (we pick the map entry that is closest to the domain). If the closest is
+// an exception, there is no value. Entries limited to a query type are not
+// considered, see Route for that.
 func (m DomainMap) GetMostSpecific(domain string) (string, bool) {
+	return m.Route(domain, 0)
+}
+
+// Route returns the value for a query for the given domain and type, using
+// a most-specific lookup like GetMostSpecific. For the same domain, the
+// entries for the query type are picked over the ones for all types.
+func (m DomainMap) Route(domain string, qtype uint16) (string, bool) {
 	domain = dns.CanonicalName(domain)
-	mc := 0
-	mv := ""
-	ok := false
-	for d, v := range m {
-		if !dns.IsSubDomain(d, domain) {
-			continue
+
+	// Look up the domain and then its parents, so the first match is the
+	// most specific one. This keeps lookups cheap even for big maps.
+	for _, off := range dns.Split(domain) {
+		d := domain[off:]
+		if qtype != 0 {
+			if _, ok := m[exceptionPrefix+typeKey(d, qtype)]; ok {
+				return "", false
+			}
+			if v, ok := m[typeKey(d, qtype)]; ok {
+				return v, true
+			}
+		}
+		if _, ok := m[exceptionPrefix+d]; ok {
+			return "", false
 		}
+		if v, ok := m[d]; ok {
+			return v, true
+		}
+	}
 
-		// Keep the match with the most labels (the most specific).
-		c := dns.CountLabel(d)
-		if c > mc {
-			mc = c
-			mv = v
-			ok = true
+	// The root only matches with a type, otherwise it would match every
+	// query.
+	if qtype != 0 {
+		if v, ok := m[typeKey(".", qtype)]; ok {
+			return v, true
 		}
 	}
+	return "", false
+}
 
-	return mv, ok
+// typeKey returns the key for the entries of the given domain that are
+// limited to the given query type.
+func typeKey(domain string, qtype uint16) string {
+	return domain + "/" + strconv.Itoa(int(qtype))
+}
+
+// parseKey parses an entry's domain, as given in strings and files (which
+// can be an exception, and be limited to a type), into its key in the map.
+func parseKey(s string) (string, error) {
+	s, exception := strings.CutPrefix(s, exceptionPrefix)
+	name, t, typed := strings.Cut(s, "/")
+	key := dns.CanonicalName(strings.TrimSpace(name))
+	if typed {
+		qtype, err := parseType(strings.TrimSpace(t))
+		if err != nil {
+			return "", err
+		}
+		key = typeKey(key, qtype)
+	} else if key == "." {
+		return "", errRootWithoutType
+	}
+	if exception {
+		key = exceptionPrefix + key
+	}
+	return key, nil
+}
+
+// parseType parses a query type, by name (like "PTR") or in the generic
+// format (like "TYPE65").
+func parseType(t string) (uint16, error) {
+	t = strings.ToUpper(t)
+	if qtype, ok := dns.StringToType[t]; ok {
+		return qtype, nil
+	}
+	if n, ok := strings.CutPrefix(t, "TYPE"); ok {
+		if qtype, err := strconv.ParseUint(n, 10, 16); err == nil {
+			return uint16(qtype), nil
+		}
+	}
+	return 0, fmt.Errorf("%w %q", errUnknownType, t)
 }
 
 // DomainMapFromString takes a string in the form of
 // "domain1:addr1,domain2:addr2,..." and returns a dnsserver.DomainMap like
 // {"domain1": "addr1", "domain2": "addr2", ...}.
+// Exceptions are given as "!domain", without an address.
 func DomainMapFromString(s string) (DomainMap, error) {
 	m := DomainMap{}
 	for _, pair := range strings.Split(s, ",") {
@@ -57,13 +141,69 @@ func DomainMapFromString(s string) (DomainMap, error) {
 			continue
 		}
 
-		xs := strings.SplitN(pair, ":", 2)
-		if len(xs) != 2 {
+		name, value, ok := strings.Cut(pair, ":")
+		exception := strings.HasPrefix(name, exceptionPrefix)
+		if exception && ok {
+			return nil, fmt.Errorf("%q: %w", pair, errExceptionValue)
+		} else if !exception && !ok {
 			return nil, fmt.Errorf("%q: %w", pair, errInvalidFormat)
 		}
-		m.Set(strings.TrimSpace(xs[0]), strings.TrimSpace(xs[1]))
+		key, err := parseKey(name)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", pair, err)
+		}
+		m[key] = strings.TrimSpace(value)
+	}
+	return m, nil
+}
+
+var (
+	errInvalidFormat   = fmt.Errorf("entry does not have a ':'")
+	errExceptionValue  = fmt.Errorf("exceptions can't have a value")
+	errUnknownType     = fmt.Errorf("unknown query type")
+	errRootWithoutType = fmt.Errorf("the root needs a query type")
+)
+
+// DomainMapFromFile reads a DomainMap from the given file, which has one
+// "domain value" pair per line, or "!domain" for exceptions. Empty lines,
+// and everything after a '#', are ignored.
+func DomainMapFromFile(path string) (DomainMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := DomainMap{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		value := ""
+		if strings.HasPrefix(fields[0], exceptionPrefix) {
+			if len(fields) != 1 {
+				return nil, fmt.Errorf("%s:%d: %w", path, n,
+					errExceptionValue)
+			}
+		} else if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, errInvalidLine)
+		} else {
+			value = fields[1]
+		}
+		key, err := parseKey(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		m[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
 	return m, nil
 }
 
-var errInvalidFormat = fmt.Errorf("entry does not have a ':'")
+var errInvalidLine = fmt.Errorf("line is not in the form \"domain value\"")
@@ -2,9 +2,11 @@ package dnsserver
 
 import (
 	"errors"
+	"os"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
 )
 
 func TestDomainMap(t *testing.T) {
@@ -73,6 +75,23 @@ func TestDomainMapFromString(t *testing.T) {
 			},
 			nil,
 		},
+		{
+			"corp:1.1.1.1:53, !public.corp",
+			DomainMap{"corp.": "1.1.1.1:53", "!public.corp.": ""},
+			nil,
+		},
+		{"!corp:1.1.1.1:53", nil, errExceptionValue},
+		{
+			"./PTR:192.168.1.1:53, corp/type65:1.1.1.1:53, !lan/AAAA",
+			DomainMap{
+				"./12":     "192.168.1.1:53",
+				"corp./65": "1.1.1.1:53",
+				"!lan./28": "",
+			},
+			nil,
+		},
+		{".:1.1.1.1:53", nil, errRootWithoutType},
+		{"corp/BLAH:1.1.1.1:53", nil, errUnknownType},
 		{"abc", nil, errInvalidFormat},
 		{"abc:def,xyz", nil, errInvalidFormat},
 	}
@@ -87,3 +106,114 @@ func TestDomainMapFromString(t *testing.T) {
 		}
 	}
 }
+
+func TestDomainMapFromFile(t *testing.T) {
+	path := t.TempDir() + "/overrides"
+	write := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`# Comment.
+d1  1.1.1.1:1111
+
+D2. https://doh.d2/dns-query  # Trailing comment.
+!Public.d2
+`)
+	m, err := DomainMapFromFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := DomainMap{
+		"d1.":         "1.1.1.1:1111",
+		"d2.":         "https://doh.d2/dns-query",
+		"!public.d2.": "",
+	}
+	if diff := cmp.Diff(expected, m); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, s := range []string{"d1\n", "d1 1.1.1.1 extra\n"} {
+		write(s)
+		if _, err := DomainMapFromFile(path); !errors.Is(err, errInvalidLine) {
+			t.Errorf("%q: expected invalid line error, got %v", s, err)
+		}
+	}
+	write("!d1 1.1.1.1\n")
+	if _, err := DomainMapFromFile(path); !errors.Is(err, errExceptionValue) {
+		t.Errorf("expected exception value error, got %v", err)
+	}
+
+	if _, err := DomainMapFromFile(path + "-missing"); err == nil {
+		t.Errorf("missing file loaded")
+	}
+}
+
+func TestDomainMapExceptions(t *testing.T) {
+	m := DomainMap{}
+	m.Set("corp.example", "10.0.0.1:53")
+	m.SetException("public.corp.example")
+	m.Set("internal.public.corp.example", "10.0.0.2:53")
+
+	cases := []struct {
+		req string
+		val string
+		ok  bool
+	}{
+		{"corp.example", "10.0.0.1:53", true},
+		{"a.corp.example", "10.0.0.1:53", true},
+		{"public.corp.example", "", false},
+		{"www.PUBLIC.corp.example", "", false},
+		{"internal.public.corp.example", "10.0.0.2:53", true},
+		{"x.internal.public.corp.example", "10.0.0.2:53", true},
+		{"example", "", false},
+	}
+	for _, c := range cases {
+		val, ok := m.GetMostSpecific(c.req)
+		if val != c.val || ok != c.ok {
+			t.Errorf("GetMostSpecific(%q) expected (%q, %v), got (%q, %v)",
+				c.req, c.val, c.ok, val, ok)
+		}
+	}
+}
+
+func TestDomainMapRoute(t *testing.T) {
+	m, err := DomainMapFromString("./PTR:router, corp:corp, " +
+		"corp/HTTPS:corp-https, !public.corp, !lan/PTR, lan:lan")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		req   string
+		qtype uint16
+		val   string
+		ok    bool
+	}{
+		{"a.corp", dns.TypeA, "corp", true},
+		{"a.corp", dns.TypeHTTPS, "corp-https", true},
+		{"a.corp", dns.TypePTR, "corp", true},
+		{"1.1.168.192.in-addr.arpa", dns.TypePTR, "router", true},
+		{"example.com", dns.TypePTR, "router", true},
+		{"example.com", dns.TypeA, "", false},
+		{"x.public.corp", dns.TypeA, "", false},
+		{"x.public.corp", dns.TypeHTTPS, "", false},
+		{"x.public.corp", dns.TypePTR, "", false},
+		{"x.lan", dns.TypeA, "lan", true},
+		{"x.lan", dns.TypePTR, "", false},
+	}
+	for _, c := range cases {
+		val, ok := m.Route(c.req, c.qtype)
+		if val != c.val || ok != c.ok {
+			t.Errorf("Route(%q, %s) expected (%q, %v), got (%q, %v)",
+				c.req, dns.TypeToString[c.qtype], c.val, c.ok, val, ok)
+		}
+	}
+
+	// Typed entries are not used without a type.
+	if val, ok := m.GetMostSpecific("x.corp"); val != "corp" || !ok {
+		t.Errorf("GetMostSpecific(x.corp) = (%q, %v)", val, ok)
+	}
+}
@@ -0,0 +1,184 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+// ecsResolver implements a Resolver that manipulates the EDNS Client Subnet
+// option (ECS, RFC 7871) of the queries sent to the backing resolver, and of
+// the replies it returns.
+type ecsResolver struct {
+	back Resolver
+
+	// Remove the ECS option from queries, instead of adding it.
+	strip bool
+
+	// Subnet to add to the queries. If nil, it is derived from the client's
+	// address, using mask4 and mask6 as the prefix lengths.
+	subnet       *net.IPNet
+	mask4, mask6 int
+}
+
+// NewECSStripResolver returns a new resolver which removes the ECS option
+// from the queries before passing them to the backing resolver, and from
+// the replies, so the clients' network information is not sent upstream.
+func NewECSStripResolver(back Resolver) *ecsResolver {
+	return &ecsResolver{back: back, strip: true}
+}
+
+// NewECSInjectResolver returns a new resolver which adds an ECS option to
+// the queries that don't have one, before passing them to the backing
+// resolver. The subnet is either fixed (a CIDR like "192.0.2.0/24"), or
+// "client" to derive it from the client's address, using mask4 and mask6
+// bits for IPv4 and IPv6 respectively.
+//
+// The subnet is part of the cache key, so for the answers to be cached per
+// subnet, this resolver should be placed above the cache.
+func NewECSInjectResolver(back Resolver, subnet string, mask4, mask6 int) (*ecsResolver, error) {
+	e := &ecsResolver{back: back, mask4: mask4, mask6: mask6}
+	if mask4 < 0 || mask4 > 32 || mask6 < 0 || mask6 > 128 {
+		return nil, fmt.Errorf("invalid masks: %d, %d", mask4, mask6)
+	}
+	if subnet != "client" {
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, err
+		}
+		e.subnet = ipnet
+	}
+	return e, nil
+}
+
+func (e *ecsResolver) Init() error {
+	return e.back.Init()
+}
+
+func (e *ecsResolver) Maintain() {
+	e.back.Maintain()
+}
+
+func (e *ecsResolver) Query(r *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
+	if e.strip {
+		return e.stripQuery(r, tr)
+	}
+	return e.injectQuery(r, tr)
+}
+
+func (e *ecsResolver) stripQuery(r *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
+	if hasECS(r) {
+		tr.Printf("ECS: removing from query")
+		r = r.Copy()
+		removeECS(r)
+	}
+
+	reply, err := e.back.Query(r, tr)
+	if err != nil || reply == nil {
+		return reply, err
+	}
+
+	// The reply's scope refers to the subnet we sent (if any), which the
+	// client did not, so it must not see it.
+	if hasECS(reply) {
+		tr.Printf("ECS: removing from reply")
+		removeECS(reply)
+	}
+	return reply, nil
+}
+
+func (e *ecsResolver) injectQuery(r *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
+	if hasECS(r) {
+		// Respect what the client sent, including opting out with a
+		// source prefix length of 0 (RFC 7871 section 7.1.2).
+		return e.back.Query(r, tr)
+	}
+
+	ecs := e.ecsFor(tr.Client())
+	if ecs == nil {
+		return e.back.Query(r, tr)
+	}
+
+	tr.Printf("ECS: adding %v/%d", ecs.Address, ecs.SourceNetmask)
+	hadOPT := r.IsEdns0() != nil
+	r = r.Copy()
+	if !hadOPT {
+		r.SetEdns0(dns.DefaultMsgSize, false)
+	}
+	opt := r.IsEdns0()
+	opt.Option = append(opt.Option, ecs)
+
+	reply, err := e.back.Query(r, tr)
+	if err != nil || reply == nil {
+		return reply, err
+	}
+
+	// The client did not send the option, so don't return it either.
+	removeECS(reply)
+	if !hadOPT {
+		reply.Extra = removeOPT(reply.Extra)
+	}
+	return reply, nil
+}
+
+// ecsFor returns the ECS option to use for the given client, or nil if we
+// should not add one.
+func (e *ecsResolver) ecsFor(client net.IP) *dns.EDNS0_SUBNET {
+	ip, mask4, mask6 := client, e.mask4, e.mask6
+	if e.subnet != nil {
+		ip = e.subnet.IP
+		ones, _ := e.subnet.Mask.Size()
+		mask4, mask6 = ones, ones
+	} else if ip == nil || ip.IsLoopback() || ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() {
+		// The client's address is not useful to the upstream.
+		return nil
+	}
+
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := ip.To4(); ip4 != nil {
+		ecs.Family = 1
+		ecs.SourceNetmask = uint8(mask4)
+		ecs.Address = ip4.Mask(net.CIDRMask(mask4, 32))
+	} else {
+		ecs.Family = 2
+		ecs.SourceNetmask = uint8(mask6)
+		ecs.Address = ip.Mask(net.CIDRMask(mask6, 128))
+	}
+	return ecs
+}
+
+func hasECS(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0SUBNET {
+			return true
+		}
+	}
+	return false
+}
+
+// removeECS removes the ECS option from the message, modifying it in place.
+func removeECS(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	opts := make([]dns.EDNS0, 0, len(opt.Option))
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			opts = append(opts, o)
+		}
+	}
+	opt.Option = opts
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &ecsResolver{}
@@ -0,0 +1,151 @@
+package dnsserver
+
+import (
+	"net"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+func withECS(m *dns.Msg, ip string, mask uint8) *dns.Msg {
+	if m.IsEdns0() == nil {
+		m.SetEdns0(4096, false)
+	}
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: mask,
+		Address:       net.ParseIP(ip),
+	})
+	return m
+}
+
+func TestECSStrip(t *testing.T) {
+	back := testutil.NewTestResolver()
+	back.Response = withECS(newReply(mustNewRR(t, "test. A 1.2.3.4")),
+		"192.0.2.0", 24)
+	e := NewECSStripResolver(back)
+
+	tr := trace.New("test", "TestECSStrip")
+	defer tr.Finish()
+
+	q := withECS(newQuery("test.", dns.TypeA), "192.0.2.0", 24)
+	resp, err := e.Query(q, tr)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+
+	if hasECS(back.LastQuery) {
+		t.Errorf("ECS was sent upstream: %v", back.LastQuery)
+	}
+	if back.LastQuery.IsEdns0() == nil {
+		t.Errorf("OPT record was removed: %v", back.LastQuery)
+	}
+	if !hasECS(q) {
+		t.Errorf("original query was modified: %v", q)
+	}
+	if hasECS(resp) {
+		t.Errorf("ECS was not removed from the reply: %v", resp)
+	}
+}
+
+func queryECS(t *testing.T, m *dns.Msg) *dns.EDNS0_SUBNET {
+	t.Helper()
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				return ecs
+			}
+		}
+	}
+	return nil
+}
+
+func TestECSInject(t *testing.T) {
+	cases := []struct {
+		subnet string
+		client string
+		want   string
+		mask   uint8
+	}{
+		{"203.0.113.0/24", "", "203.0.113.0", 24},
+		{"2001:db8::/48", "198.51.100.7", "2001:db8::", 48},
+		{"client", "198.51.100.7", "198.51.100.0", 24},
+		{"client", "2001:db8:1:2:3::1", "2001:db8:1::", 56},
+		{"client", "", "", 0},
+		{"client", "127.0.0.1", "", 0},
+		{"client", "192.168.1.1", "", 0},
+	}
+	for _, c := range cases {
+		back := testutil.NewTestResolver()
+		back.Response = withECS(newReply(mustNewRR(t, "test. A 1.2.3.4")),
+			"192.0.2.0", 24)
+		e, err := NewECSInjectResolver(back, c.subnet, 24, 56)
+		if err != nil {
+			t.Fatalf("%v: error creating resolver: %v", c, err)
+		}
+
+		tr := trace.New("test", "TestECSInject")
+		tr.SetClient(net.ParseIP(c.client))
+
+		q := newQuery("test.", dns.TypeA)
+		resp, err := e.Query(q, tr)
+		tr.Finish()
+		if err != nil {
+			t.Fatalf("%v: query failed: %v", c, err)
+		}
+
+		ecs := queryECS(t, back.LastQuery)
+		if c.want == "" {
+			if ecs != nil {
+				t.Errorf("%v: unexpected ECS sent: %v", c, ecs)
+			}
+			continue
+		}
+		if ecs == nil || !ecs.Address.Equal(net.ParseIP(c.want)) ||
+			ecs.SourceNetmask != c.mask {
+			t.Errorf("%v: expected %s/%d, got %v", c, c.want, c.mask, ecs)
+		}
+		if q.IsEdns0() != nil {
+			t.Errorf("%v: original query was modified: %v", c, q)
+		}
+		if resp.IsEdns0() != nil {
+			t.Errorf("%v: OPT not removed from the reply: %v", c, resp)
+		}
+	}
+}
+
+func TestECSInjectRespectsClient(t *testing.T) {
+	back := testutil.NewTestResolver()
+	back.Response = newReply(mustNewRR(t, "test. A 1.2.3.4"))
+	e, _ := NewECSInjectResolver(back, "203.0.113.0/24", 24, 56)
+
+	tr := trace.New("test", "TestECSInjectRespectsClient")
+	defer tr.Finish()
+
+	// A source prefix length of 0 means the client opted out.
+	q := withECS(newQuery("test.", dns.TypeA), "0.0.0.0", 0)
+	_, err := e.Query(q, tr)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if ecs := queryECS(t, back.LastQuery); ecs == nil || ecs.SourceNetmask != 0 {
+		t.Errorf("client's ECS was not kept: %v", back.LastQuery)
+	}
+}
+
+func TestECSInjectBadConfig(t *testing.T) {
+	for _, s := range []string{"", "blah", "1.2.3.4", "1.2.3.0/33"} {
+		_, err := NewECSInjectResolver(nil, s, 24, 56)
+		if err == nil {
+			t.Errorf("%q: expected error, got nil", s)
+		}
+	}
+	_, err := NewECSInjectResolver(nil, "client", 33, 56)
+	if err == nil {
+		t.Errorf("invalid mask: expected error, got nil")
+	}
+}
@@ -0,0 +1,69 @@
+package dnsserver
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+
+	"blitiri.com.ar/go/dnss/doh"
+
+	"github.com/miekg/dns"
+)
+
+// Extended DNS Errors (RFC 8914), to let clients know why we failed to
+// resolve a query.
+
+// failWithEDE returns a SERVFAIL reply to the given request, including an
+// Extended DNS Error if the request uses EDNS0.
+func failWithEDE(r *dns.Msg, code uint16, text string) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetRcode(r, dns.RcodeServerFailure)
+	addEDE(m, r, code, text)
+	return m
+}
+
+// addEDE adds an Extended DNS Error to the reply, if the request uses EDNS0
+// (otherwise the client would not understand it).
+func addEDE(m, r *dns.Msg, code uint16, text string) {
+	ropt := r.IsEdns0()
+	if ropt == nil {
+		return
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(ropt.UDPSize(), ropt.Do())
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+// errorEDE returns the Extended DNS Error code that best describes why the
+// resolution failed with the given error.
+func errorEDE(err error) uint16 {
+	var verr *validationError
+	var nerr net.Error
+	var uerr *url.Error
+	var serr *doh.StatusError
+
+	switch {
+	case errors.As(err, &verr):
+		return verr.code
+	case errors.Is(err, errMaintenance):
+		return dns.ExtendedErrorCodeNotReady
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return dns.ExtendedErrorCodeNoReachableAuthority
+	case errors.As(err, &serr) && serr.StatusCode == http.StatusForbidden:
+		return dns.ExtendedErrorCodeProhibited
+	case errors.As(err, &serr) &&
+		serr.StatusCode == http.StatusTooManyRequests:
+		// There is no code for rate limiting, the text says it.
+		return dns.ExtendedErrorCodeOther
+	case errors.As(err, &uerr), errors.As(err, &serr), errors.As(err, &nerr):
+		// Includes TLS and HTTP errors talking to the upstream.
+		return dns.ExtendedErrorCodeNetworkError
+	}
+	return dns.ExtendedErrorCodeOther
+}
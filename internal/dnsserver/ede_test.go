@@ -0,0 +1,61 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/doh"
+
+	"github.com/miekg/dns"
+)
+
+func TestErrorEDE(t *testing.T) {
+	cases := []struct {
+		err  error
+		code uint16
+	}{
+		{errors.New("something"), dns.ExtendedErrorCodeOther},
+		{errMaintenance, dns.ExtendedErrorCodeNotReady},
+		{bogus("test"), dns.ExtendedErrorCodeDNSBogus},
+		{fmt.Errorf("POST failed: %w",
+			&url.Error{Op: "Post", URL: "x", Err: context.DeadlineExceeded}),
+			dns.ExtendedErrorCodeNoReachableAuthority},
+		{fmt.Errorf("POST failed: %w",
+			&url.Error{Op: "Post", URL: "x", Err: errors.New("tls: bad")}),
+			dns.ExtendedErrorCodeNetworkError},
+		{&doh.StatusError{StatusCode: 503},
+			dns.ExtendedErrorCodeNetworkError},
+		{fmt.Errorf("upstream refused: %w", &doh.StatusError{StatusCode: 403}),
+			dns.ExtendedErrorCodeProhibited},
+		{&doh.StatusError{StatusCode: 429}, dns.ExtendedErrorCodeOther},
+	}
+	for _, c := range cases {
+		if code := errorEDE(c.err); code != c.code {
+			t.Errorf("%v: expected %d, got %d", c.err, c.code, code)
+		}
+	}
+}
+
+func TestFailWithEDE(t *testing.T) {
+	// Without EDNS0, there is no EDE.
+	r := newQuery("test.", dns.TypeA)
+	m := failWithEDE(r, dns.ExtendedErrorCodeOther, "test")
+	if m.Rcode != dns.RcodeServerFailure || m.IsEdns0() != nil {
+		t.Errorf("unexpected reply: %v", m)
+	}
+
+	r.SetEdns0(1232, true)
+	m = failWithEDE(r, dns.ExtendedErrorCodeNetworkError, "test")
+	opt := m.IsEdns0()
+	if m.Rcode != dns.RcodeServerFailure || opt == nil || !opt.Do() {
+		t.Fatalf("unexpected reply: %v", m)
+	}
+	ede, ok := opt.Option[0].(*dns.EDNS0_EDE)
+	if !ok || ede.InfoCode != dns.ExtendedErrorCodeNetworkError ||
+		ede.ExtraText != "test" {
+		t.Errorf("unexpected EDE: %v", opt.Option)
+	}
+}
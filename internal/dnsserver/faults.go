@@ -0,0 +1,123 @@
+package dnsserver
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+// FaultConfig describes the faults to inject into the resolution path.
+// This is only meant for testing how clients behave with a degraded DNS.
+type FaultConfig struct {
+	// Latency added to every query.
+	Latency time.Duration
+
+	// Fraction (0 to 1) of queries that are dropped, so the client never
+	// gets a reply.
+	Loss float64
+
+	// Fraction (0 to 1) of queries that fail as if the upstream had returned
+	// an HTTP error.
+	Errors float64
+}
+
+// FaultConfigFromString takes a string in the form of
+// "latency=100ms,loss=0.1,errors=0.05" and returns the corresponding
+// FaultConfig. All the fields are optional.
+func FaultConfigFromString(s string) (FaultConfig, error) {
+	fc := FaultConfig{}
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return fc, fmt.Errorf("%q: entry does not have a '='", kv)
+		}
+
+		var err error
+		switch strings.TrimSpace(k) {
+		case "latency":
+			fc.Latency, err = time.ParseDuration(strings.TrimSpace(v))
+		case "loss":
+			fc.Loss, err = parseRatio(v)
+		case "errors":
+			fc.Errors, err = parseRatio(v)
+		default:
+			err = fmt.Errorf("unknown fault")
+		}
+		if err != nil {
+			return fc, fmt.Errorf("%q: %v", kv, err)
+		}
+	}
+	return fc, nil
+}
+
+func parseRatio(s string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err == nil && (f < 0 || f > 1) {
+		err = fmt.Errorf("must be between 0 and 1")
+	}
+	return f, err
+}
+
+// ErrDropQuery is returned by resolvers to indicate that the query must be
+// dropped, and the client must not get a reply.
+var ErrDropQuery = errors.New("query dropped")
+
+// faultResolver implements a Resolver that injects faults before passing the
+// queries to the backing resolver.
+type faultResolver struct {
+	back Resolver
+	fc   FaultConfig
+}
+
+// NewFaultResolver returns a new resolver which injects the given faults
+// into the queries to the backing resolver.
+func NewFaultResolver(back Resolver, fc FaultConfig) *faultResolver {
+	return &faultResolver{
+		back: back,
+		fc:   fc,
+	}
+}
+
+func (f *faultResolver) Init() error {
+	return f.back.Init()
+}
+
+func (f *faultResolver) Maintain() {
+	f.back.Maintain()
+}
+
+func (f *faultResolver) Query(r *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
+	if f.fc.Latency > 0 {
+		tr.Printf("fault: adding %v latency", f.fc.Latency)
+		time.Sleep(f.fc.Latency)
+	}
+
+	if rand.Float64() < f.fc.Loss {
+		tr.Printf("fault: dropping query")
+		tr.SetPolicy("faults", "drop")
+		return nil, ErrDropQuery
+	}
+
+	if rand.Float64() < f.fc.Errors {
+		tr.SetPolicy("faults", "error")
+		return nil, fmt.Errorf("fault: injected HTTP error: " +
+			"Response status: 503 Service Unavailable")
+	}
+
+	return f.back.Query(r, tr)
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &faultResolver{}
@@ -0,0 +1,72 @@
+package dnsserver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFaultConfigFromString(t *testing.T) {
+	cases := []struct {
+		s   string
+		fc  FaultConfig
+		err string
+	}{
+		{"", FaultConfig{}, ""},
+		{"latency=10ms", FaultConfig{Latency: 10 * time.Millisecond}, ""},
+		{" loss = 0.5 , errors=1,",
+			FaultConfig{Loss: 0.5, Errors: 1}, ""},
+		{"latency", FaultConfig{}, "does not have a '='"},
+		{"latency=xx", FaultConfig{}, "invalid duration"},
+		{"loss=2", FaultConfig{}, "between 0 and 1"},
+		{"errors=-1", FaultConfig{}, "between 0 and 1"},
+		{"other=1", FaultConfig{}, "unknown fault"},
+	}
+	for _, c := range cases {
+		fc, err := FaultConfigFromString(c.s)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%q: expected error %q, got %v", c.s, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.s, err)
+		}
+		if diff := cmp.Diff(c.fc, fc); diff != "" {
+			t.Errorf("%q: mismatch (-want +got):\n%s", c.s, diff)
+		}
+	}
+}
+
+func TestFaultResolver(t *testing.T) {
+	back := testutil.NewTestResolver()
+	back.Response = newReply(mustNewRR(t, "test. A 1.2.3.4"))
+	tr := trace.New("test", "TestFaultResolver")
+	defer tr.Finish()
+
+	f := NewFaultResolver(back, FaultConfig{Latency: 20 * time.Millisecond})
+	start := time.Now()
+	if _, err := f.Query(newQuery("test.", 1), tr); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("latency not injected, query took %v", d)
+	}
+
+	f = NewFaultResolver(back, FaultConfig{Loss: 1})
+	if _, err := f.Query(newQuery("test.", 1), tr); !errors.Is(err, ErrDropQuery) {
+		t.Errorf("expected query to be dropped, got %v", err)
+	}
+
+	f = NewFaultResolver(back, FaultConfig{Errors: 1})
+	if _, err := f.Query(newQuery("test.", 1), tr); err == nil {
+		t.Errorf("expected an error, got nil")
+	}
+}
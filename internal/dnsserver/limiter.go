@@ -0,0 +1,104 @@
+package dnsserver
+
+import (
+	"sync"
+	"time"
+)
+
+// Query priorities, used by the limiter to decide who goes first.
+const (
+	prioNormal = iota
+	prioHigh
+	numPrios
+)
+
+// limiter bounds the number of queries that are resolved concurrently.
+// When all slots are taken, queries wait in line until one is released; high
+// priority queries are always served before normal ones.
+//
+// A nil limiter doesn't limit anything, like one with max 0, so the Server
+// works even if it's not started by ListenAndServe (which creates it).
+type limiter struct {
+	// Maximum number of concurrent queries; 0 means no limit.
+	max int
+
+	mu       sync.Mutex
+	inflight int
+
+	// Queries waiting for a slot, one queue per priority.
+	waiting [numPrios][]chan struct{}
+}
+
+func newLimiter(max int) *limiter {
+	return &limiter{max: max}
+}
+
+// acquire a slot, waiting up to the given timeout for one to be free.
+// Returns true if the slot was acquired (and must later be released), false
+// if we timed out.
+func (l *limiter) acquire(prio int, timeout time.Duration) bool {
+	if l == nil || l.max <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	if l.inflight < l.max {
+		l.inflight++
+		l.mu.Unlock()
+		return true
+	}
+
+	// All slots are busy, wait in line. The channel is buffered so release()
+	// never blocks handing over the slot.
+	c := make(chan struct{}, 1)
+	l.waiting[prio] = append(l.waiting[prio], c)
+	l.mu.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-c:
+		return true
+	case <-t.C:
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// We may have been handed a slot while the timer fired.
+	select {
+	case <-c:
+		return true
+	default:
+	}
+
+	q := l.waiting[prio]
+	for i := range q {
+		if q[i] == c {
+			l.waiting[prio] = append(q[:i], q[i+1:]...)
+			break
+		}
+	}
+	return false
+}
+
+// release a slot, handing it over to the next waiting query, if any.
+func (l *limiter) release() {
+	if l == nil || l.max <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for prio := numPrios - 1; prio >= 0; prio-- {
+		if q := l.waiting[prio]; len(q) > 0 {
+			l.waiting[prio] = q[1:]
+			q[0] <- struct{}{}
+			return
+		}
+	}
+
+	l.inflight--
+}
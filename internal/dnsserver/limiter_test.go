@@ -0,0 +1,99 @@
+package dnsserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterUnlimited(t *testing.T) {
+	// With max 0, and nil, there is no limit.
+	for _, l := range []*limiter{newLimiter(0), nil} {
+		for i := 0; i < 100; i++ {
+			if !l.acquire(prioNormal, 0) {
+				t.Fatalf("unlimited limiter failed to acquire")
+			}
+		}
+		for i := 0; i < 100; i++ {
+			l.release()
+		}
+		if l != nil && (l.inflight != 0 || len(l.waiting[prioNormal]) != 0) {
+			t.Errorf("unlimited limiter is tracking queries: %d, %v",
+				l.inflight, l.waiting)
+		}
+	}
+}
+
+func TestLimiterTimeout(t *testing.T) {
+	l := newLimiter(1)
+	if !l.acquire(prioNormal, time.Second) {
+		t.Fatalf("failed to acquire free slot")
+	}
+
+	if l.acquire(prioHigh, 10*time.Millisecond) {
+		t.Errorf("acquired a slot that should be busy")
+	}
+	if len(l.waiting[prioHigh]) != 0 {
+		t.Errorf("timed out waiter still in queue")
+	}
+
+	l.release()
+	if !l.acquire(prioNormal, 10*time.Millisecond) {
+		t.Errorf("failed to acquire released slot")
+	}
+}
+
+func TestLimiterPriority(t *testing.T) {
+	l := newLimiter(1)
+	l.acquire(prioNormal, time.Second)
+
+	order := make(chan int, 2)
+	wait := func(prio int) {
+		if l.acquire(prio, 5*time.Second) {
+			order <- prio
+			l.release()
+		}
+	}
+
+	// Queue a normal query first, and then a high priority one.
+	go wait(prioNormal)
+	waitForQueue(t, l, prioNormal)
+	go wait(prioHigh)
+	waitForQueue(t, l, prioHigh)
+
+	// When we release the slot, the high priority one must go first.
+	l.release()
+	if p := <-order; p != prioHigh {
+		t.Errorf("expected high priority first, got %d", p)
+	}
+	if p := <-order; p != prioNormal {
+		t.Errorf("expected normal priority second, got %d", p)
+	}
+
+	// Wait for the last release, after which the limiter must be empty.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		l.mu.Lock()
+		n := l.inflight
+		l.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("limiter still has queries in flight")
+}
+
+func waitForQueue(t *testing.T, l *limiter, prio int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		l.mu.Lock()
+		n := len(l.waiting[prio])
+		l.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for queue %d", prio)
+}
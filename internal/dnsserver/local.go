@@ -0,0 +1,217 @@
+package dnsserver
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+// localResolver implements a Resolver that answers queries from a set of
+// local records. Queries for names it does not know about are passed on to
+// the backing resolver.
+type localResolver struct {
+	// Backing resolver.
+	back Resolver
+
+	// Local records, indexed by their (canonical) name.
+	// Wildcard records are kept with their "*" label, e.g. "*.lab.home.".
+	records map[string][]dns.RR
+}
+
+// NewLocalResolver returns a new resolver which answers queries using the
+// given records, and uses the backing resolver for everything else.
+// PTR records are automatically generated for the A and AAAA records, unless
+// the reverse name already has explicit records.
+func NewLocalResolver(back Resolver, rrs []dns.RR) *localResolver {
+	r := &localResolver{
+		back:    back,
+		records: map[string][]dns.RR{},
+	}
+	for _, rr := range rrs {
+		name := dns.CanonicalName(rr.Header().Name)
+		r.records[name] = append(r.records[name], rr)
+	}
+
+	ptrs := map[string][]dns.RR{}
+	for _, rr := range rrs {
+		ptr := reversePTR(rr)
+		if ptr == nil {
+			continue
+		}
+		if _, ok := r.records[ptr.Hdr.Name]; ok {
+			continue
+		}
+		ptrs[ptr.Hdr.Name] = append(ptrs[ptr.Hdr.Name], ptr)
+	}
+	for name, rrs := range ptrs {
+		r.records[name] = rrs
+	}
+
+	return r
+}
+
+// reversePTR returns the PTR record corresponding to the given A or AAAA
+// record, or nil for other records (including wildcards).
+func reversePTR(rr dns.RR) *dns.PTR {
+	var ip string
+	switch rr := rr.(type) {
+	case *dns.A:
+		ip = rr.A.String()
+	case *dns.AAAA:
+		ip = rr.AAAA.String()
+	default:
+		return nil
+	}
+
+	hdr := rr.Header()
+	if strings.HasPrefix(hdr.Name, "*.") {
+		return nil
+	}
+
+	arpa, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return nil
+	}
+
+	return &dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   arpa,
+			Rrtype: dns.TypePTR,
+			Class:  hdr.Class,
+			Ttl:    hdr.Ttl,
+		},
+		Ptr: dns.CanonicalName(hdr.Name),
+	}
+}
+
+// LoadLocalRecords loads records from the given file, which must be in zone
+// file format (RFC 1035 section 5).
+func LoadLocalRecords(path string) ([]dns.RR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rrs := []dns.RR{}
+	zp := dns.NewZoneParser(f, ".", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	return rrs, zp.Err()
+}
+
+func (l *localResolver) Init() error {
+	return l.back.Init()
+}
+
+func (l *localResolver) Maintain() {
+	l.back.Maintain()
+}
+
+// lookup the records for the given name, expanding wildcards if needed.
+// Returns false if we don't have any records for the name.
+func (l *localResolver) lookup(name string) ([]dns.RR, bool) {
+	name = dns.CanonicalName(name)
+	if rrs, ok := l.records[name]; ok {
+		return rrs, true
+	}
+
+	// Look for the most specific wildcard that covers the name, by replacing
+	// the leftmost labels with "*".
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		wild := "*." + strings.Join(labels[i:], ".") + "."
+		rrs, ok := l.records[wild]
+		if !ok {
+			continue
+		}
+
+		// Synthesize the records with the queried name as owner.
+		synth := make([]dns.RR, 0, len(rrs))
+		for _, rr := range rrs {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			synth = append(synth, rr)
+		}
+		return synth, true
+	}
+
+	return nil, false
+}
+
+func (l *localResolver) Query(r *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
+	if len(r.Question) != 1 {
+		return l.back.Query(r, tr)
+	}
+
+	q := r.Question[0]
+	rrs, ok := l.lookup(q.Name)
+	if !ok || q.Qclass != dns.ClassINET {
+		return l.back.Query(r, tr)
+	}
+
+	tr.Printf("answering from local records")
+	tr.SetPolicy("local", "")
+
+	reply := &dns.Msg{}
+	reply.SetReply(r)
+	reply.Authoritative = true
+	for _, rr := range rrs {
+		t := rr.Header().Rrtype
+		if t == q.Qtype || t == dns.TypeCNAME || q.Qtype == dns.TypeANY {
+			reply.Answer = append(reply.Answer, rr)
+		}
+	}
+
+	return reply, nil
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &localResolver{}
+
+// SelfRecords returns A and AAAA records mapping the given name to our own
+// addresses: the host of listenAddr if it is an IP, or all of the local
+// interface addresses otherwise.
+func SelfRecords(name, listenAddr string) ([]dns.RR, error) {
+	var ips []net.IP
+
+	host, _, _ := net.SplitHostPort(listenAddr)
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		ips = append(ips, ip)
+	} else {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+	}
+
+	rrs := []dns.RR{}
+	hdr := dns.RR_Header{
+		Name:  dns.Fqdn(name),
+		Class: dns.ClassINET,
+		Ttl:   300,
+	}
+	for _, ip := range ips {
+		if ip.IsLinkLocalUnicast() {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			hdr.Rrtype = dns.TypeA
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return rrs, nil
+}
@@ -0,0 +1,167 @@
+package dnsserver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `
+host.lab.home.    3600 IN A     10.0.0.1
+host.lab.home.    3600 IN AAAA  fd00::1
+alias.lab.home.   3600 IN CNAME host.lab.home.
+*.lab.home.       60   IN A     10.0.0.5
+*.x.lab.home.     60   IN A     10.0.0.6
+other.lab.home.   3600 IN A     10.0.0.2
+explicit.lab.home. 3600 IN A    10.0.0.3
+3.0.0.10.in-addr.arpa. 3600 IN PTR custom.lab.home.
+`
+
+func mustLocalResolver(t *testing.T, zone string) (*localResolver, *testutil.TestResolver) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "zone")
+	if err := os.WriteFile(path, []byte(zone), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rrs, err := LoadLocalRecords(path)
+	if err != nil {
+		t.Fatalf("LoadLocalRecords failed: %v", err)
+	}
+
+	back := testutil.NewTestResolver()
+	back.Response = newReply(mustNewRR(t, "upstream. A 1.1.1.1"))
+	return NewLocalResolver(back, rrs), back
+}
+
+func queryLocal(t *testing.T, l *localResolver, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	tr := trace.New("test", "queryLocal")
+	defer tr.Finish()
+
+	resp, err := l.Query(newQuery(name, qtype), tr)
+	if err != nil {
+		t.Fatalf("query %q failed: %v", name, err)
+	}
+	return resp
+}
+
+func TestLocalResolver(t *testing.T) {
+	l, back := mustLocalResolver(t, testZone)
+
+	cases := []struct {
+		name   string
+		qtype  uint16
+		answer []string
+	}{
+		{"host.lab.home.", dns.TypeA,
+			[]string{"host.lab.home.\t3600\tIN\tA\t10.0.0.1"}},
+		{"HOST.lab.home.", dns.TypeAAAA,
+			[]string{"host.lab.home.\t3600\tIN\tAAAA\tfd00::1"}},
+		{"alias.lab.home.", dns.TypeA,
+			[]string{"alias.lab.home.\t3600\tIN\tCNAME\thost.lab.home."}},
+
+		// Known name, but no records of the type.
+		{"host.lab.home.", dns.TypeMX, nil},
+
+		// Wildcards.
+		{"wild.lab.home.", dns.TypeA,
+			[]string{"wild.lab.home.\t60\tIN\tA\t10.0.0.5"}},
+		{"a.b.lab.home.", dns.TypeA,
+			[]string{"a.b.lab.home.\t60\tIN\tA\t10.0.0.5"}},
+		{"a.x.lab.home.", dns.TypeA,
+			[]string{"a.x.lab.home.\t60\tIN\tA\t10.0.0.6"}},
+		{"wild.lab.home.", dns.TypeTXT, nil},
+
+		// Automatically generated PTRs.
+		{"1.0.0.10.in-addr.arpa.", dns.TypePTR,
+			[]string{"1.0.0.10.in-addr.arpa.\t3600\tIN\tPTR\thost.lab.home."}},
+		{"2.0.0.10.in-addr.arpa.", dns.TypePTR,
+			[]string{"2.0.0.10.in-addr.arpa.\t3600\tIN\tPTR\tother.lab.home."}},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.",
+			dns.TypePTR,
+			[]string{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.\t3600\tIN\tPTR\thost.lab.home."}},
+
+		// Explicit PTRs take precedence.
+		{"3.0.0.10.in-addr.arpa.", dns.TypePTR,
+			[]string{"3.0.0.10.in-addr.arpa.\t3600\tIN\tPTR\tcustom.lab.home."}},
+	}
+	for _, c := range cases {
+		resp := queryLocal(t, l, c.name, c.qtype)
+		if !resp.Authoritative || resp.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s: unexpected header: %v", c.name, resp.MsgHdr)
+		}
+		if len(resp.Answer) != len(c.answer) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.answer, resp.Answer)
+			continue
+		}
+		for i, rr := range resp.Answer {
+			if rr.String() != c.answer[i] {
+				t.Errorf("%s: expected %q, got %q", c.name, c.answer[i], rr)
+			}
+		}
+	}
+
+	// The wildcard must not have been modified by the synthesis.
+	if n := l.records["*.lab.home."][0].Header().Name; n != "*.lab.home." {
+		t.Errorf("wildcard record was modified: %q", n)
+	}
+
+	// No PTRs are generated for wildcards.
+	if _, ok := l.records["5.0.0.10.in-addr.arpa."]; ok {
+		t.Errorf("PTR generated for a wildcard record")
+	}
+
+	// Unknown names go to the backing resolver.
+	back.LastQuery = nil
+	resp := queryLocal(t, l, "lab.home.", dns.TypeA)
+	if back.LastQuery == nil || resp.Answer[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Errorf("query was not passed to the backing resolver: %v", resp)
+	}
+}
+
+func TestLoadLocalRecordsError(t *testing.T) {
+	if _, err := LoadLocalRecords("/doesnotexist"); err == nil {
+		t.Errorf("loading a non-existing file did not fail")
+	}
+
+	path := filepath.Join(t.TempDir(), "zone")
+	os.WriteFile(path, []byte("bad. IN A xxx\n"), 0600)
+	if _, err := LoadLocalRecords(path); err == nil {
+		t.Errorf("loading an invalid zone did not fail")
+	}
+}
+
+func TestSelfRecords(t *testing.T) {
+	rrs, err := SelfRecords("dnss.lan", "192.168.1.1:53")
+	if err != nil {
+		t.Fatalf("SelfRecords failed: %v", err)
+	}
+	if len(rrs) != 1 || rrs[0].String() != "dnss.lan.\t300\tIN\tA\t192.168.1.1" {
+		t.Errorf("unexpected records: %v", rrs)
+	}
+
+	rrs, err = SelfRecords("dnss.lan", "[2001:db8::1]:53")
+	if err != nil {
+		t.Fatalf("SelfRecords failed: %v", err)
+	}
+	if len(rrs) != 1 || rrs[0].String() != "dnss.lan.\t300\tIN\tAAAA\t2001:db8::1" {
+		t.Errorf("unexpected records: %v", rrs)
+	}
+
+	// With an unspecified address, we use the interface addresses, which
+	// will at least include the loopback.
+	rrs, err = SelfRecords("dnss.lan", ":53")
+	if err != nil {
+		t.Fatalf("SelfRecords failed: %v", err)
+	}
+	l := NewLocalResolver(nil, rrs)
+	if _, ok := l.lookup("1.0.0.127.in-addr.arpa."); !ok {
+		t.Errorf("no PTR for the loopback address in %v", rrs)
+	}
+}
@@ -0,0 +1,119 @@
+package dnsserver
+
+import (
+	"net"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+// Address to send mDNS queries to (RFC 6762).
+// It is declared as a variable so we can tweak it for testing.
+var mdnsAddr = "224.0.0.251:5353"
+
+// How long to wait for mDNS responses.
+var mdnsTimeout = 1 * time.Second
+
+// mdnsResolver implements a Resolver that resolves .local names using
+// multicast DNS, and passes everything else to the backing resolver.
+//
+// It uses "legacy unicast" queries (RFC 6762 section 6.7): queries are sent
+// from an ephemeral port, so responders reply via unicast directly to us.
+type mdnsResolver struct {
+	back Resolver
+}
+
+// NewMDNSResolver returns a new resolver which resolves .local names using
+// mDNS, and uses the backing resolver for everything else.
+func NewMDNSResolver(back Resolver) *mdnsResolver {
+	return &mdnsResolver{back: back}
+}
+
+func (m *mdnsResolver) Init() error {
+	return m.back.Init()
+}
+
+func (m *mdnsResolver) Maintain() {
+	m.back.Maintain()
+}
+
+func (m *mdnsResolver) Query(r *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
+	if len(r.Question) != 1 || !dns.IsSubDomain("local.", r.Question[0].Name) {
+		return m.back.Query(r, tr)
+	}
+
+	tr.Printf("resolving via mDNS")
+	tr.SetPolicy("mdns", "")
+	reply := &dns.Msg{}
+	reply.SetReply(r)
+
+	answer, err := mdnsQuery(r)
+	if err != nil {
+		return nil, err
+	}
+	if answer == nil {
+		tr.Printf("mDNS: no responses")
+		reply.Rcode = dns.RcodeNameError
+		return reply, nil
+	}
+
+	for _, rr := range answer.Answer {
+		// Clear the cache-flush bit, which is mDNS-specific and would
+		// otherwise be seen as a different class by the client.
+		rr.Header().Class &^= 1 << 15
+		reply.Answer = append(reply.Answer, rr)
+	}
+	tr.Printf("mDNS: got %d answers", len(reply.Answer))
+	return reply, nil
+}
+
+// mdnsQuery sends the query over multicast, and returns the first response
+// with answers, or nil if there were none before the timeout.
+func mdnsQuery(r *dns.Msg) (*dns.Msg, error) {
+	addr, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	q := &dns.Msg{}
+	q.SetQuestion(r.Question[0].Name, r.Question[0].Qtype)
+	q.Id = r.Id
+	q.RecursionDesired = false
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = conn.WriteTo(packed, addr); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(mdnsTimeout))
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			// Most likely the deadline expired.
+			return nil, nil
+		}
+
+		resp := &dns.Msg{}
+		if err := resp.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		if resp.Id == q.Id && resp.Response && len(resp.Answer) > 0 {
+			return resp, nil
+		}
+	}
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &mdnsResolver{}
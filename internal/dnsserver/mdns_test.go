@@ -0,0 +1,58 @@
+package dnsserver
+
+import (
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+func TestMDNSResolver(t *testing.T) {
+	// Instead of multicast, send the queries to a test server.
+	addr := testutil.GetFreePort()
+	go testutil.ServeTestDNSServer(addr,
+		testutil.MakeStaticHandler(t, "printer.local. A 192.168.1.9"))
+	testutil.WaitForDNSServer(addr)
+
+	prevAddr := mdnsAddr
+	mdnsAddr = addr
+	defer func() { mdnsAddr = prevAddr }()
+
+	back := testutil.NewTestResolver()
+	back.Response = newReply(mustNewRR(t, "test. A 1.2.3.4"))
+	m := NewMDNSResolver(back)
+
+	tr := trace.New("test", "TestMDNSResolver")
+	defer tr.Finish()
+
+	resp, err := m.Query(newQuery("printer.local.", dns.TypeA), tr)
+	if err != nil {
+		t.Fatalf("mDNS query failed: %v", err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.168.1.9" {
+		t.Errorf("unexpected mDNS response: %v", resp)
+	}
+	if back.LastQuery != nil {
+		t.Errorf(".local query was sent to the backing resolver")
+	}
+
+	// Other names go to the backing resolver.
+	resp, err = m.Query(newQuery("test.", dns.TypeA), tr)
+	if err != nil || back.LastQuery == nil {
+		t.Errorf("query not sent to the backing resolver: %v %v", resp, err)
+	}
+
+	// If nobody replies, we return NXDOMAIN.
+	mdnsAddr = testutil.GetFreePort()
+	prevTimeout := mdnsTimeout
+	mdnsTimeout = 50 * time.Millisecond
+	defer func() { mdnsTimeout = prevTimeout }()
+
+	resp, err = m.Query(newQuery("printer.local.", dns.TypeA), tr)
+	if err != nil || resp.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got %v %v", resp, err)
+	}
+}
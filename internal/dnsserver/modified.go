@@ -0,0 +1,54 @@
+package dnsserver
+
+import (
+	"expvar"
+	"fmt"
+	"sync/atomic"
+
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"blitiri.com.ar/go/log"
+	"github.com/miekg/dns"
+)
+
+// Reasons why we modify an answer, relative to what the upstream returned.
+const (
+	// The TTL of some records was capped to the maximum.
+	modTTLClamped = "ttl-clamped"
+
+	// Records were dropped so the reply fits in the client's UDP size.
+	modTruncated = "truncated"
+
+	// The answer failed DNSSEC validation, and was replaced by an error.
+	modBogus = "dnssec-bogus"
+)
+
+// Exported variables for statistics: the answers we modified, by reason.
+var answersModified *expvar.Map
+
+func init() {
+	answersModified = expvar.NewMap("answers-modified")
+}
+
+// Log every answer modification, not just count them.
+var logModified atomic.Bool
+
+// SetLogModified enables or disables logging every time we modify an answer
+// relative to what the upstream returned. They are always counted in the
+// "answers-modified" stats.
+func SetLogModified(enabled bool) {
+	logModified.Store(enabled)
+}
+
+// answerModified records that the answer to the given question was modified
+// for the given reason, with the details for the trace and the logs.
+func answerModified(tr *trace.Trace, q dns.Question, reason, format string, a ...interface{}) {
+	answersModified.Add(reason, 1)
+
+	details := fmt.Sprintf(format, a...)
+	tr.Printf("answer modified: %s: %s", reason, details)
+	if logModified.Load() {
+		log.Infof("Answer modified: %s %s: %s: %s", q.Name,
+			dns.TypeToString[q.Qtype], reason, details)
+	}
+}
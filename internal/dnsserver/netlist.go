@@ -0,0 +1,77 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// NetList is a list of networks, used to match client addresses.
+type NetList []*net.IPNet
+
+// Contains returns true if the given IP is within any of the networks.
+func (l NetList) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NetListFromString takes a string in the form of "net1,net2,..." and
+// returns the corresponding NetList. Networks are in CIDR notation; plain IP
+// addresses are also accepted, and match only that address.
+func NetListFromString(s string) (NetList, error) {
+	l := NetList{}
+	for _, n := range strings.Split(s, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+
+		if !strings.Contains(n, "/") {
+			ip := net.ParseIP(n)
+			if ip == nil {
+				return nil, fmt.Errorf("%q: %w", n, errInvalidNet)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			l = append(l, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", n, errInvalidNet)
+		}
+		l = append(l, ipnet)
+	}
+	return l, nil
+}
+
+var errInvalidNet = fmt.Errorf("invalid network")
+
+// addrIP returns the IP address of the given network address, or nil if it
+// does not have one.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
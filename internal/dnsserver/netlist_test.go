@@ -0,0 +1,59 @@
+package dnsserver
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestNetList(t *testing.T) {
+	l, err := NetListFromString("10.0.0.0/8, 192.168.1.1,, 2001:db8::/32")
+	if err != nil {
+		t.Fatalf("NetListFromString failed: %v", err)
+	}
+
+	cases := []struct {
+		ip string
+		ok bool
+	}{
+		{"10.1.2.3", true},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"::ffff:10.0.0.1", true},
+		{"11.0.0.1", false},
+	}
+	for _, c := range cases {
+		if ok := l.Contains(net.ParseIP(c.ip)); ok != c.ok {
+			t.Errorf("Contains(%q) = %v, expected %v", c.ip, ok, c.ok)
+		}
+	}
+
+	if l.Contains(nil) {
+		t.Errorf("Contains(nil) = true")
+	}
+
+	for _, s := range []string{"abc", "10.0.0.0/99", "1.2.3.4, x/8"} {
+		_, err := NetListFromString(s)
+		if !errors.Is(err, errInvalidNet) {
+			t.Errorf("NetListFromString(%q): unexpected error %v", s, err)
+		}
+	}
+}
+
+func TestAddrIP(t *testing.T) {
+	cases := []struct {
+		addr net.Addr
+		ip   string
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 53}, "1.2.3.4"},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 53}, "::1"},
+		{&net.IPAddr{IP: net.ParseIP("5.6.7.8")}, "<nil>"},
+	}
+	for _, c := range cases {
+		if ip := addrIP(c.addr); ip.String() != c.ip {
+			t.Errorf("addrIP(%v) = %v, expected %v", c.addr, ip, c.ip)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package dnsserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Observer is notified of every question the server handles, with the reply
+// sent to the client (nil if the query was dropped) and how long it took.
+// Observers must not modify the reply, and must be safe for concurrent use.
+type Observer interface {
+	Observe(q dns.Question, reply *dns.Msg, elapsed time.Duration)
+}
+
+// recordingWriter is a dns.ResponseWriter that remembers the reply written,
+// so we can pass it to the observers.
+type recordingWriter struct {
+	dns.ResponseWriter
+	reply *dns.Msg
+}
+
+func (w *recordingWriter) WriteMsg(m *dns.Msg) error {
+	w.reply = m
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// Upper bounds of the histogram buckets; anything above the last one goes
+// into a final "inf" bucket.
+var (
+	ttlBuckets = []time.Duration{
+		0, 10 * time.Second, time.Minute, 5 * time.Minute,
+		15 * time.Minute, time.Hour, 4 * time.Hour, 24 * time.Hour,
+	}
+	latencyBuckets = []time.Duration{
+		time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond,
+		50 * time.Millisecond, 100 * time.Millisecond,
+		500 * time.Millisecond, time.Second,
+	}
+)
+
+// aggregates over a period, as written out by the AggregateObserver.
+type aggregates struct {
+	Start   time.Time
+	End     time.Time
+	Queries int
+
+	// Counts by query type and response code.
+	QTypes map[string]int
+	Rcodes map[string]int
+
+	// Histograms of the minimum TTL of the answers, and of the latency.
+	// The keys are the upper bound of each bucket (e.g. "<=1m0s").
+	TTLs    map[string]int
+	Latency map[string]int
+}
+
+func newAggregates() *aggregates {
+	return &aggregates{
+		Start:   time.Now(),
+		QTypes:  map[string]int{},
+		Rcodes:  map[string]int{},
+		TTLs:    map[string]int{},
+		Latency: map[string]int{},
+	}
+}
+
+func bucket(buckets []time.Duration, d time.Duration) string {
+	for _, b := range buckets {
+		if d <= b {
+			return fmt.Sprintf("<=%v", b)
+		}
+	}
+	return "inf"
+}
+
+// AggregateObserver is an Observer that keeps anonymized aggregates of the
+// queries and answers, for network research. It does not record names or
+// clients, only distributions: query types, response codes, TTLs and
+// latency. They are written out as one JSON object per line, on every Flush.
+type AggregateObserver struct {
+	mu  sync.Mutex
+	w   io.Writer
+	cur *aggregates
+}
+
+// NewAggregateObserver returns a new AggregateObserver that writes to w.
+func NewAggregateObserver(w io.Writer) *AggregateObserver {
+	return &AggregateObserver{w: w, cur: newAggregates()}
+}
+
+// OpenAggregateObserver returns a new AggregateObserver that appends to the
+// file at the given path ("-" means stderr).
+func OpenAggregateObserver(path string) (*AggregateObserver, error) {
+	if path == "-" {
+		return NewAggregateObserver(os.Stderr), nil
+	}
+
+	f, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewAggregateObserver(f), nil
+}
+
+func (a *AggregateObserver) Observe(q dns.Question, reply *dns.Msg, elapsed time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.cur.Queries++
+	a.cur.QTypes[dns.TypeToString[q.Qtype]]++
+	a.cur.Latency[bucket(latencyBuckets, elapsed)]++
+
+	if reply == nil {
+		a.cur.Rcodes["dropped"]++
+		return
+	}
+	a.cur.Rcodes[dns.RcodeToString[reply.Rcode]]++
+
+	if len(reply.Answer) > 0 {
+		ttl := reply.Answer[0].Header().Ttl
+		for _, rr := range reply.Answer[1:] {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		a.cur.TTLs[bucket(ttlBuckets, time.Duration(ttl)*time.Second)]++
+	}
+}
+
+// Flush writes out the aggregates collected since the last flush, and
+// starts over.
+func (a *AggregateObserver) Flush() error {
+	a.mu.Lock()
+	agg := a.cur
+	agg.End = time.Now()
+	a.cur = newAggregates()
+	a.mu.Unlock()
+
+	buf, err := json.Marshal(agg)
+	if err != nil {
+		return err
+	}
+	_, err = a.w.Write(append(buf, '\n'))
+	return err
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Observer = &AggregateObserver{}
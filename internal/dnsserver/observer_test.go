@@ -0,0 +1,96 @@
+package dnsserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+func TestAggregateObserver(t *testing.T) {
+	buf := &bytes.Buffer{}
+	a := NewAggregateObserver(buf)
+
+	q := dns.Question{Name: "test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	reply := newReply(mustNewRR(t, "test. 300 A 1.2.3.4"))
+	reply.Answer = append(reply.Answer, mustNewRR(t, "test. 30 A 1.2.3.5"))
+	a.Observe(q, reply, 2*time.Millisecond)
+	a.Observe(q, nil, 2*time.Second)
+
+	nx := &dns.Msg{}
+	nx.Rcode = dns.RcodeNameError
+	a.Observe(dns.Question{Name: "x.", Qtype: dns.TypeAAAA}, nx,
+		20*time.Millisecond)
+
+	if err := a.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	agg := &aggregates{}
+	if err := json.Unmarshal(buf.Bytes(), agg); err != nil {
+		t.Fatalf("error decoding %q: %v", buf.String(), err)
+	}
+
+	if agg.Queries != 3 || agg.QTypes["A"] != 2 || agg.QTypes["AAAA"] != 1 {
+		t.Errorf("unexpected counts: %+v", agg)
+	}
+	if agg.Rcodes["NOERROR"] != 1 || agg.Rcodes["NXDOMAIN"] != 1 ||
+		agg.Rcodes["dropped"] != 1 {
+		t.Errorf("unexpected rcodes: %v", agg.Rcodes)
+	}
+	if len(agg.TTLs) != 1 || agg.TTLs["<=1m0s"] != 1 {
+		t.Errorf("unexpected TTLs: %v", agg.TTLs)
+	}
+	if agg.Latency["<=5ms"] != 1 || agg.Latency["<=50ms"] != 1 ||
+		agg.Latency["inf"] != 1 {
+		t.Errorf("unexpected latency: %v", agg.Latency)
+	}
+
+	// After flushing, we start over.
+	buf.Reset()
+	a.Flush()
+	agg = &aggregates{}
+	json.Unmarshal(buf.Bytes(), agg)
+	if agg.Queries != 0 {
+		t.Errorf("aggregates not reset: %+v", agg)
+	}
+}
+
+type testObserver struct {
+	mu    sync.Mutex
+	q     dns.Question
+	reply *dns.Msg
+}
+
+func (o *testObserver) Observe(q dns.Question, reply *dns.Msg, elapsed time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.q = q
+	o.reply = reply
+}
+
+func TestServerObservers(t *testing.T) {
+	res := testutil.NewTestResolver()
+	res.Response = &dns.Msg{
+		Answer: []dns.RR{testutil.NewRR(t, "response.test. A 1.1.1.1")},
+	}
+
+	o := &testObserver{}
+	srv := New(testutil.GetFreePort(), res, "", nil)
+	srv.Observers = []Observer{o}
+	go srv.ListenAndServe()
+	testutil.WaitForDNSServer(srv.Addr)
+
+	query(t, srv.Addr, "response.test.", "1.1.1.1")
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.q.Name != "response.test." || o.reply == nil ||
+		len(o.reply.Answer) != 1 {
+		t.Errorf("unexpected observation: %v %v", o.q, o.reply)
+	}
+}
@@ -0,0 +1,104 @@
+package dnsserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+// QueryLog writes one line per query, including which layer and rule
+// decided the answer (e.g. "cache", "local", "upstream <url>").
+// A nil *QueryLog is valid, and does not log anything.
+type QueryLog struct {
+	mu sync.Mutex
+	w  io.Writer
+
+	// Path to the file we write to, if any.
+	path string
+}
+
+// NewQueryLog returns a new QueryLog that writes to w.
+func NewQueryLog(w io.Writer) *QueryLog {
+	return &QueryLog{w: w}
+}
+
+// OpenQueryLog returns a new QueryLog that appends to the file at the given
+// path ("-" means stderr).
+func OpenQueryLog(path string) (*QueryLog, error) {
+	if path == "-" {
+		return NewQueryLog(os.Stderr), nil
+	}
+
+	f, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryLog{w: f, path: path}, nil
+}
+
+func openLogFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// Reopen the log file, so it can be rotated by external tools. It does
+// nothing if the log is not backed by a file.
+func (l *QueryLog) Reopen() error {
+	if l == nil || l.path == "" {
+		return nil
+	}
+
+	f, err := openLogFile(l.path)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	old := l.w
+	l.w = f
+	l.mu.Unlock()
+
+	return old.(*os.File).Close()
+}
+
+// Log the query, and how it was answered.
+// The line has the following space-separated fields: time, network, client
+// address, name, type, result, layer, rule, and duration. Layer and rule are
+// "-" if unknown or empty.
+func (l *QueryLog) Log(tr *trace.Trace, addr net.Addr, r *dns.Msg, result string, start time.Time) {
+	if l == nil {
+		return
+	}
+
+	name, qtype := "-", "-"
+	if len(r.Question) > 0 {
+		name = r.Question[0].Name
+		qtype = dns.TypeToString[r.Question[0].Qtype]
+	}
+
+	layer, rule := tr.Policy()
+	line := fmt.Sprintf("%s %s %s %s %s %s %s %s %s\n",
+		start.UTC().Format(time.RFC3339Nano),
+		addr.Network(), addrIP(addr),
+		name, qtype, result,
+		orDash(layer), orDash(strings.ReplaceAll(rule, " ", "_")),
+		time.Since(start).Round(time.Microsecond))
+
+	l.mu.Lock()
+	io.WriteString(l.w, line)
+	l.mu.Unlock()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
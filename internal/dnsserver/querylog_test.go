@@ -0,0 +1,102 @@
+package dnsserver
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	ql := NewQueryLog(buf)
+
+	tr := trace.New("test", "TestQueryLog")
+	defer tr.Finish()
+
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	r := newQuery("test.", dns.TypeA)
+
+	// Outer layers override the decision of inner ones.
+	tr.SetPolicy("upstream", "https://example/dns-query")
+	tr.SetPolicy("dnssec", "bogus")
+	ql.Log(tr, addr, r, "SERVFAIL", time.Now())
+
+	fields := strings.Fields(buf.String())
+	expected := []string{"udp", "192.0.2.1", "test.", "A", "SERVFAIL",
+		"dnssec", "bogus"}
+	if len(fields) != 9 || strings.Join(fields[1:8], " ") != strings.Join(expected, " ") {
+		t.Errorf("unexpected log line: %q", buf.String())
+	}
+
+	// A nil query log is valid.
+	var nilLog *QueryLog
+	nilLog.Log(tr, addr, r, "NOERROR", time.Now())
+}
+
+func TestQueryLogPolicies(t *testing.T) {
+	back := testutil.NewTestResolver()
+	back.Response = newReply(mustNewRR(t, "test. A 1.2.3.4"))
+	c := NewCachingResolver(back)
+	res := NewCanaryResolver(c)
+
+	cases := []struct {
+		name, layer, rule string
+	}{
+		{"test.", "", ""},
+		{"test.", "cache", ""},
+		{"use-application-dns.net.", "canary", "use-application-dns.net."},
+	}
+	for _, c := range cases {
+		tr := trace.New("test", "TestQueryLogPolicies")
+		res.Query(newQuery(c.name, dns.TypeA), tr)
+		layer, rule := tr.Policy()
+		if layer != c.layer || rule != c.rule {
+			t.Errorf("%s: expected %q %q, got %q %q",
+				c.name, c.layer, c.rule, layer, rule)
+		}
+		tr.Finish()
+	}
+}
+
+func TestQueryLogReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/query.log"
+
+	ql, err := OpenQueryLog(path)
+	if err != nil {
+		t.Fatalf("error opening log: %v", err)
+	}
+
+	tr := trace.New("test", "TestQueryLogReopen")
+	defer tr.Finish()
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+
+	ql.Log(tr, addr, newQuery("one.", dns.TypeA), "NOERROR", time.Now())
+
+	// Rotate the file, and check the new entries go to a new one.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("error renaming: %v", err)
+	}
+	if err := ql.Reopen(); err != nil {
+		t.Fatalf("error reopening: %v", err)
+	}
+	ql.Log(tr, addr, newQuery("two.", dns.TypeA), "NOERROR", time.Now())
+
+	old, _ := os.ReadFile(path + ".1")
+	cur, _ := os.ReadFile(path)
+	if !strings.Contains(string(old), " one. ") ||
+		strings.Contains(string(old), " two. ") {
+		t.Errorf("unexpected rotated log: %q", old)
+	}
+	if !strings.Contains(string(cur), " two. ") {
+		t.Errorf("unexpected current log: %q", cur)
+	}
+}
@@ -2,11 +2,18 @@ package dnsserver
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"expvar"
 	"fmt"
+	"hash/fnv"
+	"net"
 	"net/http"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"blitiri.com.ar/go/dnss/internal/trace"
@@ -37,21 +44,228 @@ type cachingResolver struct {
 	// Backing resolver.
 	back Resolver
 
-	// The cache where we keep the records.
-	answer map[dns.Question][]dns.RR
+	// The cache where we keep the records, split in shards so lookups and
+	// maintenance of one shard don't block the others.
+	shards [numCacheShards]*cacheShard
 
-	// mu protects the answer map.
-	mu *sync.RWMutex
+	// Number of entries in the cache, across all shards.
+	size atomic.Int64
+
+	// Approximate memory used by the entries, across all shards.
+	bytes atomic.Int64
+
+	// In maintenance mode, we only serve from the cache, never contacting
+	// the backing resolver, and entries do not expire.
+	maintenance atomic.Bool
+
+	// Refresh popular entries before they expire.
+	prefetch atomic.Bool
+
+	// Code of the EDNS0 option that makes queries bypass the cache, or 0
+	// if none.
+	bypassOption atomic.Uint32
+
+	// On a miss, try to build the answer from cached CNAMEs and the answer
+	// for their target.
+	followCNAMEs atomic.Bool
+
+	// Queries to the backing resolver in progress, so concurrent misses for
+	// the same entry wait for the same query instead of each sending their
+	// own.
+	inflightMu sync.Mutex
+	inflight   map[cacheKey]*inflightQuery
+}
+
+// inflightQuery is a query to the backing resolver in progress.
+type inflightQuery struct {
+	// Closed when the query is done, and reply and err are set.
+	done  chan struct{}
+	reply *dns.Msg
+	err   error
 }
 
 // NewCachingResolver returns a new resolver which implements a cache on top
 // of the given one.
 func NewCachingResolver(back Resolver) *cachingResolver {
-	return &cachingResolver{
-		back:   back,
-		answer: map[dns.Question][]dns.RR{},
-		mu:     &sync.RWMutex{},
+	c := &cachingResolver{
+		back:     back,
+		inflight: map[cacheKey]*inflightQuery{},
+	}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{answer: map[cacheKey]cacheEntry{}}
+	}
+	return c
+}
+
+// Number of shards the cache is split into.
+const numCacheShards = 16
+
+// cacheShard is a portion of the cache.
+type cacheShard struct {
+	// mu protects the answer map.
+	mu sync.RWMutex
+
+	answer map[cacheKey]cacheEntry
+}
+
+// shard returns the shard where the given key is stored.
+func (c *cachingResolver) shard(key cacheKey) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(key.Name)))
+	binary.Write(h, binary.LittleEndian, key.Qtype)
+	return c.shards[h.Sum32()%numCacheShards]
+}
+
+// cacheKey identifies an entry in the cache.
+// Besides the question, it includes the EDNS state of the query that changes
+// the answer: the DO bit (with it, the answer includes the signatures), and
+// the client subnet, as upstreams can tailor the answer to it.
+// Queries with CD bypass the cache, see wantToBypass.
+type cacheKey struct {
+	dns.Question
+	DO bool
+
+	// Client subnet of the query, as "address/prefix", or "" if it had none.
+	// To keep it simple we don't take the scope of the reply into account,
+	// so answers are only shared within the exact same subnet.
+	ECS string
+}
+
+func newCacheKey(r *dns.Msg) cacheKey {
+	opt := r.IsEdns0()
+	return cacheKey{
+		Question: r.Question[0],
+		DO:       opt != nil && opt.Do(),
+		ECS:      ecsKey(opt),
+	}
+}
+
+// ecsKey returns the client subnet of the given OPT record, normalized so
+// equivalent queries get the same key.
+func ecsKey(opt *dns.OPT) string {
+	if opt == nil {
+		return ""
+	}
+	for _, o := range opt.Option {
+		ecs, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		bits := 32
+		if ecs.Family == 2 {
+			bits = 128
+		}
+		mask := net.CIDRMask(int(ecs.SourceNetmask), bits)
+		if mask == nil {
+			// Invalid prefix length; keep it apart from the rest.
+			return fmt.Sprintf("invalid:%v/%d", ecs.Address, ecs.SourceNetmask)
+		}
+		return fmt.Sprintf("%v/%d", ecs.Address.Mask(mask), ecs.SourceNetmask)
+	}
+	return ""
+}
+
+// ecsOption returns the ECS option for the given cache key, or nil if it has
+// none.
+func (k cacheKey) ecsOption() *dns.EDNS0_SUBNET {
+	_, ipnet, err := net.ParseCIDR(k.ECS)
+	if err != nil {
+		return nil
+	}
+
+	ones, _ := ipnet.Mask.Size()
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        2,
+		SourceNetmask: uint8(ones),
+		Address:       ipnet.IP,
+	}
+	if ip4 := ipnet.IP.To4(); ip4 != nil {
+		ecs.Family = 1
+		ecs.Address = ip4
+	}
+	return ecs
+}
+
+// cacheEntry is an answer we keep in the cache.
+type cacheEntry struct {
+	// The answer, authority and additional sections, with the TTLs they had
+	// when they were stored. They must not be modified, as they're shared
+	// with the readers; see answerAt.
+	answer []dns.RR
+	ns     []dns.RR
+	extra  []dns.RR
+
+	// When the entry was stored, and when it expires (that is, when the
+	// record with the lowest TTL does).
+	stored  time.Time
+	expires time.Time
+
+	// Value of the AD bit in the reply.
+	authenticated bool
+
+	// How much the entry is used. Shared by all copies of the entry, and
+	// reset when it's refreshed.
+	usage *entryUsage
+
+	// Approximate memory used by the entry, see entrySize.
+	bytes int64
+}
+
+// Approximate memory overhead of each entry and each record, on top of the
+// size of the records in wire format: the map slot, key and entry structs,
+// and the Go representation of the records.
+const (
+	entryOverhead  = 200
+	recordOverhead = 64
+)
+
+// entrySize returns the approximate memory used by an entry with the given
+// key and sections. It doesn't need to be precise, just good enough to bound
+// the cache's memory on constrained devices.
+func entrySize(key cacheKey, sections ...[]dns.RR) int64 {
+	size := entryOverhead + len(key.Name) + len(key.ECS)
+	for _, rrs := range sections {
+		for _, rr := range rrs {
+			size += recordOverhead + dns.Len(rr)
+		}
 	}
+	return int64(size)
+}
+
+// TTL of the records served after they expired, which only happens in
+// maintenance mode (RFC 8767 section 4).
+const staleTTL = 30
+
+// answerAt returns a copy of the entry's answer, with the TTL of each record
+// decreased by the time elapsed since it was stored.
+func (e cacheEntry) answerAt(now time.Time) []dns.RR {
+	return e.sectionAt(e.answer, now)
+}
+
+// sectionAt is like answerAt, for any of the entry's sections.
+func (e cacheEntry) sectionAt(section []dns.RR, now time.Time) []dns.RR {
+	if len(section) == 0 {
+		return nil
+	}
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	answer := copyRRSlice(section)
+	for _, rr := range answer {
+		hdr := rr.Header()
+		if hdr.Ttl > elapsed {
+			hdr.Ttl -= elapsed
+		} else {
+			hdr.Ttl = staleTTL
+		}
+	}
+	return answer
+}
+
+// entryUsage tracks the use of a cache entry, to decide whether to prefetch
+// it.
+type entryUsage struct {
+	hits    atomic.Int64
+	lastHit atomic.Int64 // Unix time in nanoseconds.
 }
 
 // Constants that tune the cache.
@@ -63,17 +277,62 @@ var (
 	// with Maintain().
 	maxCacheSize = 2000
 
+	// Maximum approximate memory used by the entries in the cache, in bytes,
+	// or 0 for no limit (besides maxCacheSize).
+	maxCacheBytes int64 = 0
+
 	// Minimum TTL for entries we consider for the cache.
 	minTTL = 2 * time.Minute
 
 	// Maximum TTL for our cache. We cap records that exceed this.
 	maxTTL = 2 * time.Hour
 
-	// How often to run GC on the cache.
-	// Must be < minTTL if we don't want to have entries stale for too long.
+	// How often to run GC on the cache. Each shard is visited once per
+	// period, spread evenly over it. Expired entries are never served, this
+	// only frees their memory.
 	maintenancePeriod = 30 * time.Second
+
+	// Entries are prefetched if they would expire before the next GC, and
+	// have had at least prefetchMinHits hits since they were recorded, the
+	// last one within prefetchRecent.
+	prefetchMinHits = int64(3)
+	prefetchRecent  = 10 * time.Minute
 )
 
+// SetCacheTuning overrides the constants that tune the cache: the maximum
+// number of entries, the minimum TTL for an answer to be cached, the maximum
+// TTL we cache for, and how often to run GC. It must be called before any
+// caching resolver is used, and applies to all of them.
+func SetCacheTuning(size int, lowest, highest, period time.Duration) error {
+	if size <= 0 {
+		return fmt.Errorf("cache size must be positive, got %d", size)
+	}
+	if lowest < 0 || highest < lowest {
+		return fmt.Errorf("invalid TTL range: %v - %v", lowest, highest)
+	}
+	if period <= 0 {
+		return fmt.Errorf("maintenance period must be positive, got %v",
+			period)
+	}
+
+	maxCacheSize = size
+	minTTL = lowest
+	maxTTL = highest
+	maintenancePeriod = period
+	return nil
+}
+
+// SetCacheMaxBytes limits the approximate memory used by the cache entries,
+// in addition to the maximum number of entries. 0 means no limit. It must be
+// called before any caching resolver is used, and applies to all of them.
+func SetCacheMaxBytes(n int64) error {
+	if n < 0 {
+		return fmt.Errorf("cache bytes must not be negative, got %d", n)
+	}
+	maxCacheBytes = n
+	return nil
+}
+
 // Exported variables for statistics.
 // These are global and not per caching resolver, so if we have more than once
 // the results will be mixed.
@@ -92,6 +351,20 @@ var stats = struct {
 
 	// Entries we decided to record in the cache.
 	cacheRecorded *expvar.Int
+
+	// Entries we refreshed before they expired.
+	cachePrefetched *expvar.Int
+
+	// Misses that waited for an identical query already in flight.
+	cacheCoalesced *expvar.Int
+
+	// Hits and misses, by query type.
+	cacheHitsByType   *expvar.Map
+	cacheMissesByType *expvar.Map
+
+	// Entries currently in the cache, and their approximate memory use.
+	cacheEntries *expvar.Int
+	cacheBytes   *expvar.Int
 }{}
 
 func init() {
@@ -100,6 +373,23 @@ func init() {
 	stats.cacheHits = expvar.NewInt("cache-hits")
 	stats.cacheMisses = expvar.NewInt("cache-misses")
 	stats.cacheRecorded = expvar.NewInt("cache-recorded")
+	stats.cachePrefetched = expvar.NewInt("cache-prefetched")
+	stats.cacheCoalesced = expvar.NewInt("cache-coalesced")
+	stats.cacheHitsByType = expvar.NewMap("cache-hits-by-qtype")
+	stats.cacheMissesByType = expvar.NewMap("cache-misses-by-qtype")
+	stats.cacheEntries = expvar.NewInt("cache-entries")
+	stats.cacheBytes = expvar.NewInt("cache-bytes")
+	expvar.Publish("cache-hit-ratio", expvar.Func(cacheHitRatio))
+}
+
+// cacheHitRatio returns the ratio of cache hits over hits and misses, or 0 if
+// there were none.
+func cacheHitRatio() interface{} {
+	hits, misses := stats.cacheHits.Value(), stats.cacheMisses.Value()
+	if hits+misses == 0 {
+		return 0.0
+	}
+	return float64(hits) / float64(hits+misses)
 }
 
 func (c *cachingResolver) Init() error {
@@ -113,26 +403,72 @@ func (c *cachingResolver) Init() error {
 func (c *cachingResolver) RegisterDebugHandlers() {
 	http.HandleFunc("/debug/dnsserver/cache/dump", c.DumpCache)
 	http.HandleFunc("/debug/dnsserver/cache/flush", c.FlushCache)
+	http.HandleFunc("/debug/dnsserver/cache/maintenance", c.MaintenanceMode)
 }
 
+// DumpCache writes the cache entries, in text or (with format=json) JSON.
+// They can be filtered by domain (and its subdomains) with the "name"
+// parameter, and by query type with the "type" parameter.
 func (c *cachingResolver) DumpCache(w http.ResponseWriter, r *http.Request) {
-	buf := bytes.NewBuffer(nil)
+	var qtype uint16
+	if t := r.FormValue("type"); t != "" {
+		var ok bool
+		qtype, ok = dns.StringToType[strings.ToUpper(t)]
+		if !ok {
+			http.Error(w, "unknown type", http.StatusBadRequest)
+			return
+		}
+	}
+	name := r.FormValue("name")
+	if name != "" {
+		if _, ok := dns.IsDomainName(name); !ok {
+			http.Error(w, "invalid name", http.StatusBadRequest)
+			return
+		}
+		name = dns.Fqdn(name)
+	}
 
-	c.mu.RLock()
+	// Take a snapshot of all the shards.
+	entries := map[cacheKey]cacheEntry{}
+	for _, sh := range c.shards {
+		sh.mu.RLock()
+		for q, e := range sh.answer {
+			if qtype != 0 && q.Qtype != qtype {
+				continue
+			}
+			if name != "" && !dns.IsSubDomain(name, q.Name) {
+				continue
+			}
+			entries[q] = e
+		}
+		sh.mu.RUnlock()
+	}
 
 	// Sort output by expiration, so it is somewhat consistent and practical
 	// to read.
-	qs := []dns.Question{}
-	for q := range c.answer {
+	qs := []cacheKey{}
+	for q := range entries {
 		qs = append(qs, q)
 	}
 	sort.Slice(qs, func(i, j int) bool {
-		return getTTL(c.answer[qs[i]]) < getTTL(c.answer[qs[j]])
+		return entries[qs[i]].expires.Before(entries[qs[j]].expires)
 	})
 
+	if r.FormValue("format") == "json" {
+		dump := make([]jsonCacheEntry, 0, len(qs))
+		for _, q := range qs {
+			dump = append(dump, toJSONEntry(q, entries[q], log.V(1)))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dump)
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+
 	// Go through the sorted list and dump the entries.
 	for _, q := range qs {
-		ans := c.answer[q]
+		ans := entries[q].answer
 
 		// Only include names and records if we are running verbosily.
 		name := "<hidden>"
@@ -140,64 +476,357 @@ func (c *cachingResolver) DumpCache(w http.ResponseWriter, r *http.Request) {
 			name = q.Name
 		}
 
-		fmt.Fprintf(buf, "Q: %s %s %s\n", name, dns.TypeToString[q.Qtype],
+		fmt.Fprintf(buf, "Q: %s %s %s", name, dns.TypeToString[q.Qtype],
 			dns.ClassToString[q.Qclass])
+		if q.DO {
+			fmt.Fprintf(buf, " DO")
+		}
+		if q.ECS != "" && log.V(1) {
+			fmt.Fprintf(buf, " ECS %s", q.ECS)
+		}
+		fmt.Fprintf(buf, "\n")
 
-		ttl := getTTL(ans)
-		fmt.Fprintf(buf, "   expires in %s (%s)\n", ttl, time.Now().Add(ttl))
+		expires := entries[q].expires
+		fmt.Fprintf(buf, "   expires in %s (%s), %d hits\n",
+			time.Until(expires).Round(time.Second), expires,
+			entries[q].usage.hits.Load())
 
 		if log.V(1) {
 			for _, rr := range ans {
 				fmt.Fprintf(buf, "   %s\n", rr.String())
 			}
+			for _, rr := range entries[q].ns {
+				fmt.Fprintf(buf, "   NS: %s\n", rr.String())
+			}
+			for _, rr := range entries[q].extra {
+				fmt.Fprintf(buf, "   EXTRA: %s\n", rr.String())
+			}
 		} else {
-			fmt.Fprintf(buf, "   %d RRs in answer\n", len(ans))
+			fmt.Fprintf(buf, "   %d RRs in answer, %d in authority, "+
+				"%d in additional\n",
+				len(ans), len(entries[q].ns), len(entries[q].extra))
 		}
 		fmt.Fprintf(buf, "\n\n")
 	}
-	c.mu.RUnlock()
 
 	buf.WriteTo(w)
 }
 
+// jsonCacheEntry is the JSON representation of a cache entry, for the dump.
+type jsonCacheEntry struct {
+	Name          string
+	Type          string
+	Class         string
+	DO            bool
+	ECS           string `json:",omitempty"`
+	Expires       time.Time
+	TTL           int64
+	Hits          int64
+	Authenticated bool
+
+	// The records are only included if we are running verbosily, like the
+	// names; otherwise, only how many there are.
+	Answer      []string `json:",omitempty"`
+	Authority   []string `json:",omitempty"`
+	Additional  []string `json:",omitempty"`
+	NAnswer     int
+	NAuthority  int
+	NAdditional int
+}
+
+func toJSONEntry(key cacheKey, e cacheEntry, verbose bool) jsonCacheEntry {
+	j := jsonCacheEntry{
+		Name:          "<hidden>",
+		Type:          dns.Type(key.Qtype).String(),
+		Class:         dns.Class(key.Qclass).String(),
+		DO:            key.DO,
+		Expires:       e.expires,
+		TTL:           int64(time.Until(e.expires) / time.Second),
+		Hits:          e.usage.hits.Load(),
+		Authenticated: e.authenticated,
+		NAnswer:       len(e.answer),
+		NAuthority:    len(e.ns),
+		NAdditional:   len(e.extra),
+	}
+	if !verbose {
+		return j
+	}
+
+	j.Name = key.Name
+	j.ECS = key.ECS
+	for _, rr := range e.answer {
+		j.Answer = append(j.Answer, rr.String())
+	}
+	for _, rr := range e.ns {
+		j.Authority = append(j.Authority, rr.String())
+	}
+	for _, rr := range e.extra {
+		j.Additional = append(j.Additional, rr.String())
+	}
+	return j
+}
+
+// FlushCache flushes the whole cache, or if the "name" parameter is given,
+// only the entries for that domain and its subdomains.
 func (c *cachingResolver) FlushCache(w http.ResponseWriter, r *http.Request) {
-	c.mu.Lock()
-	c.answer = map[dns.Question][]dns.RR{}
-	c.mu.Unlock()
+	name := r.FormValue("name")
+	if name == "" {
+		c.Flush()
+		w.Write([]byte("cache flush complete"))
+		return
+	}
+
+	if _, ok := dns.IsDomainName(name); !ok {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+	n := c.FlushDomain(name)
+	fmt.Fprintf(w, "cache flush complete: %d entries removed", n)
+}
+
+// Flush removes all the entries from the cache.
+func (c *cachingResolver) Flush() {
+	for _, sh := range c.shards {
+		sh.mu.Lock()
+		for _, e := range sh.answer {
+			c.addBytes(-e.bytes)
+		}
+		c.addSize(-int64(len(sh.answer)))
+		sh.answer = map[cacheKey]cacheEntry{}
+		sh.mu.Unlock()
+	}
+	log.Infof("Cache flushed")
+}
+
+// FlushDomain removes the entries for the given domain and its subdomains
+// from the cache. Returns how many entries were removed.
+func (c *cachingResolver) FlushDomain(domain string) int {
+	domain = dns.CanonicalName(domain)
+	n := 0
+	for _, sh := range c.shards {
+		sh.mu.Lock()
+		for key, e := range sh.answer {
+			if dns.IsSubDomain(domain, key.Name) {
+				delete(sh.answer, key)
+				c.addBytes(-e.bytes)
+				n++
+			}
+		}
+		sh.mu.Unlock()
+	}
+	c.addSize(-int64(n))
+	log.Infof("Cache flushed for %q: %d entries", domain, n)
+	return n
+}
+
+// addSize adds n to the number of entries in the cache, and returns the new
+// value.
+func (c *cachingResolver) addSize(n int64) int64 {
+	stats.cacheEntries.Add(n)
+	return c.size.Add(n)
+}
+
+// addBytes adds n to the memory used by the cache, and returns the new
+// value.
+func (c *cachingResolver) addBytes(n int64) int64 {
+	stats.cacheBytes.Add(n)
+	return c.bytes.Add(n)
+}
+
+// Summary returns a short, human-readable summary of the cache.
+func (c *cachingResolver) Summary() string {
+	return fmt.Sprintf("cache: %d entries (~%d KiB), maintenance mode: %v",
+		c.size.Load(), c.bytes.Load()/1024, c.maintenance.Load())
+}
+
+// SetMaintenance enables or disables maintenance mode. While in maintenance
+// mode, queries are only answered from the cache (including stale entries),
+// and the backing resolver is never contacted.
+func (c *cachingResolver) SetMaintenance(enabled bool) {
+	c.maintenance.Store(enabled)
+	log.Infof("Cache maintenance mode: %v", enabled)
+}
+
+// SetPrefetch enables or disables prefetching: refreshing the entries that
+// are popular before they expire, so their clients never have to wait for
+// the backing resolver.
+func (c *cachingResolver) SetPrefetch(enabled bool) {
+	c.prefetch.Store(enabled)
+}
+
+// SetFollowCNAMEs enables or disables following the cached CNAMEs: on a
+// miss, if there's a cached CNAME for the name, and a cached answer for its
+// target (and query type), the answer is built from them.
+func (c *cachingResolver) SetFollowCNAMEs(enabled bool) {
+	c.followCNAMEs.Store(enabled)
+}
+
+// SetBypassOption makes the queries that include an EDNS0 option with the
+// given code bypass the cache, like the ones with CD do. 0 disables it.
+func (c *cachingResolver) SetBypassOption(code uint16) {
+	c.bypassOption.Store(uint32(code))
+}
+
+// wantToBypass returns the reason why the query should bypass the cache, or
+// "" if it should not.
+//
+// Queries with CD may get data that failed validation, which must not
+// replace the validated one, so they go straight to the backing resolver;
+// that also makes CD useful to force a fresh lookup.
+func (c *cachingResolver) wantToBypass(r *dns.Msg) string {
+	if len(r.Question) != 1 {
+		// To keep it simple we only cache single-question queries.
+		return "multi-question query"
+	}
+	if c.maintenance.Load() {
+		// We never contact the backing resolver in maintenance mode, so
+		// everything is served from the cache.
+		return ""
+	}
+	if r.CheckingDisabled {
+		return "checking disabled"
+	}
+
+	code := uint16(c.bypassOption.Load())
+	if opt := r.IsEdns0(); opt != nil && code != 0 {
+		for _, o := range opt.Option {
+			if o.Option() == code {
+				return "bypass option"
+			}
+		}
+	}
+	return ""
+}
 
-	w.Write([]byte("cache flush complete"))
+// MaintenanceMode is an HTTP handler to show and change the maintenance
+// mode, using the "enable" parameter (e.g. "?enable=1" or "?enable=0").
+func (c *cachingResolver) MaintenanceMode(w http.ResponseWriter, r *http.Request) {
+	switch r.FormValue("enable") {
+	case "":
+	case "1", "true":
+		c.SetMaintenance(true)
+	case "0", "false":
+		c.SetMaintenance(false)
+	default:
+		http.Error(w, "invalid value for enable", http.StatusBadRequest)
+		return
+	}
+
+	fmt.Fprintf(w, "maintenance mode: %v\n", c.maintenance.Load())
 }
 
 func (c *cachingResolver) Maintain() {
 	go c.back.Maintain()
 
-	for range time.Tick(maintenancePeriod) {
-		tr := trace.New("dnsserver.Cache", "GC")
-		var total, expired int
-
-		c.mu.Lock()
-		total = len(c.answer)
-		for q, ans := range c.answer {
-			newTTL := getTTL(ans) - maintenancePeriod
-			if newTTL > 0 {
-				// Don't modify in place, create a copy and override.
-				// That way, we avoid races with users that have gotten a
-				// cached answer and are returning it.
-				newans := copyRRSlice(ans)
-				setTTL(newans, newTTL)
-				c.answer[q] = newans
+	// Visit one shard at a time, so the GC work is spread over the period
+	// instead of blocking the whole cache at once.
+	next := 0
+	for range time.Tick(maintenancePeriod / numCacheShards) {
+		sh := c.shards[next]
+		next = (next + 1) % numCacheShards
+
+		if c.maintenance.Load() {
+			// Keep the entries around, even if they're stale, so we can
+			// continue to serve them.
+			continue
+		}
+
+		toPrefetch := c.gcShard(sh)
+		if len(toPrefetch) > 0 {
+			go c.prefetchEntries(toPrefetch)
+		}
+	}
+}
+
+// gcShard removes the expired entries from the shard. It expects to be
+// called once per maintenancePeriod. If prefetching is enabled, it returns
+// the entries that should be refreshed.
+func (c *cachingResolver) gcShard(sh *cacheShard) []cacheKey {
+	tr := trace.New("dnsserver.Cache", "GC")
+	defer tr.Finish()
+
+	var total, expired int
+	var toPrefetch []cacheKey
+	prefetch := c.prefetch.Load()
+	now := time.Now()
+
+	sh.mu.Lock()
+	total = len(sh.answer)
+	for q, e := range sh.answer {
+		remaining := e.expires.Sub(now)
+
+		// Prefetch the popular entries that would expire before the next
+		// GC, so they are never missing from the cache.
+		if prefetch && remaining <= maintenancePeriod && e.usage.popular(now) {
+			toPrefetch = append(toPrefetch, q)
+		}
+
+		if remaining <= 0 {
+			delete(sh.answer, q)
+			c.addBytes(-e.bytes)
+			expired++
+		}
+	}
+	sh.mu.Unlock()
+
+	c.addSize(-int64(expired))
+	tr.Printf("total: %d   expired: %d   to prefetch: %d",
+		total, expired, len(toPrefetch))
+	return toPrefetch
+}
+
+// popular returns true if the entry has been used enough, and recently
+// enough, to be worth prefetching.
+func (u *entryUsage) popular(now time.Time) bool {
+	return u.hits.Load() >= prefetchMinHits &&
+		now.Sub(time.Unix(0, u.lastHit.Load())) <= prefetchRecent
+}
+
+// prefetchEntries queries the backing resolver for the given entries, and
+// records the fresh answers in the cache.
+func (c *cachingResolver) prefetchEntries(keys []cacheKey) {
+	tr := trace.New("dnsserver.Cache", "Prefetch")
+	defer tr.Finish()
+
+	for _, key := range keys {
+		r := &dns.Msg{}
+		r.Id = newID()
+		r.RecursionDesired = true
+		r.Question = []dns.Question{key.Question}
+		if key.DO {
+			r.SetEdns0(dns.DefaultMsgSize, true)
+		}
+		if key.ECS != "" {
+			ecs := key.ecsOption()
+			if ecs == nil {
+				// Invalid subnet, we can't repeat the query.
 				continue
 			}
+			if r.IsEdns0() == nil {
+				r.SetEdns0(dns.DefaultMsgSize, false)
+			}
+			opt := r.IsEdns0()
+			opt.Option = append(opt.Option, ecs)
+		}
 
-			delete(c.answer, q)
-			expired++
+		tr.Question(r.Question)
+		reply, err := c.back.Query(r, tr)
+		if err != nil {
+			tr.Printf("prefetch failed: %v", err)
+			continue
+		}
+		if err = wantToCache(key.Question, reply); err != nil {
+			tr.Printf("prefetch not recording reply: %v", err)
+			continue
+		}
+		if c.record(key, reply, tr) {
+			stats.cachePrefetched.Add(1)
 		}
-		c.mu.Unlock()
-		tr.Printf("total: %d   expired: %d", total, expired)
-		tr.Finish()
 	}
 }
 
+var errMaintenance = fmt.Errorf("cache miss in maintenance mode")
+
 func wantToCache(question dns.Question, reply *dns.Msg) error {
 	if reply.Rcode != dns.RcodeSuccess {
 		return fmt.Errorf("unsuccessful query")
@@ -220,30 +849,27 @@ func wantToCache(question dns.Question, reply *dns.Msg) error {
 	return nil
 }
 
-func limitTTL(answer []dns.RR) time.Duration {
-	// This assumes all RRs have the same TTL.  That may not be the case in
-	// theory, but we are ok not caring for this for now.
-	ttl := time.Duration(answer[0].Header().Ttl) * time.Second
-
-	// This helps prevent cache pollution due to unused but long entries, as
-	// we don't do usage-based caching yet.
-	if ttl > maxTTL {
-		ttl = maxTTL
-	}
-
-	return ttl
-}
-
-func getTTL(answer []dns.RR) time.Duration {
-	// This assumes all RRs have the same TTL.  That may not be the case in
-	// theory, but we are ok not caring for this for now.
-	return time.Duration(answer[0].Header().Ttl) * time.Second
-}
-
-func setTTL(answer []dns.RR, newTTL time.Duration) {
+// limitTTL caps the TTL of each record to maxTTL, modifying them in place.
+// Returns the lowest TTL, which is how long the answer can be cached, and how
+// many records were capped.
+func limitTTL(answer []dns.RR) (time.Duration, int) {
+	// Capping helps prevent cache pollution due to unused but long entries,
+	// as we don't do usage-based caching yet.
+	limit := uint32(maxTTL / time.Second)
+	lowest := limit
+	capped := 0
 	for _, rr := range answer {
-		rr.Header().Ttl = uint32(newTTL.Seconds())
+		hdr := rr.Header()
+		if hdr.Ttl > limit {
+			hdr.Ttl = limit
+			capped++
+		}
+		if hdr.Ttl < lowest {
+			lowest = hdr.Ttl
+		}
 	}
+
+	return time.Duration(lowest) * time.Second, capped
 }
 
 func copyRRSlice(a []dns.RR) []dns.RR {
@@ -257,22 +883,31 @@ func copyRRSlice(a []dns.RR) []dns.RR {
 func (c *cachingResolver) Query(r *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
 	stats.cacheTotal.Add(1)
 
-	// To keep it simple we only cache single-question queries.
-	if len(r.Question) != 1 {
-		tr.Printf("cache bypass: multi-question query")
+	if reason := c.wantToBypass(r); reason != "" {
+		tr.Printf("cache bypass: %s", reason)
 		stats.cacheBypassed.Add(1)
 		return c.back.Query(r, tr)
 	}
 
 	question := r.Question[0]
+	key := newCacheKey(r)
 
-	c.mu.RLock()
-	answer, hit := c.answer[question]
-	c.mu.RUnlock()
+	now := time.Now()
+	entry, hit := c.lookup(key, now)
+	if !hit && c.followCNAMEs.Load() {
+		entry, hit = c.follow(key, now)
+		if hit {
+			tr.Printf("answer built from cached CNAMEs")
+		}
+	}
 
 	if hit {
 		tr.Printf("cache hit")
+		tr.SetPolicy("cache", "")
 		stats.cacheHits.Add(1)
+		stats.cacheHitsByType.Add(dns.Type(question.Qtype).String(), 1)
+		entry.usage.hits.Add(1)
+		entry.usage.lastHit.Store(now.UnixNano())
 
 		reply := &dns.Msg{
 			MsgHdr: dns.MsgHdr{
@@ -280,9 +915,28 @@ func (c *cachingResolver) Query(r *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
 				Response:      true,
 				Authoritative: false,
 				Rcode:         dns.RcodeSuccess,
+
+				// The AD bit is only set if the client asked for it, either
+				// with the AD or the DO bit (RFC 6840 section 5.8).
+				AuthenticatedData: entry.authenticated &&
+					(r.AuthenticatedData || key.DO),
+				CheckingDisabled: r.CheckingDisabled,
 			},
 			Question: r.Question,
-			Answer:   answer,
+			Answer:   entry.answerAt(now),
+			Ns:       entry.sectionAt(entry.ns, now),
+			Extra:    entry.sectionAt(entry.extra, now),
+		}
+		if opt := r.IsEdns0(); opt != nil {
+			reply.SetEdns0(dns.DefaultMsgSize, key.DO)
+
+			// Answers are only shared within the same subnet, so that's
+			// the scope (RFC 7871 section 7.2.1).
+			if ecs := key.ecsOption(); ecs != nil {
+				ecs.SourceScope = ecs.SourceNetmask
+				ropt := reply.IsEdns0()
+				ropt.Option = append(ropt.Option, ecs)
+			}
 		}
 
 		return reply, nil
@@ -290,37 +944,339 @@ func (c *cachingResolver) Query(r *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
 
 	tr.Printf("cache miss")
 	stats.cacheMisses.Add(1)
+	stats.cacheMissesByType.Add(dns.Type(question.Qtype).String(), 1)
+
+	if c.maintenance.Load() {
+		tr.SetPolicy("cache", "maintenance")
+		return nil, errMaintenance
+	}
 
-	reply, err := c.back.Query(r, tr)
+	reply, shared, err := c.queryBack(key, r, tr)
 	if err != nil {
 		return reply, err
 	}
+	if shared {
+		// Shared replies are recorded by the query that got them.
+		setOPT(r, key, reply)
+		return reply, nil
+	}
 
 	if err = wantToCache(question, reply); err != nil {
 		tr.Printf("cache not recording reply: %v", err)
-		return reply, nil
+	} else {
+		c.record(key, reply, tr)
+	}
+	setOPT(r, key, reply)
+	return reply, nil
+}
+
+// setOPT makes the OPT record of a reply from the backing resolver match the
+// query, like in the replies built from the cache: it is only included if
+// the query had one, with our own UDP size and the query's DO bit. The
+// upstream's options (like the Extended DNS Errors) are kept.
+func setOPT(r *dns.Msg, key cacheKey, reply *dns.Msg) {
+	if reply == nil {
+		return
+	}
+	var options []dns.EDNS0
+	if opt := reply.IsEdns0(); opt != nil {
+		options = opt.Option
+	}
+
+	// A new slice, as the cache could be sharing the old one.
+	reply.Extra = removeOPT(reply.Extra)
+	if r.IsEdns0() == nil {
+		return
+	}
+	reply.SetEdns0(dns.DefaultMsgSize, key.DO)
+	reply.IsEdns0().Option = options
+}
+
+// lookup the entry for the given key. Expired entries are only returned in
+// maintenance mode; otherwise, they are a miss, and will be replaced (or
+// removed by the GC).
+func (c *cachingResolver) lookup(key cacheKey, now time.Time) (cacheEntry, bool) {
+	sh := c.shard(key)
+	sh.mu.RLock()
+	entry, hit := sh.answer[key]
+	sh.mu.RUnlock()
+
+	if hit && now.After(entry.expires) && !c.maintenance.Load() {
+		return cacheEntry{}, false
+	}
+	return entry, hit
+}
+
+// Maximum length of the CNAME chains we cache and follow.
+const maxCNAMEChain = 8
+
+// follow the cached CNAMEs for the key's name, until we find a cached answer
+// for the target. Returns a new entry (which is not stored) with the whole
+// chain.
+func (c *cachingResolver) follow(key cacheKey, now time.Time) (cacheEntry, bool) {
+	if key.Qtype == dns.TypeCNAME {
+		return cacheEntry{}, false
+	}
+
+	// The entries we combine were stored at different times, so we use the
+	// already decreased TTLs, as if the new entry was stored now.
+	result := cacheEntry{stored: now, authenticated: true, usage: &entryUsage{}}
+	add := func(e cacheEntry) {
+		result.answer = append(result.answer, e.answerAt(now)...)
+		result.authenticated = result.authenticated && e.authenticated
+		if result.expires.IsZero() || e.expires.Before(result.expires) {
+			result.expires = e.expires
+		}
+	}
+
+	name := key.Name
+	for i := 0; i < maxCNAMEChain; i++ {
+		ck := key
+		ck.Name, ck.Qtype = name, dns.TypeCNAME
+		ce, ok := c.lookup(ck, now)
+		if !ok {
+			return cacheEntry{}, false
+		}
+		target := cnameTarget(ce.answer, name)
+		if target == "" {
+			return cacheEntry{}, false
+		}
+		add(ce)
+
+		tk := key
+		tk.Name = target
+		if te, ok := c.lookup(tk, now); ok {
+			add(te)
+			result.ns = te.sectionAt(te.ns, now)
+			result.extra = te.sectionAt(te.extra, now)
+			return result, true
+		}
+		name = target
+	}
+
+	return cacheEntry{}, false
+}
+
+// cnameTarget returns the target of the CNAME record for the given name in
+// the answer, or "" if there is none.
+func cnameTarget(answer []dns.RR, name string) string {
+	for _, rr := range answer {
+		if cname, ok := rr.(*dns.CNAME); ok &&
+			strings.EqualFold(cname.Hdr.Name, name) {
+			return cname.Target
+		}
+	}
+	return ""
+}
+
+// chainEntries splits an answer with a CNAME chain into entries for each
+// name along it: their CNAME record, and the rest of the chain from them on
+// (for the original query type). That way, queries for those names can be
+// answered from the cache too.
+func chainEntries(key cacheKey, answer []dns.RR) map[cacheKey][]dns.RR {
+	if key.Qtype == dns.TypeCNAME {
+		return nil
+	}
+
+	names := []string{key.Name}
+	seen := map[string]bool{strings.ToLower(key.Name): true}
+	for len(names) <= maxCNAMEChain {
+		target := cnameTarget(answer, names[len(names)-1])
+		if target == "" || seen[strings.ToLower(target)] {
+			break
+		}
+		seen[strings.ToLower(target)] = true
+		names = append(names, target)
+	}
+
+	entries := map[cacheKey][]dns.RR{}
+	for i := 0; i < len(names)-1; i++ {
+		ck := key
+		ck.Name, ck.Qtype = names[i], dns.TypeCNAME
+		entries[ck] = ownedBy(answer, names[i:i+1], dns.TypeCNAME)
+
+		tk := key
+		tk.Name = names[i+1]
+		if rest := ownedBy(answer, names[i+1:], 0); len(rest) > 0 {
+			entries[tk] = rest
+		}
+	}
+	return entries
+}
+
+// ownedBy returns the records in the answer owned by any of the given names,
+// of the given type (and their signatures), or of any type if it's 0.
+func ownedBy(answer []dns.RR, names []string, rrtype uint16) []dns.RR {
+	rrs := []dns.RR{}
+	for _, rr := range answer {
+		hdr := rr.Header()
+		t := hdr.Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			t = sig.TypeCovered
+		}
+		if rrtype != 0 && t != rrtype {
+			continue
+		}
+		for _, n := range names {
+			if strings.EqualFold(hdr.Name, n) {
+				rrs = append(rrs, rr)
+				break
+			}
+		}
+	}
+	return rrs
+}
+
+// queryBack sends the query to the backing resolver, unless there is one for
+// the same entry already in flight; in that case, it waits for it and
+// returns a copy of its reply, with shared set to true.
+func (c *cachingResolver) queryBack(key cacheKey, r *dns.Msg, tr *trace.Trace) (reply *dns.Msg, shared bool, err error) {
+	c.inflightMu.Lock()
+	if q, ok := c.inflight[key]; ok {
+		c.inflightMu.Unlock()
+		tr.Printf("waiting for in-flight query")
+		stats.cacheCoalesced.Add(1)
+
+		// Don't wait past our own deadline, even if the query we're
+		// waiting for has a later one.
+		ctx, cancel := tr.Context(context.Background())
+		defer cancel()
+		select {
+		case <-q.done:
+		case <-ctx.Done():
+			tr.Printf("timed out waiting for in-flight query")
+			return nil, true, ctx.Err()
+		}
+
+		tr.SetPolicy("cache", "coalesced")
+		if q.reply != nil {
+			reply = q.reply.Copy()
+			reply.Id = r.Id
+		}
+		return reply, true, q.err
 	}
 
-	answer = reply.Answer
-	ttl := limitTTL(answer)
+	q := &inflightQuery{done: make(chan struct{})}
+	c.inflight[key] = q
+	c.inflightMu.Unlock()
+
+	reply, err = c.back.Query(r, tr)
+
+	// The waiters get their own copy, as the reply is returned to our
+	// client, and the layers above could modify it.
+	if reply != nil {
+		q.reply = reply.Copy()
+	}
+	q.err = err
 
+	c.inflightMu.Lock()
+	delete(c.inflight, key)
+	c.inflightMu.Unlock()
+	close(q.done)
+
+	return reply, false, err
+}
+
+// record the reply in the cache, if its TTL is long enough and there is
+// space. Returns true if it was recorded.
+func (c *cachingResolver) record(key cacheKey, reply *dns.Msg, tr *trace.Trace) bool {
+	entry := cacheEntry{
+		answer:        reply.Answer,
+		ns:            reply.Ns,
+		extra:         sanitizeExtra(reply.Extra),
+		authenticated: reply.AuthenticatedData,
+	}
+
+	// The entry expires when any of its records do, so we consider all the
+	// sections together.
+	all := make([]dns.RR, 0,
+		len(entry.answer)+len(entry.ns)+len(entry.extra))
+	all = append(all, entry.answer...)
+	all = append(all, entry.ns...)
+	all = append(all, entry.extra...)
+	ttl, capped := limitTTL(all)
+	if capped > 0 {
+		answerModified(tr, key.Question, modTTLClamped,
+			"%d record(s) capped to %v", capped, maxTTL)
+	}
+
+	recorded := c.store(key, entry, ttl)
+
+	// Also store the entries for the names along the CNAME chain, if any.
+	// Their TTLs were already capped above.
+	for k, a := range chainEntries(key, entry.answer) {
+		lowest, _ := limitTTL(a)
+		c.store(k, cacheEntry{
+			answer:        a,
+			authenticated: entry.authenticated,
+		}, lowest)
+	}
+
+	return recorded
+}
+
+// sanitizeExtra returns the records of the additional section that can be
+// cached: the OPT and the transaction signatures only apply to the reply
+// they came in, and the OPT is built again for each reply from the cache.
+func sanitizeExtra(extra []dns.RR) []dns.RR {
+	rrs := []dns.RR{}
+	for _, rr := range extra {
+		switch rr.Header().Rrtype {
+		case dns.TypeOPT, dns.TypeTSIG, dns.TypeSIG:
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// store the entry's sections in the cache, with the given TTL, if it's long
+// enough and there is space. Returns true if it was stored.
+func (c *cachingResolver) store(key cacheKey, e cacheEntry, ttl time.Duration) bool {
 	// Only store answers if they're going to stay around for a bit,
 	// there's not much point in caching things we have to expire quickly.
 	if ttl < minTTL {
-		return reply, nil
+		return false
 	}
 
-	// Store the answer in the cache, but don't exceed 2k entries.
-	// TODO: Do usage based eviction when we're approaching ~1.5k.
-	c.mu.Lock()
-	if len(c.answer) < maxCacheSize {
-		setTTL(answer, ttl)
-		c.answer[question] = answer
-		stats.cacheRecorded.Add(1)
+	// Store the answer in the cache, but don't exceed the maximum number of
+	// entries, nor the memory limit.
+	// TODO: Do usage based eviction when we're approaching them.
+	size := entrySize(key, e.answer, e.ns, e.extra)
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	prev, replace := sh.answer[key]
+	if !replace && c.addSize(1) > int64(maxCacheSize) {
+		// Cache is full, give back the slot we tried to take.
+		c.addSize(-1)
+		return false
+	}
+	if c.addBytes(size-prev.bytes) > maxCacheBytes && maxCacheBytes > 0 {
+		// Not enough memory left, give it back. If we were replacing the
+		// entry, we keep the previous one.
+		c.addBytes(prev.bytes - size)
+		if !replace {
+			c.addSize(-1)
+		}
+		return false
 	}
-	c.mu.Unlock()
 
-	return reply, nil
+	// Keep our own copy, as the reply is returned to the client, and the
+	// layers above could modify it.
+	now := time.Now()
+	sh.answer[key] = cacheEntry{
+		answer:        copyRRSlice(e.answer),
+		ns:            copyRRSlice(e.ns),
+		extra:         copyRRSlice(e.extra),
+		stored:        now,
+		expires:       now.Add(ttl),
+		authenticated: e.authenticated,
+		usage:         &entryUsage{},
+		bytes:         size,
+	}
+	stats.cacheRecorded.Add(1)
+	return true
 }
 
 // Compile-time check that the implementation matches the interface.
@@ -3,51 +3,205 @@
 package dnsserver
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
+	"expvar"
 	"fmt"
+	mrand "math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"blitiri.com.ar/go/dnss/internal/budget"
+	"blitiri.com.ar/go/dnss/internal/dnsclient"
+	"blitiri.com.ar/go/dnss/internal/loop"
 	"blitiri.com.ar/go/dnss/internal/trace"
+	"blitiri.com.ar/go/dnss/internal/upgrade"
 
 	"blitiri.com.ar/go/log"
 	"blitiri.com.ar/go/systemd"
 	"github.com/miekg/dns"
 )
 
-// newID is a channel used to generate new request IDs.
-// There is a goroutine created at init() time that will get IDs randomly, to
-// help prevent guesses.
-var newID chan uint16
+// Sources of random request IDs. They are seeded from crypto/rand, but
+// generating the IDs doesn't need it, so queries never wait on the system's
+// entropy. math/rand sources are not safe for concurrent use, so we keep a
+// pool of them.
+var idSources = sync.Pool{
+	New: func() interface{} {
+		var seed int64
+		err := binary.Read(rand.Reader, binary.LittleEndian, &seed)
+		if err != nil {
+			panic(fmt.Sprintf("error seeding id source: %v", err))
+		}
+		return mrand.New(mrand.NewSource(seed))
+	},
+}
 
-func init() {
-	// Buffer 100 numbers to avoid blocking on crypto rand.
-	newID = make(chan uint16, 100)
+// IDs that take longer than this to generate are counted as slow.
+const slowIDGeneration = 1 * time.Millisecond
 
-	go func() {
-		var id uint16
-		var err error
+// Exported variables for statistics of the request ID generation.
+var idStats = struct {
+	// Maximum time it took to generate an ID, in microseconds.
+	maxLatency atomic.Int64
 
-		for {
-			err = binary.Read(rand.Reader, binary.LittleEndian, &id)
-			if err != nil {
-				panic(fmt.Sprintf("error creating id: %v", err))
-			}
+	// IDs that took more than slowIDGeneration.
+	slow *expvar.Int
+}{}
+
+func init() {
+	expvar.Publish("id-generation-max-latency-us", expvar.Func(
+		func() interface{} { return idStats.maxLatency.Load() }))
+	idStats.slow = expvar.NewInt("id-generation-slow")
+}
 
-			newID <- id
+// newID returns a new random request ID.
+func newID() uint16 {
+	start := time.Now()
+	src := idSources.Get().(*mrand.Rand)
+	id := uint16(src.Uint32())
+	idSources.Put(src)
+
+	latency := time.Since(start)
+	if latency > slowIDGeneration {
+		idStats.slow.Add(1)
+	}
+	us := latency.Microseconds()
+	for prev := idStats.maxLatency.Load(); us > prev; prev = idStats.maxLatency.Load() {
+		if idStats.maxLatency.CompareAndSwap(prev, us) {
+			break
 		}
+	}
+	return id
+}
 
-	}()
+// Exported variables for statistics of the server.
+var serverStats = struct {
+	// Queries we dropped because there were too many in flight.
+	shed *expvar.Int
+
+	// Queries we failed because they took longer than QueryTimeout.
+	timedOut *expvar.Int
+}{}
+
+func init() {
+	serverStats.shed = expvar.NewInt("queries-shed")
+	serverStats.timedOut = expvar.NewInt("queries-timed-out")
 }
 
+// How long a query can wait for an in-flight slot before it is shed, if
+// Server.InflightWait is not set.
+const defaultInflightWait = 1 * time.Second
+
 // Server implements a DNS proxy, which will (mostly) use the given resolver
 // to resolve queries.
 type Server struct {
-	Addr            string
-	unqUpstream     string
+	Addr        string
+	unqUpstream string
+	resolver    Resolver
+
+	// Protects serverOverrides and OverrideResolvers, which can be
+	// replaced while serving (see SetOverrides).
+	overridesMu     sync.RWMutex
 	serverOverrides DomainMap
-	resolver        Resolver
+
+	// Maximum number of queries to resolve concurrently (0 means no limit).
+	MaxInflight int
+
+	// How long a query can wait for a slot when MaxInflight is reached,
+	// before it is shed with a SERVFAIL. 0 means the default (1s), and a
+	// negative value means they are shed right away, without waiting.
+	InflightWait time.Duration
+
+	// How long we have to answer each query, end to end (0 means no
+	// limit). Once it passes, the work on it is canceled, and the client
+	// gets a SERVFAIL. It is passed down to the resolvers as the trace's
+	// deadline.
+	QueryTimeout time.Duration
+
+	// Clients whose queries are served first when MaxInflight is reached.
+	HighPriority NetList
+
+	// Maximum number of concurrent TCP connections per listener (0 means
+	// no limit). When reached, the least recently used one is closed.
+	MaxTCPConns int
+
+	// How long to keep a TCP connection open while waiting for the next
+	// query on it (0 means the default, 8s). Once it passes, we close it.
+	TCPIdleTimeout time.Duration
+
+	// Address to listen on if Addr is "systemd" but we were not given any
+	// sockets. If empty, not having sockets is a fatal error.
+	SystemdFallbackAddr string
+
+	// Resolvers for the overrides that are not plain DNS servers (like DoH
+	// or DoT ones), by their value in the overrides map. This package
+	// doesn't know how to talk to them, so they are built by the caller.
+	// Overrides without a resolver here are sent as plain DNS queries.
+	// To change them while serving, use SetOverrides.
+	OverrideResolvers map[string]Resolver
+
+	// Clients for the plain DNS servers we forward some queries to (the
+	// overrides and the unqualified upstream), see clientFor.
+	clientsMu sync.Mutex
+	clients   map[string]*dnsclient.Client
+
+	// Views, to use a different configuration for some clients. The first
+	// one that applies to the client is used. To change them while serving,
+	// use SetViews.
+	Views   []*View
+	viewsMu sync.RWMutex
+
+	// Network interface to bind the sockets to, so we only get the queries
+	// that arrive through it (only supported on Linux). It does not apply
+	// to the sockets given by systemd, or by a previous process.
+	Interface string
+
+	// Number of UDP sockets to listen on, all on the same address (with
+	// SO_REUSEPORT), so the kernel spreads the queries among them and they
+	// are served in parallel (only supported on Linux). 0 or 1 means a
+	// single socket.
+	UDPSockets int
+
+	// Sizes of the UDP sockets' read and write buffers, in bytes (0 means
+	// the system's default). Bigger buffers help absorb bursts of queries.
+	// The kernel may cap them (see net.core.rmem_max and wmem_max on
+	// Linux).
+	UDPReadBuffer  int
+	UDPWriteBuffer int
+
+	// Number of workers to serve each UDP socket with (0 means none, and a
+	// goroutine is started per query instead). The workers reuse their
+	// buffers across queries, and bound how many queries are handled at
+	// the same time.
+	UDPWorkers int
+
+	// Log of the queries, and how they were answered. Can be nil.
+	QueryLog *QueryLog
+
+	// Stream of the queries, for real-time troubleshooting. Can be nil.
+	QueryStream *QueryStream
+
+	// Notified of every query, with the reply and how long it took.
+	Observers []Observer
+
+	// Called once the server is ready to serve queries. Can be nil.
+	NotifyStarted func()
+
+	limiter *limiter
+
+	// Tracks the queries we answered successfully, for alerting.
+	budget *budget.Tracker
+
+	// Servers for each of our sockets, so we can shut them down.
+	mu         sync.Mutex
+	servers    []*dns.Server
+	udpServers []*udpServer
+	shutdown   atomic.Bool
 }
 
 // New *Server, which will listen on addr, use resolver as the backend
@@ -63,31 +217,114 @@ func New(addr string, resolver Resolver, unqUpstream string, serverOverrides Dom
 
 // Handler for the incoming DNS queries.
 func (s *Server) Handler(w dns.ResponseWriter, r *dns.Msg) {
-	tr := trace.New("dnsserver.Handler",
+	tr := trace.NewSampled("dnsserver.Handler",
 		w.RemoteAddr().Network()+" "+w.RemoteAddr().String())
 	defer tr.Finish()
 
 	tr.Printf("id:%v", r.Id)
 	tr.Question(r.Question)
 
+	start := time.Now()
+	if s.QueryTimeout > 0 {
+		tr.SetDeadline(start.Add(s.QueryTimeout))
+	}
+	ctx, cancel := tr.Context(context.Background())
+	defer cancel()
+
+	result := "dropped"
+	defer func() {
+		s.QueryLog.Log(tr, w.RemoteAddr(), r, result, start)
+		s.QueryStream.Publish(tr, r, result, start)
+	}()
+
 	// We only support single-question queries.
 	if len(r.Question) != 1 {
 		tr.Printf("len(Q) != 1, failing")
 		dns.HandleFailed(w, r)
+		result = "SERVFAIL"
+		return
+	}
+
+	if loop.Detected(r) {
+		tr.Printf("forwarding loop detected, failing")
+		tr.SetPolicy("loop", "")
+		result = s.handleFailed(w, r, dns.ExtendedErrorCodeOther,
+			"forwarding loop detected")
+		return
+	}
+
+	if len(s.Observers) > 0 {
+		rw := &recordingWriter{ResponseWriter: w}
+		w = rw
+		defer func() {
+			elapsed := time.Since(start)
+			for _, o := range s.Observers {
+				o.Observe(r.Question[0], rw.reply, elapsed)
+			}
+		}()
+	}
+
+	client := addrIP(w.RemoteAddr())
+	tr.SetClient(client)
+
+	resolver := s.resolver
+	view := s.viewFor(client)
+	if view != nil {
+		tr.Printf("view: %q", view.Name)
+		if view.Resolver != nil {
+			resolver = view.Resolver
+		}
+	}
+
+	prio := prioNormal
+	if s.HighPriority.Contains(client) {
+		prio = prioHigh
+	}
+	wait := s.InflightWait
+	if wait == 0 {
+		wait = defaultInflightWait
+	} else if wait < 0 {
+		wait = 0
+	}
+	if s.QueryTimeout > 0 && s.QueryTimeout < wait {
+		wait = s.QueryTimeout
+	}
+	if !s.limiter.acquire(prio, wait) {
+		tr.Printf("too many queries in flight, shedding")
+		serverStats.shed.Add(1)
+		tr.SetPolicy("limiter", "shed")
+		result = s.handleFailed(w, r, dns.ExtendedErrorCodeOther,
+			"too many queries in flight")
 		return
 	}
+	defer s.limiter.release()
 
 	// If the domain has a server override, forward to it instead.
-	override, ok := s.serverOverrides.GetMostSpecific(r.Question[0].Name)
+	s.overridesMu.RLock()
+	overrides, resolvers := s.serverOverrides, s.OverrideResolvers
+	s.overridesMu.RUnlock()
+	if view != nil && view.Overrides != nil {
+		overrides, resolvers = view.Overrides, view.OverrideResolvers
+	}
+	override, ok := overrides.Route(r.Question[0].Name, r.Question[0].Qtype)
+	res, hasRes := resolvers[override]
 	if ok {
 		tr.Printf("override found: %q", override)
-		u, err := dns.Exchange(r, override)
+		tr.SetPolicy("override", override)
+		var u *dns.Msg
+		var err error
+		if hasRes {
+			u, err = s.queryOverride(res, r, tr)
+		} else {
+			u, err = s.clientFor(override).Exchange(ctx, tr, loop.Tag(r))
+			loop.Untag(r, u)
+		}
 		if err == nil {
 			tr.Answer(u)
-			s.writeReply(tr, w, r, u)
+			result = s.writeReply(tr, w, r, u)
 		} else {
 			tr.Printf("override server returned error: %v", err)
-			dns.HandleFailed(w, r)
+			result = s.handleFailed(w, r, errorEDE(err), err.Error())
 		}
 
 		return
@@ -100,14 +337,16 @@ func (s *Server) Handler(w dns.ResponseWriter, r *dns.Msg) {
 	useUnqUpstream := s.unqUpstream != "" &&
 		dns.CountLabel(r.Question[0].Name) <= 1
 	if useUnqUpstream {
-		u, err := dns.Exchange(r, s.unqUpstream)
+		tr.SetPolicy("unqualified", s.unqUpstream)
+		u, err := s.clientFor(s.unqUpstream).Exchange(ctx, tr, loop.Tag(r))
 		if err == nil {
+			loop.Untag(r, u)
 			tr.Printf("used unqualified upstream")
 			tr.Answer(u)
-			s.writeReply(tr, w, r, u)
+			result = s.writeReply(tr, w, r, u)
 		} else {
 			tr.Printf("unqualified upstream error: %v", err)
-			dns.HandleFailed(w, r)
+			result = s.handleFailed(w, r, errorEDE(err), err.Error())
 		}
 
 		return
@@ -116,25 +355,47 @@ func (s *Server) Handler(w dns.ResponseWriter, r *dns.Msg) {
 	// Create our own IDs, in case different users pick the same id and we
 	// pass that upstream.
 	oldid := r.Id
-	r.Id = <-newID
+	r.Id = newID()
 
-	fromUp, err := s.resolver.Query(r, tr)
+	fromUp, err := resolver.Query(r, tr)
+	if errors.Is(err, ErrDropQuery) {
+		tr.Printf("dropping query")
+		return
+	}
 	if err != nil {
 		log.Infof("resolver query error: %v", err)
 		tr.Error(err)
 
 		r.Id = oldid
-		dns.HandleFailed(w, r)
+		text := err.Error()
+		if d := tr.Deadline(); !d.IsZero() && !time.Now().Before(d) {
+			serverStats.timedOut.Add(1)
+			text = "query timed out"
+		}
+		result = s.handleFailed(w, r, errorEDE(err), text)
 		return
 	}
 
 	tr.Answer(fromUp)
 
 	fromUp.Id = oldid
-	s.writeReply(tr, w, r, fromUp)
+	result = s.writeReply(tr, w, r, fromUp)
+}
+
+// handleFailed replies with SERVFAIL, including an Extended DNS Error with
+// the given code and text, and counts it as a failure. Returns the result,
+// for logging.
+func (s *Server) handleFailed(w dns.ResponseWriter, r *dns.Msg, code uint16, text string) string {
+	s.budget.Record(false)
+	w.WriteMsg(failWithEDE(r, code, text))
+	return "SERVFAIL"
 }
 
-func (s *Server) writeReply(tr *trace.Trace, w dns.ResponseWriter, r, reply *dns.Msg) {
+// writeReply writes the reply back to the client, truncating it if needed.
+// Returns the result (the reply's rcode), for logging.
+func (s *Server) writeReply(tr *trace.Trace, w dns.ResponseWriter, r, reply *dns.Msg) string {
+	s.budget.Record(reply.Rcode != dns.RcodeServerFailure)
+
 	if w.RemoteAddr().Network() == "udp" {
 		// We need to check if the response fits.
 		// UDP by default has a maximum of 512 bytes. This can be extended via
@@ -144,15 +405,57 @@ func (s *Server) writeReply(tr *trace.Trace, w dns.ResponseWriter, r, reply *dns
 		if ednsOPT != nil {
 			max = int(ednsOPT.UDPSize())
 		}
-		reply.Truncate(max)
+		wasTruncated := reply.Truncated
+		reply = fitReply(reply, max)
 		tr.Printf("UDP max:%d truncated:%v", max, reply.Truncated)
+		if reply.Truncated && !wasTruncated && len(r.Question) > 0 {
+			answerModified(tr, r.Question[0], modTruncated,
+				"does not fit in %d bytes", max)
+		}
 	}
 
 	w.WriteMsg(reply)
+	return dns.RcodeToString[reply.Rcode]
+}
+
+// SetOverrides replaces the server overrides, and the resolvers for them
+// (see OverrideResolvers), while serving. The resolvers must be initialized
+// already.
+func (s *Server) SetOverrides(overrides DomainMap, resolvers map[string]Resolver) {
+	s.overridesMu.Lock()
+	defer s.overridesMu.Unlock()
+	s.serverOverrides = overrides
+	s.OverrideResolvers = resolvers
+}
+
+// SetViews replaces the views (see Views) while serving. Their resolvers
+// must be initialized already.
+func (s *Server) SetViews(views []*View) {
+	s.viewsMu.Lock()
+	defer s.viewsMu.Unlock()
+	s.Views = views
+}
+
+// queryOverride sends the query to the resolver of an override, with our
+// own ID, like we do for the main resolver.
+func (s *Server) queryOverride(res Resolver, r *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
+	oldid := r.Id
+	r.Id = newID()
+	defer func() { r.Id = oldid }()
+
+	u, err := res.Query(r, tr)
+	if err != nil {
+		return nil, err
+	}
+	u.Id = oldid
+	return u, nil
 }
 
 // ListenAndServe launches the DNS proxy.
 func (s *Server) ListenAndServe() {
+	s.limiter = newLimiter(s.MaxInflight)
+	s.budget = budget.Get("listener dns " + s.Addr)
+
 	err := s.resolver.Init()
 	if err != nil {
 		log.Fatalf("Error initializing: %v", err)
@@ -160,37 +463,91 @@ func (s *Server) ListenAndServe() {
 
 	go s.resolver.Maintain()
 
-	if s.Addr == "systemd" {
+	for name, res := range s.OverrideResolvers {
+		if err := res.Init(); err != nil {
+			log.Fatalf("Error initializing resolver for %q: %v", name, err)
+		}
+		go res.Maintain()
+	}
+
+	s.viewsMu.RLock()
+	views := s.Views
+	s.viewsMu.RUnlock()
+	for _, v := range views {
+		if v.Resolver != nil {
+			if err := v.Resolver.Init(); err != nil {
+				log.Fatalf("Error initializing view %q: %v", v.Name, err)
+			}
+			go v.Resolver.Maintain()
+		}
+		for name, res := range v.OverrideResolvers {
+			if err := res.Init(); err != nil {
+				log.Fatalf("Error initializing resolver for %q (view %q): %v",
+					name, v.Name, err)
+			}
+			go res.Maintain()
+		}
+	}
+
+	// If we were started by an upgrade, use the sockets of the previous
+	// process, regardless of the address.
+	pconns, listeners := upgrade.Inherited("dns")
+	if len(pconns) > 0 || len(listeners) > 0 {
+		log.Infof("DNS using the sockets of the previous process")
+		s.serve(pconns, listeners)
+	} else if s.Addr == "systemd" {
 		s.systemdServe()
 	} else {
-		s.classicServe()
+		s.classicServe(s.Addr)
 	}
 }
 
-func (s *Server) classicServe() {
-	log.Infof("DNS listening on %s", s.Addr)
-
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		err := dns.ListenAndServe(s.Addr, "udp", dns.HandlerFunc(s.Handler))
-		log.Fatalf("Exiting UDP: %v", err)
-	}()
+func (s *Server) classicServe(addr string) {
+	if s.Interface != "" {
+		log.Infof("DNS listening on %s (interface %s)", addr, s.Interface)
+	} else {
+		log.Infof("DNS listening on %s", addr)
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		err := dns.ListenAndServe(s.Addr, "tcp", dns.HandlerFunc(s.Handler))
+	ctx := context.Background()
+	lc := net.ListenConfig{}
+	if s.Interface != "" {
+		lc.Control = socketControl(s.Interface, false)
+	}
+	lis, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
 		log.Fatalf("Exiting TCP: %v", err)
-	}()
+	}
 
-	wg.Wait()
+	udpLC := net.ListenConfig{}
+	if s.Interface != "" || s.UDPSockets > 1 {
+		udpLC.Control = socketControl(s.Interface, s.UDPSockets > 1)
+	}
+	pconns := []net.PacketConn{}
+	for i := 0; i < max(s.UDPSockets, 1); i++ {
+		pconn, err := udpLC.ListenPacket(ctx, "udp", addr)
+		if err != nil {
+			log.Fatalf("Exiting UDP: %v", err)
+		}
+		pconns = append(pconns, pconn)
+
+		// If the port was picked by the kernel, the other sockets must
+		// use the same one.
+		addr = pconn.LocalAddr().String()
+	}
+
+	s.serve(pconns, []net.Listener{lis})
 }
 
 func (s *Server) systemdServe() {
 	fsMap, err := systemd.Files()
 	if err != nil {
+		if s.SystemdFallbackAddr != "" {
+			log.Errorf("Error getting systemd listeners: %v", err)
+			log.Errorf("WARNING: falling back to %s", s.SystemdFallbackAddr)
+			s.classicServe(s.SystemdFallbackAddr)
+			return
+		}
 		log.Fatalf("Error getting systemd listeners: %v", err)
 	}
 
@@ -210,38 +567,143 @@ func (s *Server) systemdServe() {
 		}
 	}
 
+	if len(pconns) == 0 && len(listeners) == 0 && s.SystemdFallbackAddr != "" {
+		log.Errorf("No systemd sockets, did you forget the .socket?")
+		log.Errorf("WARNING: falling back to %s", s.SystemdFallbackAddr)
+		s.classicServe(s.SystemdFallbackAddr)
+		return
+	}
+
+	if len(pconns) == 0 && len(listeners) == 0 {
+		log.Fatalf("No systemd sockets, did you forget the .socket?")
+	}
+
+	s.serve(pconns, listeners)
+}
+
+// serve queries on the given sockets, until Shutdown is called.
+func (s *Server) serve(pconns []net.PacketConn, listeners []net.Listener) {
 	var wg sync.WaitGroup
+	var started sync.WaitGroup
+
+	// Hold the lock until all the servers have started, so Shutdown can't
+	// miss any of them.
+	s.mu.Lock()
+	if s.shutdown.Load() {
+		s.mu.Unlock()
+		return
+	}
 
 	for _, pconn := range pconns {
-		if pconn == nil {
-			continue
+		upgrade.Register("dns", pconn)
+		if uc, ok := pconn.(*net.UDPConn); ok {
+			s.setUDPBuffers(uc)
+			if s.UDPWorkers > 0 {
+				log.Infof("Activate on packet connection (UDP, %d workers): %v",
+					s.UDPWorkers, uc.LocalAddr())
+				u := newUDPServer(s, uc, s.UDPWorkers)
+				s.udpServers = append(s.udpServers, u)
+				u.serve()
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					u.wg.Wait()
+				}()
+				continue
+			}
+		}
+
+		srv := &dns.Server{
+			PacketConn:        pconn,
+			Handler:           dns.HandlerFunc(s.Handler),
+			NotifyStartedFunc: started.Done,
 		}
+		s.servers = append(s.servers, srv)
 
 		wg.Add(1)
-		go func(c net.PacketConn) {
+		started.Add(1)
+		go func() {
 			defer wg.Done()
-			log.Infof("Activate on packet connection (UDP): %v", c.LocalAddr())
-			err := dns.ActivateAndServe(nil, c, dns.HandlerFunc(s.Handler))
-			log.Fatalf("Exiting UDP listener: %v", err)
-		}(pconn)
+			log.Infof("Activate on packet connection (UDP): %v",
+				srv.PacketConn.LocalAddr())
+			err := srv.ActivateAndServe()
+			if !s.shutdown.Load() {
+				log.Fatalf("Exiting UDP listener: %v", err)
+			}
+		}()
 	}
 
 	for _, lis := range listeners {
-		if lis == nil {
-			continue
+		upgrade.Register("dns", lis)
+		if s.MaxTCPConns > 0 {
+			lis = newTCPLimitListener(lis, s.MaxTCPConns)
 		}
+		srv := &dns.Server{
+			Listener:          lis,
+			Handler:           dns.HandlerFunc(s.Handler),
+			NotifyStartedFunc: started.Done,
+		}
+		if s.TCPIdleTimeout > 0 {
+			idle := s.TCPIdleTimeout
+			srv.IdleTimeout = func() time.Duration { return idle }
+		}
+		s.servers = append(s.servers, srv)
 
 		wg.Add(1)
-		go func(l net.Listener) {
+		started.Add(1)
+		go func() {
 			defer wg.Done()
-			log.Infof("Activate on listening socket (TCP): %v", l.Addr())
-			err := dns.ActivateAndServe(l, nil, dns.HandlerFunc(s.Handler))
-			log.Fatalf("Exiting TCP listener: %v", err)
-		}(lis)
+			log.Infof("Activate on listening socket (TCP): %v",
+				srv.Listener.Addr())
+			err := srv.ActivateAndServe()
+			if !s.shutdown.Load() {
+				log.Fatalf("Exiting TCP listener: %v", err)
+			}
+		}()
+	}
+
+	started.Wait()
+	s.mu.Unlock()
+
+	if s.NotifyStarted != nil {
+		s.NotifyStarted()
 	}
 
 	wg.Wait()
+}
+
+// Shutdown stops serving, and waits (up to the given timeout) for the
+// queries in flight to be answered. ListenAndServe returns after this.
+func (s *Server) Shutdown(timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shutdown.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, srv := range s.servers {
+		if err := srv.ShutdownContext(ctx); err != nil {
+			log.Errorf("Error shutting down DNS server: %v", err)
+		}
+	}
+	for _, u := range s.udpServers {
+		if err := u.shutdown(ctx); err != nil {
+			log.Errorf("Error shutting down DNS server: %v", err)
+		}
+	}
+}
 
-	// We should only get here if there were no useful sockets.
-	log.Fatalf("No systemd sockets, did you forget the .socket?")
+// setUDPBuffers sets the sizes of the socket's buffers, if we were asked to.
+func (s *Server) setUDPBuffers(conn *net.UDPConn) {
+	if s.UDPReadBuffer > 0 {
+		if err := conn.SetReadBuffer(s.UDPReadBuffer); err != nil {
+			log.Errorf("Error setting UDP read buffer size: %v", err)
+		}
+	}
+	if s.UDPWriteBuffer > 0 {
+		if err := conn.SetWriteBuffer(s.UDPWriteBuffer); err != nil {
+			log.Errorf("Error setting UDP write buffer size: %v", err)
+		}
+	}
 }
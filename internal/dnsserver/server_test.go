@@ -1,12 +1,16 @@
 package dnsserver
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 
 	"blitiri.com.ar/go/dnss/internal/testutil"
+	"blitiri.com.ar/go/dnss/internal/trace"
 )
 
 // Tests for the DNS server.
@@ -62,6 +66,106 @@ func query(t *testing.T, srv, domain, expected string) {
 	}
 }
 
+func TestTruncatedOverride(t *testing.T) {
+	// Over UDP, the server always replies with a truncated answer; over
+	// TCP, with the full one.
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := &dns.Msg{}
+		m.SetReply(r)
+		if w.RemoteAddr().Network() == "udp" {
+			m.Truncated = true
+		} else {
+			m.Answer = append(m.Answer, testutil.NewRR(t, "tc.ov. A 5.5.5.5"))
+		}
+		w.WriteMsg(m)
+	}
+	addr := testutil.GetFreePort()
+	go testutil.ServeTestDNSServer(addr, handler)
+	tcpStarted := make(chan struct{})
+	go (&dns.Server{
+		Addr: addr, Net: "tcp", Handler: dns.HandlerFunc(handler),
+		NotifyStartedFunc: func() { close(tcpStarted) },
+	}).ListenAndServe()
+	testutil.WaitForDNSServer(addr)
+	<-tcpStarted
+
+	srv := New(testutil.GetFreePort(), testutil.NewTestResolver(), addr,
+		DomainMap{"ov.": addr})
+	go srv.ListenAndServe()
+	testutil.WaitForDNSServer(srv.Addr)
+
+	query(t, srv.Addr, "tc.ov.", "5.5.5.5")
+	query(t, srv.Addr, "unqualified.", "5.5.5.5")
+}
+
+func TestOverrideResolvers(t *testing.T) {
+	res := testutil.NewTestResolver()
+	res.Response = &dns.Msg{
+		Answer: []dns.RR{testutil.NewRR(t, "response.test. A 1.1.1.1")},
+	}
+	ovRes := testutil.NewTestResolver()
+	ovRes.Response = &dns.Msg{
+		Answer: []dns.RR{testutil.NewRR(t, "a.corp. A 6.6.6.6")},
+	}
+
+	doh := "https://doh.corp/dns-query"
+	srv := New(testutil.GetFreePort(), res, "", DomainMap{"corp.": doh})
+	srv.OverrideResolvers = map[string]Resolver{doh: ovRes}
+	go srv.ListenAndServe()
+	testutil.WaitForDNSServer(srv.Addr)
+
+	query(t, srv.Addr, "a.corp.", "6.6.6.6")
+	query(t, srv.Addr, "response.test.", "1.1.1.1")
+	if !ovRes.Initialized {
+		t.Errorf("override resolver was not initialized")
+	}
+}
+
+func TestViews(t *testing.T) {
+	res := testutil.NewTestResolver()
+	res.Response = &dns.Msg{
+		Answer: []dns.RR{testutil.NewRR(t, "response.test. A 1.1.1.1")},
+	}
+	viewRes := testutil.NewTestResolver()
+	viewRes.Response = &dns.Msg{
+		Answer: []dns.RR{testutil.NewRR(t, "response.test. A 7.7.7.7")},
+	}
+
+	ovAddr := testutil.GetFreePort()
+	go testutil.ServeTestDNSServer(ovAddr,
+		testutil.MakeStaticHandler(t, "a.ov. A 8.8.8.8"))
+	testutil.WaitForDNSServer(ovAddr)
+
+	other, _ := NetListFromString("10.0.0.0/8")
+	local, _ := NetListFromString("127.0.0.0/8, ::1/128")
+
+	serve := func(overrides DomainMap) *Server {
+		srv := New(testutil.GetFreePort(), res, "", DomainMap{"ov.": ovAddr})
+		srv.Views = []*View{
+			{Name: "other", Clients: other,
+				Resolver: testutil.NewTestResolver()},
+			{Name: "local", Clients: local, Resolver: viewRes,
+				Overrides: overrides},
+		}
+		go srv.ListenAndServe()
+		testutil.WaitForDNSServer(srv.Addr)
+		return srv
+	}
+
+	// The view's resolver is used, and the server's overrides still apply.
+	srv := serve(nil)
+	query(t, srv.Addr, "response.test.", "7.7.7.7")
+	query(t, srv.Addr, "a.ov.", "8.8.8.8")
+
+	// Once the views are replaced, the new ones apply.
+	srv.SetViews([]*View{{Name: "other", Clients: other}})
+	query(t, srv.Addr, "response.test.", "1.1.1.1")
+
+	// With its own overrides, the server's ones don't apply.
+	srv = serve(DomainMap{})
+	query(t, srv.Addr, "a.ov.", "7.7.7.7")
+}
+
 func TestBadUpstreams(t *testing.T) {
 	res := testutil.NewTestResolver()
 	res.RespError = fmt.Errorf("response error for testing")
@@ -94,3 +198,188 @@ func queryFailure(t *testing.T, srv, domain string) {
 		t.Errorf("query %q: expected SERVFAIL, got message: %v", domain, m)
 	}
 }
+
+// slowResolver never answers, it waits until the query's deadline.
+type slowResolver struct{}
+
+func (slowResolver) Init() error { return nil }
+func (slowResolver) Maintain()   {}
+func (slowResolver) Query(r *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
+	if tr.Deadline().IsZero() {
+		return nil, fmt.Errorf("no deadline")
+	}
+	ctx, cancel := tr.Context(context.Background())
+	defer cancel()
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestQueryTimeout(t *testing.T) {
+	// An unqualified upstream that never replies.
+	unq, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer unq.Close()
+
+	srv := New(testutil.GetFreePort(), slowResolver{}, unq.LocalAddr().String(), nil)
+	srv.QueryTimeout = 100 * time.Millisecond
+	go srv.ListenAndServe()
+	testutil.WaitForDNSServer(srv.Addr)
+
+	timedOut := serverStats.timedOut.Value()
+	for _, domain := range []string{"slow.test.", "unqualified."} {
+		start := time.Now()
+		queryFailure(t, srv.Addr, domain)
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%q: took too long to fail: %v", domain, d)
+		}
+	}
+	if d := serverStats.timedOut.Value() - timedOut; d != 1 {
+		t.Errorf("expected 1 query timed out, got %d", d)
+	}
+}
+
+func TestInflightShed(t *testing.T) {
+	srv := New(testutil.GetFreePort(), slowResolver{}, "", nil)
+	srv.QueryTimeout = 500 * time.Millisecond
+	srv.MaxInflight = 1
+	srv.InflightWait = -1
+	go srv.ListenAndServe()
+	testutil.WaitForDNSServer(srv.Addr)
+
+	// Take the only slot, so the next query gets shed right away.
+	done := make(chan struct{})
+	go func() {
+		queryFailure(t, srv.Addr, "slow.test.")
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	shed := serverStats.shed.Value()
+	start := time.Now()
+	queryFailure(t, srv.Addr, "shed.test.")
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Errorf("took too long to shed: %v", d)
+	}
+	if d := serverStats.shed.Value() - shed; d != 1 {
+		t.Errorf("expected 1 query shed, got %d", d)
+	}
+	<-done
+}
+
+func TestUDPWorkers(t *testing.T) {
+	res := testutil.NewTestResolver()
+	res.Response = &dns.Msg{
+		Answer: []dns.RR{testutil.NewRR(t, "response.test. A 1.1.1.1")},
+	}
+
+	srv := New(testutil.GetFreePort(), res, "", nil)
+	srv.UDPWorkers = 2
+	srv.UDPReadBuffer = 256 * 1024
+	srv.UDPWriteBuffer = 256 * 1024
+	done := make(chan struct{})
+	go func() {
+		srv.ListenAndServe()
+		close(done)
+	}()
+	testutil.WaitForDNSServer(srv.Addr)
+
+	// More queries than workers, so they get reused.
+	for i := 0; i < 5; i++ {
+		query(t, srv.Addr, "response.test.", "1.1.1.1")
+	}
+
+	// Queries that are not standard queries are not implemented.
+	m := &dns.Msg{}
+	m.SetQuestion("response.test.", dns.TypeA)
+	m.Opcode = dns.OpcodeStatus
+	reply, err := dns.Exchange(m, srv.Addr)
+	if err != nil || reply.Rcode != dns.RcodeNotImplemented {
+		t.Errorf("expected NOTIMP, got %v, %v", reply, err)
+	}
+
+	srv.Shutdown(time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("ListenAndServe did not return after Shutdown")
+	}
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	res := testutil.NewTestResolver()
+	res.Response = &dns.Msg{
+		Answer: []dns.RR{testutil.NewRR(t, "response.test. A 1.1.1.1")},
+	}
+
+	srv := New(testutil.GetFreePort(), res, "", nil)
+	srv.TCPIdleTimeout = 100 * time.Millisecond
+	go srv.ListenAndServe()
+	testutil.WaitForDNSServer(srv.Addr)
+
+	conn, err := dns.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	defer conn.Close()
+
+	m := &dns.Msg{}
+	m.SetQuestion("response.test.", dns.TypeA)
+	if err := conn.WriteMsg(m); err != nil {
+		t.Fatalf("error writing query: %v", err)
+	}
+	if _, err := conn.ReadMsg(); err != nil {
+		t.Fatalf("error reading reply: %v", err)
+	}
+
+	// Once idle for long enough, the server closes the connection.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	start := time.Now()
+	if _, err := conn.ReadMsg(); err == nil {
+		t.Errorf("read from idle connection succeeded")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("idle connection not closed after %v", d)
+	}
+}
+
+func TestSystemdFallback(t *testing.T) {
+	res := testutil.NewTestResolver()
+	res.Response = &dns.Msg{
+		Answer: []dns.RR{testutil.NewRR(t, "response.test. A 1.1.1.1")},
+	}
+
+	// No systemd sockets are passed to tests, so we should fall back.
+	srv := New("systemd", res, "", nil)
+	srv.SystemdFallbackAddr = testutil.GetFreePort()
+	go srv.ListenAndServe()
+	testutil.WaitForDNSServer(srv.SystemdFallbackAddr)
+
+	query(t, srv.SystemdFallbackAddr, "response.test.", "1.1.1.1")
+}
+
+func TestNewID(t *testing.T) {
+	// Generate IDs concurrently, they should be spread out and not repeat
+	// much.
+	const n = 1000
+	ids := make(chan uint16, n)
+	for i := 0; i < 10; i++ {
+		go func() {
+			for j := 0; j < n/10; j++ {
+				ids <- newID()
+			}
+		}()
+	}
+
+	seen := map[uint16]bool{}
+	for i := 0; i < n; i++ {
+		seen[<-ids] = true
+	}
+
+	// With 65536 possible IDs, 1000 random ones have ~8 collisions on
+	// average; more than 40 is practically impossible.
+	if len(seen) < n-40 {
+		t.Errorf("too many repeated IDs: %d unique out of %d", len(seen), n)
+	}
+}
@@ -0,0 +1,164 @@
+package dnsserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"blitiri.com.ar/go/log"
+	"github.com/miekg/dns"
+)
+
+// Snapshots of the cache, so it can be saved when we exit and loaded on the
+// next start, instead of starting cold (which means a burst of queries to
+// the upstream, and slower answers, right after every restart).
+//
+// The snapshot is a JSON file with the entries that have not expired yet,
+// with the records in text format, and how long they have left.
+
+type snapshotEntry struct {
+	Name   string
+	Qtype  uint16
+	Qclass uint16
+	DO     bool   `json:",omitempty"`
+	ECS    string `json:",omitempty"`
+	AD     bool   `json:",omitempty"`
+
+	// Seconds until the entry expires.
+	TTL int64
+
+	Answer []string `json:",omitempty"`
+	Ns     []string `json:",omitempty"`
+	Extra  []string `json:",omitempty"`
+}
+
+// SaveSnapshot writes the entries of the cache that have not expired yet to
+// the given file. The file is replaced atomically, so we never leave a
+// partial one behind.
+func (c *cachingResolver) SaveSnapshot(path string) error {
+	now := time.Now()
+	entries := []snapshotEntry{}
+	for _, sh := range c.shards {
+		sh.mu.RLock()
+		for key, e := range sh.answer {
+			if !now.Before(e.expires) {
+				continue
+			}
+			entries = append(entries, snapshotEntry{
+				Name:   key.Name,
+				Qtype:  key.Qtype,
+				Qclass: key.Qclass,
+				DO:     key.DO,
+				ECS:    key.ECS,
+				AD:     e.authenticated,
+				TTL:    int64(e.expires.Sub(now) / time.Second),
+				Answer: rrStrings(e.answerAt(now)),
+				Ns:     rrStrings(e.sectionAt(e.ns, now)),
+				Extra:  rrStrings(e.sectionAt(e.extra, now)),
+			})
+		}
+		sh.mu.RUnlock()
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	log.Infof("Cache snapshot saved to %q: %d entries", path, len(entries))
+	return nil
+}
+
+// LoadSnapshot adds the entries of the given snapshot file to the cache.
+// A missing file is not an error, as there may not be one yet (e.g. on the
+// first start). Entries that expired since, or are not valid, are skipped.
+func (c *cachingResolver) LoadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	entries := []snapshotEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("%q: %v", path, err)
+	}
+
+	// How long ago the snapshot was saved, as the TTLs are relative to it.
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	age := time.Since(st.ModTime())
+
+	n := 0
+	for _, se := range entries {
+		ttl := time.Duration(se.TTL)*time.Second - age
+		if ttl <= 0 {
+			continue
+		}
+
+		key := cacheKey{
+			Question: dns.Question{
+				Name: se.Name, Qtype: se.Qtype, Qclass: se.Qclass},
+			DO:  se.DO,
+			ECS: se.ECS,
+		}
+		e := cacheEntry{authenticated: se.AD}
+		var errs [3]error
+		e.answer, errs[0] = parseRRs(se.Answer, age)
+		e.ns, errs[1] = parseRRs(se.Ns, age)
+		e.extra, errs[2] = parseRRs(se.Extra, age)
+		if errs[0] != nil || errs[1] != nil || errs[2] != nil {
+			continue
+		}
+
+		if c.store(key, e, ttl) {
+			n++
+		}
+	}
+	log.Infof("Cache snapshot loaded from %q: %d entries", path, n)
+	return nil
+}
+
+func rrStrings(rrs []dns.RR) []string {
+	ss := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		ss = append(ss, rr.String())
+	}
+	return ss
+}
+
+// parseRRs parses the records from their text format, decreasing their TTLs
+// by the given age.
+func parseRRs(ss []string, age time.Duration) ([]dns.RR, error) {
+	if len(ss) == 0 {
+		return nil, nil
+	}
+	elapsed := uint32(age / time.Second)
+	rrs := make([]dns.RR, 0, len(ss))
+	for _, s := range ss {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, err
+		}
+		if rr == nil {
+			return nil, fmt.Errorf("empty record")
+		}
+		if hdr := rr.Header(); hdr.Ttl > elapsed {
+			hdr.Ttl -= elapsed
+		} else {
+			hdr.Ttl = 0
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
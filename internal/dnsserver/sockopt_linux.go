@@ -0,0 +1,35 @@
+package dnsserver
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketControl returns a function to use as net.ListenConfig.Control, which
+// binds the sockets to the given interface (with SO_BINDTODEVICE) if it's
+// not empty, and sets SO_REUSEPORT if requested, so several sockets can
+// listen on the same address, with the kernel spreading the load among
+// them.
+func socketControl(iface string, reusePort bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			if iface != "" {
+				err = unix.SetsockoptString(int(fd), unix.SOL_SOCKET,
+					unix.SO_BINDTODEVICE, iface)
+				if err != nil {
+					return
+				}
+			}
+			if reusePort {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET,
+					unix.SO_REUSEPORT, 1)
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
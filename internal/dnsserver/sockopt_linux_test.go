@@ -0,0 +1,51 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestBindToDevice(t *testing.T) {
+	lc := net.ListenConfig{Control: socketControl("lo", false)}
+	pconn, err := lc.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	if errors.Is(err, syscall.EPERM) {
+		t.Skipf("no permission to bind to an interface: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("error binding to lo: %v", err)
+	}
+	pconn.Close()
+
+	lc.Control = socketControl("doesnotexist0", false)
+	if _, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0"); err == nil {
+		t.Errorf("bound to a non-existent interface")
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	lc := net.ListenConfig{Control: socketControl("", true)}
+	c1, err := lc.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer c1.Close()
+
+	// With SO_REUSEPORT, we can listen on the same address again.
+	c2, err := lc.ListenPacket(context.Background(), "udp",
+		c1.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("error listening on the same address: %v", err)
+	}
+	defer c2.Close()
+
+	// Without it, we can't.
+	lc.Control = nil
+	if c3, err := lc.ListenPacket(context.Background(), "udp",
+		c1.LocalAddr().String()); err == nil {
+		c3.Close()
+		t.Errorf("listened on the same address without SO_REUSEPORT")
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package dnsserver
+
+import (
+	"errors"
+	"syscall"
+)
+
+// socketControl returns a function to use as net.ListenConfig.Control.
+// Binding to an interface and SO_REUSEPORT are only supported on Linux;
+// elsewhere, asking for them makes the sockets fail to be created.
+func socketControl(iface string, reusePort bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if iface != "" {
+			return errors.New(
+				"binding to an interface is only supported on Linux")
+		}
+		if reusePort {
+			return errors.New("SO_REUSEPORT is only supported on Linux")
+		}
+		return nil
+	}
+}
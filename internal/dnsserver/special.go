@@ -0,0 +1,155 @@
+package dnsserver
+
+import (
+	"net"
+
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+// Special-use domains that never exist in the global DNS, so queries for
+// them must not be sent upstream (RFC 6761, RFC 6762, RFC 7686, RFC 8375).
+var nxDomains = []string{
+	"invalid.",
+	"test.",
+	"onion.",
+	"local.",
+	"home.arpa.",
+}
+
+// Canary domains, used by applications to detect if they should disable
+// their own encrypted DNS resolution, and use the system's instead.
+var canaryDomains = []string{
+	// Firefox, and other browsers.
+	// https://support.mozilla.org/kb/canary-domain-use-application-dnsnet
+	"use-application-dns.net.",
+
+	// Apple's iCloud Private Relay.
+	"mask.icloud.com.",
+	"mask-h2.icloud.com.",
+}
+
+// Reverse zones of the private address ranges (RFC 1918, and the unique
+// local IPv6 addresses of RFC 4193). Their names only make sense within the
+// local network, so the queries for them should not leak to the public DNS
+// (RFC 6303).
+var PrivateReverseZones = []string{
+	"10.in-addr.arpa.",
+	"16.172.in-addr.arpa.",
+	"17.172.in-addr.arpa.",
+	"18.172.in-addr.arpa.",
+	"19.172.in-addr.arpa.",
+	"20.172.in-addr.arpa.",
+	"21.172.in-addr.arpa.",
+	"22.172.in-addr.arpa.",
+	"23.172.in-addr.arpa.",
+	"24.172.in-addr.arpa.",
+	"25.172.in-addr.arpa.",
+	"26.172.in-addr.arpa.",
+	"27.172.in-addr.arpa.",
+	"28.172.in-addr.arpa.",
+	"29.172.in-addr.arpa.",
+	"30.172.in-addr.arpa.",
+	"31.172.in-addr.arpa.",
+	"168.192.in-addr.arpa.",
+	"c.f.ip6.arpa.",
+	"d.f.ip6.arpa.",
+}
+
+// specialResolver implements a Resolver that answers queries for special
+// domains locally, and passes everything else to the backing resolver.
+type specialResolver struct {
+	back Resolver
+
+	// Answer localhost names with the loopback addresses.
+	localhost bool
+
+	// Domains to answer with NXDOMAIN.
+	nx []string
+
+	// Name of the policy layer, for the traces.
+	layer string
+
+	// Report the NXDOMAIN answers as blocked, with an Extended DNS Error.
+	blocked bool
+}
+
+// NewSpecialUseResolver returns a new resolver which answers queries for
+// special-use domains (like .localhost or .invalid) locally, and uses the
+// backing resolver for everything else.
+func NewSpecialUseResolver(back Resolver) *specialResolver {
+	return &specialResolver{back: back, localhost: true, nx: nxDomains,
+		layer: "special-use"}
+}
+
+// NewCanaryResolver returns a new resolver which answers queries for the
+// encrypted DNS canary domains (like use-application-dns.net) with NXDOMAIN,
+// so applications use us instead of their built-in DoH.
+func NewCanaryResolver(back Resolver) *specialResolver {
+	return &specialResolver{back: back, nx: canaryDomains, blocked: true,
+		layer: "canary"}
+}
+
+// NewPrivateReverseResolver returns a new resolver which answers the reverse
+// queries for private addresses (see PrivateReverseZones) with NXDOMAIN, so
+// they are not sent upstream.
+func NewPrivateReverseResolver(back Resolver) *specialResolver {
+	return &specialResolver{back: back, nx: PrivateReverseZones,
+		layer: "private-reverse"}
+}
+
+func (s *specialResolver) Init() error {
+	return s.back.Init()
+}
+
+func (s *specialResolver) Maintain() {
+	s.back.Maintain()
+}
+
+func (s *specialResolver) Query(r *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
+	if len(r.Question) != 1 {
+		return s.back.Query(r, tr)
+	}
+
+	q := r.Question[0]
+	reply := &dns.Msg{}
+	reply.SetReply(r)
+	reply.Authoritative = true
+
+	// localhost names always resolve to the loopback address (RFC 6761
+	// section 6.3).
+	if s.localhost && dns.IsSubDomain("localhost.", q.Name) {
+		tr.Printf("special-use domain: localhost")
+		tr.SetPolicy("special-use", "localhost.")
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype,
+			Class: dns.ClassINET, Ttl: 3600}
+		switch q.Qtype {
+		case dns.TypeA:
+			reply.Answer = append(reply.Answer,
+				&dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1)})
+		case dns.TypeAAAA:
+			reply.Answer = append(reply.Answer,
+				&dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback})
+		}
+		return reply, nil
+	}
+
+	for _, d := range s.nx {
+		if dns.IsSubDomain(d, q.Name) {
+			tr.Printf("%s domain: %s", s.layer, d)
+			reply.Rcode = dns.RcodeNameError
+			if s.blocked {
+				addEDE(reply, r, dns.ExtendedErrorCodeBlocked,
+					"encrypted DNS canary domain")
+			}
+			tr.SetPolicy(s.layer, d)
+			return reply, nil
+		}
+	}
+
+	return s.back.Query(r, tr)
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &specialResolver{}
@@ -0,0 +1,149 @@
+package dnsserver
+
+import (
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+func TestSpecialUseResolver(t *testing.T) {
+	back := testutil.NewTestResolver()
+	back.Response = newReply(mustNewRR(t, "test. A 1.2.3.4"))
+	s := NewSpecialUseResolver(back)
+
+	tr := trace.New("test", "TestSpecialUseResolver")
+	defer tr.Finish()
+
+	cases := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer string
+	}{
+		{"localhost.", dns.TypeA, dns.RcodeSuccess,
+			"localhost.\t3600\tIN\tA\t127.0.0.1"},
+		{"a.LOCALHOST.", dns.TypeAAAA, dns.RcodeSuccess,
+			"a.LOCALHOST.\t3600\tIN\tAAAA\t::1"},
+		{"localhost.", dns.TypeMX, dns.RcodeSuccess, ""},
+		{"x.invalid.", dns.TypeA, dns.RcodeNameError, ""},
+		{"test.", dns.TypeA, dns.RcodeNameError, ""},
+		{"blah.onion.", dns.TypeA, dns.RcodeNameError, ""},
+		{"printer.local.", dns.TypeA, dns.RcodeNameError, ""},
+		{"router.home.arpa.", dns.TypeA, dns.RcodeNameError, ""},
+	}
+	for _, c := range cases {
+		resp, err := s.Query(newQuery(c.name, c.qtype), tr)
+		if err != nil {
+			t.Errorf("%s: query failed: %v", c.name, err)
+			continue
+		}
+		if resp.Rcode != c.rcode {
+			t.Errorf("%s: expected rcode %d, got %d", c.name, c.rcode, resp.Rcode)
+		}
+
+		answer := ""
+		if len(resp.Answer) > 0 {
+			answer = resp.Answer[0].String()
+		}
+		if answer != c.answer {
+			t.Errorf("%s: expected %q, got %q", c.name, c.answer, answer)
+		}
+	}
+	if back.LastQuery != nil {
+		t.Errorf("special-use query was sent to the backing resolver")
+	}
+
+	// Other domains go to the backing resolver, including ones that just
+	// look similar.
+	for _, name := range []string{"test.example.", "mylocalhost.", "arpa."} {
+		back.LastQuery = nil
+		s.Query(newQuery(name, dns.TypeA), tr)
+		if back.LastQuery == nil {
+			t.Errorf("%s: query not sent to the backing resolver", name)
+		}
+	}
+}
+
+func TestCanaryResolver(t *testing.T) {
+	back := testutil.NewTestResolver()
+	back.Response = newReply(mustNewRR(t, "test. A 1.2.3.4"))
+	c := NewCanaryResolver(back)
+
+	tr := trace.New("test", "TestCanaryResolver")
+	defer tr.Finish()
+
+	for _, name := range []string{"use-application-dns.net.", "mask.icloud.com."} {
+		resp, err := c.Query(newQuery(name, dns.TypeA), tr)
+		if err != nil || resp.Rcode != dns.RcodeNameError {
+			t.Errorf("%s: expected NXDOMAIN, got %v %v", name, resp, err)
+		}
+	}
+	if back.LastQuery != nil {
+		t.Errorf("canary query was sent to the backing resolver")
+	}
+
+	// EDNS0 clients are told why.
+	q := newQuery("use-application-dns.net.", dns.TypeA)
+	q.SetEdns0(4096, false)
+	resp, _ := c.Query(q, tr)
+	if opt := resp.IsEdns0(); opt == nil || len(opt.Option) != 1 ||
+		opt.Option[0].(*dns.EDNS0_EDE).InfoCode != dns.ExtendedErrorCodeBlocked {
+		t.Errorf("expected blocked EDE, got %v", resp)
+	}
+
+	// Special-use domains are not handled by the canary resolver.
+	for _, name := range []string{"localhost.", "x.invalid.", "icloud.com."} {
+		back.LastQuery = nil
+		c.Query(newQuery(name, dns.TypeA), tr)
+		if back.LastQuery == nil {
+			t.Errorf("%s: query not sent to the backing resolver", name)
+		}
+	}
+}
+
+func TestPrivateReverseResolver(t *testing.T) {
+	back := testutil.NewTestResolver()
+	back.Response = newReply(mustNewRR(t, "test. A 1.2.3.4"))
+	p := NewPrivateReverseResolver(back)
+
+	tr := trace.New("test", "TestPrivateReverseResolver")
+	defer tr.Finish()
+
+	private := []string{
+		"1.0.0.10.in-addr.arpa.",
+		"10.in-addr.arpa.",
+		"5.4.16.172.in-addr.arpa.",
+		"5.4.31.172.in-addr.arpa.",
+		"1.1.168.192.in-addr.arpa.",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.",
+		"c.f.ip6.arpa.",
+	}
+	for _, name := range private {
+		resp, err := p.Query(newQuery(name, dns.TypePTR), tr)
+		if err != nil || resp.Rcode != dns.RcodeNameError {
+			t.Errorf("%s: expected NXDOMAIN, got %v %v", name, resp, err)
+		}
+	}
+	if back.LastQuery != nil {
+		t.Errorf("private reverse query was sent to the backing resolver")
+	}
+
+	// Public addresses go to the backing resolver.
+	public := []string{
+		"8.8.8.8.in-addr.arpa.",
+		"5.4.15.172.in-addr.arpa.",
+		"5.4.32.172.in-addr.arpa.",
+		"1.169.192.in-addr.arpa.",
+		"8.b.d.0.1.0.0.2.ip6.arpa.",
+	}
+	for _, name := range public {
+		back.LastQuery = nil
+		p.Query(newQuery(name, dns.TypePTR), tr)
+		if back.LastQuery == nil {
+			t.Errorf("%s: query not sent to the backing resolver", name)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package dnsserver
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+// Number of events we buffer for each subscriber. If a subscriber falls
+// further behind, the events are dropped for it.
+const streamBuffer = 100
+
+// Exported variables for statistics.
+var streamDropped *expvar.Int
+
+func init() {
+	streamDropped = expvar.NewInt("query-stream-dropped")
+}
+
+// QueryEvent is a query handled by the server, as sent to the query stream.
+type QueryEvent struct {
+	Time    time.Time
+	Name    string
+	Type    string
+	Result  string
+	Layer   string
+	Rule    string
+	Latency float64 // In milliseconds.
+
+	// The answer came from the cache.
+	CacheHit bool
+}
+
+// QueryStream sends every query the server handles to the subscribers, for
+// real-time troubleshooting (see its Handler).
+// A nil *QueryStream is valid, and does not send anything.
+type QueryStream struct {
+	mu   sync.RWMutex
+	subs map[chan QueryEvent]bool
+}
+
+// NewQueryStream returns a new QueryStream, without subscribers.
+func NewQueryStream() *QueryStream {
+	return &QueryStream{subs: map[chan QueryEvent]bool{}}
+}
+
+// Publish the query, and how it was answered, to the subscribers. The
+// arguments are the same as QueryLog.Log's.
+func (s *QueryStream) Publish(tr *trace.Trace, r *dns.Msg, result string, start time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.subs) == 0 {
+		return
+	}
+
+	layer, rule := tr.Policy()
+	ev := QueryEvent{
+		Time:     start,
+		Result:   result,
+		Layer:    layer,
+		Rule:     rule,
+		Latency:  float64(time.Since(start)) / float64(time.Millisecond),
+		CacheHit: layer == "cache",
+	}
+	if len(r.Question) > 0 {
+		ev.Name = r.Question[0].Name
+		ev.Type = dns.TypeToString[r.Question[0].Qtype]
+	}
+
+	for c := range s.subs {
+		select {
+		case c <- ev:
+		default:
+			streamDropped.Add(1)
+		}
+	}
+}
+
+func (s *QueryStream) subscribe() chan QueryEvent {
+	c := make(chan QueryEvent, streamBuffer)
+	s.mu.Lock()
+	s.subs[c] = true
+	s.mu.Unlock()
+	return c
+}
+
+func (s *QueryStream) unsubscribe(c chan QueryEvent) {
+	s.mu.Lock()
+	delete(s.subs, c)
+	s.mu.Unlock()
+}
+
+// Handler streams the queries as they are handled, as server-sent events
+// with one JSON-encoded QueryEvent each. The "name" parameter limits them to
+// a domain and its subdomains.
+// It runs until the client disconnects.
+func (s *QueryStream) Handler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name != "" {
+		if _, ok := dns.IsDomainName(name); !ok {
+			http.Error(w, "invalid name", http.StatusBadRequest)
+			return
+		}
+		name = dns.Fqdn(name)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+
+	c := s.subscribe()
+	defer s.unsubscribe(c)
+
+	// Send the headers right away, so the client knows we're there.
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-c:
+			if name != "" && !dns.IsSubDomain(name, ev.Name) {
+				continue
+			}
+			buf, _ := json.Marshal(ev)
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", buf); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
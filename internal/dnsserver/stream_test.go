@@ -0,0 +1,75 @@
+package dnsserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryStream(t *testing.T) {
+	s := NewQueryStream()
+	srv := httptest.NewServer(http.HandlerFunc(s.Handler))
+	defer srv.Close()
+
+	tr := trace.New("test", "TestQueryStream")
+	defer tr.Finish()
+
+	// Without subscribers, publishing is a no-op.
+	s.Publish(tr, newQuery("test.", dns.TypeA), "NOERROR", time.Now())
+
+	resp, err := http.Get(srv.URL + "?name=example.com")
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	// The headers are sent once subscribed.
+	s.mu.RLock()
+	if len(s.subs) != 1 {
+		t.Errorf("expected 1 subscriber, got %d", len(s.subs))
+	}
+	s.mu.RUnlock()
+
+	// Only the queries for the given domain are streamed.
+	s.Publish(tr, newQuery("other.", dns.TypeA), "NOERROR", time.Now())
+	tr.SetPolicy("cache", "")
+	s.Publish(tr, newQuery("www.example.com.", dns.TypeAAAA), "NOERROR",
+		time.Now())
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatalf("error reading: %v", err)
+	}
+	ev := QueryEvent{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+		t.Fatalf("error decoding %q: %v", line, err)
+	}
+	if ev.Name != "www.example.com." || ev.Type != "AAAA" ||
+		ev.Result != "NOERROR" || !ev.CacheHit {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+
+	// A nil stream is valid.
+	var nilStream *QueryStream
+	nilStream.Publish(tr, newQuery("test.", dns.TypeA), "NOERROR", time.Now())
+}
+
+func TestQueryStreamBadName(t *testing.T) {
+	s := NewQueryStream()
+	w := httptest.NewRecorder()
+	s.Handler(w, httptest.NewRequest("GET", "/?name=a..b", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
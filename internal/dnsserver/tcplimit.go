@@ -0,0 +1,126 @@
+package dnsserver
+
+import (
+	"container/list"
+	"expvar"
+	"net"
+	"sync"
+)
+
+// Exported variables for statistics of the TCP listeners, by listener
+// address.
+var tcpStats = struct {
+	// Connections currently open.
+	conns *expvar.Map
+
+	// Connections we closed to make room for new ones.
+	evicted *expvar.Map
+}{}
+
+func init() {
+	tcpStats.conns = expvar.NewMap("tcp-connections")
+	tcpStats.evicted = expvar.NewMap("tcp-evicted")
+}
+
+// tcpLimitListener wraps a net.Listener, limiting the number of concurrent
+// connections. When the limit is reached, it closes the least recently used
+// connection to make room for the new one, so idle (or slow) clients can't
+// hold all the slots and starve the rest.
+type tcpLimitListener struct {
+	net.Listener
+	max  int
+	name string
+
+	// Open connections, the most recently used at the front.
+	mu    sync.Mutex
+	conns *list.List
+}
+
+func newTCPLimitListener(lis net.Listener, max int) *tcpLimitListener {
+	return &tcpLimitListener{
+		Listener: lis,
+		max:      max,
+		name:     lis.Addr().String(),
+		conns:    list.New(),
+	}
+}
+
+func (l *tcpLimitListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tcpLimitConn{Conn: conn, l: l}
+
+	l.mu.Lock()
+	var evict *tcpLimitConn
+	if l.conns.Len() >= l.max {
+		evict = l.conns.Back().Value.(*tcpLimitConn)
+	}
+	c.elem = l.conns.PushFront(c)
+	l.mu.Unlock()
+	tcpStats.conns.Add(l.name, 1)
+
+	if evict != nil {
+		tcpStats.evicted.Add(l.name, 1)
+		evict.Close()
+	}
+
+	return c, nil
+}
+
+// touch marks the connection as the most recently used.
+func (l *tcpLimitListener) touch(c *tcpLimitConn) {
+	l.mu.Lock()
+	if c.elem != nil {
+		l.conns.MoveToFront(c.elem)
+	}
+	l.mu.Unlock()
+}
+
+func (l *tcpLimitListener) remove(c *tcpLimitConn) {
+	l.mu.Lock()
+	removed := c.elem != nil
+	if removed {
+		l.conns.Remove(c.elem)
+		c.elem = nil
+	}
+	l.mu.Unlock()
+
+	if removed {
+		tcpStats.conns.Add(l.name, -1)
+	}
+}
+
+// tcpLimitConn is a connection accepted by a tcpLimitListener, which keeps
+// track of its use.
+type tcpLimitConn struct {
+	net.Conn
+	l *tcpLimitListener
+
+	// Position in the listener's list, nil once closed.
+	// Protected by the listener's mutex.
+	elem *list.Element
+}
+
+func (c *tcpLimitConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.l.touch(c)
+	}
+	return n, err
+}
+
+func (c *tcpLimitConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.l.touch(c)
+	}
+	return n, err
+}
+
+func (c *tcpLimitConn) Close() error {
+	c.l.remove(c)
+	return c.Conn.Close()
+}
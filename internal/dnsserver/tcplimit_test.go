@@ -0,0 +1,69 @@
+package dnsserver
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPLimitListener(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	l := newTCPLimitListener(lis, 2)
+	defer l.Close()
+
+	// Open a connection, and return both ends.
+	open := func() (client, server net.Conn) {
+		t.Helper()
+		client, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatalf("error dialing: %v", err)
+		}
+		server, err = l.Accept()
+		if err != nil {
+			t.Fatalf("error accepting: %v", err)
+		}
+		return client, server
+	}
+
+	// Checks if the connection was closed by the server.
+	isClosed := func(c net.Conn) bool {
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := c.Read(make([]byte, 1))
+		return err == io.EOF
+	}
+
+	c1, s1 := open()
+	c2, _ := open()
+
+	// Use the first connection, so the second one is the least recently
+	// used, and gets evicted when we open a third.
+	s1.Write([]byte("x"))
+	c1.Read(make([]byte, 1))
+
+	c3, s3 := open()
+	if !isClosed(c2) {
+		t.Errorf("least recently used connection was not evicted")
+	}
+	if isClosed(c1) || isClosed(c3) {
+		t.Errorf("unexpected connection closed")
+	}
+
+	if v := tcpStats.conns.Get(l.name).String(); v != "2" {
+		t.Errorf("expected 2 connections, got %s", v)
+	}
+	if v := tcpStats.evicted.Get(l.name).String(); v != "1" {
+		t.Errorf("expected 1 eviction, got %s", v)
+	}
+
+	// Closing from the server side frees the slot.
+	s3.Close()
+	s3.Close()
+	if v := tcpStats.conns.Get(l.name).String(); v != "1" {
+		t.Errorf("expected 1 connection, got %s", v)
+	}
+	s1.Close()
+}
@@ -0,0 +1,166 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"blitiri.com.ar/go/log"
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// UDP serving with a fixed pool of workers, used instead of the dns.Server
+// when Server.UDPWorkers is set.
+//
+// The dns.Server starts a goroutine, and allocates a new buffer, for every
+// query it reads. Here, instead, each worker reads from the socket and
+// handles the query itself, reusing its buffers. This bounds the number of
+// queries being handled at the same time (per socket), and avoids most of
+// the per-query allocations and goroutine churn, which matters on small
+// hardware.
+
+// Size of the buffers to read the queries into. Queries are small, and we
+// don't expect them to be bigger than what we advertise over EDNS.
+const udpReadSize = dns.DefaultMsgSize
+
+type udpServer struct {
+	s       *Server
+	conn    *net.UDPConn
+	workers int
+
+	wg sync.WaitGroup
+}
+
+func newUDPServer(s *Server, conn *net.UDPConn, workers int) *udpServer {
+	// Ask for the destination address of the queries, so the replies are
+	// sent from it (which matters when listening on a wildcard address).
+	// This is what the dns.Server does too. If it fails, the replies are
+	// sent from the default address.
+	ipv6.NewPacketConn(conn).SetControlMessage(
+		ipv6.FlagDst|ipv6.FlagInterface, true)
+	ipv4.NewPacketConn(conn).SetControlMessage(
+		ipv4.FlagDst|ipv4.FlagInterface, true)
+
+	return &udpServer{s: s, conn: conn, workers: workers}
+}
+
+// serve queries until the socket is closed, with one goroutine per worker.
+// It returns right away; wait on wg for the workers to finish.
+func (u *udpServer) serve() {
+	for i := 0; i < u.workers; i++ {
+		u.wg.Add(1)
+		go u.worker()
+	}
+}
+
+func (u *udpServer) worker() {
+	defer u.wg.Done()
+
+	buf := make([]byte, udpReadSize)
+	w := &udpWriter{conn: u.conn, buf: make([]byte, udpReadSize)}
+	for {
+		n, session, err := dns.ReadFromSessionUDP(u.conn, buf)
+		if err != nil {
+			if u.s.shutdown.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Errorf("Error reading from UDP socket: %v", err)
+			continue
+		}
+
+		r := &dns.Msg{}
+		if err := r.Unpack(buf[:n]); err != nil || r.Response {
+			// Malformed queries and replies are dropped; there's no point
+			// in wasting our time on them.
+			continue
+		}
+
+		w.session = session
+		if reply := checkQuery(r); reply != nil {
+			w.WriteMsg(reply)
+			continue
+		}
+		u.s.Handler(w, r)
+	}
+}
+
+// shutdown stops reading queries, and waits for the ones being handled to
+// be answered (or for the context to be done).
+func (u *udpServer) shutdown(ctx context.Context) error {
+	u.conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		u.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkQuery returns an error reply if the query is not one we can handle,
+// or nil if it's fine. Like the dns.Server, we only handle standard queries;
+// the rest of the checks are done by the Handler.
+func checkQuery(r *dns.Msg) *dns.Msg {
+	if r.Opcode == dns.OpcodeQuery {
+		return nil
+	}
+	reply := &dns.Msg{}
+	reply.SetRcode(r, dns.RcodeNotImplemented)
+	return reply
+}
+
+// udpWriter is the dns.ResponseWriter for the queries read by the workers.
+// It is reused across the queries, and so is its buffer.
+type udpWriter struct {
+	// Not set, only embedded so we implement the rest of the interface,
+	// which we don't use.
+	dns.ResponseWriter
+
+	conn    *net.UDPConn
+	session *dns.SessionUDP
+	buf     []byte
+}
+
+func (w *udpWriter) LocalAddr() net.Addr {
+	return w.conn.LocalAddr()
+}
+
+func (w *udpWriter) RemoteAddr() net.Addr {
+	return w.session.RemoteAddr()
+}
+
+func (w *udpWriter) WriteMsg(m *dns.Msg) error {
+	b, err := m.PackBuffer(w.buf)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (w *udpWriter) Write(b []byte) (int, error) {
+	return dns.WriteToSessionUDP(w.conn, b, w.session)
+}
+
+func (w *udpWriter) Close() error {
+	return nil
+}
+
+func (w *udpWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *udpWriter) TsigTimersOnly(bool) {
+}
+
+func (w *udpWriter) Hijack() {
+}
@@ -0,0 +1,148 @@
+package dnsserver
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+// How long an upstream is considered down after it fails a query.
+const upstreamDownPeriod = 30 * time.Second
+
+// upstream is one of the resolvers an upstreamsResolver can use.
+type upstream struct {
+	name string
+	back Resolver
+
+	// The upstream is considered down until this time.
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+func (u *upstream) isDown(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return now.Before(u.downUntil)
+}
+
+func (u *upstream) setDown(down bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if down {
+		u.downUntil = time.Now().Add(upstreamDownPeriod)
+	} else {
+		u.downUntil = time.Time{}
+	}
+}
+
+// upstreamsResolver implements a Resolver that sends queries to one of
+// multiple backing resolvers (usually, different upstream servers), failing
+// over to the next one when it fails.
+//
+// If pinning is enabled, each client is consistently sent to the same
+// upstream (as long as it is up), using rendezvous hashing on the client's
+// address. Otherwise, the upstreams are used in the given order.
+type upstreamsResolver struct {
+	upstreams []*upstream
+	pin       bool
+}
+
+// NewUpstreamsResolver returns a new resolver which sends queries to the
+// given backing resolvers, identified by their names. If pin is true, each
+// client is consistently sent to the same upstream.
+func NewUpstreamsResolver(names []string, backs []Resolver, pin bool) *upstreamsResolver {
+	u := &upstreamsResolver{pin: pin}
+	for i, back := range backs {
+		u.upstreams = append(u.upstreams, &upstream{name: names[i], back: back})
+	}
+	return u
+}
+
+func (u *upstreamsResolver) Init() error {
+	var errs []error
+	for _, up := range u.upstreams {
+		errs = append(errs, up.back.Init())
+	}
+	return errors.Join(errs...)
+}
+
+func (u *upstreamsResolver) Maintain() {
+	for _, up := range u.upstreams {
+		go up.back.Maintain()
+	}
+}
+
+// order returns the upstreams in the order they should be tried for the
+// given client.
+func (u *upstreamsResolver) order(client net.IP) []*upstream {
+	ups := append([]*upstream{}, u.upstreams...)
+	if !u.pin || client == nil {
+		return ups
+	}
+	if v4 := client.To4(); v4 != nil {
+		client = v4
+	}
+
+	// Rendezvous hashing: the client goes to the upstream with the highest
+	// hash of (client, upstream). This keeps most clients in place when
+	// upstreams are added or removed.
+	weights := map[*upstream]uint64{}
+	for _, up := range ups {
+		h := fnv.New64a()
+		h.Write(client)
+		h.Write([]byte(up.name))
+		weights[up] = h.Sum64()
+	}
+	sort.SliceStable(ups, func(i, j int) bool {
+		return weights[ups[i]] > weights[ups[j]]
+	})
+	return ups
+}
+
+func (u *upstreamsResolver) Query(r *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
+	ups := u.order(tr.Client())
+
+	// Skip the upstreams that are down, but if all of them are, try them
+	// anyway.
+	now := time.Now()
+	up := []*upstream{}
+	for _, x := range ups {
+		if !x.isDown(now) {
+			up = append(up, x)
+		}
+	}
+	if len(up) == 0 {
+		up = ups
+	}
+
+	var reply *dns.Msg
+	var err error
+	for _, x := range up {
+		tr.Printf("upstream: %s", x.name)
+		reply, err = x.back.Query(r, tr)
+		if err == nil || errors.Is(err, ErrDropQuery) {
+			x.setDown(false)
+			return reply, err
+		}
+
+		tr.Printf("upstream %s failed: %v", x.name, err)
+		x.setDown(true)
+
+		if d := tr.Deadline(); !d.IsZero() && !time.Now().Before(d) {
+			tr.Printf("deadline passed, not trying other upstreams")
+			break
+		}
+	}
+
+	return reply, err
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &upstreamsResolver{}
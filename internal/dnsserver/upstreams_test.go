@@ -0,0 +1,108 @@
+package dnsserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+func newTestUpstreams(t *testing.T, n int, pin bool) (*upstreamsResolver, []*testutil.TestResolver) {
+	names := []string{}
+	backs := []Resolver{}
+	trs := []*testutil.TestResolver{}
+	for i := 0; i < n; i++ {
+		r := testutil.NewTestResolver()
+		r.Response = newReply(mustNewRR(t, fmt.Sprintf("test. A 1.1.1.%d", i)))
+		names = append(names, fmt.Sprintf("upstream%d", i))
+		backs = append(backs, r)
+		trs = append(trs, r)
+	}
+	return NewUpstreamsResolver(names, backs, pin), trs
+}
+
+func queryFrom(t *testing.T, u *upstreamsResolver, client string) string {
+	t.Helper()
+	tr := trace.New("test", "queryFrom")
+	defer tr.Finish()
+	tr.SetClient(net.ParseIP(client))
+
+	resp, err := u.Query(newQuery("test.", dns.TypeA), tr)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	return resp.Answer[0].(*dns.A).A.String()
+}
+
+func TestUpstreamsFailover(t *testing.T) {
+	u, backs := newTestUpstreams(t, 2, false)
+
+	// Upstreams are used in order.
+	if a := queryFrom(t, u, "192.0.2.1"); a != "1.1.1.0" {
+		t.Errorf("expected first upstream, got %s", a)
+	}
+
+	// If the first one fails, we fall back to the second.
+	backs[0].RespError = errors.New("test error")
+	if a := queryFrom(t, u, "192.0.2.1"); a != "1.1.1.1" {
+		t.Errorf("expected second upstream, got %s", a)
+	}
+
+	// While it's down, it is not used.
+	backs[0].RespError = nil
+	backs[0].LastQuery = nil
+	queryFrom(t, u, "192.0.2.1")
+	if backs[0].LastQuery != nil {
+		t.Errorf("upstream that is down was queried")
+	}
+
+	// Once it's back up, it is used again.
+	u.upstreams[0].setDown(false)
+	if a := queryFrom(t, u, "192.0.2.1"); a != "1.1.1.0" {
+		t.Errorf("expected first upstream, got %s", a)
+	}
+
+	// If all are down, they are tried anyway.
+	u.upstreams[0].setDown(true)
+	u.upstreams[1].setDown(true)
+	if a := queryFrom(t, u, "192.0.2.1"); a != "1.1.1.0" {
+		t.Errorf("expected first upstream, got %s", a)
+	}
+}
+
+func TestUpstreamsPinning(t *testing.T) {
+	u, backs := newTestUpstreams(t, 4, true)
+
+	// Each client always uses the same upstream, and clients are spread
+	// across them.
+	used := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		client := fmt.Sprintf("192.0.2.%d", i)
+		a := queryFrom(t, u, client)
+		for j := 0; j < 3; j++ {
+			if b := queryFrom(t, u, client); b != a {
+				t.Errorf("%s: got %s, then %s", client, a, b)
+			}
+		}
+		used[a] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("clients were not spread across upstreams: %v", used)
+	}
+
+	// If the client's upstream fails, it fails over to another one.
+	a := queryFrom(t, u, "192.0.2.1")
+	for _, b := range backs {
+		if b.Response.Answer[0].(*dns.A).A.String() == a {
+			b.RespError = errors.New("test error")
+		}
+	}
+	if b := queryFrom(t, u, "192.0.2.1"); b == a {
+		t.Errorf("did not fail over, got %s", b)
+	}
+}
@@ -0,0 +1,596 @@
+package dnsserver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+// Root zone trust anchors (KSK-2017 and KSK-2024), from
+// https://data.iana.org/root-anchors/root-anchors.xml.
+// It is declared as a variable so we can tweak it for testing.
+var rootAnchors = []string{
+	". IN DS 20326 8 2 " +
+		"E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 " +
+		"683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// Maximum time we keep validated keys for.
+const maxKeyTTL = 1 * time.Hour
+
+// validatingResolver implements a Resolver that validates the DNSSEC
+// signatures of the answers given by the backing resolver, instead of
+// trusting the upstream's AD bit.
+//
+// Answers are validated from the root trust anchors down. Signed answers
+// that fail validation are replied with SERVFAIL. Unsigned answers are only
+// passed through as insecure (with the AD bit unset) if they are below a
+// provably unsigned delegation, otherwise the signatures could have been
+// stripped, and they are replied with SERVFAIL too.
+//
+// Negative answers are passed through as insecure; we don't validate denial
+// of existence.
+type validatingResolver struct {
+	back Resolver
+
+	anchors []*dns.DS
+
+	mu sync.Mutex
+
+	// Validated keys, indexed by zone.
+	keys map[string]validatedKeys
+
+	// Whether the names have validated DS records (that is, if they are
+	// signed zones), and when we have to check again.
+	signed map[string]expiringBool
+
+	// Provably unsigned delegations, and when we have to check again.
+	unsigned map[string]time.Time
+}
+
+type expiringBool struct {
+	value   bool
+	expires time.Time
+}
+
+type validatedKeys struct {
+	keys    []*dns.DNSKEY
+	expires time.Time
+}
+
+// NewValidatingResolver returns a new resolver which validates the answers
+// from the backing resolver using DNSSEC.
+func NewValidatingResolver(back Resolver) *validatingResolver {
+	v := &validatingResolver{
+		back:     back,
+		keys:     map[string]validatedKeys{},
+		signed:   map[string]expiringBool{},
+		unsigned: map[string]time.Time{},
+	}
+	for _, s := range rootAnchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(fmt.Sprintf("invalid root anchor %q: %v", s, err))
+		}
+		v.anchors = append(v.anchors, rr.(*dns.DS))
+	}
+	return v
+}
+
+func (v *validatingResolver) Init() error {
+	return v.back.Init()
+}
+
+func (v *validatingResolver) Maintain() {
+	v.back.Maintain()
+}
+
+// validationError is returned when validation fails.
+type validationError struct {
+	code uint16
+	msg  string
+}
+
+func (e *validationError) Error() string {
+	return "DNSSEC validation failed: " + e.msg
+}
+
+func bogus(format string, a ...interface{}) error {
+	return &validationError{dns.ExtendedErrorCodeDNSBogus,
+		fmt.Sprintf(format, a...)}
+}
+
+func (v *validatingResolver) Query(r *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
+	clientOPT := r.IsEdns0()
+	clientDO := clientOPT != nil && clientOPT.Do()
+
+	// Ask for the signatures, and for the upstream to give us the data even
+	// if it fails validation, as we will do it ourselves.
+	q := r.Copy()
+	if opt := q.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		q.SetEdns0(4096, true)
+	}
+	q.CheckingDisabled = true
+
+	reply, err := v.back.Query(q, tr)
+	if err != nil {
+		return reply, err
+	}
+
+	secure, err := v.validate(reply, tr)
+	if err != nil {
+		tr.Printf("DNSSEC: %v", err)
+		tr.SetPolicy("dnssec", "bogus")
+		if len(r.Question) > 0 {
+			answerModified(tr, r.Question[0], modBogus, "%v", err)
+		}
+		return failWithEDE(r, err.(*validationError).code, err.Error()), nil
+	}
+	tr.Printf("DNSSEC: secure:%v", secure)
+
+	// The AD bit is only meaningful if the client asked for it, either with
+	// the AD bit or the DO bit (RFC 6840 section 5.8).
+	reply.AuthenticatedData = secure && (r.AuthenticatedData || clientDO)
+	reply.CheckingDisabled = r.CheckingDisabled
+
+	// Remove what the client did not ask for.
+	if !clientDO {
+		reply.Answer = removeRRSIGs(reply.Answer)
+		reply.Ns = removeRRSIGs(reply.Ns)
+		reply.Extra = removeRRSIGs(reply.Extra)
+	}
+	if clientOPT == nil {
+		reply.Extra = removeOPT(reply.Extra)
+	}
+
+	return reply, nil
+}
+
+// validate the answer section of the reply. Returns true if it is secure,
+// false if it's insecure (unsigned, below an unsigned delegation), and an
+// error if it is bogus.
+func (v *validatingResolver) validate(reply *dns.Msg, tr *trace.Trace) (bool, error) {
+	if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) == 0 {
+		return false, nil
+	}
+
+	secure := true
+	rrsets, sigs := splitRRsets(reply.Answer)
+	for _, rrset := range rrsets {
+		hdr := rrset[0].Header()
+		if coveringSig(hdr, sigs) {
+			if err := v.verifyRRset(rrset, sigs, tr); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		insecure, err := v.insecure(hdr.Name, tr)
+		if err != nil {
+			return false, err
+		}
+		if !insecure {
+			return false, &validationError{
+				dns.ExtendedErrorCodeRRSIGsMissing,
+				fmt.Sprintf("no signatures for %s %s, which is in a "+
+					"signed zone", hdr.Name, dns.TypeToString[hdr.Rrtype])}
+		}
+		secure = false
+	}
+
+	return secure, nil
+}
+
+// coveringSig returns true if one of the RRSIGs covers the RRset with the
+// given header.
+func coveringSig(hdr *dns.RR_Header, sigs []*dns.RRSIG) bool {
+	for _, sig := range sigs {
+		if sig.TypeCovered == hdr.Rrtype &&
+			strings.EqualFold(sig.Hdr.Name, hdr.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyRRset checks that the RRset is signed by one of the given RRSIGs,
+// using validated keys of the zone the RRset belongs to.
+func (v *validatingResolver) verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, tr *trace.Trace) error {
+	hdr := rrset[0].Header()
+	var lastErr error = bogus("no signature for %s %s",
+		hdr.Name, dns.TypeToString[hdr.Rrtype])
+
+	for _, sig := range sigs {
+		if sig.TypeCovered != hdr.Rrtype ||
+			!strings.EqualFold(sig.Hdr.Name, hdr.Name) {
+			continue
+		}
+
+		if err := v.checkSigner(sig.SignerName, hdr, tr); err != nil {
+			return err
+		}
+
+		keys, err := v.zoneKeys(sig.SignerName, tr)
+		if err != nil {
+			return err
+		}
+
+		if err := verifyWithKeys(sig, keys, rrset); err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+
+	return lastErr
+}
+
+// checkSigner checks that the signer is the zone of the RRset with the given
+// header: it must be the owner or one of its ancestors (a proper one for DS
+// records, which belong to the parent zone), and there can't be a signed
+// zone between them. Otherwise, any signed zone could sign any name.
+func (v *validatingResolver) checkSigner(signer string, hdr *dns.RR_Header, tr *trace.Trace) error {
+	signer = dns.CanonicalName(signer)
+	owner := dns.CanonicalName(hdr.Name)
+	if !dns.IsSubDomain(signer, owner) ||
+		(hdr.Rrtype == dns.TypeDS && signer == owner) {
+		return bogus("%s %s is signed by %s, which is not its zone",
+			hdr.Name, dns.TypeToString[hdr.Rrtype], signer)
+	}
+
+	for _, off := range dns.Split(owner) {
+		name := owner[off:]
+		if name == signer {
+			break
+		}
+		if hdr.Rrtype == dns.TypeDS && name == owner {
+			continue
+		}
+		signed, err := v.isSigned(name, tr)
+		if err != nil {
+			return err
+		}
+		if signed {
+			return bogus("%s %s is signed by %s, but its zone is %s",
+				hdr.Name, dns.TypeToString[hdr.Rrtype], signer, name)
+		}
+	}
+	return nil
+}
+
+// isSigned returns true if the name has validated DS records, which means
+// it is a signed zone.
+func (v *validatingResolver) isSigned(name string, tr *trace.Trace) (bool, error) {
+	v.mu.Lock()
+	s, ok := v.signed[name]
+	v.mu.Unlock()
+	if ok && time.Now().Before(s.expires) {
+		return s.value, nil
+	}
+
+	reply, err := v.fetch(name, dns.TypeDS, tr)
+	if err != nil {
+		return false, err
+	}
+	signed := false
+	rrsets, sigs := splitRRsets(reply.Answer)
+	if ds := findRRset(rrsets, name, dns.TypeDS); ds != nil {
+		if err := v.verifyRRset(ds, sigs, tr); err != nil {
+			return false, err
+		}
+		signed = true
+	}
+
+	v.mu.Lock()
+	v.signed[name] = expiringBool{signed, time.Now().Add(maxKeyTTL)}
+	v.mu.Unlock()
+	return signed, nil
+}
+
+// insecure returns true if the name is provably unsigned: if there is a
+// delegation to an unsigned zone between the root and it, as proven by the
+// signed NSEC or NSEC3 records of the parent zone.
+func (v *validatingResolver) insecure(name string, tr *trace.Trace) (bool, error) {
+	name = dns.CanonicalName(name)
+	offs := dns.Split(name)
+
+	// From the top, so we follow the chain of signed zones down.
+	parent := "."
+	for i := len(offs) - 1; i >= 0; i-- {
+		zone := name[offs[i]:]
+
+		v.mu.Lock()
+		expires, ok := v.unsigned[zone]
+		v.mu.Unlock()
+		if ok && time.Now().Before(expires) {
+			return true, nil
+		}
+
+		reply, err := v.fetch(zone, dns.TypeDS, tr)
+		if err != nil {
+			return false, err
+		}
+		rrsets, sigs := splitRRsets(reply.Answer)
+		if ds := findRRset(rrsets, zone, dns.TypeDS); ds != nil {
+			// A signed zone, keep going down.
+			if err := v.verifyRRset(ds, sigs, tr); err != nil {
+				return false, err
+			}
+			parent = zone
+			continue
+		}
+
+		unsigned, err := v.unsignedDelegation(zone, parent, reply.Ns, tr)
+		if err != nil {
+			return false, err
+		}
+		if unsigned {
+			tr.Printf("DNSSEC: %q is an unsigned delegation", zone)
+			v.mu.Lock()
+			v.unsigned[zone] = time.Now().Add(maxKeyTTL)
+			v.mu.Unlock()
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// unsignedDelegation returns true if the authority section of a reply for
+// the DS records of the name proves that it is a delegation without them.
+// That is, if it has a signed NSEC or NSEC3 record for the name with NS but
+// without DS and SOA, or an NSEC3 with the opt-out flag that covers it. The
+// NSEC3 records must be from the parent zone, as they can't be tied to the
+// name otherwise.
+func (v *validatingResolver) unsignedDelegation(name, parent string, ns []dns.RR, tr *trace.Trace) (bool, error) {
+	rrsets, sigs := splitRRsets(ns)
+	for _, rrset := range rrsets {
+		var types []uint16
+		optOut := false
+		switch rr := rrset[0].(type) {
+		case *dns.NSEC:
+			if !strings.EqualFold(rr.Hdr.Name, name) {
+				continue
+			}
+			types = rr.TypeBitMap
+		case *dns.NSEC3:
+			owner := dns.CanonicalName(rr.Hdr.Name)
+			zone := "."
+			if offs := dns.Split(owner); len(offs) > 1 {
+				zone = owner[offs[1]:]
+			}
+			if zone != parent {
+				continue
+			}
+			if rr.Match(name) {
+				types = rr.TypeBitMap
+			} else if rr.Cover(name) && rr.Flags&1 == 1 {
+				optOut = true
+			} else {
+				continue
+			}
+		default:
+			continue
+		}
+
+		if err := v.verifyRRset(rrset, sigs, tr); err != nil {
+			return false, err
+		}
+		if optOut {
+			return true, nil
+		}
+		return hasType(types, dns.TypeNS) && !hasType(types, dns.TypeDS) &&
+			!hasType(types, dns.TypeSOA), nil
+	}
+	return false, nil
+}
+
+func hasType(types []uint16, t uint16) bool {
+	for _, tt := range types {
+		if tt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// findRRset returns the RRset with the given name and type, or nil if there
+// is none.
+func findRRset(rrsets [][]dns.RR, name string, rrtype uint16) []dns.RR {
+	for _, rrset := range rrsets {
+		hdr := rrset[0].Header()
+		if hdr.Rrtype == rrtype && strings.EqualFold(hdr.Name, name) {
+			return rrset
+		}
+	}
+	return nil
+}
+
+func verifyWithKeys(sig *dns.RRSIG, keys []*dns.DNSKEY, rrset []dns.RR) error {
+	if !sig.ValidityPeriod(time.Now()) {
+		return &validationError{dns.ExtendedErrorCodeSignatureExpired,
+			fmt.Sprintf("signature for %s is not valid now", sig.Hdr.Name)}
+	}
+
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if err := sig.Verify(key, rrset); err == nil {
+			return nil
+		}
+	}
+
+	return bogus("signature for %s does not verify", sig.Hdr.Name)
+}
+
+// zoneKeys returns the validated keys of the given zone, fetching and
+// validating them if needed.
+func (v *validatingResolver) zoneKeys(zone string, tr *trace.Trace) ([]*dns.DNSKEY, error) {
+	zone = dns.CanonicalName(zone)
+
+	v.mu.Lock()
+	vk, ok := v.keys[zone]
+	v.mu.Unlock()
+	if ok && time.Now().Before(vk.expires) {
+		return vk.keys, nil
+	}
+
+	// Get the DS records for the zone, which we will use to validate the
+	// zone's keys. For the root, they're our trust anchors; for the rest, we
+	// get them from the parent (and validate them using its keys).
+	var dss []*dns.DS
+	if zone == "." {
+		dss = v.anchors
+	} else {
+		reply, err := v.fetch(zone, dns.TypeDS, tr)
+		if err != nil {
+			return nil, err
+		}
+		rrsets, sigs := splitRRsets(reply.Answer)
+		ds := findRRset(rrsets, zone, dns.TypeDS)
+		if ds == nil {
+			return nil, bogus("no DS records for signed zone %s", zone)
+		}
+		if err := v.verifyRRset(ds, sigs, tr); err != nil {
+			return nil, err
+		}
+		for _, rr := range ds {
+			dss = append(dss, rr.(*dns.DS))
+		}
+	}
+
+	reply, err := v.fetch(zone, dns.TypeDNSKEY, tr)
+	if err != nil {
+		return nil, err
+	}
+	rrsets, sigs := splitRRsets(reply.Answer)
+	if len(rrsets) != 1 || rrsets[0][0].Header().Rrtype != dns.TypeDNSKEY {
+		return nil, &validationError{dns.ExtendedErrorCodeDNSKEYMissing,
+			fmt.Sprintf("no DNSKEY records for zone %s", zone)}
+	}
+
+	keys := []*dns.DNSKEY{}
+	for _, rr := range rrsets[0] {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+
+	// The keys that match the DS records can be used to verify the whole
+	// DNSKEY RRset.
+	dsKeys := []*dns.DNSKEY{}
+	for _, key := range keys {
+		for _, ds := range dss {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+			kds := key.ToDS(ds.DigestType)
+			if kds != nil && strings.EqualFold(kds.Digest, ds.Digest) {
+				dsKeys = append(dsKeys, key)
+			}
+		}
+	}
+	if len(dsKeys) == 0 {
+		return nil, bogus("no DNSKEY for %s matches its DS records", zone)
+	}
+
+	verified := false
+	for _, sig := range sigs {
+		if sig.TypeCovered != dns.TypeDNSKEY {
+			continue
+		}
+		if verifyWithKeys(sig, dsKeys, rrsets[0]) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, bogus("DNSKEY records for %s do not verify", zone)
+	}
+
+	ttl := time.Duration(rrsets[0][0].Header().Ttl) * time.Second
+	if ttl > maxKeyTTL {
+		ttl = maxKeyTTL
+	}
+
+	v.mu.Lock()
+	v.keys[zone] = validatedKeys{keys: keys, expires: time.Now().Add(ttl)}
+	v.mu.Unlock()
+
+	tr.Printf("DNSSEC: validated %d keys for %q", len(keys), zone)
+	return keys, nil
+}
+
+// fetch records needed for validation, using the backing resolver.
+func (v *validatingResolver) fetch(name string, qtype uint16, tr *trace.Trace) (*dns.Msg, error) {
+	q := &dns.Msg{}
+	q.SetQuestion(name, qtype)
+	q.SetEdns0(4096, true)
+	q.CheckingDisabled = true
+
+	reply, err := v.back.Query(q, tr)
+	if err != nil {
+		return nil, &validationError{dns.ExtendedErrorCodeDNSSECIndeterminate,
+			fmt.Sprintf("error getting %s %s: %v",
+				name, dns.TypeToString[qtype], err)}
+	}
+	return reply, nil
+}
+
+// splitRRsets splits the records into RRsets (grouped by name and type), and
+// the RRSIGs.
+func splitRRsets(rrs []dns.RR) ([][]dns.RR, []*dns.RRSIG) {
+	rrsets := [][]dns.RR{}
+	sigs := []*dns.RRSIG{}
+	index := map[string]int{}
+
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+
+		hdr := rr.Header()
+		key := dns.CanonicalName(hdr.Name) + " " +
+			dns.TypeToString[hdr.Rrtype]
+		i, ok := index[key]
+		if !ok {
+			i = len(rrsets)
+			index[key] = i
+			rrsets = append(rrsets, nil)
+		}
+		rrsets[i] = append(rrsets[i], rr)
+	}
+
+	return rrsets, sigs
+}
+
+func removeRRSIGs(rrs []dns.RR) []dns.RR {
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeRRSIG {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+func removeOPT(rrs []dns.RR) []dns.RR {
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// Compile-time check that the implementation matches the interface.
+var _ Resolver = &validatingResolver{}
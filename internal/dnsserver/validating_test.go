@@ -0,0 +1,236 @@
+package dnsserver
+
+import (
+	"crypto"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+// zoneResolver is a Resolver that answers from a fixed set of records, for
+// testing. If there is no answer, the NSEC records for the name go in the
+// authority section.
+type zoneResolver struct {
+	rrs []dns.RR
+}
+
+func (z *zoneResolver) Init() error { return nil }
+func (z *zoneResolver) Maintain()   {}
+
+func (z *zoneResolver) Query(r *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
+	q := r.Question[0]
+	reply := &dns.Msg{}
+	reply.SetReply(r)
+	for _, rr := range z.rrs {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(q.Name, hdr.Name) || dns.CountLabel(q.Name) != dns.CountLabel(hdr.Name) {
+			continue
+		}
+		if hdr.Rrtype == q.Qtype {
+			reply.Answer = append(reply.Answer, rr)
+		} else if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == q.Qtype {
+			reply.Answer = append(reply.Answer, rr)
+		}
+	}
+	if len(reply.Answer) == 0 {
+		for _, rr := range z.rrs {
+			if !strings.EqualFold(rr.Header().Name, q.Name) {
+				continue
+			}
+			if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeNSEC {
+				reply.Ns = append(reply.Ns, rr)
+			} else if rr.Header().Rrtype == dns.TypeNSEC {
+				reply.Ns = append(reply.Ns, rr)
+			}
+		}
+	}
+	if opt := r.IsEdns0(); opt != nil {
+		reply.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	return reply, nil
+}
+
+type testKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestKey(t *testing.T, zone string) testKey {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY,
+			Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	return testKey{key, priv.(crypto.Signer)}
+}
+
+func (k testKey) sign(t *testing.T, rrset ...dns.RR) *dns.RRSIG {
+	t.Helper()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		KeyTag:     k.key.KeyTag(),
+		SignerName: k.key.Hdr.Name,
+		Algorithm:  k.key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(k.priv, rrset); err != nil {
+		t.Fatalf("error signing: %v", err)
+	}
+	return sig
+}
+
+// newSignedZones returns a zoneResolver with signed root, "example.",
+// "sub.example." and "evil." zones, and an unsigned "insecure.example." one;
+// and sets up the root trust anchor accordingly.
+func newSignedZones(t *testing.T) *zoneResolver {
+	root := newTestKey(t, ".")
+	example := newTestKey(t, "example.")
+	sub := newTestKey(t, "sub.example.")
+	evil := newTestKey(t, "evil.")
+
+	newDS := func(k testKey) *dns.DS {
+		ds := k.key.ToDS(dns.SHA256)
+		ds.Hdr.Ttl = 3600
+		return ds
+	}
+	ds := newDS(example)
+	subDS := newDS(sub)
+	evilDS := newDS(evil)
+
+	prevAnchors := rootAnchors
+	rootAnchors = []string{root.key.ToDS(dns.SHA256).String()}
+	t.Cleanup(func() { rootAnchors = prevAnchors })
+
+	www := mustNewRR(t, "www.example. 3600 A 1.2.3.4")
+	unsigned := mustNewRR(t, "unsigned.example. 3600 A 5.6.7.8")
+	forged := mustNewRR(t, "forged.example. 3600 A 6.6.6.6")
+	forgedSig := example.sign(t, mustNewRR(t, "forged.example. 3600 A 1.1.1.1"))
+
+	// Unsigned delegation, proven by the NSEC record in the parent.
+	insecureNSEC := mustNewRR(t,
+		"insecure.example. 3600 NSEC sub.example. NS RRSIG NSEC")
+	insecure := mustNewRR(t, "www.insecure.example. 3600 A 9.9.9.9")
+
+	// Signed by the parent of their zone, and by an unrelated zone.
+	subWWW := mustNewRR(t, "www.sub.example. 3600 A 7.7.7.7")
+	bank := mustNewRR(t, "bank.example. 3600 A 6.6.6.6")
+
+	return &zoneResolver{rrs: []dns.RR{
+		root.key, root.sign(t, root.key),
+		ds, root.sign(t, ds),
+		example.key, example.sign(t, example.key),
+		www, example.sign(t, www),
+		unsigned,
+		forged, forgedSig,
+		insecureNSEC, example.sign(t, insecureNSEC),
+		insecure,
+		subDS, example.sign(t, subDS),
+		sub.key, sub.sign(t, sub.key),
+		subWWW, example.sign(t, subWWW),
+		evilDS, root.sign(t, evilDS),
+		evil.key, evil.sign(t, evil.key),
+		bank, evil.sign(t, bank),
+	}}
+}
+
+func TestValidatingResolver(t *testing.T) {
+	back := newSignedZones(t)
+	v := NewValidatingResolver(back)
+	tr := trace.New("test", "TestValidatingResolver")
+	defer tr.Finish()
+
+	// Secure answer, client asked for DNSSEC.
+	q := newQuery("www.example.", dns.TypeA)
+	q.SetEdns0(4096, true)
+	resp, err := v.Query(q, tr)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess || !resp.AuthenticatedData {
+		t.Errorf("expected secure answer, got %v", resp)
+	}
+	if len(resp.Answer) != 2 {
+		t.Errorf("expected A and RRSIG, got %v", resp.Answer)
+	}
+
+	// Secure answer, client did not use EDNS0: no signatures nor OPT, and
+	// no AD bit since it was not requested.
+	resp, _ = v.Query(newQuery("www.example.", dns.TypeA), tr)
+	if resp.Rcode != dns.RcodeSuccess || resp.AuthenticatedData {
+		t.Errorf("unexpected answer: %v", resp)
+	}
+	if len(resp.Answer) != 1 || resp.IsEdns0() != nil {
+		t.Errorf("unexpected answer: %v", resp)
+	}
+
+	// Unsigned answers below an unsigned delegation are insecure, but pass
+	// through.
+	q = newQuery("www.insecure.example.", dns.TypeA)
+	q.AuthenticatedData = true
+	resp, _ = v.Query(q, tr)
+	if resp.Rcode != dns.RcodeSuccess || resp.AuthenticatedData ||
+		len(resp.Answer) != 1 {
+		t.Errorf("expected insecure answer, got %v", resp)
+	}
+
+	// Unsigned answers in a signed zone could have had their signatures
+	// stripped, and bogus answers are bogus; both result in SERVFAIL with
+	// EDE.
+	cases := []struct {
+		name string
+		code uint16
+	}{
+		{"unsigned.example.", dns.ExtendedErrorCodeRRSIGsMissing},
+		{"forged.example.", dns.ExtendedErrorCodeDNSBogus},
+		{"www.sub.example.", dns.ExtendedErrorCodeDNSBogus},
+		{"bank.example.", dns.ExtendedErrorCodeDNSBogus},
+	}
+	for _, c := range cases {
+		q = newQuery(c.name, dns.TypeA)
+		q.SetEdns0(4096, false)
+		resp, _ = v.Query(q, tr)
+		if resp.Rcode != dns.RcodeServerFailure || len(resp.Answer) != 0 {
+			t.Errorf("%s: expected SERVFAIL, got %v", c.name, resp)
+			continue
+		}
+		ede, ok := resp.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+		if !ok || ede.InfoCode != c.code {
+			t.Errorf("%s: expected EDE %d, got %v",
+				c.name, c.code, resp.IsEdns0())
+		}
+	}
+
+	// Keys are cached.
+	if _, ok := v.keys["example."]; !ok {
+		t.Errorf("keys for example. were not cached")
+	}
+}
+
+func TestValidatingResolverBadAnchor(t *testing.T) {
+	back := newSignedZones(t)
+
+	// Use a trust anchor that doesn't match the root key.
+	other := newTestKey(t, ".")
+	rootAnchors = []string{other.key.ToDS(dns.SHA256).String()}
+
+	v := NewValidatingResolver(back)
+	tr := trace.New("test", "TestValidatingResolverBadAnchor")
+	defer tr.Finish()
+
+	resp, _ := v.Query(newQuery("www.example.", dns.TypeA), tr)
+	if resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL, got %v", resp)
+	}
+}
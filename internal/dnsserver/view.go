@@ -0,0 +1,37 @@
+package dnsserver
+
+import "net"
+
+// View is an alternative configuration for the queries of some clients,
+// selected by their address, so different networks can get different
+// answers (split-horizon DNS). For example, the IoT network could resolve
+// the internal names differently than the trusted one.
+type View struct {
+	// Name of the view, for the traces and logs.
+	Name string
+
+	// Clients the view applies to.
+	Clients NetList
+
+	// Server overrides, and the resolvers for them (see
+	// Server.OverrideResolvers). If nil, the server's ones are used.
+	Overrides         DomainMap
+	OverrideResolvers map[string]Resolver
+
+	// Resolver for the queries. If nil, the server's one is used.
+	// It is initialized and maintained by the server.
+	Resolver Resolver
+}
+
+// viewFor returns the view for the given client, or nil if none applies.
+// If more than one does, the first one wins.
+func (s *Server) viewFor(client net.IP) *View {
+	s.viewsMu.RLock()
+	defer s.viewsMu.RUnlock()
+	for _, v := range s.Views {
+		if v.Clients.Contains(client) {
+			return v
+		}
+	}
+	return nil
+}
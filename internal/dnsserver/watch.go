@@ -0,0 +1,114 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+// Minimum interval between queries when watching a name.
+// It is declared as a variable so we can tweak it for testing.
+var minWatchInterval = 1 * time.Second
+
+// WatchHandler returns an http handler that re-resolves a name at an
+// interval using the given resolver, and streams a line every time the
+// result changes (the answers, or which layer decided them), including the
+// latency. It is useful to debug propagation and flapping records.
+//
+// Parameters: name (required), type (default A), interval (default 5s), and
+// all=1 to print every result, not only the changes.
+// It runs until the client disconnects.
+func WatchHandler(res Resolver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.FormValue("name")
+		if _, ok := dns.IsDomainName(name); !ok || name == "" {
+			http.Error(w, "invalid name", http.StatusBadRequest)
+			return
+		}
+
+		qtype := dns.TypeA
+		if t := r.FormValue("type"); t != "" {
+			var ok bool
+			qtype, ok = dns.StringToType[strings.ToUpper(t)]
+			if !ok {
+				http.Error(w, "invalid type", http.StatusBadRequest)
+				return
+			}
+		}
+
+		interval := 5 * time.Second
+		if i := r.FormValue("interval"); i != "" {
+			var err error
+			interval, err = time.ParseDuration(i)
+			if err != nil || interval < minWatchInterval {
+				http.Error(w, "invalid interval", http.StatusBadRequest)
+				return
+			}
+		}
+		all := r.FormValue("all") == "1"
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		flusher, _ := w.(http.Flusher)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		prev := ""
+		for {
+			result, latency := watchQuery(res, dns.Fqdn(name), qtype)
+			if all || result != prev {
+				fmt.Fprintf(w, "%s  %-8v  %s\n",
+					time.Now().Format("2006-01-02 15:04:05"),
+					latency.Round(time.Millisecond), result)
+				if flusher != nil {
+					flusher.Flush()
+				}
+				prev = result
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+}
+
+// watchQuery resolves the name, and returns a description of the result
+// (without TTLs, so it only changes when the answers do), and the latency.
+func watchQuery(res Resolver, name string, qtype uint16) (string, time.Duration) {
+	tr := trace.New("dnsserver.Watch", name)
+	defer tr.Finish()
+
+	m := &dns.Msg{}
+	m.SetQuestion(name, qtype)
+	m.Id = newID()
+
+	start := time.Now()
+	reply, err := res.Query(m, tr)
+	latency := time.Since(start)
+	if err != nil {
+		return fmt.Sprintf("error: %v", err), latency
+	}
+
+	answers := []string{}
+	for _, rr := range reply.Answer {
+		hdr := rr.Header()
+		answers = append(answers, dns.TypeToString[hdr.Rrtype]+" "+
+			strings.TrimSpace(strings.TrimPrefix(rr.String(), hdr.String())))
+	}
+	sort.Strings(answers)
+
+	layer, rule := tr.Policy()
+	return fmt.Sprintf("%s via %s [%s]",
+		dns.RcodeToString[reply.Rcode],
+		strings.TrimSpace(orDash(layer)+" "+rule),
+		strings.Join(answers, ", ")), latency
+}
@@ -0,0 +1,53 @@
+package dnsserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+)
+
+func TestWatch(t *testing.T) {
+	minWatchInterval = time.Millisecond
+	defer func() { minWatchInterval = 1 * time.Second }()
+
+	back := testutil.NewTestResolver()
+	back.Response = newReply(mustNewRR(t, "test. A 1.2.3.4"))
+	res := NewCachingResolver(back)
+	res.Init()
+	h := WatchHandler(res)
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("GET",
+		"/debug/dnsserver/watch?name=test&interval=10ms", nil)
+	w := httptest.NewRecorder()
+	h(w, req.WithContext(ctx))
+
+	// The first answer comes from upstream, the rest from the cache.
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 2 ||
+		!strings.HasSuffix(lines[0], "NOERROR via - [A 1.2.3.4]") ||
+		!strings.HasSuffix(lines[1], "NOERROR via cache [A 1.2.3.4]") {
+		t.Errorf("unexpected output: %q", w.Body.String())
+	}
+}
+
+func TestWatchBadRequests(t *testing.T) {
+	h := WatchHandler(testutil.NewTestResolver())
+	for _, q := range []string{
+		"", "name=a..b", "name=test&type=XYZ", "name=test&interval=1ms",
+		"name=test&interval=blah",
+	} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/debug/dnsserver/watch?"+q, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", q, w.Code)
+		}
+	}
+}
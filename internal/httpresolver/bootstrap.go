@@ -0,0 +1,205 @@
+package httpresolver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/dnsclient"
+	"blitiri.com.ar/go/log"
+	"github.com/miekg/dns"
+)
+
+// Cache of the addresses of the upstream's name, so we can connect to it
+// without having to resolve it every time. They are resolved via the
+// fallback upstreams, refreshed in the background honoring the TTL, and
+// (optionally) saved to disk, so on the next start we can connect to the
+// upstream even if the fallback upstreams are not reachable then (e.g. at
+// boot, when the network is not fully up yet).
+//
+// If the addresses can't be refreshed, we keep using the last known-good
+// ones.
+
+// Limits to the TTL we honor, and how often to retry if the resolution
+// fails. They are declared as variables so we can tweak them for testing.
+var (
+	bootstrapMinTTL = 1 * time.Minute
+	bootstrapMaxTTL = 1 * time.Hour
+	bootstrapRetry  = 30 * time.Second
+)
+
+type bootstrapCache struct {
+	name      string
+	fallbacks []string
+
+	// File to save the addresses to, or "" to keep them only in memory.
+	path string
+
+	mu      sync.Mutex
+	ips     []string
+	refresh time.Time
+}
+
+// newBootstrapCache returns a cache for the addresses of the given name,
+// resolved via the fallback servers (tried in order). If dir is not empty,
+// the addresses are saved there, and loaded from it.
+func newBootstrapCache(name string, fallbacks []string, dir string) *bootstrapCache {
+	c := &bootstrapCache{
+		name:      name,
+		fallbacks: fallbacks,
+	}
+	if dir != "" {
+		c.path = filepath.Join(dir, "bootstrap-"+name)
+	}
+	return c
+}
+
+// get returns the cached addresses, which may be empty.
+func (c *bootstrapCache) get() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ips
+}
+
+// load the addresses saved to disk, if there are any. They are refreshed on
+// the next maybeRefresh.
+func (c *bootstrapCache) load() error {
+	if c.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	ips := []string{}
+	for _, ip := range strings.Fields(string(data)) {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("%q: invalid IP address %q", c.path, ip)
+		}
+		ips = append(ips, ip)
+	}
+
+	c.mu.Lock()
+	c.ips = ips
+	c.mu.Unlock()
+	return nil
+}
+
+// maybeRefresh resolves the name again if the addresses expired.
+func (c *bootstrapCache) maybeRefresh() {
+	c.mu.Lock()
+	due := !time.Now().Before(c.refresh)
+	c.mu.Unlock()
+	if !due {
+		return
+	}
+
+	ips, ttl, err := c.resolve()
+	if err != nil {
+		log.Errorf("Error resolving upstream %q (via %s), will retry: %v",
+			c.name, strings.Join(c.fallbacks, ", "), err)
+		c.mu.Lock()
+		c.refresh = time.Now().Add(bootstrapRetry)
+		c.mu.Unlock()
+		return
+	}
+
+	c.mu.Lock()
+	changed := strings.Join(ips, " ") != strings.Join(c.ips, " ")
+	c.ips = ips
+	c.refresh = time.Now().Add(ttl)
+	c.mu.Unlock()
+
+	if changed {
+		log.Infof("Upstream %q resolved to %v", c.name, ips)
+		if err := c.save(ips); err != nil {
+			log.Errorf("Error saving upstream addresses: %v", err)
+		}
+	}
+}
+
+// resolve the name's A and AAAA records via the first fallback server that
+// answers. It returns the addresses, and the (clamped) lowest TTL among
+// them.
+func (c *bootstrapCache) resolve() ([]string, time.Duration, error) {
+	var err error
+	for _, fallback := range c.fallbacks {
+		var ips []string
+		var ttl time.Duration
+		ips, ttl, err = c.resolveVia(fallback)
+		if err == nil {
+			return ips, ttl, nil
+		}
+	}
+	return nil, 0, err
+}
+
+func (c *bootstrapCache) resolveVia(fallback string) ([]string, time.Duration, error) {
+	addr, tlsConfig := dnsclient.ParseAddr(fallback)
+	client := &dns.Client{Timeout: 2 * time.Second}
+	if tlsConfig != nil {
+		client.Net = "tcp-tls"
+		client.TLSConfig = tlsConfig
+	}
+
+	ips := []string{}
+	ttl := bootstrapMaxTTL
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := &dns.Msg{}
+		m.SetQuestion(dns.Fqdn(c.name), qtype)
+		reply, _, err := client.Exchange(m, addr)
+		if err != nil {
+			return nil, 0, err
+		}
+		if reply.Rcode != dns.RcodeSuccess {
+			return nil, 0, fmt.Errorf("query for %s returned %s",
+				dns.TypeToString[qtype], dns.RcodeToString[reply.Rcode])
+		}
+
+		for _, rr := range reply.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			ips = append(ips, ip.String())
+			if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+				ttl = t
+			}
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, 0, fmt.Errorf("no addresses found")
+	}
+	if ttl < bootstrapMinTTL {
+		ttl = bootstrapMinTTL
+	}
+	return ips, ttl, nil
+}
+
+// save the addresses to disk, atomically, so we never leave a partial file.
+func (c *bootstrapCache) save(ips []string) error {
+	if c.path == "" {
+		return nil
+	}
+
+	tmp := c.path + ".tmp"
+	err := os.WriteFile(tmp, []byte(strings.Join(ips, "\n")+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
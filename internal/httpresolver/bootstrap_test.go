@@ -0,0 +1,95 @@
+package httpresolver
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"github.com/miekg/dns"
+)
+
+func TestBootstrapCache(t *testing.T) {
+	var mu sync.Mutex
+	answers := map[uint16][]string{
+		dns.TypeA: {"doh.example. 300 A 192.0.2.1",
+			"doh.example. 120 A 192.0.2.2"},
+		dns.TypeAAAA: {"doh.example. 600 AAAA 2001:db8::1"},
+	}
+	addr := testutil.GetFreePort()
+	go testutil.ServeTestDNSServer(addr,
+		func(w dns.ResponseWriter, r *dns.Msg) {
+			m := &dns.Msg{}
+			m.SetReply(r)
+			mu.Lock()
+			for _, a := range answers[r.Question[0].Qtype] {
+				m.Answer = append(m.Answer, testutil.NewRR(t, a))
+			}
+			mu.Unlock()
+			w.WriteMsg(m)
+		})
+	testutil.WaitForDNSServer(addr)
+
+	dir := t.TempDir()
+	// The first fallback server is down, so the second is used.
+	down := testutil.GetFreePort()
+	c := newBootstrapCache("doh.example", []string{down, addr}, dir)
+	if err := c.load(); err != nil || len(c.get()) != 0 {
+		t.Fatalf("load with no file: %v %v", c.get(), err)
+	}
+
+	expected := []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}
+	c.maybeRefresh()
+	if !reflect.DeepEqual(c.get(), expected) {
+		t.Errorf("expected %v, got %v", expected, c.get())
+	}
+
+	// The lowest TTL is honored.
+	if d := time.Until(c.refresh); d < 110*time.Second || d > 120*time.Second {
+		t.Errorf("unexpected refresh in %v", d)
+	}
+
+	// Not due yet, so no refresh.
+	mu.Lock()
+	answers[dns.TypeA] = []string{"doh.example. 1 A 192.0.2.3"}
+	mu.Unlock()
+	c.maybeRefresh()
+	if !reflect.DeepEqual(c.get(), expected) {
+		t.Errorf("refreshed before the TTL expired: %v", c.get())
+	}
+
+	// A new cache picks up the saved addresses.
+	c2 := newBootstrapCache("doh.example", []string{down}, dir)
+	if err := c2.load(); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if !reflect.DeepEqual(c2.get(), expected) {
+		t.Errorf("loaded %v, expected %v", c2.get(), expected)
+	}
+
+	// If we can't refresh them, the last known-good ones are kept.
+	defer func(prev time.Duration) { bootstrapRetry = prev }(bootstrapRetry)
+	bootstrapRetry = 0
+	c2.maybeRefresh()
+	if !reflect.DeepEqual(c2.get(), expected) {
+		t.Errorf("lost the addresses after a failed refresh: %v", c2.get())
+	}
+
+	// Once due, the new addresses are used, and the TTL is clamped.
+	c.refresh = time.Time{}
+	c.maybeRefresh()
+	expected = []string{"192.0.2.3", "2001:db8::1"}
+	if !reflect.DeepEqual(c.get(), expected) {
+		t.Errorf("expected %v, got %v", expected, c.get())
+	}
+	if d := time.Until(c.refresh); d < bootstrapMinTTL-time.Second {
+		t.Errorf("TTL not clamped, refresh in %v", d)
+	}
+
+	// Broken files are not loaded.
+	writeFile(t, c.path, []byte("192.0.2.1\nbroken\n"))
+	if err := c2.load(); err == nil {
+		t.Errorf("broken file loaded: %v", c2.get())
+	}
+}
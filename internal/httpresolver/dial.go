@@ -0,0 +1,153 @@
+package httpresolver
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// How long to wait for a connection attempt before starting the next one in
+// parallel, as recommended by Happy Eyeballs (RFC 8305).
+// It is declared as a variable so we can tweak it for testing.
+var happyEyeballsDelay = 250 * time.Millisecond
+
+// dialContext returns the function to dial the upstream with: if we have
+// IPs for the upstream's host (see IP and Bootstrap, or the cached ones),
+// it connects to them (see dialRace) instead of resolving it. Other
+// addresses (like proxies) are dialed as usual; when the dialer resolves
+// the names itself, it already races IPv6 and IPv4.
+func (r *httpsResolver) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if len(r.dialIPs) == 0 && r.bootstrap == nil {
+		return dialer.DialContext
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || host != r.Upstream.Hostname() {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		ips := r.dialIPs
+		if r.bootstrap != nil {
+			ips = r.bootstrap.get()
+		}
+		if len(ips) > 0 {
+			addrs := []string{}
+			for _, ip := range interleave(ips) {
+				addrs = append(addrs, net.JoinHostPort(ip, port))
+			}
+			var conn net.Conn
+			conn, err = dialRace(ctx, dialer, network, addrs)
+			if err == nil {
+				return conn, nil
+			}
+		}
+
+		// The cached addresses may be stale (or we don't have any yet), so
+		// fall back to resolving the name.
+		if r.bootstrap != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		return nil, err
+	}
+}
+
+// dialRace connects to the given addresses Happy Eyeballs style: they are
+// tried in order, but if one doesn't connect within happyEyeballsDelay, the
+// next one is started in parallel (or right away, if it fails). The first connection wins,
+// and the rest are canceled. If they all fail, the last error is returned.
+func dialRace(ctx context.Context, dialer *net.Dialer, network string, addrs []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	// Close the connections of the attempts still pending when we return,
+	// in case they succeed anyway.
+	defer func() {
+		go func(n int) {
+			for ; n > 0; n-- {
+				if res := <-results; res.conn != nil {
+					res.conn.Close()
+				}
+			}
+		}(pending)
+	}()
+
+	var err error
+	for {
+		var timeout <-chan time.Time
+		if next < len(addrs) {
+			if pending == 0 {
+				start()
+				continue
+			}
+			timeout = time.After(happyEyeballsDelay)
+		} else if pending == 0 {
+			return nil, err
+		}
+
+		select {
+		case <-timeout:
+			start()
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.conn, nil
+			}
+			err = res.err
+			if next < len(addrs) {
+				start()
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// interleave returns the IPs with the address families alternating,
+// starting with the first one's, as recommended by Happy Eyeballs. The
+// order within each family is kept.
+func interleave(ips []string) []string {
+	if len(ips) == 0 {
+		return ips
+	}
+
+	isV4 := func(ip string) bool {
+		return net.ParseIP(ip).To4() != nil
+	}
+	first, second := []string{}, []string{}
+	for _, ip := range ips {
+		if isV4(ip) == isV4(ips[0]) {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+
+	out := []string{}
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
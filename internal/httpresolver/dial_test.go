@@ -0,0 +1,81 @@
+package httpresolver
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDialRace(t *testing.T) {
+	defer func(prev time.Duration) { happyEyeballsDelay = prev }(happyEyeballsDelay)
+	happyEyeballsDelay = 10 * time.Millisecond
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// An unreachable address (TEST-NET-1), which usually hangs, but may
+	// fail right away depending on the network; and an address with
+	// nothing listening, which fails right away.
+	dialer := &net.Dialer{}
+	hang := "192.0.2.1:" + port
+	refused := "127.0.0.2:" + port
+	good := ln.Addr().String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, addrs := range [][]string{
+		{good},
+		{refused, good},
+		{hang, good},
+		{hang, refused, good},
+	} {
+		start := time.Now()
+		conn, err := dialRace(ctx, dialer, "tcp", addrs)
+		if err != nil {
+			t.Errorf("%v: error dialing: %v", addrs, err)
+			continue
+		}
+		if a := conn.RemoteAddr().String(); a != good {
+			t.Errorf("%v: connected to %q", addrs, a)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%v: took too long: %v", addrs, d)
+		}
+		conn.Close()
+	}
+
+	_, err = dialRace(ctx, dialer, "tcp", []string{refused, refused})
+	if err == nil {
+		t.Errorf("dialing to closed addresses succeeded")
+	}
+
+	cctx, ccancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer ccancel()
+	_, err = dialRace(cctx, dialer, "tcp", []string{hang})
+	if err == nil {
+		t.Errorf("dialing with a canceled context succeeded")
+	}
+}
+
+func TestInterleave(t *testing.T) {
+	cases := []struct{ in, out []string }{
+		{[]string{}, []string{}},
+		{[]string{"192.0.2.1", "192.0.2.2"}, []string{"192.0.2.1", "192.0.2.2"}},
+		{[]string{"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"},
+			[]string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"}},
+		{[]string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1"},
+			[]string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "192.0.2.3"}},
+	}
+	for _, c := range cases {
+		if got := interleave(c.in); !reflect.DeepEqual(got, c.out) {
+			t.Errorf("interleave(%v) = %v, expected %v", c.in, got, c.out)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package httpresolver
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"blitiri.com.ar/go/dnss/internal/dnsclient"
+)
+
+// fallbackDialer connects to the fallback servers, which are used to
+// resolve the upstream's name. They are used in order: we stick to one
+// until it fails, and then move on to the next one, so one of them being
+// down doesn't stop us from resolving the upstream.
+type fallbackDialer struct {
+	addrs  []string
+	dialer net.Dialer
+
+	// Index of the server currently in use.
+	cur atomic.Int64
+}
+
+// newFallbackDialer returns a dialer for the given comma-separated list of
+// servers, or nil if the list is empty.
+func newFallbackDialer(fallbacks string) *fallbackDialer {
+	d := &fallbackDialer{}
+	for _, addr := range strings.Split(fallbacks, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			d.addrs = append(d.addrs, addr)
+		}
+	}
+	if len(d.addrs) == 0 {
+		return nil
+	}
+	return d
+}
+
+// DialContext connects to the current server (ignoring the given address),
+// moving on to the next ones if that fails. It is meant to be used as
+// net.Resolver.Dial.
+func (d *fallbackDialer) DialContext(ctx context.Context, network, _ string) (net.Conn, error) {
+	var err error
+	for range d.addrs {
+		i := d.cur.Load()
+		var conn net.Conn
+		addr, tlsConfig := dnsclient.ParseAddr(d.addrs[i])
+		if tlsConfig != nil {
+			// The resolver talks to stream connections using TCP framing,
+			// which is what DoT needs.
+			td := &tls.Dialer{NetDialer: &d.dialer, Config: tlsConfig}
+			conn, err = td.DialContext(ctx, "tcp", addr)
+		} else {
+			conn, err = d.dialer.DialContext(ctx, network, addr)
+		}
+		if err == nil {
+			// The resolver checks if the connection is a PacketConn to know
+			// how to talk to it, so we need to keep that.
+			if uc, ok := conn.(*net.UDPConn); ok {
+				return &fallbackUDPConn{uc, d, i}, nil
+			}
+			return &fallbackConn{conn, d, i}, nil
+		}
+		d.failed(i)
+	}
+	return nil, err
+}
+
+// failed marks the given server as failed, so the next connections go to the
+// next one. If it is not the current one, someone else noticed already.
+func (d *fallbackDialer) failed(i int64) {
+	d.cur.CompareAndSwap(i, (i+1)%int64(len(d.addrs)))
+}
+
+// fallbackConn and fallbackUDPConn mark the server as failed if there are
+// errors reading from them (e.g. timeouts).
+type fallbackConn struct {
+	net.Conn
+	d *fallbackDialer
+	i int64
+}
+
+func (c *fallbackConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.d.failed(c.i)
+	}
+	return n, err
+}
+
+type fallbackUDPConn struct {
+	*net.UDPConn
+	d *fallbackDialer
+	i int64
+}
+
+func (c *fallbackUDPConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if err != nil {
+		c.d.failed(c.i)
+	}
+	return n, err
+}
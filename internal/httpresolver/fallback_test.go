@@ -0,0 +1,125 @@
+package httpresolver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/dnsclient"
+	"blitiri.com.ar/go/dnss/internal/testutil"
+	"github.com/miekg/dns"
+)
+
+func TestFallbackDialer(t *testing.T) {
+	addr := testutil.GetFreePort()
+	go testutil.ServeTestDNSServer(addr,
+		testutil.MakeStaticHandler(t, "test.blah. A 1.2.3.4"))
+	testutil.WaitForDNSServer(addr)
+
+	// Nothing listens on this one.
+	down := testutil.GetFreePort()
+
+	d := newFallbackDialer(" " + down + ", " + addr + ",")
+	if !reflect.DeepEqual(d.addrs, []string{down, addr}) {
+		t.Fatalf("unexpected addresses: %v", d.addrs)
+	}
+
+	res := &net.Resolver{PreferGo: true, Dial: d.DialContext}
+	ips, err := res.LookupIP(context.Background(), "ip4", "test.blah")
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("1.2.3.4")) {
+		t.Errorf("unexpected result: %v", ips)
+	}
+
+	// We stick to the one that works.
+	if d.cur.Load() != 1 {
+		t.Errorf("expected to be using the second server, got %d",
+			d.cur.Load())
+	}
+	if _, err := res.LookupIP(context.Background(), "ip4", "test.blah"); err != nil {
+		t.Errorf("second lookup failed: %v", err)
+	}
+	if d.cur.Load() != 1 {
+		t.Errorf("moved away from a working server: %d", d.cur.Load())
+	}
+
+	if d := newFallbackDialer(" , "); d != nil {
+		t.Errorf("expected no dialer for an empty list, got %v", d.addrs)
+	}
+}
+
+func TestFallbackDoT(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dot.test"},
+		DNSNames:     []string{"dot.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	defer func(prev *x509.CertPool) { dnsclient.RootCAs = prev }(
+		dnsclient.RootCAs)
+	dnsclient.RootCAs = x509.NewCertPool()
+	dnsclient.RootCAs.AddCert(cert)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{
+			{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	dnsSrv := &dns.Server{
+		Net:      "tcp-tls",
+		Listener: ln,
+		Handler: dns.HandlerFunc(
+			testutil.MakeStaticHandler(t, "test.blah. A 1.2.3.4")),
+	}
+	go dnsSrv.ActivateAndServe()
+	defer dnsSrv.Shutdown()
+
+	fallback := "tls://" + ln.Addr().String() + "#dot.test"
+	d := newFallbackDialer(fallback)
+	res := &net.Resolver{PreferGo: true, Dial: d.DialContext}
+	ips, err := res.LookupIP(context.Background(), "ip4", "test.blah")
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("1.2.3.4")) {
+		t.Errorf("unexpected result: %v", ips)
+	}
+
+	c := newBootstrapCache("test.blah", []string{fallback}, "")
+	if _, _, err := c.resolve(); err != nil {
+		t.Errorf("bootstrap resolution over DoT failed: %v", err)
+	}
+
+	// The name is verified against the certificate.
+	d = newFallbackDialer("tls://" + ln.Addr().String() + "#other.test")
+	res = &net.Resolver{PreferGo: true, Dial: d.DialContext}
+	if _, err := res.LookupIP(context.Background(), "ip4", "test.blah"); err == nil {
+		t.Errorf("lookup with the wrong name succeeded")
+	}
+}
@@ -0,0 +1,168 @@
+package httpresolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"blitiri.com.ar/go/dnss/doh"
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+// Support for upstreams that only have the JSON API, like the one
+// implemented by dns.google:
+// https://developers.google.com/speed/public-dns/docs/doh/json.
+
+// Media type of the JSON API replies.
+const jsonMediaType = "application/dns-json"
+
+// Maximum size of a reply we are willing to read.
+const maxJSONSize = 64 * 1024
+
+// jsonResponse is the JSON representation of a DNS reply.
+type jsonResponse struct {
+	Status     int
+	TC         bool
+	RD         bool
+	RA         bool
+	AD         bool
+	CD         bool
+	Answer     []jsonRR
+	Authority  []jsonRR
+	Additional []jsonRR
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32
+	Data string `json:"data"`
+}
+
+// exchangeJSON resolves the query using the JSON API. Only the question,
+// and the DO and CD bits are sent; the client subnet too, if the query has
+// one.
+func (r *httpsResolver) exchangeJSON(ctx context.Context, tr *trace.Trace, client *http.Client, req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return nil, fmt.Errorf("the JSON API only supports one question")
+	}
+	q := req.Question[0]
+
+	u := *r.Upstream
+	params := u.Query()
+	params.Set("name", q.Name)
+	params.Set("type", strconv.Itoa(int(q.Qtype)))
+	if req.CheckingDisabled {
+		params.Set("cd", "1")
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		if opt.Do() {
+			params.Set("do", "1")
+		}
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				params.Set("edns_client_subnet", fmt.Sprintf("%s/%d",
+					ecs.Address, ecs.SourceNetmask))
+			}
+		}
+	}
+	u.RawQuery = params.Encode()
+
+	hreq, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request: %v", err)
+	}
+	if r.Host != "" {
+		hreq.Host = r.Host
+	}
+	for name, values := range r.Header {
+		for _, v := range values {
+			hreq.Header.Add(name, v)
+		}
+	}
+	hreq.Header.Set("Accept", jsonMediaType)
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	hr, err := client.Do(hreq)
+	if err != nil {
+		return nil, fmt.Errorf("GET failed: %w", err)
+	}
+	defer hr.Body.Close()
+
+	if hr.StatusCode != http.StatusOK {
+		return nil, &doh.StatusError{Proto: hr.Proto, Status: hr.Status,
+			StatusCode: hr.StatusCode}
+	}
+
+	// Some servers reply with application/json, or application/x-javascript
+	// (dns.google does, unless asked for application/dns-json).
+	ct, _, err := mime.ParseMediaType(hr.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse content type: %v", err)
+	}
+	if ct != jsonMediaType && ct != "application/json" &&
+		ct != "application/x-javascript" {
+		return nil, fmt.Errorf("unknown response content type %q", ct)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(hr.Body, maxJSONSize))
+	if err != nil {
+		return nil, fmt.Errorf("error reading from body: %v", err)
+	}
+
+	jr := &jsonResponse{}
+	if err := json.Unmarshal(body, jr); err != nil {
+		return nil, fmt.Errorf("error unmarshalling response: %v", err)
+	}
+
+	return fromJSON(tr, req, jr), nil
+}
+
+// fromJSON converts the JSON reply to a DNS message, as a reply to the
+// given query.
+func fromJSON(tr *trace.Trace, req *dns.Msg, jr *jsonResponse) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetReply(req)
+	m.Rcode = jr.Status
+	m.Truncated = jr.TC
+	m.RecursionAvailable = jr.RA
+	m.AuthenticatedData = jr.AD
+	m.CheckingDisabled = jr.CD
+
+	m.Answer = fromJSONRRs(tr, jr.Answer)
+	m.Ns = fromJSONRRs(tr, jr.Authority)
+	m.Extra = fromJSONRRs(tr, jr.Additional)
+
+	if opt := req.IsEdns0(); opt != nil {
+		m.SetEdns0(dns.DefaultMsgSize, opt.Do())
+	}
+	return m
+}
+
+func fromJSONRRs(tr *trace.Trace, jrrs []jsonRR) []dns.RR {
+	var rrs []dns.RR
+	for _, j := range jrrs {
+		t, ok := dns.TypeToString[j.Type]
+		if !ok {
+			t = fmt.Sprintf("TYPE%d", j.Type)
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s",
+			dns.Fqdn(j.Name), j.TTL, t, j.Data))
+		if err != nil || rr == nil {
+			// We can't do much if the data can't be parsed, skip the
+			// record instead of failing the whole reply.
+			tr.Printf("skipping unparseable record %v: %v", j, err)
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
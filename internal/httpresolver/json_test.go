@@ -0,0 +1,98 @@
+package httpresolver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/trace"
+	"github.com/miekg/dns"
+)
+
+func TestJSON(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" || r.Header.Get("Accept") != jsonMediaType {
+				t.Errorf("unexpected request: %s %v", r.Method, r.Header)
+			}
+			q := r.URL.Query()
+			if q.Get("name") != "test.blah." || q.Get("type") != "1" ||
+				q.Get("do") != "1" || q.Get("cd") != "" ||
+				q.Get("edns_client_subnet") != "192.0.2.0/24" {
+				t.Errorf("unexpected query: %v", q)
+			}
+
+			w.Header().Set("Content-Type", "application/x-javascript")
+			w.Write([]byte(`{"Status": 0, "TC": false, "RD": true,
+				"RA": true, "AD": true, "CD": false,
+				"Question": [{"name": "test.blah.", "type": 1}],
+				"Answer": [
+					{"name": "test.blah.", "type": 5, "TTL": 60,
+					 "data": "other.blah."},
+					{"name": "other.blah.", "type": 1, "TTL": 30,
+					 "data": "1.2.3.4"},
+					{"name": "other.blah.", "type": 1, "TTL": 30,
+					 "data": "not an IP"}],
+				"Authority": [
+					{"name": "blah.", "type": 6, "TTL": 300,
+					 "data": "ns.blah. admin.blah. 1 2 3 4 5"}]}`))
+		}))
+	defer ts.Close()
+
+	r := mustNewDoH(t, ts.URL+"/resolve")
+	r.JSON = true
+
+	tr := trace.New("test", "TestJSON")
+	defer tr.Finish()
+
+	req := &dns.Msg{}
+	req.SetQuestion("test.blah.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       []byte{192, 0, 2, 0},
+	})
+
+	resp, err := r.Query(req, tr)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if resp.Id != req.Id || !resp.Response || !resp.AuthenticatedData ||
+		!resp.RecursionAvailable || resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("unexpected header: %v", resp.MsgHdr)
+	}
+	if len(resp.Answer) != 2 || len(resp.Ns) != 1 {
+		t.Fatalf("unexpected reply: %v", resp)
+	}
+	if a := resp.Answer[1].(*dns.A); a.A.String() != "1.2.3.4" ||
+		a.Hdr.Ttl != 30 {
+		t.Errorf("unexpected A record: %v", a)
+	}
+	if opt := resp.IsEdns0(); opt == nil || !opt.Do() {
+		t.Errorf("missing or wrong OPT record: %v", opt)
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	for _, c := range []struct{ body, ct string }{
+		{`{"Status": 0`, jsonMediaType},
+		{`{"Status": 0}`, "text/html"},
+		{`{"Status": 0}`, ""},
+	} {
+		body, ct := c.body, c.ct
+		ts := httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", ct)
+				w.Write([]byte(body))
+			}))
+
+		r := mustNewDoH(t, ts.URL)
+		r.JSON = true
+		if _, err := query(t, r, "test.blah."); err == nil {
+			t.Errorf("%q %q: expected error, got nil", body, ct)
+		}
+		ts.Close()
+	}
+}
@@ -0,0 +1,64 @@
+package httpresolver
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Public key pinning for the upstreams: on top of the usual verification,
+// the certificate chain must include one of the pinned public keys. This
+// protects us from a compromised (or coerced) CA issuing certificates for
+// the upstream.
+//
+// The pins are the base64-encoded SHA-256 hashes of the DER-encoded Subject
+// Public Key Info, like in HPKP (RFC 7469). They can be computed with:
+//
+//	openssl x509 -in cert.pem -pubkey -noout |
+//	  openssl pkey -pubin -outform der |
+//	  openssl dgst -sha256 -binary | base64
+
+var errNoPinnedKey = errors.New("no pinned key in the certificate chain")
+
+// pinVerifier returns a function to use as tls.Config.VerifyConnection,
+// which checks that the connection's verified chains include one of the keys
+// in the given comma-separated list of pins.
+func pinVerifier(pins string) (func(tls.ConnectionState) error, error) {
+	pinned := map[[sha256.Size]byte]bool{}
+	for _, p := range strings.Split(pins, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		h, err := base64.StdEncoding.DecodeString(p)
+		if err != nil || len(h) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %q, must be a base64 "+
+				"SHA-256 hash", p)
+		}
+		pinned[[sha256.Size]byte(h)] = true
+	}
+	if len(pinned) == 0 {
+		return nil, fmt.Errorf("no pins given")
+	}
+
+	return func(cs tls.ConnectionState) error {
+		// The chains are verified before this is called, unless
+		// verification is disabled; in that case, just look at what the
+		// server sent.
+		chains := cs.VerifiedChains
+		if len(chains) == 0 {
+			chains = [][]*x509.Certificate{cs.PeerCertificates}
+		}
+		for _, chain := range chains {
+			for _, cert := range chain {
+				if pinned[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+					return nil
+				}
+			}
+		}
+		return errNoPinnedKey
+	}, nil
+}
@@ -1,20 +1,21 @@
 package httpresolver
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
+	"expvar"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"mime"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"blitiri.com.ar/go/dnss/doh"
+	"blitiri.com.ar/go/dnss/internal/budget"
 	"blitiri.com.ar/go/dnss/internal/dnsserver"
 	"blitiri.com.ar/go/dnss/internal/trace"
 
@@ -25,13 +26,92 @@ import (
 // httpsResolver implements the dnsserver.Resolver interface by querying a
 // server via DNS over HTTPS (DoH, RFC 8484).
 type httpsResolver struct {
-	Upstream  *url.URL
-	CAFile    string
-	tlsConfig *tls.Config
+	Upstream *url.URL
+
+	// Comma-separated list of files and directories with the CAs to verify
+	// the upstream with. If empty, the system's CAs are used.
+	// They are reloaded when they change.
+	CAFile string
+
+	// Also trust the system's CAs, in addition to the ones in CAFile.
+	SystemCAs bool
+
+	// Comma-separated list of public key pins (base64-encoded SHA-256
+	// hashes of the SPKI); if set, the upstream's certificate chain must
+	// include one of them. See pin.go for details.
+	Pins string
+
+	// Minimum TLS version to use with the upstream ("1.2", "1.3"), and
+	// comma-separated list of allowed cipher suites (which only apply up to
+	// TLS 1.2, the ones in 1.3 are not configurable). If empty, the Go
+	// defaults are used.
+	MinTLSVersion string
+	CipherSuites  string
 
-	// net.Resolver that will contact the server at --fallback_upstream for
-	// DNS resolutions.
+	tlsConfig *tls.Config
+	trust     *trustStore
+	caChecked time.Time
+
+	// If set, use this as the HTTP Host header and TLS server name (SNI),
+	// instead of the upstream URL's host, which is still used to connect.
+	Host string
+
+	// If set, connect to this IP address instead of resolving the upstream
+	// URL's host, which is still used for the HTTP Host header and to verify
+	// the certificate. This avoids having to resolve the upstream's name
+	// before we can resolve anything.
+	IP string
+
+	// Comma-separated list of IP addresses to use for the upstream URL's
+	// host, instead of resolving it. Unlike IP, they are all tried until
+	// one works (see dialRace).
+	Bootstrap string
+
+	// Addresses to dial instead of the upstream's host, from IP or
+	// Bootstrap.
+	dialIPs []string
+
+	// Directory to save the upstream's addresses to, once resolved via the
+	// fallback upstream, so they can be used on the next start even if the
+	// fallback upstream is not reachable then. See bootstrap.go.
+	BootstrapDir string
+
+	// Cache of the upstream's addresses, if we have to resolve its name
+	// (that is, if it is not an IP, and neither IP nor Bootstrap are set).
+	bootstrap *bootstrapCache
+
+	// Additional HTTP headers to send to the upstream (for example, for
+	// authentication).
+	Header http.Header
+
+	// Send the queries with GET instead of POST, so HTTP caches can answer
+	// them (see doh.Client.GET).
+	GET bool
+
+	// Use the JSON API instead of DoH, for upstreams that only have that.
+	// The forwarding loop detection does not work over it.
+	JSON bool
+
+	// Timeout for the HTTP requests; how long to see errors for before
+	// rotating the client (see maybeRotateClient); and how often to do the
+	// periodic maintenance (rotating the client, reloading the CAs, etc.).
+	// NewDoH sets them to the defaults.
+	Timeout        time.Duration
+	RotateAfter    time.Duration
+	MaintainPeriod time.Duration
+
+	// If set, send a query to the upstream this often, to detect dead
+	// connections before the clients' queries do (see maybeProbe).
+	ProbePeriod time.Duration
+	lastProbe   time.Time
+
+	// net.Resolver that will contact the servers at --fallback_upstream for
+	// DNS resolutions, and their addresses.
 	fallbackResolver *net.Resolver
+	fallback         []string
+
+	// Tracks the queries the upstream answered successfully, for alerting.
+	budget *budget.Tracker
 
 	mu       sync.Mutex
 	client   *http.Client
@@ -41,39 +121,78 @@ type httpsResolver struct {
 
 var errAppendingCerts = fmt.Errorf("error appending certificates")
 
-func loadCertPool(caFile string) (*x509.CertPool, error) {
-	pemData, err := ioutil.ReadFile(caFile)
-	if err != nil {
-		return nil, err
-	}
+// Exported variables for statistics. The time since the last successful
+// query to each upstream is exported by the budget package.
+var stats = struct {
+	// Requests sent to the upstreams.
+	requests *expvar.Int
+
+	// Failed requests, by class: "timeout" and "transport" for errors
+	// connecting to the upstream, "http" for non-200 replies, and
+	// "response" for invalid replies.
+	failures *expvar.Map
+
+	// HTTP errors returned by the upstreams, by status code.
+	httpErrors *expvar.Map
+
+	// Requests retried after transient errors.
+	retries *expvar.Int
+
+	// Clients rotated because of persistent errors.
+	rotations *expvar.Int
+
+	// Health probes sent to the upstreams, by result ("ok", "failed").
+	probes *expvar.Map
+}{}
+
+func init() {
+	stats.requests = expvar.NewInt("httpresolver-requests")
+	stats.failures = expvar.NewMap("httpresolver-failures")
+	stats.httpErrors = expvar.NewMap("httpresolver-http-errors")
+	stats.retries = expvar.NewInt("httpresolver-retries")
+	stats.rotations = expvar.NewInt("httpresolver-client-rotations")
+	stats.probes = expvar.NewMap("httpresolver-probes")
+}
 
-	pool := x509.NewCertPool()
-	if !pool.AppendCertsFromPEM(pemData) {
-		return nil, errAppendingCerts
-	}
+// How many times to retry the requests that failed with transient errors,
+// and the initial backoff between retries (see retryDelay).
+// They are declared as variables so we can tweak them for testing.
+var (
+	maxRetries   = 2
+	retryBackoff = 100 * time.Millisecond
+)
 
-	return pool, nil
-}
+// How often to check if the CA files changed.
+// It is declared as a variable so we can tweak it for testing.
+var caCheckPeriod = 30 * time.Second
+
+// Defaults for the timeouts and periods of the client.
+const (
+	DefaultTimeout        = 4 * time.Second
+	DefaultRotateAfter    = 10 * time.Second
+	DefaultMaintainPeriod = 2 * time.Second
+)
 
 // NewDoH creates a new DoH resolver, which uses the given upstream
-// URL to resolve queries.
+// URL to resolve queries. The upstream's name is resolved using the given
+// fallback servers (comma-separated list, used in order), if any.
 func NewDoH(upstream *url.URL, caFile, fallback string) *httpsResolver {
 	r := &httpsResolver{
-		Upstream: upstream,
-		CAFile:   caFile,
+		Upstream:       upstream,
+		CAFile:         caFile,
+		Timeout:        DefaultTimeout,
+		RotateAfter:    DefaultRotateAfter,
+		MaintainPeriod: DefaultMaintainPeriod,
+		budget:         budget.Get("upstream " + upstream.String()),
 	}
 
-	if fallback != "" {
-		// Dial function that will always use the fallback address to contact
-		// DNS.
-		dialer := net.Dialer{}
-		dialFallback := func(ctx context.Context, network, address string) (net.Conn, error) {
-			return dialer.DialContext(ctx, network, fallback)
-		}
+	if d := newFallbackDialer(fallback); d != nil {
+		r.fallback = d.addrs
 
+		// Always use the fallback servers to contact DNS.
 		r.fallbackResolver = &net.Resolver{
 			PreferGo: true, // Avoid the system resolver.
-			Dial:     dialFallback,
+			Dial:     d.DialContext,
 		}
 	}
 
@@ -84,16 +203,83 @@ func (r *httpsResolver) Init() error {
 	// If CAFile is empty, we're ok with the defaults (use the system default
 	// CA database).
 	if r.CAFile != "" {
-		pool, err := loadCertPool(r.CAFile)
+		r.trust = newTrustStore(r.CAFile, r.SystemCAs)
+		pool, err := r.trust.load()
 		if err != nil {
 			return err
 		}
+		r.caChecked = time.Now()
 
 		r.tlsConfig = &tls.Config{
 			RootCAs: pool,
 		}
 	}
 
+	if r.Host != "" {
+		if r.tlsConfig == nil {
+			r.tlsConfig = &tls.Config{}
+		}
+
+		// The Host header can have a port, but the server name can't.
+		name, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			name = r.Host
+		}
+		r.tlsConfig.ServerName = name
+	}
+
+	r.dialIPs = nil
+	for _, ip := range strings.Split(r.IP+","+r.Bootstrap, ",") {
+		if ip = strings.TrimSpace(ip); ip == "" {
+			continue
+		}
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid upstream IP address %q", ip)
+		}
+		r.dialIPs = append(r.dialIPs, ip)
+	}
+
+	r.bootstrap = nil
+	host := r.Upstream.Hostname()
+	if len(r.dialIPs) == 0 && len(r.fallback) > 0 && net.ParseIP(host) == nil {
+		r.bootstrap = newBootstrapCache(host, r.fallback, r.BootstrapDir)
+		if err := r.bootstrap.load(); err != nil {
+			// Not fatal, we will resolve them again.
+			log.Errorf("Error loading upstream addresses: %v", err)
+		}
+	}
+
+	if r.Pins != "" {
+		verify, err := pinVerifier(r.Pins)
+		if err != nil {
+			return err
+		}
+		if r.tlsConfig == nil {
+			r.tlsConfig = &tls.Config{}
+		}
+		r.tlsConfig.VerifyConnection = verify
+	}
+
+	if r.MinTLSVersion != "" || r.CipherSuites != "" {
+		version, err := parseTLSVersion(r.MinTLSVersion)
+		if err != nil {
+			return err
+		}
+		suites, err := parseCipherSuites(r.CipherSuites)
+		if err != nil {
+			return err
+		}
+		if r.tlsConfig == nil {
+			r.tlsConfig = &tls.Config{}
+		}
+		r.tlsConfig.MinVersion = version
+		r.tlsConfig.CipherSuites = suites
+	}
+
+	if r.MaintainPeriod <= 0 {
+		return fmt.Errorf("invalid maintain period %v", r.MaintainPeriod)
+	}
+
 	client, err := r.newClient()
 
 	r.mu.Lock()
@@ -106,6 +292,14 @@ func (r *httpsResolver) Init() error {
 }
 
 func (r *httpsResolver) newClient() (*http.Client, error) {
+	// Reasonable defaults, based on http.DefaultTransport.
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 1 * time.Second,
+		DualStack: true,
+		Resolver:  r.fallbackResolver,
+	}
+
 	transport := &http.Transport{
 		TLSClientConfig: r.tlsConfig,
 
@@ -117,13 +311,7 @@ func (r *httpsResolver) newClient() (*http.Client, error) {
 		// which can happen with intermittent network issues.
 		IdleConnTimeout: 30 * time.Second,
 
-		// Reasonable defaults, based on http.DefaultTransport.
-		DialContext: (&net.Dialer{
-			Timeout:   10 * time.Second,
-			KeepAlive: 1 * time.Second,
-			DualStack: true,
-			Resolver:  r.fallbackResolver,
-		}).DialContext,
+		DialContext:           r.dialContext(dialer),
 		ForceAttemptHTTP2:     true,
 		MaxIdleConns:          10,
 		TLSHandshakeTimeout:   4 * time.Second,
@@ -131,9 +319,10 @@ func (r *httpsResolver) newClient() (*http.Client, error) {
 	}
 
 	client := &http.Client{
-		// Give our HTTP requests 4 second timeouts: DNS usually doesn't wait
-		// that long anyway, but this helps with slow connections.
-		Timeout: 4 * time.Second,
+		// Give our HTTP requests short timeouts (4s by default): DNS usually
+		// doesn't wait that long anyway, but this helps with slow
+		// connections.
+		Timeout: r.Timeout,
 
 		Transport: transport,
 	}
@@ -156,9 +345,51 @@ func (r *httpsResolver) setClientError(err error) {
 }
 
 func (r *httpsResolver) Maintain() {
-	for range time.Tick(2 * time.Second) {
+	for range time.Tick(r.MaintainPeriod) {
 		r.maybeRotateClient()
+		r.maybeProbe()
+		r.maybeReloadCAs()
+		if r.bootstrap != nil {
+			r.bootstrap.maybeRefresh()
+		}
+	}
+}
+
+// maybeReloadCAs reloads the CAs if their files changed, and replaces the
+// client so the new connections use them.
+func (r *httpsResolver) maybeReloadCAs() {
+	if r.trust == nil || time.Since(r.caChecked) < caCheckPeriod {
+		return
+	}
+	r.caChecked = time.Now()
+
+	if !r.trust.changed() {
+		return
+	}
+
+	pool, err := r.trust.load()
+	if err != nil {
+		log.Errorf("Error reloading CAs from %q, keeping the old ones: %v",
+			r.CAFile, err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tlsConfig := r.tlsConfig.Clone()
+	tlsConfig.RootCAs = pool
+	r.tlsConfig = tlsConfig
+
+	client, err := r.newClient()
+	if err != nil {
+		r.tr.Errorf("Error creating new client: %v", err)
+		return
 	}
+	r.client.CloseIdleConnections()
+	r.client = client
+	r.tr.Printf("Reloaded CAs, new client: %p", r.client)
+	log.Infof("Reloaded CAs from %q", r.CAFile)
 }
 
 func (r *httpsResolver) maybeRotateClient() {
@@ -169,7 +400,7 @@ func (r *httpsResolver) maybeRotateClient() {
 		return
 	}
 
-	// If we've seen errors for the last 10s, rotate the client.
+	// If we've seen errors for a while (10s by default), rotate the client.
 	// This is unfortunately needed because the Go HTTP/2 transport will
 	// insist on using a dead connection for a long time, and cannot be told
 	// to close it. This causes problems when the computer changes connections
@@ -178,80 +409,215 @@ func (r *httpsResolver) maybeRotateClient() {
 	// connection, and the old one will die in the background.
 	// The time chosen here combines with the transport timeouts set above, so
 	// we never have too many in-flight connections.
-	if time.Since(r.firstErr) > 10*time.Second {
-		// Close the old trace, and create a new one.
-		// This makes it easier to analyze the client behaviour in the traces.
-		r.tr.Errorf("Rotating client after %s of errors: %p",
-			time.Since(r.firstErr), r.client)
-		r.tr.Finish()
-
-		r.tr = trace.New("httpresolver.Client", r.Upstream.String())
-		client, err := r.newClient()
-		if err != nil {
-			r.tr.Errorf("Error creating new client: %v", err)
-			return
-		}
-
-		r.client = client
-		r.firstErr = time.Time{}
-		r.tr.Printf("Rotated client: %p", r.client)
+	if time.Since(r.firstErr) > r.RotateAfter {
+		r.rotateClient(fmt.Sprintf("%s of errors", time.Since(r.firstErr)))
 	}
 }
 
-func (r *httpsResolver) Query(req *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
-	packed, err := req.Pack()
+// rotateClient replaces the client with a new one. Must be called with r.mu
+// held.
+func (r *httpsResolver) rotateClient(reason string) {
+	// Close the old trace, and create a new one.
+	// This makes it easier to analyze the client behaviour in the traces.
+	r.tr.Errorf("Rotating client after %s: %p", reason, r.client)
+	r.tr.Finish()
+
+	r.tr = trace.New("httpresolver.Client", r.Upstream.String())
+	client, err := r.newClient()
 	if err != nil {
-		return nil, fmt.Errorf("cannot pack query: %v", err)
+		r.tr.Errorf("Error creating new client: %v", err)
+		return
 	}
 
-	if log.V(1) {
-		tr.Printf("DoH POST %v", r.Upstream)
-	}
+	r.client = client
+	r.firstErr = time.Time{}
+	stats.rotations.Add(1)
+	r.tr.Printf("Rotated client: %p", r.client)
+}
 
-	// TODO: Accept header.
+// maybeProbe sends a query to the upstream if it's been ProbePeriod since
+// the last one, and rotates the client if it fails at the transport level.
+// This way we find out about dead connections (e.g. after a network change)
+// before the clients' queries do.
+func (r *httpsResolver) maybeProbe() {
+	if r.ProbePeriod <= 0 || time.Since(r.lastProbe) < r.ProbePeriod {
+		return
+	}
+	r.lastProbe = time.Now()
 
 	r.mu.Lock()
 	client := r.client
 	r.mu.Unlock()
 
-	hr, err := client.Post(
-		r.Upstream.String(),
-		"application/dns-message",
-		bytes.NewReader(packed))
-	r.setClientError(err)
-	if err != nil {
-		return nil, fmt.Errorf("POST failed: %v", err)
+	tr := trace.New("httpresolver.Probe", r.Upstream.String())
+	defer tr.Finish()
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+
+	req := &dns.Msg{}
+	req.SetQuestion(".", dns.TypeNS)
+	_, err := r.exchange(ctx, tr, client, req)
+	if err == nil {
+		stats.probes.Add("ok", 1)
+		tr.Printf("Probe successful")
+		return
 	}
-	tr.Printf("%s  %s", hr.Proto, hr.Status)
-	defer hr.Body.Close()
 
-	if hr.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Response status: %s", hr.Status)
+	stats.probes.Add("failed", 1)
+	tr.Errorf("Probe failed: %v", err)
+	if failureClass(err) != "timeout" && failureClass(err) != "transport" {
+		// The upstream is reachable, the problem is elsewhere.
+		return
 	}
 
-	// Read the HTTPS response, and parse the message.
-	ct, _, err := mime.ParseMediaType(hr.Header.Get("Content-Type"))
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse content type: %v", err)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.client == client {
+		r.rotateClient("failed probe")
 	}
+}
 
-	if ct != "application/dns-message" {
-		return nil, fmt.Errorf("unknown response content type %q", ct)
+func (r *httpsResolver) Query(req *dns.Msg, tr *trace.Trace) (*dns.Msg, error) {
+	if log.V(1) {
+		method := "DoH POST"
+		if r.JSON {
+			method = "JSON GET"
+		} else if r.GET {
+			method = "DoH GET"
+		}
+		tr.Printf("%s %v", method, r.Upstream)
 	}
+	tr.SetPolicy("upstream", r.Upstream.String())
 
-	respRaw, err := ioutil.ReadAll(io.LimitReader(hr.Body, 64*1024))
-	if err != nil {
-		return nil, fmt.Errorf("error reading from body: %v", err)
+	r.mu.Lock()
+	client := r.client
+	r.mu.Unlock()
+
+	// Transient errors (like connection resets) are retried, with
+	// backoff, as long as we are within the timeout (and the query's
+	// deadline, if it has one).
+	qctx, qcancel := tr.Context(context.Background())
+	defer qcancel()
+	ctx, cancel := context.WithTimeout(qctx, r.Timeout)
+	defer cancel()
+
+	var respDNS *dns.Msg
+	var err error
+	for attempt := 0; ; attempt++ {
+		stats.requests.Add(1)
+		respDNS, err = r.exchange(ctx, tr, client, req)
+		if err == nil {
+			break
+		}
+		stats.failures.Add(failureClass(err), 1)
+
+		if attempt >= maxRetries || failureClass(err) != "transport" {
+			break
+		}
+		delay := retryDelay(attempt)
+		tr.Printf("Retrying in %v after error: %v", delay, err)
+		if !sleepCtx(ctx, delay) {
+			break
+		}
+		stats.retries.Add(1)
+	}
+
+	// Only errors at the HTTP transport level count as client errors, the
+	// rest are problems with the server or the query.
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		r.setClientError(err)
+	} else {
+		r.setClientError(nil)
 	}
 
-	respDNS := &dns.Msg{}
-	err = respDNS.Unpack(respRaw)
 	if err != nil {
-		return nil, fmt.Errorf("error unpacking response: %v", err)
+		r.budget.Record(false)
+		return nil, statusError(err)
 	}
 
+	r.budget.Record(respDNS.Rcode != dns.RcodeServerFailure)
 	return respDNS, nil
 }
 
+// exchange sends the query to the upstream, once.
+func (r *httpsResolver) exchange(ctx context.Context, tr *trace.Trace, client *http.Client, req *dns.Msg) (*dns.Msg, error) {
+	if r.JSON {
+		return r.exchangeJSON(ctx, tr, client, req)
+	}
+
+	c := &doh.Client{
+		URL:        r.Upstream,
+		HTTPClient: client,
+		Host:       r.Host,
+		Header:     r.Header,
+		Padding:    true,
+		GET:        r.GET,
+	}
+	// Note the queries are not tagged for loop detection, as the tag would
+	// let the upstream link all our queries together.
+	return c.Exchange(ctx, req)
+}
+
+// retryDelay returns how long to wait before retrying after the given
+// (0-based) attempt: the first retry is right away, and then the delay
+// doubles each time.
+func retryDelay(attempt int) time.Duration {
+	if attempt == 0 {
+		return 0
+	}
+	return retryBackoff << (attempt - 1)
+}
+
+// sleepCtx sleeps for the given duration, or until the context is done.
+// It returns false in the latter case.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// failureClass returns the class of the error, for the statistics.
+func failureClass(err error) string {
+	var uerr *url.Error
+	var serr *doh.StatusError
+	switch {
+	case errors.As(err, &uerr) && uerr.Timeout():
+		return "timeout"
+	case errors.As(err, &uerr):
+		return "transport"
+	case errors.As(err, &serr):
+		return "http"
+	default:
+		return "response"
+	}
+}
+
+// statusError counts the HTTP errors returned by the upstream, and makes the
+// ones that mean it is refusing to serve us stand out in the logs. The
+// original error is wrapped, so the DNS server can pick the right Extended
+// DNS Error for the clients.
+func statusError(err error) error {
+	var serr *doh.StatusError
+	if !errors.As(err, &serr) {
+		return err
+	}
+
+	stats.httpErrors.Add(strconv.Itoa(serr.StatusCode), 1)
+	switch serr.StatusCode {
+	case http.StatusTooManyRequests:
+		return fmt.Errorf("upstream is rate limiting us: %w", err)
+	case http.StatusForbidden:
+		return fmt.Errorf("upstream refused the query: %w", err)
+	}
+	return err
+}
+
 // Compile-time check that the implementation matches the interface.
 var _ dnsserver.Resolver = &httpsResolver{}
@@ -1,14 +1,28 @@
 package httpresolver
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"expvar"
 	"fmt"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"blitiri.com.ar/go/dnss/internal/testutil"
 	"blitiri.com.ar/go/dnss/internal/trace"
@@ -88,6 +102,310 @@ func TestBasic(t *testing.T) {
 	queryExpectA(t, r, "test.blah.", "1.2.3.4")
 }
 
+func TestGET(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" || r.FormValue("dns") == "" {
+				http.Error(w, "expected GET", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/dns-message")
+			m := &dns.Msg{}
+			m.Answer = append(m.Answer,
+				testutil.NewRR(t, "test.blah. A 1.2.3.4"))
+			msg, _ := m.Pack()
+			w.Write(msg)
+		}))
+	defer ts.Close()
+
+	r := mustNewDoH(t, ts.URL)
+	r.GET = true
+	queryExpectA(t, r, "test.blah.", "1.2.3.4")
+}
+
+func TestHostOverride(t *testing.T) {
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Host != "example.com" ||
+				r.TLS.ServerName != "example.com" {
+				http.Error(w, "wrong host", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/dns-message")
+			m := &dns.Msg{}
+			m.Answer = append(m.Answer,
+				testutil.NewRR(t, "test.blah. A 1.2.3.4"))
+			msg, _ := m.Pack()
+			w.Write(msg)
+		}))
+	defer ts.Close()
+
+	// The test server's certificate is valid for example.com, but we connect
+	// to it using its IP address.
+	caFile := t.TempDir() + "/ca.pem"
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatalf("error writing CA file: %v", err)
+	}
+
+	u, _ := url.Parse(ts.URL)
+	r := NewDoH(u, caFile, "0.0.0.0:0")
+	r.Host = "example.com"
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+	queryExpectA(t, r, "test.blah.", "1.2.3.4")
+}
+
+func TestIPOverride(t *testing.T) {
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS.ServerName != "example.com" {
+				http.Error(w, "wrong server name", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/dns-message")
+			m := &dns.Msg{}
+			m.Answer = append(m.Answer,
+				testutil.NewRR(t, "test.blah. A 1.2.3.4"))
+			msg, _ := m.Pack()
+			w.Write(msg)
+		}))
+	defer ts.Close()
+
+	caFile := t.TempDir() + "/ca.pem"
+	writeFile(t, caFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}))
+
+	// Use a name that can't be resolved, we should never need to.
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	u, _ := url.Parse("https://example.com:" + port + "/dns-query")
+	r := NewDoH(u, caFile, "0.0.0.0:0")
+	r.IP = "127.0.0.1"
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+	queryExpectA(t, r, "test.blah.", "1.2.3.4")
+
+	// Bootstrap IPs are tried in order; nothing listens on 127.0.0.2 (the
+	// test server is on 127.0.0.1 only), so that one fails right away.
+	r = NewDoH(u, caFile, "0.0.0.0:0")
+	r.Bootstrap = "127.0.0.2, 127.0.0.1"
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+	queryExpectA(t, r, "test.blah.", "1.2.3.4")
+
+	r = NewDoH(u, caFile, "0.0.0.0:0")
+	r.Bootstrap = "127.0.0.2"
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+	queryExpectErr(t, r, "test.blah.", "refused")
+
+	r = NewDoH(u, caFile, "0.0.0.0:0")
+	r.IP = "example.com"
+	if err := r.Init(); err == nil {
+		t.Errorf("Init() with an invalid IP succeeded")
+	}
+	r.IP = ""
+	r.Bootstrap = "127.0.0.1, example.com"
+	if err := r.Init(); err == nil {
+		t.Errorf("Init() with an invalid bootstrap IP succeeded")
+	}
+}
+
+func TestPins(t *testing.T) {
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/dns-message")
+			m := &dns.Msg{}
+			m.Answer = append(m.Answer,
+				testutil.NewRR(t, "test.blah. A 1.2.3.4"))
+			msg, _ := m.Pack()
+			w.Write(msg)
+		}))
+	defer ts.Close()
+
+	caFile := t.TempDir() + "/ca.pem"
+	writeFile(t, caFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}))
+
+	spki := sha256.Sum256(ts.Certificate().RawSubjectPublicKeyInfo)
+	goodPin := base64.StdEncoding.EncodeToString(spki[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	newDoH := func(pins string) *httpsResolver {
+		t.Helper()
+		u, _ := url.Parse(ts.URL)
+		r := NewDoH(u, caFile, "0.0.0.0:0")
+		r.Host = "example.com"
+		r.Pins = pins
+		if err := r.Init(); err != nil {
+			t.Fatalf("Init() failed: %v", err)
+		}
+		return r
+	}
+
+	queryExpectA(t, newDoH(goodPin), "test.blah.", "1.2.3.4")
+	queryExpectA(t, newDoH(otherPin+", "+goodPin), "test.blah.", "1.2.3.4")
+	queryExpectErr(t, newDoH(otherPin), "test.blah.", "no pinned key")
+
+	// Invalid pins are rejected at Init.
+	for _, pins := range []string{"not base64!", "aGVsbG8=", ","} {
+		u, _ := url.Parse(ts.URL)
+		r := NewDoH(u, caFile, "0.0.0.0:0")
+		r.Pins = pins
+		if err := r.Init(); err == nil {
+			t.Errorf("Init() with pins %q succeeded", pins)
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	ts := httptest.NewUnstartedServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/dns-message")
+			m := &dns.Msg{}
+			m.Answer = append(m.Answer,
+				testutil.NewRR(t, "test.blah. A 1.2.3.4"))
+			msg, _ := m.Pack()
+			w.Write(msg)
+		}))
+	ts.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := t.TempDir() + "/ca.pem"
+	writeFile(t, caFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}))
+
+	newDoH := func(version, suites string) *httpsResolver {
+		t.Helper()
+		u, _ := url.Parse(ts.URL)
+		r := NewDoH(u, caFile, "0.0.0.0:0")
+		r.Host = "example.com"
+		r.MinTLSVersion = version
+		r.CipherSuites = suites
+		if err := r.Init(); err != nil {
+			t.Fatalf("Init() failed: %v", err)
+		}
+		return r
+	}
+
+	queryExpectA(t, newDoH("1.2", ""), "test.blah.", "1.2.3.4")
+	queryExpectA(t, newDoH("", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"),
+		"test.blah.", "1.2.3.4")
+
+	// The server doesn't support TLS 1.3, or the suite (the test
+	// certificate has an RSA key).
+	queryExpectErr(t, newDoH("1.3", ""), "test.blah.", "version")
+	queryExpectErr(t,
+		newDoH("", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"),
+		"test.blah.", "handshake failure")
+
+	// Invalid settings are rejected at Init.
+	for _, c := range [][2]string{
+		{"1.4", ""}, {"tls1.3", ""},
+		{"", "TLS_NOPE"}, {"", "TLS_RSA_WITH_RC4_128_SHA"},
+	} {
+		u, _ := url.Parse(ts.URL)
+		r := NewDoH(u, caFile, "0.0.0.0:0")
+		r.MinTLSVersion, r.CipherSuites = c[0], c[1]
+		if err := r.Init(); err == nil {
+			t.Errorf("Init() with %q succeeded", c)
+		}
+	}
+}
+
+func TestReloadCAs(t *testing.T) {
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/dns-message")
+			m := &dns.Msg{}
+			m.Answer = append(m.Answer,
+				testutil.NewRR(t, "test.blah. A 1.2.3.4"))
+			msg, _ := m.Pack()
+			w.Write(msg)
+		}))
+	defer ts.Close()
+
+	// Start with a directory that has an unrelated CA, and a file which is
+	// not a certificate (which should be skipped).
+	dir := t.TempDir()
+	writeFile(t, dir+"/other.pem", newCA(t))
+	writeFile(t, dir+"/README", []byte("not a certificate\n"))
+
+	u, _ := url.Parse(ts.URL)
+	r := NewDoH(u, dir, "0.0.0.0:0")
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+	queryExpectErr(t, r, "test.blah.", "certificate")
+
+	// Nothing changed, so there's nothing to reload.
+	prevCheckPeriod := caCheckPeriod
+	caCheckPeriod = 0
+	defer func() { caCheckPeriod = prevCheckPeriod }()
+
+	client := r.client
+	r.maybeReloadCAs()
+	if r.client != client {
+		t.Errorf("client replaced without CA changes")
+	}
+
+	// Add the server's CA, which should be picked up.
+	writeFile(t, dir+"/server.pem", pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}))
+	r.maybeReloadCAs()
+	if r.client == client {
+		t.Errorf("client not replaced after CA changes")
+	}
+	queryExpectA(t, r, "test.blah.", "1.2.3.4")
+
+	// Broken files are not loaded, and we keep the old CAs.
+	writeFile(t, dir+"/server.pem", []byte("broken"))
+	writeFile(t, dir+"/other.pem", []byte("broken"))
+	client = r.client
+	r.maybeReloadCAs()
+	if r.client != client {
+		t.Errorf("client replaced with broken CAs")
+	}
+	queryExpectA(t, r, "test.blah.", "1.2.3.4")
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("error writing %q: %v", path, err)
+	}
+}
+
+// newCA returns a new self-signed CA certificate, in PEM format.
+func newCA(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
 func TestInvalidServer(t *testing.T) {
 	ts := httptest.NewServer(nil)
 	ts.Close()
@@ -96,6 +414,154 @@ func TestInvalidServer(t *testing.T) {
 	queryExpectErr(t, r, "test.blah.", "POST failed:")
 }
 
+func TestTimeoutAndRotation(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+		}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	r := NewDoH(u, "", "0.0.0.0:0")
+	r.Timeout = 50 * time.Millisecond
+	r.RotateAfter = 10 * time.Millisecond
+	if err := r.Init(); err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+	requests, timeouts := stats.requests.Value(), failures("timeout")
+	queryExpectErr(t, r, "test.blah.", "deadline exceeded")
+	if d := stats.requests.Value() - requests; d != 1 {
+		t.Errorf("expected 1 request, got %d", d)
+	}
+	if d := failures("timeout") - timeouts; d != 1 {
+		t.Errorf("expected 1 timeout, got %d", d)
+	}
+
+	// Rotate the client after errors for longer than RotateAfter.
+	client := r.client
+	rotations := stats.rotations.Value()
+	time.Sleep(20 * time.Millisecond)
+	r.maybeRotateClient()
+	if r.client == client {
+		t.Errorf("client not rotated")
+	}
+	if d := stats.rotations.Value() - rotations; d != 1 {
+		t.Errorf("expected 1 rotation, got %d", d)
+	}
+
+	r = NewDoH(u, "", "0.0.0.0:0")
+	r.MaintainPeriod = 0
+	if err := r.Init(); err == nil {
+		t.Errorf("Init() with an invalid maintain period succeeded")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	// Drop the connections for the first requests, as if they were reset.
+	var mu sync.Mutex
+	drop := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			d := drop > 0
+			drop--
+			mu.Unlock()
+			if d {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			w.Header().Set("Content-Type", "application/dns-message")
+			m := &dns.Msg{}
+			m.Answer = append(m.Answer,
+				testutil.NewRR(t, "test.blah. A 1.2.3.4"))
+			msg, _ := m.Pack()
+			w.Write(msg)
+		}))
+	defer ts.Close()
+
+	defer func(prev time.Duration) { retryBackoff = prev }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	r := mustNewDoH(t, ts.URL)
+	retries := stats.retries.Value()
+	drop = 2
+	queryExpectA(t, r, "test.blah.", "1.2.3.4")
+	if d := stats.retries.Value() - retries; d != 2 {
+		t.Errorf("expected 2 retries, got %d", d)
+	}
+
+	// We give up after maxRetries.
+	drop = maxRetries + 1
+	queryExpectErr(t, r, "test.blah.", "EOF")
+
+	if d := retryDelay(0); d != 0 {
+		t.Errorf("first retry is not immediate: %v", d)
+	}
+	if d := retryDelay(3); d != 4*retryBackoff {
+		t.Errorf("unexpected backoff for the 4th retry: %v", d)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	var mu sync.Mutex
+	broken := false
+	queries := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			queries++
+			if broken {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			w.Header().Set("Content-Type", "application/dns-message")
+			msg, _ := (&dns.Msg{}).Pack()
+			w.Write(msg)
+		}))
+	defer ts.Close()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return queries
+	}
+
+	// Disabled by default.
+	r := mustNewDoH(t, ts.URL)
+	r.maybeProbe()
+	if count() != 0 {
+		t.Errorf("probe sent while disabled")
+	}
+
+	r.ProbePeriod = time.Millisecond
+	client := r.client
+	r.maybeProbe()
+	if count() != 1 || r.client != client {
+		t.Errorf("successful probe: %d queries, rotated: %v",
+			count(), r.client != client)
+	}
+
+	// Not due yet.
+	r.ProbePeriod = time.Hour
+	r.maybeProbe()
+	if count() != 1 {
+		t.Errorf("probe sent before it was due")
+	}
+
+	// A failed probe rotates the client right away.
+	mu.Lock()
+	broken = true
+	mu.Unlock()
+	r.lastProbe = time.Time{}
+	r.maybeProbe()
+	if count() != 2 || r.client == client {
+		t.Errorf("failed probe: %d queries, rotated: %v",
+			count(), r.client != client)
+	}
+}
+
 func TestNotOK(t *testing.T) {
 	ts := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -107,6 +573,38 @@ func TestNotOK(t *testing.T) {
 	queryExpectErr(t, r, "test.blah.", "Response status:")
 }
 
+func TestRefused(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The status to return is given in the path.
+			status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+			http.Error(w, "Go away", status)
+		}))
+	defer ts.Close()
+
+	httpFailures := failures("http")
+	r := mustNewDoH(t, ts.URL+"/429")
+	queryExpectErr(t, r, "test.blah.", "upstream is rate limiting us")
+
+	r = mustNewDoH(t, ts.URL+"/403")
+	queryExpectErr(t, r, "test.blah.", "upstream refused the query")
+
+	if v := stats.httpErrors.Get("429"); v == nil || v.String() != "1" {
+		t.Errorf("expected 1 429 error, got %v", v)
+	}
+	if d := failures("http") - httpFailures; d != 2 {
+		t.Errorf("expected 2 http failures, got %d", d)
+	}
+}
+
+// failures returns the number of failures of the given class so far.
+func failures(class string) int64 {
+	if v, ok := stats.failures.Get(class).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
 func TestNoContentType(t *testing.T) {
 	ts := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
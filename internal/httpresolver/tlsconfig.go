@@ -0,0 +1,50 @@
+package httpresolver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// parseTLSVersion returns the TLS version for the given name, like "1.2" or
+// "1.3". An empty name means the default (0).
+func parseTLSVersion(name string) (uint16, error) {
+	switch strings.TrimSpace(name) {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", name)
+}
+
+// parseCipherSuites returns the cipher suites in the given comma-separated
+// list of names, like "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256". Only the
+// ones Go considers secure are allowed. An empty list means the default
+// (nil).
+func parseCipherSuites(names string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q",
+				name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
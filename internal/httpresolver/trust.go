@@ -0,0 +1,131 @@
+package httpresolver
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// trustStore is the set of CAs we use to verify the upstreams, loaded from a
+// list of files and directories. It keeps track of the files it was loaded
+// from, so it can be reloaded when they change (e.g. when rotating internal
+// CAs).
+type trustStore struct {
+	paths []string
+
+	// Also trust the system's CAs.
+	system bool
+
+	// Signature of the files the CAs were last loaded from.
+	sig string
+}
+
+// newTrustStore returns a trust store for the given comma-separated list of
+// files and directories.
+func newTrustStore(paths string, system bool) *trustStore {
+	s := &trustStore{system: system}
+	for _, p := range strings.Split(paths, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			s.paths = append(s.paths, p)
+		}
+	}
+	return s
+}
+
+// caFile is a file to load CAs from.
+type caFile struct {
+	path string
+
+	// The file was given explicitly (and not found in a directory), so it
+	// must contain certificates.
+	explicit bool
+}
+
+// files returns the files to load the CAs from, and a signature of them
+// (names, sizes and modification times), to detect changes.
+func (s *trustStore) files() ([]caFile, string, error) {
+	files := []caFile{}
+	sig := &strings.Builder{}
+	add := func(path string, fi os.FileInfo, explicit bool) {
+		files = append(files, caFile{path, explicit})
+		fmt.Fprintf(sig, "%s %d %d\n", path, fi.Size(), fi.ModTime().UnixNano())
+	}
+
+	for _, p := range s.paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, "", err
+		}
+		if !fi.IsDir() {
+			add(p, fi, true)
+			continue
+		}
+
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, e := range entries {
+			path := filepath.Join(p, e.Name())
+
+			// Follow symlinks, which are common in CA directories.
+			fi, err := os.Stat(path)
+			if err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			add(path, fi, false)
+		}
+	}
+
+	return files, sig.String(), nil
+}
+
+// load the CAs into a new pool.
+func (s *trustStore) load() (*x509.CertPool, error) {
+	files, sig, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if s.system {
+		pool, err = x509.SystemCertPool()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	loaded := 0
+	for _, f := range files {
+		pemData, err := os.ReadFile(f.path)
+		if err != nil {
+			return nil, err
+		}
+
+		if pool.AppendCertsFromPEM(pemData) {
+			loaded++
+		} else if f.explicit {
+			return nil, errAppendingCerts
+		}
+	}
+
+	// Directories can have other files, but there has to be at least one
+	// certificate.
+	if loaded == 0 {
+		return nil, errAppendingCerts
+	}
+
+	s.sig = sig
+	return pool, nil
+}
+
+// changed returns true if the files changed since they were last loaded.
+func (s *trustStore) changed() bool {
+	_, sig, err := s.files()
+
+	// If we can't read them, keep the ones we have; it's likely a transient
+	// problem while they're being replaced.
+	return err == nil && sig != s.sig
+}
@@ -0,0 +1,114 @@
+package httpserver
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Token authentication, for restricting the server to known clients that
+// can't use client certificates (like most mobile OSes). The token can be
+// given in the path (e.g. /dns-query/<token>), or as a bearer token in the
+// Authorization header.
+
+// Exported variables for statistics: the requests authenticated with each
+// token, by name.
+var tokenRequests *expvar.Map
+
+func init() {
+	tokenRequests = expvar.NewMap("httpserver-requests-by-token")
+}
+
+var errUnauthorized = errors.New("missing or invalid token")
+
+// loadTokens reads the tokens from the file, which has one token per line,
+// preceded by its name (used for the statistics and traces, so the token
+// itself is not exposed). Empty lines and lines starting with '#' are
+// ignored. Returns a map of token to name.
+func loadTokens(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<name> <token>\"",
+				path, n)
+		}
+		name, token := fields[0], fields[1]
+		if strings.Contains(token, "/") {
+			return nil, fmt.Errorf("%s:%d: token can't contain '/'", path, n)
+		}
+		if _, ok := tokens[token]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicated token", path, n)
+		}
+		tokens[token] = name
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%s: no tokens found", path)
+	}
+	return tokens, nil
+}
+
+// Paths that can have a token after them, in addition to the routes'.
+var tokenPaths = []string{"/dns-query/", "/resolve/"}
+
+// authenticate the request, if we have tokens. Returns the name of the token
+// used (empty if we have no tokens), and whether it's valid.
+func (s *Server) authenticate(req *http.Request) (string, bool) {
+	if len(s.tokens) == 0 {
+		return "", true
+	}
+
+	// The token is what comes after the longest matching path, so the ones
+	// of routes like /dns-query/filtered take precedence.
+	paths := append([]string{}, tokenPaths...)
+	for p := range s.Routes {
+		paths = append(paths, p+"/")
+	}
+	given, longest := "", 0
+	for _, p := range paths {
+		if strings.HasPrefix(req.URL.Path, p) && len(p) > longest {
+			given, longest = strings.TrimPrefix(req.URL.Path, p), len(p)
+		}
+	}
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		if t, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			given = strings.TrimSpace(t)
+		}
+	}
+	if given == "" {
+		return "", false
+	}
+
+	// Compare against all of them in constant time, so the timing doesn't
+	// reveal anything about the tokens.
+	name, found := "", false
+	for token, n := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+			name, found = n, true
+		}
+	}
+	if found {
+		tokenRequests.Add(name, 1)
+	}
+	return name, found
+}
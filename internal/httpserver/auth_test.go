@@ -0,0 +1,102 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadTokens(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		t.Helper()
+		f, err := os.CreateTemp(dir, "tokens")
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		f.WriteString(content)
+		f.Close()
+		return f.Name()
+	}
+
+	tokens, err := loadTokens(write(
+		"# My devices.\nphone s3cret\n\n  laptop  0ther \n"))
+	if err != nil {
+		t.Fatalf("error loading tokens: %v", err)
+	}
+	if len(tokens) != 2 || tokens["s3cret"] != "phone" ||
+		tokens["0ther"] != "laptop" {
+		t.Errorf("unexpected tokens: %v", tokens)
+	}
+
+	for _, bad := range []string{
+		"", "# nothing\n", "phone\n", "phone a b\n",
+		"phone a/b\n", "phone a\nlaptop a\n",
+	} {
+		if _, err := loadTokens(write(bad)); err == nil {
+			t.Errorf("%q: expected error, got nil", bad)
+		}
+	}
+	if _, err := loadTokens(dir + "/doesnotexist"); err == nil {
+		t.Errorf("expected error loading a missing file")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	srv := &Server{
+		tokens:       map[string]string{"s3cret": "phone"},
+		Routes:       map[string]*Route{"/dns-query/filtered": {}},
+		BanThreshold: 2,
+		BanDuration:  time.Minute,
+	}
+
+	cases := []struct {
+		path, auth string
+		ok         bool
+	}{
+		{"/dns-query/s3cret", "", true},
+		{"/resolve/s3cret", "", true},
+		{"/dns-query", "Bearer s3cret", true},
+		{"/dns-query", "", false},
+		{"/dns-query/wrong", "", false},
+		{"/dns-query/s3cre", "", false},
+		{"/dns-query", "Bearer wrong", false},
+		{"/dns-query", "Basic s3cret", false},
+		{"/other/s3cret", "", false},
+		{"/dns-query/filtered/s3cret", "", true},
+		{"/dns-query/filtered", "Bearer s3cret", true},
+		{"/dns-query/filtered", "", false},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.path, nil)
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		name, ok := srv.authenticate(req)
+		if ok != c.ok || (ok && name != "phone") {
+			t.Errorf("%s %q: got %q %v, expected %v",
+				c.path, c.auth, name, ok, c.ok)
+		}
+	}
+	if v := tokenRequests.Get("phone").String(); v != "5" {
+		t.Errorf("expected 5 requests for the token, got %v", v)
+	}
+
+	// Unauthorized requests are rejected, and count towards bans.
+	for i, exp := range []int{http.StatusUnauthorized,
+		http.StatusUnauthorized, http.StatusUnauthorized,
+		http.StatusTooManyRequests} {
+		resp := query(t, srv, "GET", "/dns-query/wrong?dns=0000", "")
+		if resp.StatusCode != exp {
+			t.Errorf("%d: expected %d, got %v", i, exp, resp.StatusCode)
+		}
+	}
+
+	// Without tokens, everything is allowed.
+	if _, ok := (&Server{}).authenticate(
+		httptest.NewRequest("GET", "/dns-query", nil)); !ok {
+		t.Errorf("request rejected without tokens")
+	}
+}
@@ -0,0 +1,92 @@
+package httpserver
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Period over which we count malformed requests, to decide on bans.
+const banWindow = 1 * time.Minute
+
+// Maximum number of clients we keep track of. When exceeded, we drop the
+// records that are no longer relevant.
+const maxClientRecords = 10000
+
+// clientRecord keeps track of the malformed requests sent by a client.
+type clientRecord struct {
+	// Number of malformed requests since windowStart.
+	count       int
+	windowStart time.Time
+
+	// If the client is banned, when the ban expires.
+	bannedUntil time.Time
+}
+
+func clientKey(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// isBanned returns true if the client that sent the request is currently
+// banned.
+func (s *Server) isBanned(req *http.Request) bool {
+	if s.BanThreshold <= 0 {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.clients[clientKey(req)]
+	return ok && time.Now().Before(c.bannedUntil)
+}
+
+// recordMalformed records that the client sent a malformed request, and bans
+// it if it went over the threshold.
+func (s *Server) recordMalformed(req *http.Request) {
+	if s.BanThreshold <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.clients == nil {
+		s.clients = map[string]*clientRecord{}
+	}
+
+	now := time.Now()
+	key := clientKey(req)
+	c, ok := s.clients[key]
+	if !ok {
+		if len(s.clients) >= maxClientRecords {
+			s.pruneClients(now)
+		}
+		c = &clientRecord{windowStart: now}
+		s.clients[key] = c
+	}
+
+	if now.Sub(c.windowStart) > banWindow {
+		c.count = 0
+		c.windowStart = now
+	}
+
+	c.count++
+	if c.count > s.BanThreshold {
+		c.bannedUntil = now.Add(s.BanDuration)
+	}
+}
+
+// pruneClients removes the records that are no longer relevant. Must be
+// called with s.mu held.
+func (s *Server) pruneClients(now time.Time) {
+	for k, c := range s.clients {
+		if now.Sub(c.windowStart) > banWindow && now.After(c.bannedUntil) {
+			delete(s.clients, k)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package httpserver
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// enableH2C makes the server accept cleartext HTTP/2 (h2c) connections, in
+// addition to HTTP/1. Both HTTP/2 with prior knowledge and upgrades from
+// HTTP/1 are supported.
+func enableH2C(srv *http.Server) {
+	srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{})
+}
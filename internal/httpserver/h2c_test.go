@@ -0,0 +1,49 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestH2C(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}))
+	enableH2C(ts.Config)
+	ts.Start()
+	defer ts.Close()
+
+	h2client := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string,
+				_ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+	}
+
+	for _, h2 := range []bool{true, false} {
+		client := http.DefaultClient
+		if h2 {
+			client = h2client
+		}
+
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatalf("h2=%v: request failed: %v", h2, err)
+		}
+		resp.Body.Close()
+		if (resp.ProtoMajor == 2) != h2 {
+			t.Errorf("h2=%v: got protocol %s", h2, resp.Proto)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"blitiri.com.ar/go/dnss/internal/trace"
+
+	"github.com/miekg/dns"
+)
+
+// Support for the JSON API, as implemented by dns.google:
+// https://developers.google.com/speed/public-dns/docs/doh/json.
+
+// jsonResponse is the JSON representation of a DNS reply.
+type jsonResponse struct {
+	Status     int
+	TC         bool
+	RD         bool
+	RA         bool
+	AD         bool
+	CD         bool
+	Question   []jsonQuestion
+	Answer     []jsonRR `json:",omitempty"`
+	Authority  []jsonRR `json:",omitempty"`
+	Additional []jsonRR `json:",omitempty"`
+
+	// Client subnet the answer is for, as "address/scope".
+	ECS string `json:"edns_client_subnet,omitempty"`
+}
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32
+	Data string `json:"data"`
+}
+
+var (
+	errBadName = errors.New("invalid name")
+	errBadType = errors.New("invalid type")
+	errBadBool = errors.New("invalid boolean parameter")
+	errBadECS  = errors.New("invalid edns_client_subnet")
+)
+
+// Resolve JSON requests.
+func (s *Server) resolveJSON(tr *trace.Trace, w http.ResponseWriter, req *http.Request) {
+	r, err := jsonQuery(req)
+	if err != nil {
+		s.malformed(tr, w, req, "bad-json-param", err,
+			http.StatusBadRequest)
+		return
+	}
+
+	// random_padding is only used by clients to hide the length of the
+	// request, we accept it and ignore its contents.
+
+	fromUp := s.query(tr, w, req, r)
+	if fromUp == nil {
+		return
+	}
+
+	// Clients can ask for the reply in DNS wire format (ct=).
+	if req.FormValue("ct") == "application/dns-message" {
+		packed, err := fromUp.Pack()
+		s.listenerBudget.Record(err == nil &&
+			fromUp.Rcode != dns.RcodeServerFailure)
+		if err != nil {
+			err = tr.Errorf("cannot pack reply: %v", err)
+			http.Error(w, err.Error(), http.StatusFailedDependency)
+			return
+		}
+		w.Header().Set("Content-type", "application/dns-message")
+		w.WriteHeader(http.StatusOK)
+		w.Write(packed)
+		return
+	}
+
+	s.listenerBudget.Record(fromUp.Rcode != dns.RcodeServerFailure)
+
+	// Cloudflare's clients ask for application/dns-json, via the Accept
+	// header; reply with it so they're happy.
+	ct := "application/json"
+	if req.FormValue("ct") == "application/dns-json" ||
+		strings.Contains(req.Header.Get("Accept"), "application/dns-json") {
+		ct = "application/dns-json"
+	}
+	w.Header().Set("Content-type", ct)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(toJSON(fromUp))
+}
+
+// jsonQuery builds the DNS query from the request's parameters.
+func jsonQuery(req *http.Request) (*dns.Msg, error) {
+	name := req.FormValue("name")
+	if _, ok := dns.IsDomainName(name); !ok || len(name) > 253 {
+		return nil, errBadName
+	}
+
+	qtype := dns.TypeA
+	if t := req.FormValue("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if n, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qtype = n
+		} else {
+			return nil, errBadType
+		}
+	}
+
+	cd, err := jsonBool(req.FormValue("cd"))
+	if err != nil {
+		return nil, err
+	}
+	do, err := jsonBool(req.FormValue("do"))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &dns.Msg{}
+	r.SetQuestion(dns.Fqdn(name), qtype)
+	r.CheckingDisabled = cd
+	if do {
+		r.SetEdns0(4096, true)
+	}
+
+	if subnet := req.FormValue("edns_client_subnet"); subnet != "" {
+		ecs, err := jsonECS(subnet)
+		if err != nil {
+			return nil, err
+		}
+		if r.IsEdns0() == nil {
+			r.SetEdns0(4096, false)
+		}
+		opt := r.IsEdns0()
+		opt.Option = append(opt.Option, ecs)
+	}
+	return r, nil
+}
+
+// jsonECS parses the edns_client_subnet parameter, an IP address with an
+// optional prefix length (like "192.0.2.0/24"), into the option.
+func jsonECS(s string) (*dns.EDNS0_SUBNET, error) {
+	if !strings.Contains(s, "/") {
+		if strings.Contains(s, ":") {
+			s += "/128"
+		} else {
+			s += "/32"
+		}
+	}
+	ip, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, errBadECS
+	}
+	prefix, _ := ipnet.Mask.Size()
+
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(prefix),
+		Address:       ipnet.IP,
+	}
+	if ip.To4() != nil {
+		ecs.Family = 1
+		ecs.Address = ipnet.IP.To4()
+	} else {
+		ecs.Family = 2
+	}
+	return ecs, nil
+}
+
+// jsonBool parses a boolean parameter. Like dns.google, we accept "1" and
+// "true" for true, and "0", "false" and "" for false.
+func jsonBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "", "0", "false":
+		return false, nil
+	case "1", "true":
+		return true, nil
+	}
+	return false, errBadBool
+}
+
+func toJSON(m *dns.Msg) *jsonResponse {
+	resp := &jsonResponse{
+		Status:     m.Rcode,
+		TC:         m.Truncated,
+		RD:         m.RecursionDesired,
+		RA:         m.RecursionAvailable,
+		AD:         m.AuthenticatedData,
+		CD:         m.CheckingDisabled,
+		Answer:     toJSONRRs(m.Answer),
+		Authority:  toJSONRRs(m.Ns),
+		Additional: toJSONRRs(m.Extra),
+	}
+	for _, q := range m.Question {
+		resp.Question = append(resp.Question,
+			jsonQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				resp.ECS = fmt.Sprintf("%s/%d", ecs.Address, ecs.SourceScope)
+			}
+		}
+	}
+	return resp
+}
+
+func toJSONRRs(rrs []dns.RR) []jsonRR {
+	var out []jsonRR
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		out = append(out, jsonRR{
+			Name: hdr.Name,
+			Type: hdr.Rrtype,
+			TTL:  hdr.Ttl,
+			Data: strings.TrimPrefix(rr.String(), hdr.String()),
+		})
+	}
+	return out
+}
@@ -0,0 +1,142 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
+)
+
+func TestJSON(t *testing.T) {
+	upstreamAddr := testutil.GetFreePort()
+	go testutil.ServeTestDNSServer(upstreamAddr,
+		testutil.MakeStaticHandler(t, "test. A 1.1.1.1"))
+	testutil.WaitForDNSServer(upstreamAddr)
+
+	srv := &Server{
+		Upstream: upstreamAddr,
+	}
+
+	resp := query(t, srv, "GET",
+		"/resolve?name=test&type=A&do=1&cd=true&random_padding=XXXXXXXX", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected http status ok, got %v", resp.StatusCode)
+	}
+
+	jr := jsonResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&jr); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if jr.Status != dns.RcodeSuccess || !jr.CD {
+		t.Errorf("unexpected response: %+v", jr)
+	}
+	if len(jr.Question) != 1 || jr.Question[0].Name != "test." ||
+		jr.Question[0].Type != dns.TypeA {
+		t.Errorf("unexpected question: %+v", jr.Question)
+	}
+	if len(jr.Answer) != 1 || jr.Answer[0].Data != "1.1.1.1" {
+		t.Errorf("unexpected answer: %+v", jr.Answer)
+	}
+	if len(jr.Additional) != 0 {
+		t.Errorf("OPT record should not be included: %+v", jr.Additional)
+	}
+
+	// Wire format reply.
+	resp = query(t, srv, "GET",
+		"/resolve?name=test&type=1&ct=application/dns-message", "")
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK ||
+		ct != "application/dns-message" {
+		t.Errorf("expected DNS message, got %v %q", resp.StatusCode, ct)
+	}
+
+	// Cloudflare's content type.
+	req := httptest.NewRequest("GET", "/dns-query?name=test", nil)
+	req.Header.Set("Accept", "application/dns-json")
+	w := httptest.NewRecorder()
+	srv.Resolve(w, req)
+	if ct := w.Result().Header.Get("Content-Type"); ct != "application/dns-json" {
+		t.Errorf("expected application/dns-json, got %q", ct)
+	}
+
+	// Invalid parameters.
+	for _, url := range []string{
+		"/resolve?name=test&edns_client_subnet=1.2.3.4/33",
+		"/resolve?name=test&edns_client_subnet=blah",
+		"/resolve?name=test&type=XYZ",
+		"/resolve?name=test&do=maybe",
+		"/resolve?name=test&cd=2",
+		"/resolve?name=a..b",
+	} {
+		resp = query(t, srv, "GET", url, "")
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected bad request, got %v",
+				url, resp.StatusCode)
+		}
+	}
+}
+
+func TestJSONQuery(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/resolve?name=example.com&type=aaaa&do=1", nil)
+	r, err := jsonQuery(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Question[0].Name != "example.com." || r.Question[0].Qtype != dns.TypeAAAA {
+		t.Errorf("unexpected question: %v", r.Question)
+	}
+	if opt := r.IsEdns0(); opt == nil || !opt.Do() {
+		t.Errorf("expected DO bit to be set: %v", r)
+	}
+	if r.CheckingDisabled {
+		t.Errorf("unexpected CD bit: %v", r)
+	}
+}
+
+func TestJSONECS(t *testing.T) {
+	cases := []struct {
+		param   string
+		family  uint16
+		netmask uint8
+		addr    string
+	}{
+		{"192.0.2.55/24", 1, 24, "192.0.2.0"},
+		{"192.0.2.55", 1, 32, "192.0.2.55"},
+		{"2001:db8::1/48", 2, 48, "2001:db8::"},
+		{"2001:db8::1", 2, 128, "2001:db8::1"},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET",
+			"/resolve?name=test&edns_client_subnet="+c.param, nil)
+		r, err := jsonQuery(req)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.param, err)
+			continue
+		}
+		opt := r.IsEdns0()
+		if opt == nil || len(opt.Option) != 1 || opt.Do() {
+			t.Errorf("%s: unexpected OPT: %v", c.param, opt)
+			continue
+		}
+		ecs := opt.Option[0].(*dns.EDNS0_SUBNET)
+		if ecs.Family != c.family || ecs.SourceNetmask != c.netmask ||
+			ecs.Address.String() != c.addr {
+			t.Errorf("%s: unexpected ECS: %v", c.param, ecs)
+		}
+	}
+
+	// The subnet is included in the reply.
+	m := &dns.Msg{}
+	m.SetEdns0(4096, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24,
+		SourceScope: 16, Address: net.ParseIP("192.0.2.0").To4()})
+	if ecs := toJSON(m).ECS; ecs != "192.0.2.0/16" {
+		t.Errorf("unexpected ECS in the reply: %q", ecs)
+	}
+}
@@ -0,0 +1,273 @@
+package httpserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
+)
+
+// Support for running behind load balancers and reverse proxies, so we see
+// the real client addresses (for the logs, traces and bans). The proxies
+// can tell us with the PROXY protocol, or the X-Forwarded-For header; we
+// only believe them if they are in the trusted list. When listening on a
+// unix socket, whoever connects to it is trusted, as it must be a local
+// process with access to the socket (usually, a reverse proxy).
+//
+// The PROXY protocol is described in
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+
+// Maximum time to wait for the PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// Exported variables for statistics: the connections with invalid PROXY
+// protocol headers, or from untrusted sources, by reason.
+var proxyErrors *expvar.Map
+
+func init() {
+	proxyErrors = expvar.NewMap("httpserver-proxy-errors")
+}
+
+var (
+	errUntrustedProxy = errors.New("connection from an untrusted proxy")
+	errProxyHeader    = errors.New("invalid PROXY protocol header")
+)
+
+// Signature of the PROXY protocol v2 headers.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Maximum length of a v1 header, including the CRLF.
+const proxyV1MaxLen = 107
+
+// proxyListener wraps a listener, expecting the connections to start with a
+// PROXY protocol header.
+type proxyListener struct {
+	net.Listener
+	trusted dnsserver.NetList
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, trusted: l.trusted}, nil
+}
+
+// proxyConn is a connection that starts with a PROXY protocol header. The
+// header is read lazily (on the first Read or RemoteAddr), so we don't block
+// the accept loop on it.
+type proxyConn struct {
+	net.Conn
+	trusted dnsserver.NetList
+
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		_, unix := c.Conn.(*net.UnixConn)
+		if !unix && !c.trusted.Contains(addrIP(c.remote)) {
+			c.err = errUntrustedProxy
+			proxyErrors.Add("untrusted", 1)
+			return
+		}
+
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		c.r = bufio.NewReader(c.Conn)
+		addr, err := readProxyHeader(c.r)
+		if err != nil {
+			c.err = err
+			proxyErrors.Add("bad-header", 1)
+			return
+		}
+		if addr != nil {
+			c.remote = addr
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// readProxyHeader reads a PROXY protocol header (v1 or v2), and returns the
+// source address in it. It returns nil if the header doesn't have one (e.g.
+// for health checks from the proxy itself).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	if sig, err := r.Peek(len(proxyV2Sig)); err == nil &&
+		bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2(r)
+	}
+	if sig, err := r.Peek(6); err != nil || string(sig) != "PROXY " {
+		return nil, errProxyHeader
+	}
+	return readProxyV1(r)
+}
+
+// readProxyV1 reads the human-readable header, like
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, errProxyHeader
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, len(proxyV2Sig)+4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	verCmd, family := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: version %d", errProxyHeader, verCmd>>4)
+	}
+	switch verCmd & 0xf {
+	case 0: // LOCAL, the connection is from the proxy itself.
+		return nil, nil
+	case 1: // PROXY.
+	default:
+		return nil, fmt.Errorf("%w: command %d", errProxyHeader, verCmd&0xf)
+	}
+
+	// We only care about the source address; the rest (including the
+	// TLVs) is ignored.
+	switch family {
+	case 0x11: // TCP over IPv4.
+		if len(body) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:4]),
+			Port: int(binary.BigEndian.Uint16(body[8:])),
+		}, nil
+	case 0x21: // TCP over IPv6.
+		if len(body) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:16]),
+			Port: int(binary.BigEndian.Uint16(body[32:])),
+		}, nil
+	default:
+		// Unspecified or unsupported family, use the connection's
+		// address.
+		return nil, nil
+	}
+}
+
+// addrIP returns the IP address of the given network address, or nil if it
+// does not have one.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// realClient wraps the handler so requests coming from trusted proxies get
+// their RemoteAddr from the X-Forwarded-For header.
+func (s *Server) realClient(h http.Handler) http.Handler {
+	if _, unix := unixSocketPath(s.Addr); !unix && len(s.TrustedProxies) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ip := s.forwardedFor(req); ip != nil {
+			req = req.WithContext(req.Context())
+			req.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// forwardedFor returns the client address in the X-Forwarded-For header, or
+// nil if there isn't one or the request doesn't come from a trusted proxy.
+// The header is read from right to left, skipping our trusted proxies, as
+// the leftmost entries can be set by anyone.
+func (s *Server) forwardedFor(req *http.Request) net.IP {
+	if _, unix := unixSocketPath(s.Addr); !unix {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil || !s.TrustedProxies.Contains(net.ParseIP(host)) {
+			return nil
+		}
+	}
+
+	hops := []string{}
+	for _, h := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+
+	var ip net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip = net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			return nil
+		}
+		if !s.TrustedProxies.Contains(ip) {
+			break
+		}
+	}
+	return ip
+}
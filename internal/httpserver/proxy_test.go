@@ -0,0 +1,201 @@
+package httpserver
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(verCmd, family byte, body ...byte) string {
+		return string(proxyV2Sig) + string([]byte{
+			verCmd, family, byte(len(body) >> 8), byte(len(body))}) +
+			string(body)
+	}
+	v4Body := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0x12, 0x34, 1, 187}
+	v6Body := append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...)
+	v6Body = append(v6Body, 0x12, 0x34, 1, 187)
+
+	cases := []struct {
+		header, addr string
+		ok           bool
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 4660 443\r\n", "192.0.2.1:4660", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 4660 443\r\n",
+			"[2001:db8::1]:4660", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY UNKNOWN 1 2 3 4\r\n", "", true},
+		{v2(0x21, 0x11, v4Body...), "192.0.2.1:4660", true},
+		{v2(0x21, 0x21, v6Body...), "[2001:db8::1]:4660", true},
+		{v2(0x20, 0x11, v4Body...), "", true}, // LOCAL.
+		{v2(0x21, 0x00), "", true},            // Unspecified family.
+
+		{"GET / HTTP/1.1\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 4660\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 99999 443\r\n", "", false},
+		{"PROXY TCP4 bad 192.0.2.2 4660 443\r\n", "", false},
+		{"PROXY UDP4 192.0.2.1 192.0.2.2 4660 443\r\n", "", false},
+		{"PROXY " + strings.Repeat("x", 200) + "\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1", "", false},
+		{v2(0x11, 0x11, v4Body...), "", false}, // Version 1.
+		{v2(0x22, 0x11, v4Body...), "", false}, // Unknown command.
+		{v2(0x21, 0x11, 1, 2, 3), "", false},   // Short body.
+		{v2(0x21, 0x11)[:15], "", false},       // Truncated.
+	}
+	for _, c := range cases {
+		r := bufio.NewReader(strings.NewReader(c.header + "rest"))
+		addr, err := readProxyHeader(r)
+		if (err == nil) != c.ok {
+			t.Errorf("%q: expected ok=%v, got error %v", c.header, c.ok, err)
+			continue
+		}
+		if !c.ok {
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != c.addr {
+			t.Errorf("%q: expected %q, got %q", c.header, c.addr, got)
+		}
+
+		// The rest of the connection is left as-is.
+		if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+			t.Errorf("%q: unexpected rest: %q", c.header, rest)
+		}
+	}
+}
+
+func TestProxyConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+
+	trusted, _ := dnsserver.NetListFromString("127.0.0.1")
+	pl := &proxyListener{Listener: ln, trusted: trusted}
+
+	dial := func(data string) {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Errorf("error dialing: %v", err)
+			return
+		}
+		c.Write([]byte(data))
+		c.Close()
+	}
+
+	go dial("PROXY TCP4 192.0.2.1 192.0.2.2 4660 443\r\nhello")
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("error accepting: %v", err)
+	}
+	if a := c.RemoteAddr().String(); a != "192.0.2.1:4660" {
+		t.Errorf("unexpected remote address %q", a)
+	}
+	if data, err := io.ReadAll(c); err != nil || string(data) != "hello" {
+		t.Errorf("unexpected data: %q, %v", data, err)
+	}
+	c.Close()
+
+	// Missing header.
+	go dial("hello")
+	c, _ = pl.Accept()
+	if _, err := io.ReadAll(c); err == nil {
+		t.Errorf("connection without header was accepted")
+	}
+	c.Close()
+
+	// Untrusted proxy.
+	pl.trusted, _ = dnsserver.NetListFromString("192.0.2.0/24")
+	go dial("PROXY TCP4 192.0.2.1 192.0.2.2 4660 443\r\nhello")
+	c, _ = pl.Accept()
+	if _, err := c.Read(make([]byte, 10)); err != errUntrustedProxy {
+		t.Errorf("expected untrusted proxy error, got %v", err)
+	}
+	if a := c.RemoteAddr().String(); !strings.HasPrefix(a, "127.0.0.1:") {
+		t.Errorf("untrusted proxy changed the address to %q", a)
+	}
+	c.Close()
+}
+
+func TestForwardedFor(t *testing.T) {
+	trusted, _ := dnsserver.NetListFromString("10.0.0.0/8")
+	srv := &Server{TrustedProxies: trusted}
+
+	var got string
+	h := srv.realClient(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			got = r.RemoteAddr
+		}))
+
+	cases := []struct {
+		remote   string
+		xff      []string
+		expected string
+	}{
+		{"10.0.0.1:1234", []string{"192.0.2.1"}, "192.0.2.1:0"},
+		{"10.0.0.1:1234", []string{"192.0.2.9, 192.0.2.1, 10.0.0.2"},
+			"192.0.2.1:0"},
+		{"10.0.0.1:1234", []string{"192.0.2.9", "192.0.2.1"}, "192.0.2.1:0"},
+		{"10.0.0.1:1234", []string{"2001:db8::1"}, "[2001:db8::1]:0"},
+		{"10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3:0"},
+
+		// Not from a trusted proxy, or with a bad header: left as-is.
+		{"192.0.2.5:1234", []string{"192.0.2.1"}, "192.0.2.5:1234"},
+		{"10.0.0.1:1234", nil, "10.0.0.1:1234"},
+		{"10.0.0.1:1234", []string{"192.0.2.1, bad"}, "10.0.0.1:1234"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/dns-query", nil)
+		req.RemoteAddr = c.remote
+		for _, v := range c.xff {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if got != c.expected {
+			t.Errorf("%s %q: expected %q, got %q",
+				c.remote, c.xff, c.expected, got)
+		}
+	}
+}
+
+func TestForwardedForUnix(t *testing.T) {
+	srv := &Server{Addr: "unix:/run/dnss.sock"}
+
+	var got string
+	h := srv.realClient(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			got = r.RemoteAddr
+		}))
+
+	// Connections over the unix socket are trusted.
+	req := httptest.NewRequest("GET", "/dns-query", nil)
+	req.RemoteAddr = "@"
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "192.0.2.1:0" {
+		t.Errorf("expected 192.0.2.1:0, got %q", got)
+	}
+
+	for addr, expected := range map[string]string{
+		"unix:/run/dnss.sock": "/run/dnss.sock",
+		"/run/dnss.sock":      "/run/dnss.sock",
+		"unix:rel.sock":       "rel.sock",
+		":443":                "",
+		"localhost:443":       "",
+	} {
+		path, ok := unixSocketPath(addr)
+		if ok != (expected != "") || (ok && path != expected) {
+			t.Errorf("%q: expected %q, got %q %v", addr, expected, path, ok)
+		}
+	}
+}
@@ -6,13 +6,29 @@
 package httpserver
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
+	"expvar"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"mime"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"blitiri.com.ar/go/dnss/doh"
+	"blitiri.com.ar/go/dnss/internal/acme"
+	"blitiri.com.ar/go/dnss/internal/budget"
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
+	"blitiri.com.ar/go/dnss/internal/loop"
 	"blitiri.com.ar/go/dnss/internal/trace"
+	"blitiri.com.ar/go/dnss/internal/upgrade"
 
 	"blitiri.com.ar/go/log"
 	"github.com/miekg/dns"
@@ -21,39 +37,329 @@ import (
 // Server is an HTTPS server that implements DNS over HTTPS, see the
 // package-level documentation for more references.
 type Server struct {
+	// Address to listen on. It can also be a unix socket path, as
+	// "unix:<path>" or an absolute path.
 	Addr     string
 	Upstream string
 	CertFile string
 	KeyFile  string
 	Insecure bool
+
+	// Also accept cleartext HTTP/2 (h2c) connections. Only valid with
+	// Insecure, for running behind reverse proxies that speak HTTP/2.
+	H2C bool
+
+	// If set, queries are resolved with it instead of being sent to
+	// Upstream, which is then only used as a name for statistics. This
+	// allows relaying to another DoH server, using an httpresolver.
+	Resolver dnsserver.Resolver
+
+	// Timeout for the queries to the upstreams, when not using a Resolver.
+	// 0 means the default (2s).
+	UpstreamTimeout time.Duration
+
+	// Alternative upstreams, by path (e.g. "/dns-query/filtered"), so
+	// different clients can use different resolvers. The requests to these
+	// paths (or to them followed by "/<token>") are handled like the ones to
+	// /dns-query, but resolved using the route's upstream.
+	Routes map[string]*Route
+
+	// If set, clients must present a certificate signed by one of the CAs
+	// in this file (PEM format).
+	ClientCAFile string
+
+	// If set, clients must present one of the tokens in this file, see
+	// loadTokens for the format.
+	TokensFile string
+
+	// If set, the certificate is obtained and renewed automatically, and
+	// CertFile and KeyFile are not used.
+	ACME *acme.Manager
+
+	// Clients that send more than BanThreshold malformed requests within a
+	// minute are banned for BanDuration. 0 disables banning.
+	BanThreshold int
+	BanDuration  time.Duration
+
+	// Timeouts for reading the requests, writing the replies, and keeping
+	// idle connections open. 0 means no timeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// Maximum number of requests handled at the same time; the ones over it
+	// are rejected. 0 means no limit.
+	MaxConcurrent int
+
+	// Proxies (e.g. load balancers) we trust to tell us the real address of
+	// the clients, with the X-Forwarded-For header or the PROXY protocol.
+	TrustedProxies dnsserver.NetList
+
+	// Expect the connections to start with a PROXY protocol header (v1 or
+	// v2). They must come from TrustedProxies, the rest are rejected.
+	ProxyProtocol bool
+
+	// Called once the server is ready to serve requests. Can be nil.
+	NotifyStarted func()
+
+	// Malformed requests by client, used for banning.
+	mu      sync.Mutex
+	clients map[string]*clientRecord
+
+	// The underlying HTTP server, so we can shut it down.
+	srv *http.Server
+
+	// Resolvers for the upstreams, when not given one, by upstream.
+	upstreams map[string]dnsserver.Resolver
+
+	// Valid tokens, mapped to their names. If empty, no token is needed.
+	tokens map[string]string
+
+	// Track the requests we (and the upstream) answered successfully, for
+	// alerting.
+	listenerBudget *budget.Tracker
+	upstreamBudget *budget.Tracker
+}
+
+// Maximum size of a DNS query we accept.
+const maxQuerySize = 4092
+
+// Route is an upstream for the requests to a specific path, see
+// Server.Routes.
+type Route struct {
+	// Same as the Server fields of the same name.
+	Upstream string
+	Resolver dnsserver.Resolver
+
+	budget *budget.Tracker
+}
+
+// Exported variables for statistics.
+var stats = struct {
+	// Malformed requests, by reason.
+	malformed *expvar.Map
+
+	// Requests we could not resolve due to upstream failures.
+	upstreamErrors *expvar.Int
+
+	// Requests rejected because the client was banned.
+	banned *expvar.Int
+
+	// Requests rejected because of MaxConcurrent.
+	overloaded *expvar.Int
+}{}
+
+func init() {
+	stats.malformed = expvar.NewMap("httpserver-malformed")
+	stats.upstreamErrors = expvar.NewInt("httpserver-upstream-errors")
+	stats.banned = expvar.NewInt("httpserver-banned")
+	stats.overloaded = expvar.NewInt("httpserver-overloaded")
 }
 
 // ListenAndServe starts the HTTPS server.
 func (s *Server) ListenAndServe() {
+	s.listenerBudget = budget.Get("listener https " + s.Addr)
+	s.upstreamBudget = budget.Get("upstream dns " + s.Upstream)
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/dns-query", s.Resolve)
 	mux.HandleFunc("/resolve", s.Resolve)
-	srv := http.Server{
-		Addr:    s.Addr,
-		Handler: mux,
+	if s.TokensFile != "" {
+		tokens, err := loadTokens(s.TokensFile)
+		if err != nil {
+			log.Fatalf("HTTPS exiting: error loading tokens: %v", err)
+		}
+		s.tokens = tokens
+		for _, p := range tokenPaths {
+			mux.HandleFunc(p, s.Resolve)
+		}
+	}
+	if s.Resolver != nil {
+		if err := s.Resolver.Init(); err != nil {
+			log.Fatalf("HTTPS exiting: error initializing resolver: %v",
+				err)
+		}
+		go s.Resolver.Maintain()
+	}
+	for path, rt := range s.Routes {
+		rt.budget = budget.Get("upstream dns " + rt.Upstream)
+		mux.HandleFunc(path, s.Resolve)
+		if s.tokens != nil {
+			mux.HandleFunc(path+"/", s.Resolve)
+		}
+		if rt.Resolver != nil {
+			if err := rt.Resolver.Init(); err != nil {
+				log.Fatalf("HTTPS exiting: error initializing resolver "+
+					"for %s: %v", path, err)
+			}
+			go rt.Resolver.Maintain()
+		}
+	}
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		log.Fatalf("HTTPS exiting: %s", err)
+	}
+	if s.ACME != nil {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		s.ACME.Configure(tlsConfig)
+	}
+	srv := &http.Server{
+		Addr:         s.Addr,
+		Handler:      s.limit(s.realClient(mux)),
+		TLSConfig:    tlsConfig,
+		ReadTimeout:  s.ReadTimeout,
+		WriteTimeout: s.WriteTimeout,
+		IdleTimeout:  s.IdleTimeout,
+	}
+	if s.H2C {
+		if !s.Insecure {
+			log.Fatalf("HTTPS exiting: h2c is only for the insecure server")
+		}
+		enableH2C(srv)
+	}
+	s.mu.Lock()
+	s.srv = srv
+	s.mu.Unlock()
+
+	// Use the listener handed off by the previous process, if we were
+	// started by an upgrade.
+	network, addr := "tcp", s.Addr
+	if path, ok := unixSocketPath(s.Addr); ok {
+		network, addr = "unix", path
+	}
+	lis, err := upgrade.Listen("https", network, addr)
+	if err != nil {
+		log.Fatalf("HTTPS exiting: %s", err)
+	}
+	if s.ProxyProtocol {
+		if network != "unix" && len(s.TrustedProxies) == 0 {
+			log.Fatalf("HTTPS exiting: the PROXY protocol needs " +
+				"trusted proxies")
+		}
+		lis = &proxyListener{Listener: lis, trusted: s.TrustedProxies}
 	}
 
 	log.Infof("HTTPS listening on %s", s.Addr)
-	var err error
+	if s.NotifyStarted != nil {
+		s.NotifyStarted()
+	}
+
 	if s.Insecure {
-		err = srv.ListenAndServe()
+		err = srv.Serve(lis)
 	} else {
-		err = srv.ListenAndServeTLS(s.CertFile, s.KeyFile)
+		err = srv.ServeTLS(lis, s.CertFile, s.KeyFile)
+	}
+	if err == http.ErrServerClosed {
+		return
 	}
 	log.Fatalf("HTTPS exiting: %s", err)
 }
 
+// unixSocketPath returns the path of the unix socket to listen on, if the
+// address is one (see Server.Addr).
+func unixSocketPath(addr string) (string, bool) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return path, true
+	}
+	return addr, strings.HasPrefix(addr, "/")
+}
+
+// limit wraps the handler so at most MaxConcurrent requests are handled at
+// the same time. The ones over the limit are rejected right away instead of
+// piling up, so slow clients or upstream stalls can't exhaust our resources.
+func (s *Server) limit(h http.Handler) http.Handler {
+	if s.MaxConcurrent <= 0 {
+		return h
+	}
+
+	sem := make(chan struct{}, s.MaxConcurrent)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			h.ServeHTTP(w, req)
+		default:
+			s.listenerBudget.Record(false)
+			stats.overloaded.Add(1)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many concurrent requests",
+				http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// tlsConfig returns the TLS configuration for the server, which requires
+// and verifies client certificates if ClientCAFile is set. The server's own
+// certificate is loaded by ServeTLS (or given by ACME).
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	if s.ClientCAFile == "" {
+		return nil, nil
+	}
+
+	pemData, err := os.ReadFile(s.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificates found in client CA file %q",
+			s.ClientCAFile)
+	}
+
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// Shutdown stops serving, and waits (up to the given timeout) for the
+// requests in flight to be answered. ListenAndServe returns after this.
+func (s *Server) Shutdown(timeout time.Duration) {
+	s.mu.Lock()
+	srv := s.srv
+	s.mu.Unlock()
+	if srv == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Errorf("Error shutting down HTTPS server: %v", err)
+	}
+}
+
 // Resolve incoming DoH requests.
 func (s *Server) Resolve(w http.ResponseWriter, req *http.Request) {
-	tr := trace.New("httpserver", "/resolve")
+	tr := trace.NewSampled("httpserver", "/resolve")
 	defer tr.Finish()
 	tr.Printf("from:%v", req.RemoteAddr)
 	tr.Printf("method:%v", req.Method)
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		tr.Printf("client cert:%v", req.TLS.PeerCertificates[0].Subject)
+	}
+
+	if s.isBanned(req) {
+		tr.Errorf("client is banned")
+		stats.banned.Add(1)
+		http.Error(w, "too many malformed requests",
+			http.StatusTooManyRequests)
+		return
+	}
+
+	// Requests without a valid token count as malformed, so clients
+	// guessing them get banned.
+	name, ok := s.authenticate(req)
+	if !ok {
+		s.malformed(tr, w, req, "unauthorized", errUnauthorized,
+			http.StatusUnauthorized)
+		return
+	}
+	if name != "" {
+		tr.Printf("token:%s", name)
+	}
 
 	req.ParseForm()
 
@@ -62,75 +368,115 @@ func (s *Server) Resolve(w http.ResponseWriter, req *http.Request) {
 	//  - POST requests have a content-type = application/dns-message.
 	if req.Method == "GET" && req.FormValue("dns") != "" {
 		tr.Printf("DoH:GET")
-		dnsQuery, err := base64.RawURLEncoding.DecodeString(
-			req.FormValue("dns"))
+		param := req.FormValue("dns")
+		if len(param) > base64.RawURLEncoding.EncodedLen(maxQuerySize) {
+			s.malformed(tr, w, req, "oversize", errOversize,
+				http.StatusRequestURITooLong)
+			return
+		}
+
+		dnsQuery, err := base64.RawURLEncoding.DecodeString(param)
 		if err != nil {
-			tr.Error(err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			s.malformed(tr, w, req, "bad-base64", err,
+				http.StatusBadRequest)
 			return
 		}
 
-		s.resolveDoH(tr, w, dnsQuery)
+		s.resolveDoH(tr, w, req, dnsQuery)
+		return
+	}
+
+	// JSON requests are GET requests with a "name=" query parameter, using
+	// the dns.google JSON API.
+	if req.Method == "GET" && req.FormValue("name") != "" {
+		tr.Printf("JSON:GET")
+		s.resolveJSON(tr, w, req)
 		return
 	}
 
 	if req.Method == "POST" {
 		ct, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
 		if err != nil {
-			tr.Error(err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			s.malformed(tr, w, req, "bad-media-type", err,
+				http.StatusBadRequest)
 			return
 		}
 
 		if ct == "application/dns-message" {
 			tr.Printf("DoH:POST")
-			// Limit the size of request to 4k.
-			dnsQuery, err := ioutil.ReadAll(io.LimitReader(req.Body, 4092))
+			// Limit the size of request to 4k. We read one extra byte, so we
+			// can tell when the request is too large.
+			dnsQuery, err := ioutil.ReadAll(
+				io.LimitReader(req.Body, maxQuerySize+1))
 			if err != nil {
-				tr.Error(err)
-				http.Error(w, err.Error(), http.StatusBadRequest)
+				s.malformed(tr, w, req, "bad-body", err,
+					http.StatusBadRequest)
+				return
+			}
+			if len(dnsQuery) > maxQuerySize {
+				s.malformed(tr, w, req, "oversize", errOversize,
+					http.StatusRequestEntityTooLarge)
 				return
 			}
 
-			s.resolveDoH(tr, w, dnsQuery)
+			s.resolveDoH(tr, w, req, dnsQuery)
 			return
 		}
 	}
 
 	// Could not found how to handle this request.
-	tr.Errorf("unknown request type")
-	http.Error(w, "unknown request type", http.StatusUnsupportedMediaType)
+	s.malformed(tr, w, req, "unknown-request", errUnknownRequest,
+		http.StatusUnsupportedMediaType)
+}
+
+var (
+	errOversize       = errors.New("request too large")
+	errUnknownRequest = errors.New("unknown request type")
+)
+
+// malformed handles a malformed request: it is counted by reason, traced,
+// taken into account for banning, and replied to with the given status.
+func (s *Server) malformed(tr *trace.Trace, w http.ResponseWriter, req *http.Request, reason string, err error, status int) {
+	stats.malformed.Add(reason, 1)
+	err = tr.Errorf("malformed request (%s): %v", reason, err)
+	s.recordMalformed(req)
+	http.Error(w, err.Error(), status)
 }
 
 // Resolve DNS over HTTPS requests, as specified in RFC 8484.
-func (s *Server) resolveDoH(tr *trace.Trace, w http.ResponseWriter, dnsQuery []byte) {
+func (s *Server) resolveDoH(tr *trace.Trace, w http.ResponseWriter, req *http.Request, dnsQuery []byte) {
 	r := &dns.Msg{}
 	err := r.Unpack(dnsQuery)
 	if err != nil {
-		tr.Error(err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		s.malformed(tr, w, req, "bad-dns-message", err,
+			http.StatusBadRequest)
 		return
 	}
 
-	tr.Question(r.Question)
-
-	// Do the DNS request, get the reply.
-	fromUp, err := exchange(tr, r, s.Upstream)
-	if err != nil {
-		err = tr.Errorf("dns exchange error: %v", err)
-		http.Error(w, err.Error(), http.StatusFailedDependency)
+	if loop.Detected(r) {
+		s.listenerBudget.Record(false)
+		err = tr.Errorf("forwarding loop detected")
+		http.Error(w, err.Error(), http.StatusLoopDetected)
 		return
 	}
 
+	fromUp := s.query(tr, w, req, r)
 	if fromUp == nil {
-		err = tr.Errorf("no response from upstream")
-		http.Error(w, err.Error(), http.StatusRequestTimeout)
 		return
 	}
 
-	tr.Answer(fromUp)
+	// Pad the response if the client supports EDNS0, so its size does not
+	// reveal the name that was queried (RFC 7830, RFC 8467).
+	if opt := r.IsEdns0(); opt != nil {
+		if fromUp.IsEdns0() == nil {
+			fromUp.SetEdns0(dns.DefaultMsgSize, opt.Do())
+		}
+		doh.Pad(fromUp, doh.ResponsePaddingBlock)
+	}
 
 	packed, err := fromUp.Pack()
+	s.listenerBudget.Record(err == nil &&
+		fromUp.Rcode != dns.RcodeServerFailure)
 	if err != nil {
 		err = tr.Errorf("cannot pack reply: %v", err)
 		http.Error(w, err.Error(), http.StatusFailedDependency)
@@ -144,26 +490,57 @@ func (s *Server) resolveDoH(tr *trace.Trace, w http.ResponseWriter, dnsQuery []b
 	w.Write(packed)
 }
 
-func exchange(tr *trace.Trace, r *dns.Msg, addr string) (*dns.Msg, error) {
-	reply, err := dns.Exchange(r, addr)
-	if err == nil && !reply.Truncated {
-		tr.Printf("UDP exchange successful")
-		return reply, err
+// route returns the Route for the given path, or nil if the default upstream
+// should be used. The longest matching route wins.
+func (s *Server) route(path string) *Route {
+	var found *Route
+	longest := 0
+	for p, rt := range s.Routes {
+		if (path == p || strings.HasPrefix(path, p+"/")) && len(p) > longest {
+			found, longest = rt, len(p)
+		}
+	}
+	return found
+}
+
+// query the upstream server for the request's path, and return its reply.
+// On errors, an HTTP error is written back to the client, and nil is
+// returned.
+func (s *Server) query(tr *trace.Trace, w http.ResponseWriter, req *http.Request, r *dns.Msg) *dns.Msg {
+	tr.Question(r.Question)
+
+	upstream, resolver, upBudget := s.Upstream, s.Resolver, s.upstreamBudget
+	if rt := s.route(req.URL.Path); rt != nil {
+		upstream, resolver, upBudget = rt.Upstream, rt.Resolver, rt.budget
+		tr.Printf("route:%s", upstream)
 	}
 
-	// If we had issues over UDP, or the message was truncated, retry over
-	// TCP. We don't try beyond that.
+	if resolver == nil {
+		resolver = s.upstreamFor(upstream)
+	}
+
+	// Do the DNS request, get the reply. If the client goes away, the
+	// resolvers can give up on it.
+	tr.SetContext(req.Context())
+	fromUp, err := resolver.Query(r, tr)
+	upBudget.Record(err == nil && fromUp != nil &&
+		fromUp.Rcode != dns.RcodeServerFailure)
 	if err != nil {
-		tr.Printf("error on UDP exchange: %v", err)
-	} else if reply.Truncated {
-		tr.Printf("UDP exchange returned truncated reply: %v", reply.MsgHdr)
+		s.listenerBudget.Record(false)
+		stats.upstreamErrors.Add(1)
+		err = tr.Errorf("dns exchange error: %v", err)
+		http.Error(w, err.Error(), http.StatusFailedDependency)
+		return nil
 	}
-	tr.Printf("retrying on TCP")
 
-	c := &dns.Client{
-		Net: "tcp",
+	if fromUp == nil {
+		s.listenerBudget.Record(false)
+		stats.upstreamErrors.Add(1)
+		err = tr.Errorf("no response from upstream")
+		http.Error(w, err.Error(), http.StatusRequestTimeout)
+		return nil
 	}
 
-	reply, _, err = c.Exchange(r, addr)
-	return reply, err
+	tr.Answer(fromUp)
+	return fromUp
 }
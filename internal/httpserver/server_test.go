@@ -1,13 +1,29 @@
 package httpserver
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
+	"io"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"blitiri.com.ar/go/dnss/doh"
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
 	"blitiri.com.ar/go/dnss/internal/testutil"
+
+	"github.com/miekg/dns"
 )
 
 func TestBasic(t *testing.T) {
@@ -50,6 +66,27 @@ func TestBasic(t *testing.T) {
 		}
 	}
 
+	// Invalid base64.
+	resp = query(t, srv, "GET", "/ignored?dns=%25%25%25", "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("base64 test: expected bad request, got %v",
+			resp.StatusCode)
+	}
+
+	// Oversized requests.
+	resp = query(t, srv, "GET",
+		"/ignored?dns="+strings.Repeat("A", 2*maxQuerySize), "")
+	if resp.StatusCode != http.StatusRequestURITooLong {
+		t.Errorf("oversize GET test: expected URI too long, got %v",
+			resp.StatusCode)
+	}
+	resp = query(t, srv, "POST", "/ignored",
+		strings.Repeat("A", maxQuerySize+1))
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversize POST test: expected entity too large, got %v",
+			resp.StatusCode)
+	}
+
 	// Upstream error.
 	// Put this last because we override the upstream address.
 	srv.Upstream = "localhost:0"
@@ -61,6 +98,316 @@ func TestBasic(t *testing.T) {
 	}
 }
 
+func TestLimit(t *testing.T) {
+	entered := make(chan bool)
+	release := make(chan bool)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- true
+		<-release
+	})
+
+	srv := &Server{MaxConcurrent: 1}
+	limited := srv.limit(h)
+
+	serve := func() *http.Response {
+		w := httptest.NewRecorder()
+		limited.ServeHTTP(w, httptest.NewRequest("GET", "/dns-query", nil))
+		return w.Result()
+	}
+
+	// The first request takes the only slot.
+	done := make(chan *http.Response)
+	go func() { done <- serve() }()
+	<-entered
+
+	// So the second one is rejected.
+	if resp := serve(); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected service unavailable, got %v", resp.Status)
+	}
+
+	release <- true
+	if resp := <-done; resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status ok, got %v", resp.Status)
+	}
+
+	// Once it's done, the slot is free again.
+	go func() { <-entered; release <- true }()
+	if resp := serve(); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status ok after release, got %v", resp.Status)
+	}
+
+	// Without a limit, the handler is used as-is.
+	if (&Server{}).limit(h) == nil {
+		t.Errorf("nil handler without a limit")
+	}
+}
+
+func TestResolver(t *testing.T) {
+	res := testutil.NewTestResolver()
+	res.Response = &dns.Msg{
+		Answer: []dns.RR{testutil.NewRR(t, "test. A 1.1.1.1")},
+	}
+	srv := &Server{
+		Upstream: "https://doh.test/dns-query",
+		Resolver: res,
+	}
+
+	resp := query(t, srv, "GET",
+		"/ignored?dns=q80BAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected http status ok, got %v", resp.Status)
+	}
+	if res.LastQuery == nil ||
+		res.LastQuery.Question[0].Name != "www.example.com." {
+		t.Errorf("resolver got unexpected query: %v", res.LastQuery)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	reply := &dns.Msg{}
+	if err := reply.Unpack(body); err != nil {
+		t.Fatalf("error unpacking reply: %v", err)
+	}
+	if len(reply.Answer) != 1 ||
+		reply.Answer[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Errorf("unexpected reply: %v", reply)
+	}
+
+	// Resolver errors are upstream errors.
+	res.Response, res.RespError = nil, errors.New("test error")
+	resp = query(t, srv, "GET",
+		"/ignored?dns=q80BAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", "")
+	if resp.StatusCode != http.StatusFailedDependency {
+		t.Errorf("expected failed dependency, got %v", resp.Status)
+	}
+}
+
+func TestCache(t *testing.T) {
+	upstreamAddr := testutil.GetFreePort()
+	var queries atomic.Int32
+	handler := testutil.MakeStaticHandler(t, "www.example.com. 300 A 1.1.1.1")
+	go testutil.ServeTestDNSServer(upstreamAddr,
+		func(w dns.ResponseWriter, r *dns.Msg) {
+			queries.Add(1)
+			handler(w, r)
+		})
+	testutil.WaitForDNSServer(upstreamAddr)
+	queries.Store(0)
+
+	srv := &Server{
+		Upstream: upstreamAddr,
+		Resolver: dnsserver.NewCachingResolver(
+			dnsserver.NewUpstreamResolver(upstreamAddr, 0)),
+	}
+	for i := 0; i < 3; i++ {
+		resp := query(t, srv, "GET",
+			"/ignored?dns=q80BAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", "")
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%d: expected http status ok, got %v", i, resp.Status)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("expected 1 upstream query, got %d", n)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	filtered := testutil.NewTestResolver()
+	filtered.Response = &dns.Msg{}
+	filtered.Response.Rcode = dns.RcodeRefused
+	srv := &Server{
+		// The default upstream fails, so we can tell when it's used.
+		Upstream: "localhost:0",
+		Routes: map[string]*Route{
+			"/dns-query/filtered":      {Upstream: "filtered", Resolver: filtered},
+			"/dns-query/filtered/more": {Upstream: "more"},
+		},
+	}
+
+	for path, expected := range map[string]string{
+		"/dns-query":                   "",
+		"/dns-query/filteredx":         "",
+		"/dns-query/filtered":          "filtered",
+		"/dns-query/filtered/tok":      "filtered",
+		"/dns-query/filtered/more":     "more",
+		"/dns-query/filtered/more/tok": "more",
+	} {
+		got := ""
+		if rt := srv.route(path); rt != nil {
+			got = rt.Upstream
+		}
+		if got != expected {
+			t.Errorf("%q: expected route %q, got %q", path, expected, got)
+		}
+	}
+
+	q := "?dns=q80BAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB"
+	resp := query(t, srv, "GET", "/dns-query/filtered"+q, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("route: expected http status ok, got %v", resp.Status)
+	}
+	if filtered.LastQuery == nil {
+		t.Errorf("route: query not sent to the route's resolver")
+	}
+
+	resp = query(t, srv, "GET", "/dns-query"+q, "")
+	if resp.StatusCode != http.StatusFailedDependency {
+		t.Errorf("default: expected failed dependency, got %v", resp.Status)
+	}
+}
+
+func TestPadding(t *testing.T) {
+	upstreamAddr := testutil.GetFreePort()
+	go testutil.ServeTestDNSServer(upstreamAddr,
+		testutil.MakeStaticHandler(t, "test. A 1.1.1.1"))
+	testutil.WaitForDNSServer(upstreamAddr)
+
+	srv := &Server{
+		Upstream: upstreamAddr,
+	}
+
+	for _, edns := range []bool{false, true} {
+		q := &dns.Msg{}
+		q.SetQuestion("test.", dns.TypeA)
+		if edns {
+			q.SetEdns0(4096, false)
+		}
+		packed, _ := q.Pack()
+
+		resp := query(t, srv, "POST", "/ignored", string(packed))
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected http status ok, got %v", resp.StatusCode)
+		}
+
+		padded := len(body)%doh.ResponsePaddingBlock == 0
+		if padded != edns {
+			t.Errorf("edns:%v, but got a response of %d bytes",
+				edns, len(body))
+		}
+	}
+}
+
+func TestBan(t *testing.T) {
+	srv := &Server{
+		BanThreshold: 2,
+		BanDuration:  time.Hour,
+	}
+
+	// The first 3 malformed requests are processed, the rest are rejected
+	// because the client is banned.
+	for i, exp := range []int{400, 400, 400, 429, 429} {
+		resp := query(t, srv, "GET", "/ignored?dns=0000", "")
+		if resp.StatusCode != exp {
+			t.Errorf("%d: expected %d, got %v", i, exp, resp.StatusCode)
+		}
+	}
+
+	// Other clients are not affected.
+	req := httptest.NewRequest("GET", "/ignored?dns=0000", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	w := httptest.NewRecorder()
+	srv.Resolve(w, req)
+	if resp := w.Result(); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("other client: expected bad request, got %v",
+			resp.StatusCode)
+	}
+
+	// Once the ban expires, the client can send requests again.
+	srv.clients["192.0.2.1"].bannedUntil = time.Now()
+	resp := query(t, srv, "GET", "/ignored?dns=0000", "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("after ban: expected bad request, got %v", resp.StatusCode)
+	}
+}
+
+func TestClientCerts(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(
+		rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("error creating CA certificate: %v", err)
+	}
+
+	// Client certificate, signed by the CA.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, tmpl, caTmpl, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("error creating client certificate: %v", err)
+	}
+
+	caFile := t.TempDir() + "/ca.pem"
+	err = os.WriteFile(caFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		0600)
+	if err != nil {
+		t.Fatalf("error writing CA file: %v", err)
+	}
+
+	srv := &Server{ClientCAFile: caFile}
+	cfg, err := srv.tlsConfig()
+	if err != nil {
+		t.Fatalf("error building TLS config: %v", err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(srv.Resolve))
+	ts.TLS = cfg
+	ts.StartTLS()
+	defer ts.Close()
+
+	// Without a client certificate, the handshake fails.
+	if resp, err := ts.Client().Get(ts.URL); err == nil {
+		t.Errorf("request without client cert succeeded: %v", resp.Status)
+	}
+
+	// With it, the request gets to the handler (which doesn't know what to
+	// do with it, but that's fine).
+	client := ts.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates =
+		[]tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("request with client cert failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("expected unsupported media type, got %v", resp.Status)
+	}
+
+	// Without a client CA, there's no TLS config of our own; and bad files
+	// are an error.
+	if cfg, err := (&Server{}).tlsConfig(); cfg != nil || err != nil {
+		t.Errorf("unexpected config without a client CA: %v, %v", cfg, err)
+	}
+	for _, f := range []string{"/doesnotexist", os.DevNull} {
+		if _, err := (&Server{ClientCAFile: f}).tlsConfig(); err == nil {
+			t.Errorf("%s: expected error, got nil", f)
+		}
+	}
+}
+
 func query(t *testing.T, srv *Server, method, url, body string) *http.Response {
 	t.Helper()
 
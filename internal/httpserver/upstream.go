@@ -0,0 +1,22 @@
+package httpserver
+
+import (
+	"blitiri.com.ar/go/dnss/internal/dnsserver"
+)
+
+// upstreamFor returns the resolver for the given upstream, creating it the
+// first time, so its connections are reused across requests.
+func (s *Server) upstreamFor(upstream string) dnsserver.Resolver {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.upstreams == nil {
+		s.upstreams = map[string]dnsserver.Resolver{}
+	}
+	r, ok := s.upstreams[upstream]
+	if !ok {
+		r = dnsserver.NewUpstreamResolver(upstream, s.UpstreamTimeout)
+		s.upstreams[upstream] = r
+	}
+	return r
+}
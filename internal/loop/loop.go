@@ -0,0 +1,137 @@
+// Package loop detects forwarding loops, where the queries we forward come
+// back to us (e.g. because an upstream is misconfigured to point back at
+// dnss), so they can be refused right away instead of going around until
+// they time out.
+//
+// The queries we forward are tagged with an EDNS0 option carrying a random
+// value, unique to this process. If we receive a query with our tag, it
+// already went through us.
+//
+// As the tag identifies this process, it could be used to link all our
+// queries together, so tagging is off by default, and the queries to the
+// DNS over HTTPS upstream are never tagged.
+//
+// Note the queries made by the system resolver (e.g. to resolve the name of
+// the upstream) can't be tagged; -fallback_upstream avoids depending on it.
+package loop
+
+import (
+	"bytes"
+	"crypto/rand"
+	"expvar"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"blitiri.com.ar/go/log"
+	"github.com/miekg/dns"
+)
+
+// Code of the EDNS0 option we tag the queries with, from the range reserved
+// for local use (RFC 6891 section 9).
+const optionCode = dns.EDNS0LOCALSTART + 0x44
+
+// Our tag, random for every process.
+var tag = make([]byte, 8)
+
+// Tag the queries we forward. Detection is always on, but it only catches
+// loops if tagging is enabled.
+var enabled atomic.Bool
+
+// Exported variables for statistics.
+var detected *expvar.Int
+
+func init() {
+	if _, err := rand.Read(tag); err != nil {
+		panic(fmt.Sprintf("error creating loop tag: %v", err))
+	}
+	detected = expvar.NewInt("loops-detected")
+}
+
+// SetEnabled enables or disables tagging the queries we forward. It is
+// disabled by default.
+func SetEnabled(e bool) {
+	enabled.Store(e)
+}
+
+// Tag returns a copy of the query, with our tag added, to forward it. If
+// tagging is disabled, the query is returned as-is.
+func Tag(r *dns.Msg) *dns.Msg {
+	if !enabled.Load() || hasTag(r) {
+		return r
+	}
+
+	r = r.Copy()
+	opt := r.IsEdns0()
+	if opt == nil {
+		r.SetEdns0(dns.DefaultMsgSize, false)
+		opt = r.IsEdns0()
+	}
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_LOCAL{Code: optionCode, Data: tag})
+	return r
+}
+
+// Untag cleans up the reply to a query we tagged, so it matches the original
+// query: if the query had no EDNS0, the OPT record our tag caused is
+// removed. It modifies the reply in place.
+func Untag(r, reply *dns.Msg) {
+	if reply == nil || r.IsEdns0() != nil {
+		return
+	}
+
+	extra := make([]dns.RR, 0, len(reply.Extra))
+	for _, rr := range reply.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	reply.Extra = extra
+}
+
+func hasTag(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if l, ok := o.(*dns.EDNS0_LOCAL); ok &&
+			l.Code == optionCode && bytes.Equal(l.Data, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Minimum time between log messages about loops, as they come in bursts.
+// It is declared as a variable so we can tweak it for testing.
+var logPeriod = 1 * time.Minute
+
+var (
+	logMu   sync.Mutex
+	lastLog time.Time
+)
+
+// Detected returns true if the query has our tag, which means it's in a
+// forwarding loop. It counts and logs them.
+func Detected(r *dns.Msg) bool {
+	if !hasTag(r) {
+		return false
+	}
+
+	detected.Add(1)
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	if time.Since(lastLog) >= logPeriod {
+		lastLog = time.Now()
+		name := "?"
+		if len(r.Question) > 0 {
+			name = r.Question[0].Name
+		}
+		log.Errorf("Forwarding loop detected: query for %q came back to "+
+			"us, check that the upstreams don't point back at dnss", name)
+	}
+	return true
+}
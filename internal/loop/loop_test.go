@@ -0,0 +1,86 @@
+package loop
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newQuery() *dns.Msg {
+	m := &dns.Msg{}
+	m.SetQuestion("test.", dns.TypeA)
+	return m
+}
+
+func TestTagAndDetect(t *testing.T) {
+	SetEnabled(true)
+	defer SetEnabled(false)
+	logPeriod = 0
+	detected.Set(0)
+
+	r := newQuery()
+	if Detected(r) {
+		t.Errorf("untagged query detected as a loop")
+	}
+
+	// Tagging returns a copy, and leaves the original untouched.
+	tagged := Tag(r)
+	if tagged == r || r.IsEdns0() != nil {
+		t.Errorf("original query was modified: %v", r)
+	}
+	if !Detected(tagged) {
+		t.Errorf("tagged query not detected as a loop: %v", tagged)
+	}
+	if detected.Value() != 1 {
+		t.Errorf("expected 1 loop detected, got %v", detected)
+	}
+
+	// Tagging twice doesn't add a second tag.
+	if Tag(tagged) != tagged {
+		t.Errorf("query tagged twice")
+	}
+
+	// Another process' tag is not a loop.
+	other := newQuery()
+	other.SetEdns0(dns.DefaultMsgSize, false)
+	opt := other.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: optionCode, Data: []byte("12345678")})
+	if Detected(other) {
+		t.Errorf("another process' tag detected as a loop")
+	}
+}
+
+func TestUntag(t *testing.T) {
+	SetEnabled(true)
+	defer SetEnabled(false)
+
+	// The query had no EDNS0, so the OPT is removed from the reply.
+	r := newQuery()
+	reply := &dns.Msg{}
+	reply.SetReply(Tag(r))
+	reply.SetEdns0(dns.DefaultMsgSize, false)
+	Untag(r, reply)
+	if reply.IsEdns0() != nil {
+		t.Errorf("OPT not removed from the reply: %v", reply)
+	}
+
+	// The query had EDNS0, so the reply is left alone.
+	r.SetEdns0(dns.DefaultMsgSize, true)
+	reply.SetEdns0(dns.DefaultMsgSize, true)
+	Untag(r, reply)
+	if reply.IsEdns0() == nil {
+		t.Errorf("OPT removed from the reply: %v", reply)
+	}
+
+	// Nil replies (e.g. on errors) are fine.
+	Untag(r, nil)
+}
+
+func TestDisabled(t *testing.T) {
+	// Disabled by default.
+	r := newQuery()
+	if Tag(r) != r || r.IsEdns0() != nil {
+		t.Errorf("query tagged while disabled: %v", r)
+	}
+}
@@ -326,7 +326,19 @@ func findBucket(latency time.Duration) int {
 }
 
 // How many traces we keep per bucket.
-const tracesInBucket = 10
+// This is what bounds the memory used by each family, see
+// SetTracesPerBucket.
+var tracesInBucket = 10
+
+// SetTracesPerBucket sets how many finished traces are kept per latency
+// bucket (and for errors), for each family. It must be called before any
+// traces are created.
+func SetTracesPerBucket(n int) {
+	if n < 1 {
+		n = 1
+	}
+	tracesInBucket = n
+}
 
 type traceRing struct {
 	ring *ring.Ring
@@ -213,3 +213,24 @@ func TestFindParent(t *testing.T) {
 		t.Errorf("finding parent with ref, expected %v, got %v", parent, found)
 	}
 }
+
+func TestTracesPerBucket(t *testing.T) {
+	prev := tracesInBucket
+	defer SetTracesPerBucket(prev)
+
+	SetTracesPerBucket(0)
+	if tracesInBucket != 1 {
+		t.Errorf("expected minimum of 1, got %d", tracesInBucket)
+	}
+
+	SetTracesPerBucket(3)
+	for i := 0; i < 10; i++ {
+		tr := New("TestTracesPerBucket", fmt.Sprintf("evt %d", i))
+		tr.Finish()
+	}
+
+	ft := families["TestTracesPerBucket"]
+	if n := ft.LenBucket(0); n != 3 {
+		t.Errorf("expected 3 traces in bucket, got %d", n)
+	}
+}
@@ -0,0 +1,178 @@
+// Package statsd periodically pushes our statistics to a statsd server, for
+// users who use statsd/graphite instead of scraping the exported variables.
+//
+// All the numeric exported variables (expvar) are sent as gauges, with their
+// absolute values, so restarts and lost packets don't skew them; rates can be
+// derived on the graphite side (e.g. with perSecond()). The latency of the
+// queries is sent as timings, sampled if there are too many.
+package statsd
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/log"
+	"github.com/miekg/dns"
+)
+
+// Constants that tune the exporter.
+// They are declared as variables so we can tweak them for testing.
+var (
+	// Maximum number of latency samples we send on each push.
+	maxTimings = 1000
+
+	// Maximum size of the UDP packets we send, so they don't get
+	// fragmented.
+	maxPacketSize = 1400
+)
+
+// Exporter pushes the statistics to a statsd server. It is also an Observer
+// (see dnsserver.Observer), to get the latency of the queries.
+type Exporter struct {
+	// Address of the statsd server (host:port, over UDP).
+	Addr string
+
+	// Prefix for the names of all the metrics.
+	Prefix string
+
+	// How often to push the statistics.
+	Period time.Duration
+
+	mu sync.Mutex
+
+	// Latency samples since the last push, and how many queries they were
+	// sampled from.
+	timings []time.Duration
+	seen    int
+}
+
+// Observe records the latency of a query, to send it on the next push.
+func (e *Exporter) Observe(q dns.Question, reply *dns.Msg, elapsed time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Reservoir sampling, so if there are too many queries, the ones we send
+	// are representative of the whole period.
+	e.seen++
+	if len(e.timings) < maxTimings {
+		e.timings = append(e.timings, elapsed)
+	} else if i := rand.Intn(e.seen); i < maxTimings {
+		e.timings[i] = elapsed
+	}
+}
+
+// Run pushes the statistics every period, forever.
+func (e *Exporter) Run() {
+	conn, err := net.Dial("udp", e.Addr)
+	if err != nil {
+		log.Errorf("statsd: error dialing %q: %v", e.Addr, err)
+		return
+	}
+	defer conn.Close()
+
+	for range time.Tick(e.Period) {
+		for _, p := range packets(e.lines()) {
+			if _, err := conn.Write(p); err != nil {
+				log.Errorf("statsd: error sending to %q: %v", e.Addr, err)
+				break
+			}
+		}
+	}
+}
+
+// lines returns the metrics to send, one per line in the statsd format, and
+// resets the latency samples.
+func (e *Exporter) lines() []string {
+	lines := []string{}
+	expvar.Do(func(kv expvar.KeyValue) {
+		for _, g := range gauges(kv.Key, kv.Value) {
+			lines = append(lines, fmt.Sprintf("%s.%s|g", e.Prefix, g))
+		}
+	})
+	sort.Strings(lines)
+
+	e.mu.Lock()
+	timings, seen := e.timings, e.seen
+	e.timings, e.seen = nil, 0
+	e.mu.Unlock()
+
+	rate := ""
+	if seen > len(timings) {
+		rate = fmt.Sprintf("|@%.4f", float64(len(timings))/float64(seen))
+	}
+	for _, t := range timings {
+		lines = append(lines, fmt.Sprintf("%s.query-latency:%.3f|ms%s",
+			e.Prefix, float64(t)/float64(time.Millisecond), rate))
+	}
+
+	return lines
+}
+
+// gauges returns the "name:value" pairs for the variable, if it's numeric (or
+// a map of numeric values).
+func gauges(name string, v expvar.Var) []string {
+	name = sanitize(name)
+	switch v := v.(type) {
+	case *expvar.Int, *expvar.Float:
+		return []string{name + ":" + v.String()}
+	case *expvar.Map:
+		gs := []string{}
+		v.Do(func(kv expvar.KeyValue) {
+			gs = append(gs, gauges(name+"."+kv.Key, kv.Value)...)
+		})
+		return gs
+	case expvar.Func:
+		switch f := v.Value().(type) {
+		case int, int64, float64:
+			return []string{fmt.Sprintf("%s:%v", name, f)}
+		case map[string]float64:
+			gs := []string{}
+			for k, x := range f {
+				gs = append(gs, fmt.Sprintf("%s.%s:%v", name, sanitize(k), x))
+			}
+			return gs
+		}
+	}
+	return nil
+}
+
+// sanitize the name so it's safe to use in a metric: only letters, digits,
+// '-', '_' and '.' are kept, the rest are replaced with '_'.
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z',
+			r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// packets groups the lines into as few packets as possible, without going
+// over maxPacketSize (unless a single line does).
+func packets(lines []string) [][]byte {
+	ps := [][]byte{}
+	buf := &bytes.Buffer{}
+	for _, l := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(l) > maxPacketSize {
+			ps = append(ps, buf.Bytes())
+			buf = &bytes.Buffer{}
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(l)
+	}
+	if buf.Len() > 0 {
+		ps = append(ps, buf.Bytes())
+	}
+	return ps
+}
@@ -0,0 +1,125 @@
+package statsd
+
+import (
+	"expvar"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	i := expvar.NewInt("statsd-test-int")
+	i.Set(42)
+	m := expvar.NewMap("statsd-test-map")
+	m.Add("A", 3)
+	m.Add("bad key!", 1)
+	expvar.Publish("statsd-test-func", expvar.Func(
+		func() interface{} { return 0.5 }))
+	expvar.Publish("statsd-test-string", expvar.Func(
+		func() interface{} { return "not a number" }))
+}
+
+func contains(lines []string, l string) bool {
+	for _, x := range lines {
+		if x == l {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLines(t *testing.T) {
+	e := &Exporter{Prefix: "dnss"}
+	e.Observe(dns.Question{}, nil, 1500*time.Microsecond)
+
+	lines := e.lines()
+	for _, l := range []string{
+		"dnss.statsd-test-int:42|g",
+		"dnss.statsd-test-map.A:3|g",
+		"dnss.statsd-test-map.bad_key_:1|g",
+		"dnss.statsd-test-func:0.5|g",
+		"dnss.query-latency:1.500|ms",
+	} {
+		if !contains(lines, l) {
+			t.Errorf("line %q missing from %v", l, lines)
+		}
+	}
+	for _, l := range lines {
+		if strings.Contains(l, "statsd-test-string") {
+			t.Errorf("non-numeric variable exported: %q", l)
+		}
+	}
+
+	// The timings are reset on every push.
+	for _, l := range e.lines() {
+		if strings.Contains(l, "query-latency") {
+			t.Errorf("timing sent twice: %q", l)
+		}
+	}
+}
+
+func TestSampling(t *testing.T) {
+	defer func(prev int) { maxTimings = prev }(maxTimings)
+	maxTimings = 10
+
+	e := &Exporter{Prefix: "dnss"}
+	for i := 0; i < 40; i++ {
+		e.Observe(dns.Question{}, nil, time.Millisecond)
+	}
+
+	n := 0
+	for _, l := range e.lines() {
+		if strings.Contains(l, "query-latency") {
+			n++
+			if l != "dnss.query-latency:1.000|ms|@0.2500" {
+				t.Errorf("unexpected timing line: %q", l)
+			}
+		}
+	}
+	if n != 10 {
+		t.Errorf("expected 10 timings, got %d", n)
+	}
+}
+
+func TestPackets(t *testing.T) {
+	defer func(prev int) { maxPacketSize = prev }(maxPacketSize)
+	maxPacketSize = 10
+
+	ps := packets([]string{"aaaa", "bbbb", "cccc", "dddddddddddd", "e"})
+	got := []string{}
+	for _, p := range ps {
+		got = append(got, string(p))
+	}
+	expected := []string{"aaaa\nbbbb", "cccc", "dddddddddddd", "e"}
+	if strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestRun(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer conn.Close()
+
+	e := &Exporter{
+		Addr:   conn.LocalAddr().String(),
+		Prefix: "dnss",
+		Period: 10 * time.Millisecond,
+	}
+	go e.Run()
+
+	buf := make([]byte, 64*1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("error reading: %v", err)
+	}
+	if !strings.Contains(string(buf[:n]), "dnss.") {
+		t.Errorf("unexpected packet: %q", buf[:n])
+	}
+}
@@ -2,9 +2,13 @@
 package trace
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"blitiri.com.ar/go/log"
 	"github.com/miekg/dns"
@@ -16,27 +20,81 @@ import (
 type Trace struct {
 	family string
 	title  string
-	t      nettrace.Trace
+
+	// The underlying trace. It is nil for traces that were not sampled,
+	// until they see an error.
+	t nettrace.Trace
+
+	// Address of the client that sent the request, if known.
+	client net.IP
+
+	// Layer and rule that decided the answer, see SetPolicy.
+	layer, rule string
+
+	// When the request must be answered by, see SetDeadline.
+	deadline time.Time
+
+	// Context of the request, see SetContext.
+	ctx context.Context
 }
 
 // New trace.
 func New(family, title string) *Trace {
-	t := &Trace{family, title, nettrace.New(family, title)}
+	t := &Trace{family: family, title: title}
+	t.start()
+	return t
+}
+
+func (t *Trace) start() {
+	t.t = nettrace.New(t.family, t.title)
 
 	// The default for max events is 10, which is a bit short for our uses.
 	// Expand it to 30 which should be large enough to keep most of the
 	// traces.
 	t.t.SetMaxEvents(30)
-	return t
+}
+
+// Sampling of the traces created with NewSampled: we record 1 in every
+// sampleRate traces.
+var (
+	sampleRate  atomic.Uint64
+	sampleCount atomic.Uint64
+)
+
+// SetSampleRate makes NewSampled record only 1 in every n traces (traces
+// that see an error are always recorded). 0 or 1 means all of them.
+func SetSampleRate(n int) {
+	if n < 1 {
+		n = 1
+	}
+	sampleRate.Store(uint64(n))
+}
+
+// NewSampled creates a new trace, which is subject to sampling (see
+// SetSampleRate). It is meant for per-request traces, which can be very
+// frequent.
+// Traces that are not sampled do not record any events, unless they see an
+// error, in which case they are recorded from that point on.
+func NewSampled(family, title string) *Trace {
+	n := sampleRate.Load()
+	if n <= 1 || sampleCount.Add(1)%n == 0 {
+		return New(family, title)
+	}
+	return &Trace{family: family, title: title}
 }
 
 // Printf adds this message to the trace's log.
 func (t *Trace) Printf(format string, a ...interface{}) {
+	if t.t == nil {
+		return
+	}
 	t.t.Printf(format, a...)
 }
 
 func (t *Trace) lprintf(n int, format string, a ...interface{}) {
-	t.t.Printf(format, a...)
+	if t.t != nil {
+		t.t.Printf(format, a...)
+	}
 
 	// If -v=3, also log to the main log.
 	if log.V(3) {
@@ -45,10 +103,20 @@ func (t *Trace) lprintf(n int, format string, a ...interface{}) {
 	}
 }
 
+// startOnError starts recording the trace if it was not sampled, as traces
+// with errors are always recorded.
+func (t *Trace) startOnError() {
+	if t.t == nil {
+		t.start()
+		t.t.Printf("not sampled, recording from the first error")
+	}
+}
+
 // Errorf adds this message to the trace's log, with an error level.
 func (t *Trace) Errorf(format string, a ...interface{}) error {
 	// Note we can't just call t.Error here, as it breaks caller logging.
 	err := fmt.Errorf(format, a...)
+	t.startOnError()
 	t.t.SetError()
 	t.t.Printf("error: %v", err)
 
@@ -60,6 +128,7 @@ func (t *Trace) Errorf(format string, a ...interface{}) error {
 // Error marks the trace as having seen an error, and also logs it to the
 // trace's log.
 func (t *Trace) Error(err error) error {
+	t.startOnError()
 	t.t.SetError()
 	t.t.Printf("error: %v", err)
 
@@ -71,7 +140,9 @@ func (t *Trace) Error(err error) error {
 
 // Finish the trace. It should not be changed after this is called.
 func (t *Trace) Finish() {
-	t.t.Finish()
+	if t.t != nil {
+		t.t.Finish()
+	}
 }
 
 ////////////////////////////////////////////////////////////
@@ -80,6 +151,9 @@ func (t *Trace) Finish() {
 
 // Question adds the given question to the trace.
 func (t *Trace) Question(qs []dns.Question) {
+	if t.t == nil && !log.V(3) {
+		return
+	}
 	if log.V(1) {
 		t.lprintf(1, questionsToString(qs))
 	}
@@ -96,7 +170,7 @@ func questionsToString(qs []dns.Question) string {
 
 // Answer adds the given DNS answer to the trace.
 func (t *Trace) Answer(m *dns.Msg) {
-	if !log.V(1) {
+	if !log.V(1) || (t.t == nil && !log.V(3)) {
 		return
 	}
 
@@ -106,6 +180,73 @@ func (t *Trace) Answer(m *dns.Msg) {
 	}
 }
 
+// SetClient sets the address of the client that sent the request being
+// traced, so the resolvers can use it.
+func (t *Trace) SetClient(ip net.IP) {
+	t.client = ip
+}
+
+// Client returns the address of the client that sent the request being
+// traced, or nil if it's not known.
+func (t *Trace) Client() net.IP {
+	return t.client
+}
+
+// SetPolicy records which layer (and which rule within it, if any) decided
+// the answer to the request being traced. Later calls override earlier ones,
+// so an outer layer that changes the answer takes precedence.
+func (t *Trace) SetPolicy(layer, rule string) {
+	t.layer, t.rule = layer, rule
+	t.Printf("policy: %s %s", layer, rule)
+}
+
+// Policy returns the layer and rule that decided the answer to the request
+// being traced, as given to SetPolicy.
+func (t *Trace) Policy() (layer, rule string) {
+	return t.layer, t.rule
+}
+
+// SetDeadline sets when the request being traced must be answered by. The
+// resolvers should give up on it by then (see Context).
+func (t *Trace) SetDeadline(d time.Time) {
+	t.deadline = d
+}
+
+// Deadline returns when the request being traced must be answered by, or
+// the zero time if there is no deadline.
+func (t *Trace) Deadline() time.Time {
+	return t.deadline
+}
+
+// SetContext sets the context of the request being traced (like the one of
+// an HTTP request), so the resolvers give up on it if it's canceled (see
+// Context).
+func (t *Trace) SetContext(ctx context.Context) {
+	t.ctx = ctx
+}
+
+// Context returns a context derived from the given one, which is done at the
+// trace's deadline (if it has one), or when the request's context is (see
+// SetContext).
+func (t *Trace) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if t.deadline.IsZero() {
+		ctx, cancel = context.WithCancel(parent)
+	} else {
+		ctx, cancel = context.WithDeadline(parent, t.deadline)
+	}
+	if t.ctx == nil {
+		return ctx, cancel
+	}
+
+	stop := context.AfterFunc(t.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
 func quote(s string) string {
 	qs := strconv.Quote(s)
 	return qs[1 : len(qs)-1]
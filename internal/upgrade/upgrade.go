@@ -0,0 +1,236 @@
+// Package upgrade implements zero-downtime upgrades, by handing off the
+// listening sockets to a newly executed binary.
+//
+// The sockets to hand off are registered by the servers (Listen and
+// Inherited do that automatically). On Exec, we start a new process with the
+// same arguments, passing it the sockets, and wait until it calls Ready.
+// Then the old process can stop serving and exit.
+//
+// Because the sockets are shared, the kernel queues the incoming queries and
+// connections while the new process is starting, so none are dropped.
+package upgrade
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/log"
+)
+
+// Environment variable with the names of the sockets passed to the new
+// process, in the order of their file descriptors.
+const fdsEnv = "DNSS_UPGRADE_FDS"
+
+// File descriptor the new process uses to tell us it's ready. The sockets
+// come right after it.
+const readyFD = 3
+
+// How long to wait for the new process to be ready.
+// It is declared as a variable so we can tweak it for testing.
+var readyTimeout = 30 * time.Second
+
+// Command line used to start the new process.
+// It is declared as a variable so we can tweak it for testing.
+var argv = os.Args
+
+// filer is implemented by the sockets that can be handed off, like
+// *net.TCPListener and *net.UDPConn.
+type filer interface {
+	File() (*os.File, error)
+}
+
+type socket struct {
+	name string
+	conn filer
+}
+
+var (
+	mu sync.Mutex
+
+	// Sockets to hand off on the next upgrade.
+	registered []socket
+
+	// Sockets handed off to us by the previous process, and the pipe to
+	// tell it we're ready. Only set if we were started by an upgrade.
+	inherited []*os.File
+	readyPipe *os.File
+)
+
+func init() {
+	names := os.Getenv(fdsEnv)
+	if names == "" {
+		return
+	}
+
+	// Don't pass it on to our own children.
+	os.Unsetenv(fdsEnv)
+
+	readyPipe = os.NewFile(readyFD, "upgrade-ready")
+	for i, name := range strings.Split(names, ",") {
+		inherited = append(inherited,
+			os.NewFile(uintptr(readyFD+1+i), name))
+	}
+}
+
+// Register the socket to be handed off on the next upgrade, with the given
+// name. The socket must be backed by a file descriptor (like
+// *net.TCPListener or *net.UDPConn); others are not handed off.
+func Register(name string, conn interface{}) {
+	f, ok := conn.(filer)
+	if !ok {
+		log.Errorf("upgrade: cannot hand off %s socket of type %T",
+			name, conn)
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	registered = append(registered, socket{name: name, conn: f})
+}
+
+// Inherited returns the sockets with the given name that the previous
+// process handed off to us, if we were started by an upgrade. They are
+// registered, so they are handed off again on the next upgrade.
+func Inherited(name string) ([]net.PacketConn, []net.Listener) {
+	mu.Lock()
+	files := []*os.File{}
+	rest := []*os.File{}
+	for _, f := range inherited {
+		if f.Name() == name {
+			files = append(files, f)
+		} else {
+			rest = append(rest, f)
+		}
+	}
+	inherited = rest
+	mu.Unlock()
+
+	// PacketConns are UDP sockets, Listeners are TCP sockets.
+	pconns := []net.PacketConn{}
+	listeners := []net.Listener{}
+	for _, f := range files {
+		if lis, err := net.FileListener(f); err == nil {
+			listeners = append(listeners, lis)
+			Register(name, lis)
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			pconns = append(pconns, pc)
+			Register(name, pc)
+		} else {
+			log.Errorf("upgrade: unknown socket %s: %v", name, err)
+		}
+		f.Close()
+	}
+
+	return pconns, listeners
+}
+
+// Listen is like net.Listen, but if the previous process handed off a
+// listener with the given name, it uses it instead of creating a new one.
+// The listener is registered, so it is handed off on the next upgrade.
+//
+// For unix sockets, a stale socket file left by a previous run is removed.
+// The file is not removed when the listener is closed, as the socket may
+// have been handed off to the new process.
+func Listen(name, network, addr string) (net.Listener, error) {
+	_, listeners := Inherited(name)
+	if len(listeners) > 0 {
+		return listeners[0], nil
+	}
+
+	if network == "unix" {
+		if fi, err := os.Stat(addr); err == nil &&
+			fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	}
+
+	lis, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if ul, ok := lis.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	Register(name, lis)
+	return lis, nil
+}
+
+// Ready tells the previous process (if any) that we are ready to serve, so
+// it can stop. It is safe to call it if we were not started by an upgrade.
+func Ready() {
+	mu.Lock()
+	defer mu.Unlock()
+	if readyPipe == nil {
+		return
+	}
+
+	readyPipe.Write([]byte{1})
+	readyPipe.Close()
+	readyPipe = nil
+}
+
+// Exec starts a new process with the same arguments, hands off the
+// registered sockets to it, and waits until it's ready. If it returns nil,
+// the caller should stop serving and exit.
+func Exec() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	files := []*os.File{}
+	names := []string{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, s := range registered {
+		f, err := s.conn.File()
+		if err != nil {
+			return fmt.Errorf("cannot get file for %s socket: %v",
+				s.name, err)
+		}
+		files = append(files, f)
+		names = append(names, s.name)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no sockets to hand off")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("cannot create pipe: %v", err)
+	}
+	defer r.Close()
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), fdsEnv+"="+strings.Join(names, ","))
+	cmd.ExtraFiles = append([]*os.File{w}, files...)
+	err = cmd.Start()
+
+	// The new process has its own copy, close ours so we see EOF if it
+	// exits before being ready.
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("cannot start new process: %v", err)
+	}
+	log.Infof("upgrade: started new process (pid %d)", cmd.Process.Pid)
+
+	r.SetReadDeadline(time.Now().Add(readyTimeout))
+	_, err = r.Read(make([]byte, 1))
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process did not become ready: %v", err)
+	}
+
+	// The new process will outlive us, don't wait for it.
+	go cmd.Wait()
+	return nil
+}
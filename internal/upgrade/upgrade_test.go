@@ -0,0 +1,124 @@
+package upgrade
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// When set, the test binary acts as the new process; see TestMain.
+const helperEnv = "UPGRADE_TEST_HELPER"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(helperEnv) {
+	case "ready":
+		// Check we got the listener, and that it's the same one.
+		_, listeners := Inherited("test")
+		if len(listeners) != 1 ||
+			listeners[0].Addr().String() != os.Getenv("UPGRADE_TEST_ADDR") {
+			os.Exit(2)
+		}
+		Ready()
+		os.Exit(0)
+	case "fail":
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Minute)
+		os.Exit(1)
+	}
+
+	os.Exit(m.Run())
+}
+
+func setup(t *testing.T, helper string) net.Listener {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	mu.Lock()
+	registered = nil
+	mu.Unlock()
+	Register("test", lis)
+
+	argv = []string{os.Args[0], "-test.run=^$"}
+	t.Setenv(helperEnv, helper)
+	t.Setenv("UPGRADE_TEST_ADDR", lis.Addr().String())
+	return lis
+}
+
+func TestExec(t *testing.T) {
+	setup(t, "ready")
+	if err := Exec(); err != nil {
+		t.Errorf("Exec failed: %v", err)
+	}
+}
+
+func TestExecNotReady(t *testing.T) {
+	setup(t, "fail")
+	if err := Exec(); err == nil {
+		t.Errorf("Exec succeeded, but new process exited")
+	}
+
+	setup(t, "hang")
+	readyTimeout = 100 * time.Millisecond
+	defer func() { readyTimeout = 30 * time.Second }()
+	if err := Exec(); err == nil {
+		t.Errorf("Exec succeeded, but new process was not ready")
+	}
+}
+
+func TestNothingToHandOff(t *testing.T) {
+	mu.Lock()
+	registered = nil
+	mu.Unlock()
+	if err := Exec(); err == nil {
+		t.Errorf("Exec succeeded without sockets")
+	}
+}
+
+func TestNotUpgraded(t *testing.T) {
+	// Not started by an upgrade, so nothing inherited and Ready is a no-op.
+	pconns, listeners := Inherited("test")
+	if len(pconns) != 0 || len(listeners) != 0 {
+		t.Errorf("unexpected sockets: %v %v", pconns, listeners)
+	}
+	Ready()
+
+	lis, err := Listen("test", "tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	lis.Close()
+}
+
+func TestListenUnix(t *testing.T) {
+	path := t.TempDir() + "/test.sock"
+	lis, err := Listen("test", "unix", path)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	// The socket file is left behind on close, and removed when listening
+	// again.
+	lis.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("socket file removed on close: %v", err)
+	}
+	lis, err = Listen("test", "unix", path)
+	if err != nil {
+		t.Fatalf("Listen on stale socket failed: %v", err)
+	}
+	lis.Close()
+
+	// Other files are not removed.
+	os.Remove(path)
+	os.WriteFile(path, nil, 0600)
+	if _, err := Listen("test", "unix", path); err == nil {
+		t.Errorf("Listen over a regular file succeeded")
+	}
+}
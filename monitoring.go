@@ -10,7 +10,9 @@ import (
 	"runtime/debug"
 	"time"
 
+	"blitiri.com.ar/go/dnss/internal/budget"
 	"blitiri.com.ar/go/dnss/internal/nettrace"
+	"blitiri.com.ar/go/dnss/internal/upgrade"
 	"blitiri.com.ar/go/log"
 )
 
@@ -56,9 +58,15 @@ func monitoringServer(addr string) {
 	log.Infof("Monitoring HTTP server listening on %s", addr)
 
 	http.HandleFunc("/", debugRoot())
+	registerDashboard(http.DefaultServeMux)
 	nettrace.RegisterHandler(http.DefaultServeMux)
 
-	go http.ListenAndServe(addr, nil)
+	lis, err := upgrade.Listen("monitoring", "tcp", addr)
+	if err != nil {
+		log.Errorf("Monitoring HTTP server failed to listen: %v", err)
+		return
+	}
+	go http.Serve(lis, nil)
 }
 
 func debugRoot() http.HandlerFunc {
@@ -99,7 +107,8 @@ func debugRoot() http.HandlerFunc {
 }
 
 var tmplFuncs = template.FuncMap{
-	"since": time.Since,
+	"since":     time.Since,
+	"freshness": budget.AllFreshness,
 	"roundDuration": func(d time.Duration) time.Duration {
 		return d.Round(time.Second)
 	},
@@ -140,9 +149,35 @@ var htmlIndex = template.Must(
   os hostname <i>{{.Hostname}}</i><br>
   <p>
 
+  {{with freshness}}
+  last success:
+  <ul>
+    {{range .}}
+    <li>{{.Name}}:
+      {{if .LastSuccess.IsZero}}<b>never</b>
+      {{else}}{{.LastSuccess | since | roundDuration}} ago{{end}}
+    {{end}}
+  </ul>
+  {{end}}
+
   <ul>
+    <li><a href="/dashboard">dashboard</a>
     <li><a href="/debug/traces">traces</a>
+    <li><a href="/debug/queries/stream">query stream</a>
+        <small>(with <tt>-query_stream</tt>)</small>
     <li><a href="/debug/dnsserver/cache/dump">cache dump</a>
+        (<a href="/debug/dnsserver/cache/dump?format=json">json</a>)
+    <li><a href="/debug/dnsserver/cache/maintenance">cache maintenance mode</a>
+    <li><form action="/debug/dnsserver/cache/flush" method="post">
+        flush cache for <input name="name" placeholder="example.com" required>
+        <input type="submit" value="go">
+        </form>
+    <li><form action="/debug/dnsserver/watch">
+        watch <input name="name" placeholder="example.com">
+        <input name="type" value="A" size="5">
+        every <input name="interval" value="5s" size="4">
+        <input type="submit" value="go">
+        </form>
     <li><a href="/debug/pprof">pprof</a>
         <small><a href="https://golang.org/pkg/net/http/pprof/">
           (ref)</a></small>